@@ -1,292 +1,424 @@
 package main
 
 import (
+	"bufio"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
 	"os"
-	"os/signal"
-	"syscall"
+	"runtime/debug"
+	"strconv"
+	"strings"
 
 	"github.com/xplshn/chains/pkg/chains"
 
 	"github.com/spf13/pflag"
-	"gopkg.in/ini.v1"
+	"golang.org/x/sys/unix"
 )
 
 var (
-	ai                     *chains.AppImage
-	argv0                  string
+	ai                     *chains.AppImage // The AppImage being run, unmounted on interrupt
+	config                 *chains.Config   // Defaults for the flags, see chains.LoadConfig
+	configErr              error            // Why the config files couldn't be loaded
+	errUsage               = errors.New("wrong arguments")
 	invalidBundle          = errors.New("failed to open bundle")
 	invalidIcon            = errors.New("failed to extract icon")
 	invalidThumbnail       = errors.New("failed to extract thumbnail preview")
 	invalidPerms           = errors.New("failed to get permissions from profile")
-	invalidPermLevel       = errors.New("failed to set permissions level (this shouldn't happen)")
+	invalidPermLevel       = errors.New("failed to set permissions level")
 	invalidFallbackProfile = errors.New("failed to set fallback profile")
 	invalidSocketSet       = errors.New("failed to set socket")
 	cantRun                = errors.New("failed to run application")
+	cantInspect            = errors.New("failed to inspect bundle")
+	cantExport             = errors.New("failed to export OCI bundle")
+	cantMount              = errors.New("failed to mount bundle")
+	cantExtract            = errors.New("failed to extract bundle")
+	cantProfile            = errors.New("failed to change profile")
+	cantIntegrate          = errors.New("failed to integrate bundle")
+	cantGC                 = errors.New("failed to clean up")
+	cantTrust              = errors.New("failed to change trust")
+	cantVerify             = errors.New("failed to verify bundle")
+	cantUpdate             = errors.New("failed to update bundle")
+	cantRollback           = errors.New("failed to roll back bundle")
+	cantConfigure          = errors.New("failed to change configuration")
+	invalidConfig          = errors.New("failed to load configuration")
 )
 
-// Command line flags
+// Command line flags, each command registers the ones it takes
 var (
-	help             = pflag.BoolP("help", "h", false, "display this help menu")
-	listPerms        = pflag.BoolP("list-perms", "l", false, "print all permissions to be granted to the app")
-	verbose          = pflag.BoolP("verbose", "v", false, "make output more verbose")
-	level            = flag.Int("level", -1, "change the permissions level")
-	rootDir          = flag.String("root-dir", "", "use a different filesystem root for system files")
-	dataDir          = flag.String("data-dir", "", "change the AppImage's sandbox home location")
-	noDataDir        = flag.Bool("no-data-dir", false, "force AppImage's HOME to be a tmpfs")
-	extractIcon      = flag.String("extract-icon", "", "extract the AppImage's icon")
-	extractThumbnail = flag.String("extract-thumbnail", "", "extract the AppImage's thumbnail preview")
-	profile          = flag.String("profile", "", "use a profile from a desktop entry")
-	fallbackProfile  = flag.String("fallback-profile", "", "set profile to fallback on if one isn't found")
-	version          = flag.Bool("version", false, "show the version and quit")
-	trustOnce        = flag.Bool("trust-once", false, "trust the AppImage for one run")
-	trust            = flag.Bool("trust", false, "set whether the AppImage is trusted or not")
-
-	addFiles   arrayFlags
-	rmFiles    arrayFlags
-	addDevices arrayFlags
-	rmDevices  arrayFlags
-	addSockets arrayFlags
-	rmSockets  arrayFlags
+	help             bool
+	verbose          bool
+	level            string
+	rootDir          string
+	dataDir          string
+	noDataDir        bool
+	extractIcon      string
+	extractThumbnail string
+	listPerms        bool
+	profile          string
+	fallbackProfile  string
+	trustOnce        bool
+	trust            bool
+	acceptPerms      bool
+	shareID          bool
+	printSpec        bool
+	backend          string
+	noLandlock       bool
+	mountStrategy    string
+	dryRun           bool
+	removeEntry      bool
+	systemConfig     bool
+	format           string
+	emitScript       string
+
+	addFiles   []string
+	rmFiles    []string
+	addDevices []string
+	rmDevices  []string
+	addSockets []string
+	rmSockets  []string
 )
 
-// arrayFlags type for multiple string flags
-type arrayFlags []string
+// A subcommand of chains, eg: `chains inspect`
+type command struct {
+	name    string
+	args    string // Arguments it takes, for its usage
+	summary string
+	flags   func(fs *pflag.FlagSet) // Registers the flags it takes
+	run     func(fs *pflag.FlagSet) error
+	err     error // Says what failed when `run` fails
+
+	// Stops reading flags at the first argument, so that those following
+	// the AppImage are passed on to it
+	passArgs bool
+}
+
+// The first command is the one run when none is given
+var commands = []*command{
+	{
+		name:     "run",
+		args:     "<AppImage> [app args]",
+		summary:  "Run an AppImage in its sandbox. This is the default command, so `chains <AppImage>` does the same",
+		flags:    runFlags,
+		run:      run,
+		err:      cantRun,
+		passArgs: true,
+	},
+	{
+		name:    "inspect",
+		args:    "<AppImage>",
+		summary: "Show an AppImage's details and the permissions it would be granted",
+		flags:   inspectFlags,
+		run:     inspect,
+		err:     cantInspect,
+	},
+	{
+		name:    "trust",
+		args:    "list|add|revoke|keys|add-key|revoke-key [AppImage|sha256|key file|fingerprint]",
+		summary: "Manage which AppImages are trusted to run and the keys they may be signed with",
+		run:     trustCommand,
+		err:     cantTrust,
+	},
+	{
+		name:    "profile",
+		args:    "list|show|save|remove [AppImage|name]",
+		summary: "Manage the profiles that set what AppImages may access. `save` writes an AppImage's permissions, with the flags given applied, to the user's profile for it",
+		flags:   permFlags,
+		run:     profileCommand,
+		err:     cantProfile,
+	},
+	{
+		name:    "mount",
+		args:    "<AppImage> [dir]",
+		summary: "Mount an AppImage and print where, until interrupted",
+		flags:   mountFlags,
+		run:     mountCommand,
+		err:     cantMount,
+	},
+	{
+		name:    "extract",
+		args:    "<AppImage> [dir]",
+		summary: "Extract an AppImage's files, by default into `<AppImage name>.AppDir`. With --icon or --thumbnail, only those are extracted",
+		flags:   extractFlags,
+		run:     extractCommand,
+		err:     cantExtract,
+	},
+	{
+		name:     "export-oci",
+		args:     "<AppImage> [bundle dir] [app args]",
+		summary:  "Write an AppImage's sandbox as an OCI bundle, by default into `<AppImage name>.oci`",
+		flags:    exportOCIFlags,
+		run:      exportOCI,
+		err:      cantExport,
+		passArgs: true,
+	},
+	{
+		name:    "integrate",
+		args:    "<AppImage>",
+		summary: "Add an AppImage to the application menu, launching it through chains",
+		flags:   integrateFlags,
+		run:     integrate,
+		err:     cantIntegrate,
+	},
+	{
+		name:    "update",
+		args:    "<AppImage>",
+		summary: "Replace an AppImage with its newest version, keeping the current one for `chains rollback`",
+		flags:   dryRunFlag,
+		run:     update,
+		err:     cantUpdate,
+	},
+	{
+		name:    "rollback",
+		args:    "<app ID|AppImage> [sha256]",
+		summary: "Put back a previous version of an app, the newest one kept unless a hash is given",
+		flags:   dryRunFlag,
+		run:     rollback,
+		err:     cantRollback,
+	},
+	{
+		name:    "verify",
+		args:    "<AppImage>",
+		summary: "Check that an AppImage is complete and unmodified, and who signed it",
+		run:     verify,
+		err:     cantVerify,
+	},
+	{
+		name:    "gc",
+		summary: "Clean up after crashed instances and deleted AppImages",
+		flags:   dryRunFlag,
+		run:     gc,
+		err:     cantGC,
+	},
+	{
+		name:    "config",
+		args:    "show|get|set [setting] [value]",
+		summary: "Show chains' settings and where each came from, or change them in the user's config file. Lists are given comma separated",
+		flags:   configFlags,
+		run:     configCommand,
+		err:     cantConfigure,
+	},
+}
+
+// failure is returned by commands to say which of their steps failed,
+// instead of their `err`
+type failure struct {
+	msg error
+	err error
+}
+
+func (f *failure) Error() string {
+	return f.msg.Error() + ": " + f.err.Error()
+}
+
+func fail(msg error, err error) error {
+	return &failure{msg, err}
+}
 
 // Main function
 func main() {
-	setupSignalHandler()
+	// Must come first, this is how the native backend sets up its sandbox
+	chains.NativeInit()
 
-	flag.Var(&addFiles, "add-file", "give the sandbox access to a filesystem object")
-	flag.Var(&rmFiles, "rm-file", "revoke a file from the sandbox")
-	flag.Var(&addDevices, "add-device", "add a device to the sandbox")
-	flag.Var(&rmDevices, "rm-device", "remove access to a device")
-	flag.Var(&addSockets, "add-socket", "allow the sandbox to access another socket")
-	flag.Var(&rmSockets, "rm-socket", "disable a socket")
+	// NativeInit also runs the helper that applies Landlock under bwrap
+	chains.LandlockHelper = true
 
-	handleFlags()
+	args := os.Args[1:]
+	c := commands[0]
 
-	ai, err := chains.NewAppImage(flag.Arg(0))
-	if err != nil {
-		fatal(invalidBundle, err)
-		return
+	// Loaded before any flags are, as it sets their defaults. A broken config
+	// is only reported once the command is known, as `chains config` can fix it
+	config, configErr = chains.LoadConfig()
+	if configErr != nil {
+		config = chains.DefaultConfig()
 	}
-	defer ai.Destroy()
+	config.Apply()
 
-	if *extractIcon != "" {
-		if err := extractIconFromAppImage(ai); err != nil {
-			fatal(invalidIcon, err)
-			return
-		}
-		return
+	if len(args) == 0 {
+		usage(os.Stderr)
+		os.Exit(2)
 	}
 
-	if *extractThumbnail != "" {
-		if err := extractThumbnailFromAppImage(ai); err != nil {
-			fatal(invalidThumbnail, err)
-			return
+	switch args[0] {
+	case "-h", "--help", "help":
+		if len(args) > 1 {
+			if c := findCommand(args[1]); c != nil {
+				newFlagSet(c).Usage()
+				return
+			}
 		}
+		usage(os.Stdout)
+		return
+	case "-V", "--version", "version":
+		printVersion()
 		return
 	}
 
-	perms, err := setPermissions(ai)
-	if err != nil {
-		fatal(invalidPerms, err)
-		return
+	// Anything that isn't a command is an AppImage to run (or a flag to run
+	// it with), as before chains had commands
+	if found := findCommand(args[0]); found != nil {
+		c, args = found, args[1:]
 	}
 
-	// List permissions if required
-	if *listPerms {
-		listAppImagePermissions(ai, perms)
-		return
+	if configErr != nil && c.name != "config" {
+		fatal(invalidConfig, configErr)
 	}
 
-	if err := mountAppImage(ai); err != nil {
-		fatal(err, err)
-		return
+	fs := newFlagSet(c)
+	if err := fs.Parse(compatArgs(fs, args, c.passArgs)); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n\n", err)
+		fs.Usage()
+		os.Exit(2)
 	}
 
-	if err := configureAppImage(ai, perms); err != nil {
-		fatal(cantRun, err)
+	if help {
+		fs.Usage()
 		return
 	}
 
-	if err := ai.Sandbox(perms, flag.Args()[1:]); err != nil {
-		fmt.Errorf("sandbox error:", err)
-		return
+	var f *failure
+
+	switch err := c.run(fs); {
+	case err == nil:
+	case errors.Is(err, errUsage):
+		fs.Usage()
+		os.Exit(2)
+	case errors.As(err, &f):
+		fatal(f.msg, f.err)
+	default:
+		fatal(c.err, err)
 	}
 }
 
-// Handle interrupt signal
-func setupSignalHandler() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-
-	go func() {
-		<-c
-		if *verbose {
-			fmt.Println("\nQuitting due to interrupt signal!")
-		}
-		if ai != nil {
-			ai.FuserUmount()
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
 		}
-	}()
-}
-
-// Handle command line flags
-func handleFlags() {
-	flag.Parse()
-
-	//if *version {
-	//	fmt.Println(chains.Version)
-	//	os.Exit(0)
-	//}
-
-	if *help || len(os.Args) < 2 {
-		flag.Usage()
 	}
+
+	return nil
 }
 
-// Extract the AppImage's icon
-func extractIconFromAppImage(ai *chains.AppImage) error {
-	if *verbose {
-		fmt.Printf("Extracting icon to %s", *extractIcon)
-	}
-	f, err := os.Create(*extractIcon)
-	if err != nil {
-		return err
+// Creates the command's flag set, with its own help
+func newFlagSet(c *command) *pflag.FlagSet {
+	fs := pflag.NewFlagSet("chains "+c.name, pflag.ContinueOnError)
+	fs.SetInterspersed(!c.passArgs)
+	fs.BoolVarP(&help, "help", "h", false, "show this help")
+
+	if c.flags != nil {
+		c.flags(fs)
 	}
-	defer f.Close()
 
-	// Open the icon file
-	iconFile, err := os.Open(ai.Icon)
-	if err != nil {
-		return err
+	fs.Usage = func() {
+		line := strings.TrimSpace("chains " + c.name + " [flags] " + c.args)
+		fmt.Fprintf(os.Stderr, "usage: %s\n\n%s\n\nflags:\n%s", line, c.summary, fs.FlagUsages())
 	}
-	defer iconFile.Close()
 
-	// Copy the icon file to the destination
-	_, err = io.Copy(f, iconFile)
-	return err
+	return fs
 }
 
-// Extract the AppImage's thumbnail
-func extractThumbnailFromAppImage(ai *chains.AppImage) error {
-	if *verbose {
-		fmt.Printf("Extracting thumbnail preview to %s\n", *extractThumbnail)
-	}
-	thumbnail, err := ai.Thumbnail()
-	if err != nil {
-		return err
+// Lists the commands
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: chains [command] [flags] <AppImage> [app args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Runs AppImages in a sandbox. Without a command, the AppImage is run")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, c := range commands {
+		summary, _, _ := strings.Cut(c.summary, ". ")
+		fmt.Fprintf(w, "  %-11s %s\n", c.name, summary)
 	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run `chains <command> --help` for the flags a command takes")
+}
 
-	f, err := os.Create(*extractThumbnail)
-	if err != nil {
-		return err
+// Prints the version chains was built as, and from which commit if known
+func printVersion() {
+	version := "(devel)"
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version = info.Main.Version
+
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+				version += " (" + s.Value[:12] + ")"
+			}
+		}
 	}
-	defer f.Close()
 
-	_, err = io.Copy(f, thumbnail)
-	return err
+	fmt.Println("chains", version)
 }
 
-// Set permissions from profile or defaults
-func setPermissions(ai *chains.AppImage) (*chains.AppImagePerms, error) {
-	perms, err := ai.GetPermissions()
-	if err != nil {
-		return perms, err
-	}
+// chains used to read its flags with the standard flag package, which takes
+// long flags after a single dash (`-level 2`). pflag would read those as a
+// bunch of shorthands, so they're given a second dash
+func compatArgs(fs *pflag.FlagSet, args []string, passArgs bool) []string {
+	out := make([]string, 0, len(args))
 
-	if *profile != "" {
-		f, err := os.Open(*profile)
-		if err != nil {
-			return perms, err
-		}
-		defer f.Close()
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
 
-		perms, err = chains.FromReader(f)
-		if err != nil {
-			return perms, err
+		if arg == "--" || (passArgs && !strings.HasPrefix(arg, "-")) {
+			return append(out, args[i:]...)
 		}
-	}
 
-	// Process permission adjustments
-	perms.RemoveFiles(rmFiles...)
-	perms.AddFiles(addFiles...)
+		if !strings.HasPrefix(arg, "-") {
+			out = append(out, arg)
+			continue
+		}
 
-	for _, file := range rmFiles {
-		perms.RemoveFiles(file)
-	}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
 
-	for _, file := range addFiles {
-		perms.AddFiles(file)
-	}
+		f := fs.Lookup(name)
+		if f == nil && len(name) == 1 {
+			f = fs.ShorthandLookup(name)
+		}
 
-	// Setting the permissions level if provided
-	if *level > -1 && *level <= 3 {
-		if err := perms.SetLevel(*level); err != nil {
-			return perms, err
+		if !strings.HasPrefix(arg, "--") && len(name) > 1 && f != nil {
+			arg = "-" + arg
 		}
-	}
+		out = append(out, arg)
 
-	// Fall back to default level if needed
-	if perms.Level < 0 || perms.Level > 3 {
-		if *fallbackProfile != "" {
-			return loadFallbackProfile(perms)
+		// Keep the flag's value from being taken for the AppImage
+		if f != nil && f.NoOptDefVal == "" && !hasValue && i+1 < len(args) {
+			i++
+			out = append(out, args[i])
 		}
-		perms.Level = 3
 	}
 
-	return perms, nil
+	return out
 }
 
-// Load permissions from fallback profile
-func loadFallbackProfile(perms *chains.AppImagePerms) (*chains.AppImagePerms, error) {
-	f, err := ini.LoadSources(ini.LoadOptions{
-		IgnoreInlineComment: true,
-	}, *fallbackProfile)
-	if err != nil {
-		return perms, err
+// Ask the user a yes or no question, no if stdin isn't a terminal
+func confirm(question string) bool {
+	if _, err := unix.IoctlGetTermios(int(os.Stdin.Fd()), unix.TCGETS); err != nil {
+		return false
 	}
-	return chains.FromIni(f)
-}
 
-// List the AppImage permissions
-func listAppImagePermissions(ai *chains.AppImage, perms *chains.AppImagePerms) {
-	if *verbose {
-		fmt.Printf("Bundle Info:\nName: %s\nVersion: %s\n", ai.Name, ai.Version)
-	}
-	// List permissions here
-	fmt.Println("Permissions:")
-	fmt.Println(perms)
-}
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
 
-// Mount the AppImage
-func mountAppImage(ai *chains.AppImage) error {
-	return ai.Mount()
+	return answer == "y" || answer == "yes"
 }
 
-// Configure AppImage before running
-func configureAppImage(ai *chains.AppImage, perms *chains.AppImagePerms) error {
-	if *rootDir != "" {
-		ai.SetRootDir(*rootDir)
-	}
-	if *dataDir != "" {
-		ai.SetDataDir(*dataDir)
-	}
-	if *noDataDir {
-		perms.DataDir = false
-	}
-	if flagUsed("trust") {
-		ai.SetTrusted(*trust)
+// Formats a number of bytes for humans
+func formatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	n := float64(size)
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
 	}
-	if !ai.Trusted() && !*trustOnce {
-		return errors.New("bundle isn't marked trusted")
+
+	if i == 0 {
+		return strconv.FormatInt(size, 10) + " B"
 	}
-	return nil
+
+	return strconv.FormatFloat(n, 'f', 1, 64) + " " + units[i]
 }
 
 // Fatal error handler
@@ -294,25 +426,3 @@ func fatal(msg error, err error) {
 	fmt.Fprintf(os.Stderr, "%s: %v\n", msg, err)
 	os.Exit(1)
 }
-
-// Check if a flag has been used
-func flagUsed(name string) bool {
-	found := false
-	flag.Visit(func(f *flag.Flag) {
-		if f.Name == name {
-			found = true
-		}
-	})
-	return found
-}
-
-// String representation for arrayFlags
-func (i *arrayFlags) String() string {
-	return ""
-}
-
-// Type representation for arrayFlags
-func (i *arrayFlags) Set(value string) error {
-	*i = append(*i, value)
-	return nil
-}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/xplshn/chains/pkg/chains"
+
+	"github.com/spf13/pflag"
+)
+
+func configFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&systemConfig, "system", false, "change the config file shared by every user, "+chains.SystemConfigPath())
+}
+
+// `chains config show|get|set`. Settings come from the system's config file,
+// then the user's, then the environment, see chains.LoadConfig
+func configCommand(fs *pflag.FlagSet) error {
+	switch {
+	case fs.Arg(0) == "show" && fs.NArg() == 1:
+		if configErr != nil {
+			return fail(invalidConfig, configErr)
+		}
+		return showConfig()
+	case fs.Arg(0) == "get" && fs.NArg() == 2:
+		if configErr != nil {
+			return fail(invalidConfig, configErr)
+		}
+
+		value, err := config.Get(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(value)
+		return nil
+	case fs.Arg(0) == "set" && fs.NArg() == 3:
+		path := chains.UserConfigPath()
+		if systemConfig {
+			path = chains.SystemConfigPath()
+		}
+
+		if err := chains.SetConfig(path, fs.Arg(1), fs.Arg(2)); err != nil {
+			return err
+		}
+
+		fmt.Printf("set %s in %s\n", fs.Arg(1), path)
+		return nil
+	}
+
+	return errUsage
+}
+
+// Lists every setting, its value and where it came from
+func showConfig() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SETTING\tVALUE\tFROM")
+
+	for _, key := range chains.ConfigKeys() {
+		value, err := config.Get(key)
+		if err != nil {
+			return err
+		}
+
+		if value == "" {
+			value = "-"
+		}
+
+		source := config.Source(key)
+		if config.Locked(key) {
+			source += " (locked)"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key, value, source)
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/xplshn/chains/pkg/chains"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+func inspectFlags(fs *pflag.FlagSet) {
+	permFlags(fs)
+	fs.StringVar(&format, "format", "text", "output format: text, json or yaml. JSON and YAML follow a versioned schema, text is for people")
+}
+
+// `chains inspect <AppImage>` shows what's known about the AppImage and what
+// it would be granted if run with the same flags
+func inspect(fs *pflag.FlagSet) error {
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	if format != "text" && format != "json" && format != "yaml" {
+		return fmt.Errorf("unknown format `%s`", format)
+	}
+
+	ai, err := chains.NewAppImage(fs.Arg(0))
+	if err != nil {
+		return fail(invalidBundle, err)
+	}
+
+	var layers chains.InspectedPerms
+	perms, source, err := layerPermissions(ai, func(source chains.PermsSource, perms *chains.AppImagePerms) {
+		if layers.Sources == nil {
+			layers = chains.InspectPerms(perms, source)
+		} else {
+			layers.Apply(source, perms)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	i, err := ai.Inspect(perms, source)
+	if err != nil {
+		return err
+	}
+	i.Permissions = layers
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(i)
+	case "yaml":
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(i); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+
+	fmt.Printf("Name: %s\n", i.Name)
+	fmt.Printf("Version: %s\n", i.Version)
+	fmt.Printf("ID: %s\n", i.ID)
+	fmt.Printf("Path: %s\n", i.Path)
+	fmt.Printf("SHA256: %s\n", i.SHA256)
+	fmt.Printf("Image: type %d, %s at offset %d\n", i.Type, i.Filesystem, i.Offset)
+	fmt.Printf("Architectures: %s\n", listOrNone(i.Architectures))
+	if i.UpdateInfo != "" {
+		fmt.Printf("Update information: %s\n", i.UpdateInfo)
+	}
+	if i.Icon != "" {
+		fmt.Printf("Icon: %s\n", i.Icon)
+	}
+	fmt.Printf("Trust: %s\n", i.Trust)
+	fmt.Printf("Data directory: %s\n", i.DataDir)
+
+	switch {
+	case i.Mount.Mounted:
+		fmt.Printf("Mounted: at %s, %d instances running\n", i.Mount.Dir, i.Mount.Instances)
+	case i.Mount.Extracted:
+		fmt.Printf("Mounted: extracted to %s, %d instances running\n", i.Mount.Dir, i.Mount.Instances)
+	default:
+		fmt.Println("Mounted: no")
+	}
+
+	var adjusted []string
+	for name, source := range i.Permissions.Sources {
+		if source != i.Permissions.Source {
+			adjusted = append(adjusted, strings.ReplaceAll(name, "_", " ")+" from "+string(source))
+		}
+	}
+	slices.Sort(adjusted)
+
+	from := string(i.Permissions.Source)
+	if len(adjusted) > 0 {
+		from += " (" + strings.Join(adjusted, ", ") + ")"
+	}
+	fmt.Printf("Permissions from: %s\n", from)
+	fmt.Println()
+
+	return printPermissions(perms)
+}
+
+// Lists the permissions to be granted to the app
+func printPermissions(perms *chains.AppImagePerms) error {
+	level := fmt.Sprint(perms.Level)
+	if perms.LevelName != "" {
+		level = perms.LevelName
+	}
+
+	sockets := make([]string, len(perms.Sockets))
+	for i := range perms.Sockets {
+		sockets[i] = string(perms.Sockets[i])
+	}
+
+	fmt.Println("Permissions:")
+	fmt.Printf("Level: %s\n", level)
+	fmt.Printf("Files: %s\n", listOrNone(perms.Files))
+	fmt.Printf("Devices: %s\n", listOrNone(perms.Devices))
+	fmt.Printf("Sockets: %s\n", listOrNone(sockets))
+	fmt.Printf("Persistent home: %t\n", perms.DataDir)
+	if perms.Seccomp != "" {
+		fmt.Printf("Seccomp filter: %s\n", perms.Seccomp)
+	}
+
+	id, err := perms.GetIdentity()
+	if err != nil {
+		fmt.Println("Identity: invalid:", err)
+		return nil
+	}
+
+	mode := perms.Identity
+	if mode == "" {
+		mode = "real"
+	}
+	fmt.Printf("Identity: %s (%s)\n", id, mode)
+
+	caps := "default"
+	if perms.DropCaps {
+		caps = "dropped"
+		if len(perms.KeepCaps) > 0 {
+			caps += " except " + strings.Join(perms.KeepCaps, ", ")
+		}
+	}
+	fmt.Printf("Capabilities: %s\n", caps)
+
+	if perms.DisableUserns {
+		fmt.Println("Nested user namespaces: disabled")
+	}
+
+	return nil
+}
+
+func listOrNone(s []string) string {
+	if len(s) == 0 {
+		return "none"
+	}
+
+	return strings.Join(s, ", ")
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/xplshn/chains/pkg/chains"
+
+	"github.com/spf13/pflag"
+)
+
+func integrateFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&removeEntry, "remove", false, "remove the AppImage from the application menu instead")
+}
+
+// `chains integrate [--remove] <AppImage>`. The entry runs the AppImage
+// through this chains, so it's sandboxed however it's launched
+func integrate(fs *pflag.FlagSet) error {
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	ai, err := chains.NewAppImage(fs.Arg(0))
+	if err != nil {
+		return fail(invalidBundle, err)
+	}
+
+	if removeEntry {
+		if err := ai.Unintegrate(); err != nil {
+			return err
+		}
+
+		fmt.Printf("removed %s from the application menu\n", ai.Name)
+		return nil
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	if err := ai.Integrate(self, "run"); err != nil {
+		return err
+	}
+
+	fmt.Printf("added %s to the application menu as %s\n", ai.Name, ai.DesktopEntryPath())
+	return nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/xplshn/chains/pkg/chains"
+
+	"github.com/spf13/pflag"
+)
+
+func dryRunFlag(fs *pflag.FlagSet) {
+	fs.BoolVar(&dryRun, "dry-run", false, "only report what would be done")
+}
+
+// Reports whether the AppImage is complete, unmodified and who signed it.
+// Has to work on AppImages too broken to open
+func verify(fs *pflag.FlagSet) error {
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	path := fs.Arg(0)
+
+	report, err := chains.CheckIntegrity(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Size: %d bytes\n", report.Size)
+	fmt.Printf("Image: %s at offset %d, ending at %d\n", report.FSType, report.Offset, report.ImageEnd)
+
+	var problems []string
+
+	if missing := report.Missing(); missing > 0 {
+		problems = append(problems, fmt.Sprintf("truncated, %d bytes missing", missing))
+	}
+	if report.Signature > 0 {
+		fmt.Printf("Appended signature: %d bytes after the image\n", report.Signature)
+	}
+	if report.Trailing > 0 {
+		problems = append(problems, fmt.Sprintf("%d bytes of trailing garbage after the image", report.Trailing))
+	}
+
+	switch {
+	case report.DigestMD5 == "":
+		fmt.Println("Digest: none recorded")
+	case report.DigestOK:
+		fmt.Printf("Digest: ok (md5 %s)\n", report.DigestMD5)
+	default:
+		fmt.Printf("Digest: mismatch (md5 %s)\n", report.DigestMD5)
+		problems = append(problems, "contents don't match the recorded digest")
+	}
+
+	// Signatures can only be checked on AppImages that open
+	if report.Missing() == 0 {
+		var sig *chains.Signature
+
+		ai, err := chains.NewAppImage(path)
+		if err == nil {
+			sig, err = ai.Verify()
+		}
+
+		switch {
+		case ai == nil:
+			fmt.Printf("Signature: couldn't be checked (%v)\n", err)
+		case errors.Is(err, chains.NotSigned):
+			fmt.Println("Signature: none")
+		case err != nil:
+			fmt.Printf("Signature: invalid (%v)\n", err)
+			problems = append(problems, "signature invalid")
+		case sig.Approved:
+			fmt.Printf("Signature: ok, by approved key %s (%s)\n", sig.Fingerprint, strings.Join(sig.Identities, ", "))
+		default:
+			fmt.Printf("Signature: ok, by unapproved key %s (%s)\n", sig.Fingerprint, strings.Join(sig.Identities, ", "))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+
+	fmt.Println("Integrity: ok")
+	return nil
+}
+
+// Replaces the AppImage with its newest version, reusing what it can of the
+// old one
+func update(fs *pflag.FlagSet) error {
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	ai, err := chains.NewAppImage(fs.Arg(0))
+	if err != nil {
+		return fail(invalidBundle, err)
+	}
+
+	u, err := ai.CheckUpdate()
+	if err != nil {
+		return err
+	}
+
+	if !u.Available {
+		fmt.Printf("%s is up to date\n", ai.Name)
+		return nil
+	}
+
+	release := u.Name
+	if u.Tag != "" {
+		release += " (" + u.Tag + ")"
+	}
+
+	if dryRun {
+		fmt.Printf("%s can be updated to %s, %s\n", ai.Name, release, formatSize(u.Size))
+		return nil
+	}
+
+	// Trust is tied to the contents, unless they're trusted for being signed
+	state, _ := ai.TrustState()
+
+	stats, err := ai.Update(u)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("updated %s to %s: reused %s, downloaded %s\n", ai.Name, release, formatSize(stats.Reused), formatSize(stats.Downloaded))
+	if state == chains.TrustValid {
+		fmt.Println("the new version has to be approved before it runs")
+	}
+	return nil
+}
+
+// Puts back a previous version of an app, given by its ID or an AppImage
+// of it, and optionally the start of the version's SHA-256
+func rollback(fs *pflag.FlagSet) error {
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errUsage
+	}
+
+	id := fs.Arg(0)
+	if chains.FileExists(id) {
+		ai, err := chains.NewAppImage(id)
+		if err != nil {
+			return fail(invalidBundle, err)
+		}
+		id = ai.ID
+	}
+
+	versions, err := chains.ListVersions(id)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		if len(versions) == 0 {
+			fmt.Printf("no previous versions of %s are kept\n", id)
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tSHA256\tREPLACED\tTRUSTED\tPATH")
+		for _, v := range versions {
+			fmt.Fprintf(w, "%s\t%.12s\t%s\t%t\t%s\n", v.Version, v.SHA256, v.Time.Local().Format("2006-01-02 15:04"), v.Trust != nil, v.Path)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		for _, v := range versions {
+			if strings.HasPrefix(v.SHA256, strings.ToLower(fs.Arg(1))) {
+				fmt.Printf("would roll %s back to %s (%.12s)\n", v.Path, v.Version, v.SHA256)
+				break
+			}
+		}
+		return nil
+	}
+
+	v, err := chains.Rollback(id, fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("rolled %s back to %s (%.12s)\n", v.Path, v.Version, v.SHA256)
+	if v.Trust == nil {
+		fmt.Println("it wasn't trusted when it was replaced, approve it with `chains trust add`")
+	}
+	return nil
+}
+
+// Cleans up after crashed instances and deleted AppImages
+func gc(fs *pflag.FlagSet) error {
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	report, err := chains.GC(dryRun)
+
+	unmounted, removed, reclaimed := "unmounted", "removed", "reclaimed"
+	if dryRun {
+		unmounted, removed, reclaimed = "would unmount", "would remove", "would reclaim"
+	}
+
+	for _, m := range report.Mounts {
+		fmt.Println(unmounted, m)
+	}
+	for _, r := range report.Removed {
+		fmt.Println(removed, r)
+	}
+	fmt.Println(reclaimed, formatSize(report.Reclaimed))
+
+	return err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/xplshn/chains/pkg/chains"
+
+	"github.com/spf13/pflag"
+)
+
+func mountFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&mountStrategy, "mount", string(config.Mount), "how to access the AppImage's files: fuse, extract (into the cache, for hosts without FUSE) or auto")
+}
+
+func extractFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&extractIcon, "icon", "", "only extract the AppImage's icon, to this file")
+	fs.StringVar(&extractThumbnail, "thumbnail", "", "only extract the AppImage's thumbnail preview, to this file")
+	fs.BoolVarP(&verbose, "verbose", "v", false, "make output more verbose")
+}
+
+// `chains mount <AppImage> [dir]` keeps the AppImage mounted until it's
+// interrupted. Mounting at a given directory always uses FUSE
+func mountCommand(fs *pflag.FlagSet) error {
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errUsage
+	}
+
+	ai, err := chains.NewAppImage(fs.Arg(0))
+	if err != nil {
+		return fail(invalidBundle, err)
+	}
+
+	// Listen before mounting so that an early interrupt still unmounts
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	if fs.NArg() == 2 {
+		err = ai.Mount(fs.Arg(1))
+	} else {
+		err = mountAppImage(ai)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(ai.MountDir())
+	<-c
+
+	return ai.Destroy()
+}
+
+// `chains extract <AppImage> [dir]`, by default into `<name>.AppDir`
+func extractCommand(fs *pflag.FlagSet) error {
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		return errUsage
+	}
+
+	if extractIcon != "" || extractThumbnail != "" {
+		if fs.NArg() != 1 {
+			return errUsage
+		}
+		return extractImages(fs.Arg(0), extractIcon, extractThumbnail)
+	}
+
+	ai, err := chains.NewAppImage(fs.Arg(0))
+	if err != nil {
+		return fail(invalidBundle, err)
+	}
+
+	dir := strings.TrimSuffix(filepath.Base(ai.Path), filepath.Ext(ai.Path)) + ".AppDir"
+	if fs.NArg() == 2 {
+		dir = fs.Arg(1)
+	}
+
+	if err := ai.ExtractTo(dir); err != nil {
+		return err
+	}
+
+	if verbose {
+		fmt.Printf("Extracted %s to %s\n", ai.Name, dir)
+	}
+	return nil
+}
+
+// Extracts the AppImage's icon and thumbnail preview to the files given, if
+// any
+func extractImages(path string, icon string, thumbnail string) error {
+	ai, err := chains.NewAppImage(path)
+	if err != nil {
+		return fail(invalidBundle, err)
+	}
+
+	if icon != "" {
+		if verbose {
+			fmt.Printf("Extracting icon to %s\n", icon)
+		}
+
+		b, _, err := ai.ReadIcon()
+		if err != nil {
+			return fail(invalidIcon, err)
+		}
+
+		if err := os.WriteFile(icon, b, 0644); err != nil {
+			return fail(invalidIcon, err)
+		}
+	}
+
+	if thumbnail != "" {
+		if verbose {
+			fmt.Printf("Extracting thumbnail preview to %s\n", thumbnail)
+		}
+
+		if err := writeThumbnail(ai, thumbnail); err != nil {
+			return fail(invalidThumbnail, err)
+		}
+	}
+
+	return nil
+}
+
+func writeThumbnail(ai *chains.AppImage, dest string) error {
+	thumbnail, err := ai.Thumbnail()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, thumbnail)
+	return err
+}
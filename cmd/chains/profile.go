@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/xplshn/chains/pkg/chains"
+
+	"github.com/spf13/pflag"
+)
+
+// `chains profile list|show|save|remove`. User profiles are looked up by the
+// app's name and take precedence over the built-in ones, see
+// *AppImage.GetPermissions
+func profileCommand(fs *pflag.FlagSet) error {
+	switch fs.Arg(0) {
+	case "list":
+		if fs.NArg() != 1 {
+			return errUsage
+		}
+		return listProfiles()
+	case "show":
+		if fs.NArg() != 2 {
+			return errUsage
+		}
+		return showProfile(fs.Arg(1))
+	case "save":
+		if fs.NArg() != 2 {
+			return errUsage
+		}
+		return saveProfile(fs.Arg(1))
+	case "remove":
+		if fs.NArg() != 2 {
+			return errUsage
+		}
+		return removeProfile(fs.Arg(1))
+	}
+
+	return errUsage
+}
+
+// Lists the user's profiles, those in the configured profile dirs and the
+// built-in ones
+func listProfiles() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSOURCE")
+
+	for i, dir := range append([]string{chains.ProfileDir()}, chains.ProfileSearchPath...) {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		source := dir
+		if i == 0 {
+			source = "user"
+		}
+
+		for _, e := range entries {
+			if !e.IsDir() {
+				fmt.Fprintf(w, "%s\t%s\n", e.Name(), source)
+			}
+		}
+	}
+
+	var names []string
+	for name := range chains.Profiles() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\tbuilt-in\n", name)
+	}
+
+	return w.Flush()
+}
+
+// Prints the permissions an AppImage would be granted, or those of the
+// profile named `target`, as a profile
+func showProfile(target string) error {
+	var perms *chains.AppImagePerms
+	var err error
+
+	if chains.FileExists(target) {
+		ai, err := chains.NewAppImage(target)
+		if err != nil {
+			return fail(invalidBundle, err)
+		}
+
+		perms, _, err = setPermissions(ai)
+		if err != nil {
+			return err
+		}
+	} else {
+		perms, err = chains.FromSystem(target)
+		if err != nil {
+			perms, err = chains.FromName(target)
+		}
+		if err != nil {
+			return fmt.Errorf("no profile named `%s`", target)
+		}
+	}
+
+	return perms.WriteIni(os.Stdout)
+}
+
+// Saves the permissions the AppImage would be granted, with the flags
+// applied, as the user's profile for it
+func saveProfile(path string) error {
+	ai, err := chains.NewAppImage(path)
+	if err != nil {
+		return fail(invalidBundle, err)
+	}
+
+	perms, _, err := setPermissions(ai)
+	if err != nil {
+		return err
+	}
+
+	dest := chains.ProfilePath(ai.Name)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	if err := perms.WriteIni(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("saved profile for %s to %s\n", ai.Name, dest)
+	return nil
+}
+
+// Removes the user's profile for an app, given by its name or an AppImage of
+// it
+func removeProfile(target string) error {
+	name := target
+
+	if chains.FileExists(target) {
+		ai, err := chains.NewAppImage(target)
+		if err != nil {
+			return fail(invalidBundle, err)
+		}
+		name = ai.Name
+	}
+
+	if err := os.Remove(chains.ProfilePath(name)); err != nil {
+		return err
+	}
+
+	fmt.Printf("removed profile for %s\n", name)
+	return nil
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/xplshn/chains/pkg/chains"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/ini.v1"
+)
+
+// Flags that change the permissions an AppImage is granted
+func permFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&level, "level", config.Level, "change the permissions level, either 0-3 or a custom level name (0 runs the app unsandboxed)")
+	fs.StringVar(&profile, "profile", "", "use a profile from a desktop entry")
+	fs.StringVar(&fallbackProfile, "fallback-profile", "", "set profile to fallback on if one isn't found")
+	fs.StringArrayVar(&addFiles, "add-file", nil, "give the sandbox access to a filesystem object")
+	fs.StringArrayVar(&rmFiles, "rm-file", nil, "revoke a file from the sandbox")
+	fs.StringArrayVar(&addDevices, "add-device", nil, "add a device to the sandbox")
+	fs.StringArrayVar(&rmDevices, "rm-device", nil, "remove access to a device")
+	fs.StringArrayVar(&addSockets, "add-socket", nil, "allow the sandbox to access another socket")
+	fs.StringArrayVar(&rmSockets, "rm-socket", nil, "disable a socket")
+}
+
+// Flags that change how the sandbox is set up
+func sandboxFlags(fs *pflag.FlagSet) {
+	permFlags(fs)
+	fs.StringVar(&rootDir, "root-dir", "", "use a different filesystem root for system files")
+	fs.StringVar(&dataDir, "data-dir", "", "change the AppImage's sandbox home location")
+	fs.BoolVar(&noDataDir, "no-data-dir", false, "force AppImage's HOME to be a tmpfs")
+	fs.StringVar(&backend, "backend", string(config.Backend), "program used to sandbox the app (bwrap, native)")
+	fs.BoolVar(&noLandlock, "no-landlock", false, "don't apply Landlock filesystem restrictions inside of the sandbox")
+	mountFlags(fs)
+	fs.BoolVarP(&verbose, "verbose", "v", false, "make output more verbose")
+}
+
+// Flags that approve an AppImage before its sandbox is used
+func trustFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&trustOnce, "trust-once", false, "trust the AppImage for one run")
+	fs.BoolVar(&trust, "trust", false, "set whether the AppImage is trusted or not")
+	fs.BoolVar(&acceptPerms, "accept-permission-changes", false, "run the AppImage even if its permissions changed since it was trusted")
+	fs.BoolVar(&shareID, "share-app-id", false, "let the AppImage use the data of its app ID even if another AppImage already does")
+}
+
+func runFlags(fs *pflag.FlagSet) {
+	sandboxFlags(fs)
+	trustFlags(fs)
+	fs.BoolVar(&printSpec, "print-spec", false, "print the sandbox spec as JSON and quit")
+	fs.BoolVar(&dryRun, "dry-run", false, "print the commands and environment the AppImage would be run with, shell quoted, and quit")
+	fs.StringVar(&emitScript, "emit-script", "", "write a shell script that runs the AppImage as chains would, without chains, to this file (- for stdout) and quit")
+
+	// Kept working for scripts written before chains had commands
+	fs.BoolVarP(&listPerms, "list-perms", "l", false, "print all permissions to be granted to the app")
+	fs.StringVar(&extractIcon, "extract-icon", "", "extract the AppImage's icon")
+	fs.StringVar(&extractThumbnail, "extract-thumbnail", "", "extract the AppImage's thumbnail preview")
+	fs.MarkDeprecated("list-perms", "use `chains inspect` instead")
+	fs.MarkDeprecated("extract-icon", "use `chains extract --icon` instead")
+	fs.MarkDeprecated("extract-thumbnail", "use `chains extract --thumbnail` instead")
+}
+
+// `chains run <AppImage> [app args]`, also what `chains <AppImage>` does
+func run(fs *pflag.FlagSet) error {
+	if fs.NArg() < 1 {
+		return errUsage
+	}
+
+	if extractIcon != "" || extractThumbnail != "" {
+		return extractImages(fs.Arg(0), extractIcon, extractThumbnail)
+	}
+
+	if dryRun || emitScript != "" {
+		return planLaunch(fs.Arg(0), fs.Args()[1:])
+	}
+
+	perms, err := prepare(fs.Arg(0))
+	if ai != nil {
+		defer destroyAppImage()
+	}
+	if err != nil {
+		return err
+	}
+
+	if listPerms {
+		return printPermissions(perms)
+	}
+
+	if printSpec {
+		spec, err := ai.Spec(perms, fs.Args()[1:])
+		if err != nil {
+			return err
+		}
+		_, err = spec.WriteTo(os.Stdout)
+		return err
+	}
+
+	if err := checkTrust(fs, ai, perms); err != nil {
+		return err
+	}
+
+	if err := checkID(ai); err != nil {
+		return err
+	}
+
+	running.Store(true)
+	defer running.Store(false)
+
+	return ai.Sandbox(perms, fs.Args()[1:])
+}
+
+func exportOCIFlags(fs *pflag.FlagSet) {
+	sandboxFlags(fs)
+	trustFlags(fs)
+}
+
+// Write the AppImage's sandbox as an OCI bundle, by default in the current
+// directory as `<name>.oci`
+func exportOCI(fs *pflag.FlagSet) error {
+	if fs.NArg() < 1 {
+		return errUsage
+	}
+
+	perms, err := prepare(fs.Arg(0))
+	if ai != nil {
+		defer destroyAppImage()
+	}
+	if err != nil {
+		return err
+	}
+
+	// The bundle runs the app just like chains would
+	if err := checkTrust(fs, ai, perms); err != nil {
+		return err
+	}
+
+	if err := checkID(ai); err != nil {
+		return err
+	}
+
+	dir := strings.TrimSuffix(filepath.Base(ai.Path), filepath.Ext(ai.Path)) + ".oci"
+	var args []string
+
+	if fs.NArg() > 1 {
+		dir = fs.Arg(1)
+		args = fs.Args()[2:]
+	}
+
+	if err := ai.ExportOCI(perms, dir, args); err != nil {
+		return err
+	}
+
+	if verbose {
+		fmt.Printf("Wrote OCI bundle to %s\n", dir)
+	}
+	return nil
+}
+
+// Opens and mounts the AppImage at `path` as `ai`, and works out its
+// permissions from the flags
+func prepare(path string) (*chains.AppImagePerms, error) {
+	var err error
+
+	ai, err = chains.NewAppImage(path)
+	if err != nil {
+		return nil, fail(invalidBundle, err)
+	}
+
+	setupSignalHandler()
+
+	perms, _, err := setPermissions(ai)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := mountAppImage(ai); err != nil {
+		return nil, fail(cantMount, err)
+	}
+
+	if err := configureAppImage(ai, perms); err != nil {
+		return nil, err
+	}
+
+	return perms, nil
+}
+
+// Prints or writes as a script how the AppImage at `path` would be run,
+// without mounting or running it
+func planLaunch(path string, args []string) error {
+	ai, err := chains.NewAppImage(path)
+	if err != nil {
+		return fail(invalidBundle, err)
+	}
+
+	perms, _, err := setPermissions(ai)
+	if err != nil {
+		return err
+	}
+
+	strategy, err := chains.MountStrategyFromString(mountStrategy)
+	if err != nil {
+		return err
+	}
+	ai.SetMountStrategy(strategy)
+
+	if err := configureAppImage(ai, perms); err != nil {
+		return err
+	}
+
+	plan, err := ai.Plan(perms, args)
+	if err != nil {
+		return err
+	}
+
+	if emitScript == "" {
+		return plan.WriteDryRun(os.Stdout)
+	}
+
+	if emitScript == "-" {
+		return plan.WriteScript(os.Stdout)
+	}
+
+	f, err := os.OpenFile(emitScript, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	if err := plan.WriteScript(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Handle interrupt signal. The mount may be shared with other instances, so
+// it's left like on any other exit, see destroyAppImage
+func setupSignalHandler() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		for range c {
+			// The app is sent the signal too, and unmounted once it quits
+			if running.Load() {
+				continue
+			}
+
+			if verbose {
+				fmt.Println("\nQuitting due to interrupt signal!")
+			}
+			if ai != nil {
+				destroyAppImage()
+			}
+			os.Exit(1)
+		}
+	}()
+}
+
+// Whether the app is running, see setupSignalHandler
+var running atomic.Bool
+
+var destroyOnce sync.Once
+
+// Unmounts `ai` once, whether the run ends or is interrupted
+func destroyAppImage() {
+	destroyOnce.Do(func() {
+		ai.Destroy()
+	})
+}
+
+// Set permissions from profile or defaults, adjusted by the flags. Also
+// returns which layer they came from
+func setPermissions(ai *chains.AppImage) (*chains.AppImagePerms, chains.PermsSource, error) {
+	return layerPermissions(ai, func(chains.PermsSource, *chains.AppImagePerms) {})
+}
+
+// Like setPermissions, calling `layer` with the permissions each time a layer
+// is applied, starting with the one they came from
+func layerPermissions(ai *chains.AppImage, layer func(chains.PermsSource, *chains.AppImagePerms)) (*chains.AppImagePerms, chains.PermsSource, error) {
+	perms, source, err := ai.ResolvePermissions()
+	if err != nil {
+		return perms, source, fail(invalidPerms, err)
+	}
+
+	if profile != "" {
+		f, err := os.Open(profile)
+		if err != nil {
+			return perms, source, fail(invalidPerms, err)
+		}
+		defer f.Close()
+
+		perms, err = chains.FromReader(f)
+		if err != nil {
+			return perms, source, fail(invalidPerms, err)
+		}
+		source = chains.ProfileFile
+	}
+	layer(source, perms)
+
+	// Restrictions from the config come first, so flags can lift them
+	perms.RemoveSockets(config.DenySockets...)
+	perms.RemoveDevices(config.DenyDevices...)
+	layer(chains.Settings, perms)
+
+	// Process permission adjustments
+	perms.RemoveFiles(rmFiles...)
+	perms.AddFiles(addFiles...)
+	perms.RemoveDevices(rmDevices...)
+	perms.AddDevices(addDevices...)
+	perms.RemoveSockets(rmSockets...)
+
+	if err := perms.AddSockets(addSockets...); err != nil {
+		return perms, source, fail(invalidSocketSet, err)
+	}
+	layer(chains.Flags, perms)
+
+	// Setting the permissions level if provided
+	if l, err := strconv.Atoi(level); err == nil {
+		if err := perms.SetLevel(l); err != nil {
+			return perms, source, fail(invalidPermLevel, err)
+		}
+	} else if level != "" {
+		if err := perms.SetLevelName(level); err != nil {
+			return perms, source, fail(invalidPermLevel, err)
+		}
+	}
+
+	// The flag defaults to the config's level
+	if level != "" && level == config.Level {
+		layer(chains.Settings, perms)
+	} else {
+		layer(chains.Flags, perms)
+	}
+
+	// Fall back to default level if needed
+	if perms.Level < 0 || perms.Level > 3 {
+		if fallbackProfile != "" {
+			perms, err := loadFallbackProfile(perms)
+			layer(chains.FallbackProfile, perms)
+			return perms, chains.FallbackProfile, err
+		}
+		perms.Level = config.FallbackLevel
+		layer(chains.Settings, perms)
+	}
+
+	return perms, source, nil
+}
+
+// Load permissions from fallback profile
+func loadFallbackProfile(perms *chains.AppImagePerms) (*chains.AppImagePerms, error) {
+	f, err := ini.LoadSources(ini.LoadOptions{
+		IgnoreInlineComment: true,
+	}, fallbackProfile)
+	if err != nil {
+		return perms, fail(invalidFallbackProfile, err)
+	}
+
+	perms, err = chains.FromIni(f)
+	if err != nil {
+		return perms, fail(invalidFallbackProfile, err)
+	}
+
+	return perms, nil
+}
+
+// Mount the AppImage
+func mountAppImage(ai *chains.AppImage) error {
+	strategy, err := chains.MountStrategyFromString(mountStrategy)
+	if err != nil {
+		return err
+	}
+	ai.SetMountStrategy(strategy)
+
+	if err := ai.Mount(); err != nil {
+		return err
+	}
+
+	if verbose && ai.IsExtracted() {
+		fmt.Println("Running from extracted AppImage")
+	}
+	return nil
+}
+
+// Configure AppImage before running
+func configureAppImage(ai *chains.AppImage, perms *chains.AppImagePerms) error {
+	if rootDir != "" {
+		ai.SetRootDir(rootDir)
+	}
+	if dataDir != "" {
+		ai.SetDataDir(dataDir)
+	}
+	if backend != "" {
+		b, err := chains.BackendFromString(backend)
+		if err != nil {
+			return err
+		}
+		ai.SetBackend(b)
+	}
+	if noDataDir {
+		perms.DataDir = false
+	}
+	if noLandlock {
+		ai.SetLandlock(false)
+	}
+	return nil
+}
+
+// Make sure the AppImage is allowed to run with `perms`, the permissions it's
+// about to be granted
+func checkTrust(fs *pflag.FlagSet, ai *chains.AppImage, perms *chains.AppImagePerms) error {
+	if fs.Changed("trust") {
+		var err error
+		if trust {
+			err = ai.SetTrustedWith(perms)
+		} else {
+			err = ai.SetTrusted(false)
+		}
+		if err != nil && !errors.Is(err, chains.NotTrustedEntry) {
+			return err
+		}
+	}
+	if trustOnce {
+		return nil
+	}
+
+	state, err := ai.TrustState()
+	if err != nil {
+		return err
+	}
+	if state == chains.TrustNone {
+		return errors.New("bundle isn't marked trusted")
+	}
+
+	diff, err := ai.PermissionChanges(perms)
+	if err != nil {
+		return err
+	}
+
+	// A replaced bundle needs approving again either way, the diff shows what
+	// the new version asks for
+	if state == chains.TrustChanged {
+		fmt.Fprintln(os.Stderr, "bundle changed since it was trusted")
+		if diff != nil && !diff.Empty() {
+			fmt.Fprintf(os.Stderr, "its permissions changed:\n%s\n", diff)
+		}
+		if !acceptPerms && !confirm("trust the new version?") {
+			return errors.New("bundle changed since it was trusted, approve it again with `chains trust add` or --accept-permission-changes")
+		}
+		return ai.SetTrustedWith(perms)
+	}
+
+	if diff == nil || !diff.Escalates() {
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "bundle asks for more permissions than when it was trusted:\n%s\n", diff)
+	if !acceptPerms && !confirm("grant them?") {
+		return errors.New("permissions changed since the bundle was trusted, accept them with --accept-permission-changes")
+	}
+	return ai.SetTrustedWith(perms)
+}
+
+// Make sure the AppImage may use the data of its app ID, which any bundle can
+// claim by naming its desktop entry after another app's
+func checkID(ai *chains.AppImage) error {
+	err := ai.CheckID()
+	if !errors.Is(err, chains.IDClaimed) {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%s uses the app ID `%s`, whose data dir belongs to another AppImage\n", ai.Path, ai.ID)
+	if !shareID && !confirm("let it use that data?") {
+		return errors.Join(err, errors.New("let it with --share-app-id"))
+	}
+
+	return ai.ShareID()
+}
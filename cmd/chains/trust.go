@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/xplshn/chains/pkg/chains"
+
+	"github.com/spf13/pflag"
+)
+
+// `chains trust list|add|revoke|keys|add-key|revoke-key`
+func trustCommand(fs *pflag.FlagSet) error {
+	switch fs.Arg(0) {
+	case "list", "keys":
+		if fs.NArg() != 1 {
+			return errUsage
+		}
+	default:
+		if fs.NArg() != 2 {
+			return errUsage
+		}
+	}
+
+	switch fs.Arg(0) {
+	case "list":
+		return listTrusted()
+	case "add":
+		ai, err := chains.NewAppImage(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+
+		if err := ai.SetTrusted(true); err != nil {
+			return err
+		}
+
+		fmt.Printf("trusted %s %s (%s)\n", ai.Name, ai.Version, ai.SHA256())
+		return nil
+	case "revoke":
+		// The AppImage may well have been deleted already
+		target := fs.Arg(1)
+		if chains.FileExists(target) {
+			target, _ = filepath.Abs(target)
+		}
+
+		removed := 0
+		err := chains.UpdateTrustDB(func(db *chains.TrustDB) error {
+			removed = db.Revoke(target)
+			if hash, err := chains.CalculateSHA256(target); err == nil {
+				removed += db.Revoke(hash)
+			}
+			if removed == 0 {
+				return chains.NotTrustedEntry
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("revoked trust in %s\n", fs.Arg(1))
+		return nil
+	case "keys":
+		keyring, err := chains.LoadKeyring()
+		if err != nil {
+			return err
+		}
+		for _, k := range keyring {
+			fmt.Printf("%X", k.PrimaryKey.Fingerprint)
+			for name := range k.Identities {
+				fmt.Printf("  %s", name)
+			}
+			fmt.Println()
+		}
+		return nil
+	case "add-key":
+		// Approving the key an AppImage was signed with saves exporting it
+		var key []byte
+		ai, err := chains.NewAppImage(fs.Arg(1))
+		if err == nil {
+			key, err = ai.SigningKey()
+		} else {
+			key, err = os.ReadFile(fs.Arg(1))
+		}
+		if err != nil {
+			return err
+		}
+
+		fingerprints, err := chains.ApproveKey(key)
+		if err != nil {
+			return err
+		}
+		for _, f := range fingerprints {
+			fmt.Printf("approved key %s\n", f)
+		}
+		return nil
+	case "revoke-key":
+		return chains.RevokeKey(fs.Arg(1))
+	}
+
+	return errUsage
+}
+
+// Lists the trusted AppImages and whether they've changed since
+func listTrusted() error {
+	db, err := chains.LoadTrustDB()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STATE\tNAME\tVERSION\tTRUSTED\tPATH")
+
+	for _, e := range db.Entries {
+		state := string(chains.TrustValid)
+		if hash, err := chains.CalculateSHA256(e.Path); err != nil {
+			state = "missing"
+		} else if hash != e.SHA256 {
+			state = string(chains.TrustChanged)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", state, e.Name, e.Version, e.Time.Local().Format("2006-01-02 15:04"), e.Path)
+	}
+
+	return w.Flush()
+}
@@ -3,38 +3,27 @@ module github.com/xplshn/chains
 go 1.23.1
 
 require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/CalebQ42/squashfs v1.0.3
+	github.com/ProtonMail/go-crypto v1.3.0
 	github.com/adrg/xdg v0.5.3
-	github.com/probonopd/go-appimage v0.0.0-20241103094929-6bb97135d6d7
+	github.com/hanwen/go-fuse/v2 v2.9.0
+	github.com/opencontainers/runtime-spec v1.2.0
 	github.com/spf13/pflag v1.0.5
+	golang.org/x/crypto v0.33.0
+	golang.org/x/sys v0.30.0
 	gopkg.in/ini.v1 v1.67.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/CalebQ42/squashfs v1.0.3 // indirect
-	github.com/Microsoft/go-winio v0.6.2 // indirect
-	github.com/alokmenghrajani/gpgeez v0.0.0-20161206084504-1a06f1c582f9 // indirect
-	github.com/eclipse/paho.mqtt.golang v1.5.0 // indirect
-	github.com/emirpasic/gods v1.18.1 // indirect
-	github.com/google/go-github v17.0.0+incompatible // indirect
-	github.com/google/go-querystring v1.1.0 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
-	github.com/hashicorp/go-version v1.7.0 // indirect
-	github.com/jbenet/go-context v0.0.0-20150711004518-d14ea06fba99 // indirect
-	github.com/kevinburke/ssh_config v1.2.0 // indirect
+	github.com/cloudflare/circl v1.6.1 // indirect
 	github.com/klauspost/compress v1.17.11 // indirect
-	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/pierrec/lz4/v4 v4.1.21 // indirect
 	github.com/rasky/go-lzo v0.0.0-20200203143853-96a758eda86e // indirect
-	github.com/sergi/go-diff v1.3.1 // indirect
-	github.com/src-d/gcfg v1.4.0 // indirect
 	github.com/therootcompany/xz v1.0.1 // indirect
 	github.com/ulikunitz/xz v0.5.12 // indirect
-	github.com/xanzy/ssh-agent v0.3.3 // indirect
-	golang.org/x/crypto v0.29.0 // indirect
-	golang.org/x/net v0.31.0 // indirect
-	golang.org/x/sync v0.9.0 // indirect
-	golang.org/x/sys v0.27.0 // indirect
-	gopkg.in/src-d/go-billy.v4 v4.3.2 // indirect
-	gopkg.in/src-d/go-git.v4 v4.13.1 // indirect
-	gopkg.in/warnings.v0 v0.1.2 // indirect
 )
+
+// Patched to stop printing debug output to stdout, see third_party/squashfs
+replace github.com/CalebQ42/squashfs => ./third_party/squashfs
@@ -7,39 +7,46 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"reflect"
-	"strconv"
 	"strings"
 
 	"github.com/adrg/xdg"
-	"github.com/probonopd/go-appimage/src/goappimage"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"gopkg.in/ini.v1"
 )
 
 type AppImage struct {
-	Desktop    *ini.File // INI of internal desktop entry
-	Path       string    // Location of AppImage
-	Icon       string    // Location of AppImage
-	dataDir    string    // The AppImage's `HOME` directory
-	rootDir    string    // Can be used to give the AppImage fake system files
-	tempDir    string    // The AppImage's `/tmp` directory
-	mountDir   string    // The location the AppImage is mounted at
-	md5        string    // MD5 of AppImage's URI
-	Name       string    // AppImage name from the desktop entry
-	Version    string
-	UpdateInfo string
-	Offset     int                  // Offset of SquashFS image
-	AI         *goappimage.AppImage // Using the go-appimage package
-	file       *os.File
+	Desktop       *ini.File // INI of internal desktop entry
+	Path          string    // Location of AppImage
+	Icon          string    // Location of AppImage
+	dataDir       string    // The AppImage's `HOME` directory
+	rootDir       string    // Can be used to give the AppImage fake system files
+	tempDir       string    // The AppImage's `/tmp` directory
+	mountDir      string    // The location the AppImage is mounted at
+	md5           string    // MD5 of AppImage's URI, see *AppImage.MD5
+	sha256        string    // SHA-256 of AppImage's contents, see identity.go
+	ID            string    // App ID from the desktop entry's name
+	Name          string    // AppImage name from the desktop entry
+	Version       string
+	UpdateInfo    string
+	Offset        int           // Offset of the filesystem image
+	imageType     int           // See GetAppImageType
+	FSType        FSType        // Filesystem the AppImage's files are stored in
+	file          *os.File      // Open handle of the mounted AppImage
+	fuseServer    *fuse.Server  // Serves the mounted filesystem
+	extracted     bool          // mountDir is an extraction rather than a mount
+	shared        bool          // Registered as using the shared mount, see mounts.go
+	mountStrategy MountStrategy // See *AppImage.SetMountStrategy
+	noLandlock    bool          // Skip the Landlock ruleset, see *AppImage.SetLandlock
+	backend       Backend       // Program used to create the sandbox
 	// --- MISC -- //
 	WrapArgs     []string // TODO: Get rid of this
 	mainWrapArgs []string
 }
 
-// Create a new AppImage object from a path using goappimage
+// Create a new AppImage object from a path
 func NewAppImage(src string) (*AppImage, error) {
 	ai := &AppImage{Path: src}
 
@@ -49,27 +56,43 @@ func NewAppImage(src string) (*AppImage, error) {
 
 	ai.md5 = CalculateMD5(ai.Path)
 
-	appImage, err := goappimage.NewAppImage(ai.Path)
+	var err error
+
+	ai.sha256, err = CalculateSHA256(ai.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	ai.imageType, err = GetAppImageType(ai.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	ai.Offset, ai.FSType, err = GetImage(ai.Path)
 	if err != nil {
 		return nil, err
 	}
-	ai.AI = appImage
 
 	// Set directories and load desktop entry
 	ai.rootDir = "/"
-	ai.dataDir = ai.Path + ".home"
-	ai.tempDir = filepath.Join(os.TempDir(), "appimage-"+ai.md5)
+	ai.tempDir = filepath.Join(os.TempDir(), "appimage-"+ai.sha256)
 
-	// Load desktop entry from the appimage
-	desktopReader := appImage.Desktop
-
-	ai.Desktop, err = ini.LoadSources(ini.LoadOptions{
-		IgnoreInlineComment: true,
-	}, desktopReader)
+	ai.Desktop, err = ai.loadDesktop()
 	if err != nil {
 		return nil, err
 	}
 
+	ai.UpdateInfo, _ = ReadUpdateInfo(ai.Path)
+
+	if ai.ID == "" {
+		ai.ID, err = ai.fallbackID()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ai.dataDir = ai.defaultDataDir()
+
 	ai.Name = ai.Desktop.Section("Desktop Entry").Key("Name").String()
 	ai.Version = ai.Desktop.Section("Desktop Entry").Key("X-AppImage-Version").String()
 
@@ -77,36 +100,116 @@ func NewAppImage(src string) (*AppImage, error) {
 		ai.Version = "1.0"
 	}
 
-	ai.UpdateInfo = appImage.UpdateInfo
-
 	return ai, nil
 }
 
+// Loads the AppImage's desktop entry, taking the app ID from its name
+func (ai *AppImage) loadDesktop() (*ini.File, error) {
+	img, err := ai.openImage()
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+
+	entries, err := fs.ReadDir(img, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ".desktop" {
+			continue
+		}
+
+		b, err := img.ReadFile(e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		ai.ID = appID(e.Name())
+
+		return ini.LoadSources(ini.LoadOptions{IgnoreInlineComment: true}, b)
+	}
+
+	return nil, NoDesktopFile
+}
+
+// imageFS is the filesystem inside of an AppImage
+type imageFS interface {
+	fs.ReadFileFS
+	Close() error
+}
+
+// Opens the filesystem inside of the AppImage. DwarFS images can only be read
+// once extracted, which is done into the cache so it's only done once
+func (ai *AppImage) openImage() (imageFS, error) {
+	switch ai.FSType {
+	case ISO9660:
+		img, err := openISO(ai.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		return img, nil
+	case DwarFS:
+		dir, err := ai.extractCached()
+		if err != nil {
+			return nil, err
+		}
+
+		return dirImage{root: dir}, nil
+	}
+
+	img, err := ai.openSquashfs()
+	if err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
 // Calculate MD5 hash for a file path
 func CalculateMD5(path string) string {
 	b := md5.Sum([]byte("file://" + path))
 	return fmt.Sprintf("%x", b)
 }
 
-// Unmount the AppImage using fusermount -u
+// Unmount the AppImage, failing if its files are still in use
 func (ai *AppImage) FuserUmount() error {
-	cmd := exec.Command("fusermount", "-u", ai.mountDir)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to unmount: %v", err)
+	if ai.extracted {
+		return nil
 	}
-	return nil
+
+	if ai.fuseServer != nil {
+		if err := ai.fuseServer.Unmount(); err != nil {
+			return &MountError{Path: ai.mountDir, Err: err}
+		}
+
+		ai.fuseServer = nil
+		return nil
+	}
+
+	return unmount(ai.mountDir, false)
 }
 
-// Unmount and destroy the AppImage using fusermount -uz
+// Unmount the AppImage lazily, even if its files are still in use
 func (ai *AppImage) FuserDestroy() error {
-	cmd := exec.Command("fusermount", "-uz", ai.mountDir)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to destroy: %v", err)
+	if ai.extracted {
+		return nil
 	}
-	return nil
+
+	// Through the server while nothing uses the files, so it finishes up
+	if ai.fuseServer != nil && ai.FuserUmount() == nil {
+		return nil
+	}
+
+	return unmountDir(ai.mountDir)
 }
 
-// Unmounts an AppImage
+// Unmounts an AppImage. The mount and temporary directory are shared by every
+// instance of the same AppImage, so are only cleaned up by the last one to
+// exit. It never waits for the others, as the mount is served by a process of
+// its own
 func (ai *AppImage) Destroy() error {
 	if ai == nil {
 		return NilAppImage
@@ -116,65 +219,121 @@ func (ai *AppImage) Destroy() error {
 		return NotMounted
 	}
 
-	err := unmountDir(ai.mountDir)
+	if !ai.shared {
+		return ai.destroy()
+	}
+
+	reg, err := lockMountRegistry(ai.sha256)
 	if err != nil {
 		return err
 	}
 
-	ai.mountDir = ""
+	ai.shared = false
 
-	ai.file.Close()
+	if reg.leave() > 0 {
+		ai.mountDir = ""
+		return reg.Close()
+	}
 
-	// Clean up
-	err = os.RemoveAll(ai.TempDir())
+	// Keep the registry locked while cleaning up so that a new instance
+	// doesn't start using the mount as it goes away
+	err = ai.destroy()
+
+	return errors.Join(err, reg.Close())
+}
 
-	ai = nil
+func (ai *AppImage) destroy() error {
+	// Try a clean unmount first so the server's goroutines finish up. The
+	// extraction is left in the cache for the next launch
+	if ai.extracted {
+		ai.extracted = false
+	} else if ai.fuseServer == nil || ai.FuserUmount() != nil {
+		if err := unmountDir(ai.mountDir); err != nil {
+			return err
+		}
+	}
+
+	ai.mountDir = ""
 
-	return err
+	if ai.file != nil {
+		ai.file.Close()
+		ai.file = nil
+	}
+
+	// Clean up
+	return os.RemoveAll(ai.TempDir())
 }
 
-// Unmounts a directory (lazily in case the process is finishing up)
-func unmountDir(mntPt string) error {
-	var umount *exec.Cmd
+// Thumbnail returns a reader for the `.DirIcon` file of the AppImage
+func (ai *AppImage) Thumbnail() (io.Reader, error) {
+	if ai.imageType == -2 {
+		r, err := ExtractResourceReader(ai.Path, "icon/256.png")
+		if err == nil {
+			return r, nil
+		}
+	}
 
-	if _, err := exec.LookPath("fusermount"); err == nil {
-		umount = exec.Command("fusermount", "-uz", mntPt)
-	} else {
-		umount = exec.Command("umount", "-l", mntPt)
+	img, err := ai.openImage()
+	if err != nil {
+		return nil, err
 	}
+	defer img.Close()
 
-	// Run unmount command, returning the stdout+stderr if fail
-	out, err := umount.CombinedOutput()
+	b, err := img.ReadFile(".DirIcon")
 	if err != nil {
-		err = errors.New(string(out))
+		return nil, err
 	}
 
-	return err
+	return bytes.NewReader(b), nil
 }
 
-// Thumbnail returns a reader for the `.DirIcon` file of the AppImage
-func (ai *AppImage) Thumbnail() (io.Reader, error) {
-	// Use reflection to access the unexported field
-	v := reflect.ValueOf(ai).Elem()
-	imageTypeField := v.FieldByName("imageType")
+// ReadIcon returns the icon named by the AppImage's desktop entry, which
+// AppImages keep at the root of their filesystem, along with its extension
+func (ai *AppImage) ReadIcon() ([]byte, string, error) {
+	name := ai.Desktop.Section("Desktop Entry").Key("Icon").String()
+	if name == "" {
+		return nil, "", NoIcon
+	}
 
-	if !imageTypeField.IsValid() {
-		return nil, errors.New("imageType field not found")
+	img, err := ai.openImage()
+	if err != nil {
+		return nil, "", err
 	}
+	defer img.Close()
 
-	// Check the value of the unexported field
-	if imageTypeField.Int() == -2 {
-		r, err := ExtractResourceReader(ai.Path, "icon/256.png")
-		if err == nil {
-			return r, nil
+	for _, ext := range []string{".svg", ".png"} {
+		if b, err := img.ReadFile(name + ext); err == nil {
+			return b, ext, nil
 		}
 	}
 
-	return ai.AI.ExtractFileReader(".DirIcon") // ExtractFileReader tries to get an io.ReadCloser for the file at filepath. Returns an error if the path is pointing to a folder. If the path is pointing to a symlink, it will try to return the file being pointed to, but only if it's within the AppImage.
+	return nil, "", InvalidIconExtension
+}
+
+// Path of the icon inside the AppImage, see ReadIcon
+func (ai *AppImage) IconPath() (string, error) {
+	_, ext, err := ai.ReadIcon()
+	if err != nil {
+		return "", err
+	}
+
+	return ai.Desktop.Section("Desktop Entry").Key("Icon").String() + ext, nil
 }
+
 func (ai *AppImage) IsMounted() bool {
 	return ai.mountDir != ""
 }
+
+// Where the AppImage's files can be found once it's mounted or extracted
+func (ai *AppImage) MountDir() string {
+	return ai.mountDir
+}
+
+// The AppImage's `HOME` directory, if it's given one, see *AppImage.SetDataDir
+func (ai *AppImage) DataDir() string {
+	return ai.dataDir
+}
+
 func (ai *AppImage) TempDir() string {
 	return ai.tempDir
 }
@@ -194,33 +353,31 @@ func (ai *AppImage) SetTempDir(d string) {
 	ai.tempDir = d
 }
 
-// mount mounts the requested AppImage `src` to `dest`
-// Quick, hacky implementation, ideally this should be redone using the
-// squashfuse library
-func mount(src string, dest string, offset int) error {
-	squashfuse, present := CommandExists("squashfuse")
-	if !present {
-		return errors.New("failed to find squashfuse binary! cannot mount AppImage")
+// mount mounts the AppImage to `dest`. SquashFS images are served by this
+// process, so must be unmounted before it exits
+func (ai *AppImage) mount(dest string) error {
+	switch ai.FSType {
+	case ISO9660:
+		return mountISO(ai.Path, dest)
+	case DwarFS:
+		return mountDwarfs(ai.Path, dest, ai.Offset)
 	}
 
-	// Store the error message in a string
-	errBuf := &bytes.Buffer{}
-
-	// Convert the offset to a string and mount using squashfuse
-	o := strconv.Itoa(offset)
-	mnt := exec.Command(squashfuse, "-o", "offset="+o, src, dest)
-	mnt.Stderr = errBuf
-
-	if mnt.Run() != nil {
-		return errors.New(errBuf.String())
+	server, f, err := mountSquashfs(ai.Path, dest, ai.Offset)
+	if err != nil {
+		return err
 	}
 
+	ai.fuseServer, ai.file = server, f
+
 	return nil
 }
 
 // Takes an optional argument to mount at a specific location (failing if it
 // doesn't exist or more than one arg given. If none given, automatically
-// create a temporary directory and mount to it
+// create a temporary directory and mount to it, or extract the AppImage into
+// the cache depending on its mount strategy (see *AppImage.SetMountStrategy).
+// Mounting at a specific location always uses FUSE
 func (ai *AppImage) Mount(dest ...string) error {
 	// If arg given
 	if len(dest) > 1 {
@@ -230,36 +387,98 @@ func (ai *AppImage) Mount(dest ...string) error {
 			return NoMountPoint
 		}
 
+		ai.mountDir = dest[0]
+
 		if !isMountPoint(ai.mountDir) {
-			return mount(ai.Path, ai.mountDir, ai.Offset)
+			return ai.mount(ai.mountDir)
 		}
 
 		return nil
 	}
 
-	var err error
+	// Hold the registry while mounting, so that two instances starting at
+	// once don't both mount
+	reg, err := lockMountRegistry(ai.sha256)
+	if err != nil {
+		return err
+	}
+	defer reg.Close()
 
-	ai.tempDir, err = MakeTemp(xdg.RuntimeDir+"/aisap/tmp", ai.md5)
+	ai.tempDir, err = MakeTemp(xdg.RuntimeDir+"/aisap/tmp", ai.sha256)
 	if err != nil {
 		return err
 	}
 
-	ai.mountDir, err = MakeTemp(xdg.RuntimeDir+"/aisap/mount", ai.md5)
+	if ai.mountStrategy == MountExtract {
+		err = ai.mountExtracted()
+	} else {
+		err = ai.mountFuse(len(reg.holders) == 0)
+
+		if err != nil && ai.mountStrategy != MountFuse {
+			if extractErr := ai.mountExtracted(); extractErr != nil {
+				err = errors.Join(err, extractErr)
+			} else {
+				err = nil
+			}
+		}
+	}
+
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(ai.mountDir)
-	fmt.Println(ai.tempDir)
+	ai.shared = true
+
+	return reg.add()
+}
+
+// Mounts the AppImage in the runtime directory. If `alone`, no other instance
+// is running, so anything already mounted there was left behind by one that
+// crashed
+func (ai *AppImage) mountFuse(alone bool) error {
+	mountDir := filepath.Join(xdg.RuntimeDir, "aisap", "mount", ai.sha256)
+
+	// Its server is gone, so this has to happen before anything touches the
+	// directory or that would hang
+	if alone && isMountPoint(mountDir) {
+		if err := unmountDir(mountDir); err != nil {
+			return err
+		}
+	}
+
+	mountDir, err := MakeTemp(xdg.RuntimeDir+"/aisap/mount", ai.sha256)
+	if err != nil {
+		return err
+	}
 
 	// Only mount if no previous instances (launched of the same version) are
 	// already mounted there. This is to reuse their libraries, save on RAM and
 	// to spam the mount list as little as possible
-	if !isMountPoint(ai.mountDir) {
-		err = mount(ai.Path, ai.mountDir, ai.Offset)
+	if !isMountPoint(mountDir) {
+		mount := ai.mount
+		if ai.FSType == SquashFS {
+			mount = ai.mountDetached
+		}
+
+		if err := mount(mountDir); err != nil {
+			return err
+		}
 	}
 
-	return err
+	ai.mountDir = mountDir
+
+	return nil
+}
+
+func (ai *AppImage) mountExtracted() error {
+	dir, err := ai.extractCached()
+	if err != nil {
+		return err
+	}
+
+	ai.mountDir, ai.extracted = dir, true
+
+	return nil
 }
 
 // Returns true if directory is detected as already being mounted
@@ -276,25 +495,3 @@ func isMountPoint(dir string) bool {
 
 	return false
 }
-
-// Returns `true` if the AppImage in question is both executable and has
-// its profile copied to the aisap config dir. This is to ensure the
-// permissions can't change under the user's feet through an update to the
-// AppImage
-func (ai *AppImage) Trusted() bool {
-	aisapConfig := filepath.Join(xdg.DataHome, "aisap", "profiles")
-	filePath := filepath.Join(aisapConfig, ai.Name)
-
-	// If the AppImage permissions exist in aisap's config directory and the
-	// AppImage is executable, we consider it trusted
-	if FileExists(filePath) {
-		info, err := os.Stat(ai.Path)
-		if err != nil {
-			return false
-		}
-
-		return info.Mode()&0100 != 0
-	}
-
-	return false
-}
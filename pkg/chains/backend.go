@@ -0,0 +1,55 @@
+package chains
+
+import (
+	"errors"
+)
+
+var (
+	InvalidBackend = errors.New("backend invalid")
+)
+
+// Backend is the program used to actually set up the sandbox
+type Backend string
+
+const (
+	// Use bubblewrap, this is the default when it is installed
+	Bwrap Backend = "bwrap"
+	// Use chains' own namespace code, so no external tools are needed
+	Native Backend = "native"
+)
+
+var (
+	BackendMap = map[string]Backend{
+		"bwrap":  Bwrap,
+		"native": Native,
+	}
+)
+
+func BackendFromString(backendString string) (Backend, error) {
+	backend, present := BackendMap[backendString]
+
+	if !present {
+		return backend, InvalidBackend
+	}
+
+	return backend, nil
+}
+
+// Set the backend used to sandbox the AppImage. If never called, bwrap is
+// used when installed and the native backend otherwise
+func (ai *AppImage) SetBackend(b Backend) {
+	ai.backend = b
+}
+
+// Returns the backend that will be used to run the AppImage
+func (ai *AppImage) Backend() Backend {
+	if ai.backend != "" {
+		return ai.backend
+	}
+
+	if _, present := CommandExists("bwrap"); present {
+		return Bwrap
+	}
+
+	return Native
+}
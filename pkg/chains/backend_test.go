@@ -0,0 +1,289 @@
+package chains
+
+import (
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// The native backend re-executes the test binary as its helper, as does the
+// Landlock helper
+func TestMain(m *testing.M) {
+	NativeInit()
+	LandlockHelper = true
+	os.Exit(m.Run())
+}
+
+// A spec running `script` with sh, with just enough of the host to do so
+func scriptSpec(script string) *SandboxSpec {
+	spec := &SandboxSpec{
+		Version:       SpecVersion,
+		DieWithParent: true,
+		Namespaces:    Namespaces{User: true, Pid: true},
+		Exec:          Exec{Path: "/bin/sh", Args: []string{"-c", script}},
+	}
+
+	for _, dir := range []string{"bin", "sbin", "lib", "lib32", "lib64", "usr"} {
+		src, err := filepath.EvalSymlinks("/" + dir)
+		if err != nil {
+			continue
+		}
+
+		spec.bind(ROBindMount, src, "/"+dir, true)
+	}
+
+	spec.Mounts = append(spec.Mounts,
+		Mount{Type: ProcMount, Dest: "/proc"},
+		Mount{Type: DevMount, Dest: "/dev"},
+		Mount{Type: TmpfsMount, Dest: "/tmp"},
+	)
+
+	return spec
+}
+
+// A compiled seccomp filter failing the syscalls `nrs` with EPERM, allowing
+// everything else
+func denySyscalls(nrs ...uint32) []byte {
+	prog := []unix.SockFilter{{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0}}
+	for i, nr := range nrs {
+		// Jump to the EPERM at the end
+		prog = append(prog, unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: uint8(len(nrs) - i), K: nr})
+	}
+	prog = append(prog,
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW},
+		unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)},
+	)
+
+	var b []byte
+	for _, ins := range prog {
+		b = binary.NativeEndian.AppendUint16(b, ins.Code)
+		b = append(b, ins.Jt, ins.Jf)
+		b = binary.NativeEndian.AppendUint32(b, ins.K)
+	}
+
+	return b
+}
+
+// Every backend runs these, each checks from inside of the sandbox that it
+// was set up as the spec says, failing if it wasn't
+var backendCases = []struct {
+	name     string
+	spec     func(dir string) *SandboxSpec
+	fails    bool                           // The sandbox is expected not to start or the check to fail
+	landlock bool                           // Only checked on kernels with Landlock
+	verify   func(t *testing.T, dir string) // Checks the host afterwards
+}{
+	{
+		name: "read-only bind",
+		spec: func(dir string) *SandboxSpec {
+			s := scriptSpec(`test "$(cat /data/file)" = hello && ! touch /data/new 2>/dev/null`)
+			s.bind(ROBindMount, dir, "/data", false)
+			return s
+		},
+	},
+	{
+		name: "bind",
+		spec: func(dir string) *SandboxSpec {
+			s := scriptSpec(`echo written > /data/new`)
+			s.bind(BindMount, dir, "/data", false)
+			return s
+		},
+		verify: func(t *testing.T, dir string) {
+			if b, err := os.ReadFile(filepath.Join(dir, "new")); err != nil || string(b) != "written\n" {
+				t.Errorf("file written in the sandbox: %q, %v", b, err)
+			}
+		},
+	},
+	{
+		name: "host is hidden",
+		spec: func(dir string) *SandboxSpec {
+			return scriptSpec(`! test -e ` + dir + ` && ! test -e /etc/passwd && ! test -e /root`)
+		},
+	},
+	{
+		name: "tmpfs is private",
+		spec: func(dir string) *SandboxSpec {
+			s := scriptSpec(`touch /tmp/chains-backend-test && test -z "$(ls /data)"`)
+			s.Mounts = append(s.Mounts, Mount{Type: TmpfsMount, Dest: "/data"})
+			return s
+		},
+		verify: func(t *testing.T, dir string) {
+			if FileExists("/tmp/chains-backend-test") {
+				os.Remove("/tmp/chains-backend-test")
+				t.Error("file written to the sandbox's tmpfs is on the host")
+			}
+		},
+	},
+	{
+		name: "dir with mode",
+		spec: func(dir string) *SandboxSpec {
+			s := scriptSpec(`test "$(stat -c %a /run/test)" = 700`)
+			s.Mounts = append(s.Mounts, Mount{Type: DirMount, Dest: "/run/test", Mode: 0700})
+			return s
+		},
+	},
+	{
+		name: "missing optional bind",
+		spec: func(dir string) *SandboxSpec {
+			s := scriptSpec(`! test -e /missing`)
+			s.bind(ROBindMount, filepath.Join(dir, "missing"), "/missing", true)
+			return s
+		},
+	},
+	{
+		name: "missing required bind",
+		spec: func(dir string) *SandboxSpec {
+			s := scriptSpec(`true`)
+			s.bind(ROBindMount, filepath.Join(dir, "missing"), "/missing", false)
+			return s
+		},
+		fails: true,
+	},
+	{
+		name: "env",
+		spec: func(dir string) *SandboxSpec {
+			s := scriptSpec(`test "$CHAINS_TEST" = "a b"`)
+			s.setenv("CHAINS_TEST", "a b")
+			return s
+		},
+	},
+	{
+		name: "args",
+		spec: func(dir string) *SandboxSpec {
+			s := scriptSpec(`test "$0 $1" = "first second"`)
+			s.Exec.Args = append(s.Exec.Args, "first", "second")
+			return s
+		},
+	},
+	{
+		name: "pid namespace",
+		spec: func(dir string) *SandboxSpec {
+			// Whatever backend set the sandbox up is its init
+			return scriptSpec(`grep -q -e chains-native-init -e bwrap /proc/1/cmdline`)
+		},
+	},
+	{
+		name: "net namespace",
+		spec: func(dir string) *SandboxSpec {
+			s := scriptSpec(`test "$(grep -c : /proc/net/dev)" = 1`)
+			s.Namespaces.Net = true
+			return s
+		},
+	},
+	{
+		name: "landlock",
+		spec: func(dir string) *SandboxSpec {
+			s := scriptSpec(`touch /data/new && ! touch /run/test/new 2>/dev/null && ! ls / >/dev/null 2>&1`)
+			s.bind(BindMount, dir, "/data", false)
+			s.Mounts = append(s.Mounts, Mount{Type: DirMount, Dest: "/run/test", Mode: 0555})
+			s.Landlock = s.landlockRules()
+			return s
+		},
+		landlock: true,
+	},
+	{
+		name: "landlock shared memory and created dirs",
+		spec: func(dir string) *SandboxSpec {
+			s := scriptSpec(`touch /dev/shm/x && rm /dev/shm/x && touch /run/test/x && ! touch /run/readonly/x 2>/dev/null`)
+			s.Mounts = append(s.Mounts,
+				Mount{Type: DirMount, Dest: "/run/test", Mode: 0700},
+				Mount{Type: DirMount, Dest: "/run/readonly", Mode: 0555},
+			)
+			s.Landlock = s.landlockRules()
+			return s
+		},
+		landlock: true,
+	},
+	{
+		name: "seccomp",
+		spec: func(dir string) *SandboxSpec {
+			filter := filepath.Join(dir, "filter.bpf")
+			if err := os.WriteFile(filter, denySyscalls(unix.SYS_UNAME), 0644); err != nil {
+				panic(err)
+			}
+
+			s := scriptSpec(`! uname 2>/dev/null && ! test -e ` + filter)
+			s.Seccomp = &Seccomp{Filter: filter}
+			return s
+		},
+	},
+	{
+		name: "caps dropped",
+		spec: func(dir string) *SandboxSpec {
+			s := scriptSpec(`grep -q '^CapEff:	0000000000000000$' /proc/self/status && grep -q '^CapAmb:	0000000000000000$' /proc/self/status`)
+			s.DropCaps = true
+			return s
+		},
+	},
+	{
+		name: "caps kept",
+		spec: func(dir string) *SandboxSpec {
+			// CAP_NET_RAW is bit 13
+			s := scriptSpec(`grep -q '^CapBnd:	0000000000002000$' /proc/self/status`)
+			s.DropCaps = true
+			s.KeepCaps = []string{"CAP_NET_RAW"}
+			return s
+		},
+	},
+}
+
+// Backends and how to tell whether they can run here
+var testBackends = []struct {
+	backend Backend
+	run     func(*SandboxSpec) error
+	usable  func() bool
+}{
+	{
+		Bwrap,
+		runBwrap,
+		func() bool {
+			_, present := CommandExists("bwrap")
+			return present && exec.Command("bwrap", "--unshare-user", "--ro-bind", "/", "/", "true").Run() == nil
+		},
+	},
+	{
+		Native,
+		runNative,
+		func() bool {
+			return exec.Command("unshare", "--user", "--map-root-user", "true").Run() == nil
+		},
+	},
+}
+
+func TestBackends(t *testing.T) {
+	for _, b := range testBackends {
+		t.Run(string(b.backend), func(t *testing.T) {
+			if !b.usable() {
+				t.Skip(string(b.backend) + " can't create sandboxes here")
+			}
+
+			for _, c := range backendCases {
+				t.Run(c.name, func(t *testing.T) {
+					if c.landlock && landlockABI() < 1 {
+						t.Skip("Landlock isn't supported by the kernel")
+					}
+
+					dir := t.TempDir()
+					if err := os.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644); err != nil {
+						t.Fatal(err)
+					}
+
+					err := b.run(c.spec(dir))
+					if c.fails && err == nil {
+						t.Fatal("sandbox ran, expected it to fail")
+					} else if !c.fails && err != nil {
+						t.Fatal(err)
+					}
+
+					if c.verify != nil {
+						c.verify(t, dir)
+					}
+				})
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package chains
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	InvalidCapability = errors.New("capability invalid")
+	InvalidIdentity   = errors.New("identity invalid")
+)
+
+var (
+	CapabilityMap = map[string]int{
+		"CAP_CHOWN":              unix.CAP_CHOWN,
+		"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+		"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+		"CAP_FOWNER":             unix.CAP_FOWNER,
+		"CAP_FSETID":             unix.CAP_FSETID,
+		"CAP_KILL":               unix.CAP_KILL,
+		"CAP_SETGID":             unix.CAP_SETGID,
+		"CAP_SETUID":             unix.CAP_SETUID,
+		"CAP_SETPCAP":            unix.CAP_SETPCAP,
+		"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+		"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+		"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+		"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+		"CAP_NET_RAW":            unix.CAP_NET_RAW,
+		"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+		"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+		"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+		"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+		"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+		"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+		"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+		"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+		"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+		"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+		"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+		"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+		"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+		"CAP_MKNOD":              unix.CAP_MKNOD,
+		"CAP_LEASE":              unix.CAP_LEASE,
+		"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+		"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+		"CAP_SETFCAP":            unix.CAP_SETFCAP,
+		"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+		"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+		"CAP_SYSLOG":             unix.CAP_SYSLOG,
+		"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+		"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+		"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+		"CAP_PERFMON":            unix.CAP_PERFMON,
+		"CAP_BPF":                unix.CAP_BPF,
+		"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+	}
+)
+
+// CapabilityFromString returns the canonical name of a capability, which may
+// be given in any case and with or without the `CAP_` prefix (eg: `net_raw`)
+func CapabilityFromString(capString string) (string, error) {
+	name := strings.ToUpper(capString)
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+
+	if _, present := CapabilityMap[name]; !present {
+		return name, InvalidCapability
+	}
+
+	return name, nil
+}
+
+// Identity is the user and group the app runs as inside of the sandbox
+type Identity struct {
+	Uid int `json:"uid"`
+	Gid int `json:"gid"`
+}
+
+// ParseIdentity reads an identity from a profile's `Identity` key, which can
+// be one of:
+//
+//	real:     the user running chains (default)
+//	fake:     uid and gid 1000, a typical desktop user
+//	nobody:   uid and gid 65534
+//	uid:gid:  any numeric ids, eg: `1000:100`
+//
+// A nil *Identity is returned for `real`
+func ParseIdentity(s string) (*Identity, error) {
+	switch s {
+	case "", "real":
+		return nil, nil
+	case "fake":
+		return &Identity{Uid: 1000, Gid: 1000}, nil
+	case "nobody":
+		return &Identity{Uid: 65534, Gid: 65534}, nil
+	}
+
+	u, g, found := strings.Cut(s, ":")
+	if !found {
+		return nil, InvalidIdentity
+	}
+
+	uid, err := strconv.Atoi(u)
+	if err != nil || uid < 0 {
+		return nil, InvalidIdentity
+	}
+
+	gid, err := strconv.Atoi(g)
+	if err != nil || gid < 0 {
+		return nil, InvalidIdentity
+	}
+
+	return &Identity{Uid: uid, Gid: gid}, nil
+}
+
+func (id Identity) String() string {
+	return "uid=" + strconv.Itoa(id.Uid) + " gid=" + strconv.Itoa(id.Gid)
+}
@@ -0,0 +1,378 @@
+package chains
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/adrg/xdg"
+)
+
+// chains' defaults are read from config.toml, first from SystemConfigPath
+// then from UserConfigPath, each setting overriding the one before. The
+// environment variables chains read before it had a config file override
+// both, and flags override everything. The trust policy is the exception:
+// when the system's config file sets it, what the user's file or the
+// environment say is ignored
+
+var (
+	UnknownSetting = errors.New("no such setting")
+	InvalidSetting = errors.New("setting invalid")
+	LockedSetting  = errors.New("setting is locked by the system's config file")
+)
+
+// Settings the system's config file has the final say on
+var policyKeys = []string{"allow_unsandboxed", "trust_signed"}
+
+// Directory the system's config file is in, see SystemConfigPath
+var systemConfigDir = "/etc/chains"
+
+// DataRoot is where AppImages' data dirs are kept, named after their app
+// ID. If empty, they're kept in `$XDG_DATA_HOME/chains/data`
+var DataRoot string
+
+// ProfileSearchPath lists directories searched for profiles after
+// ProfileDir, see FromSystem
+var ProfileSearchPath []string
+
+// PreferBuiltinProfiles makes the built-in profiles take precedence over the
+// user's, see *AppImage.GetPermissions. Setting `PREFER_CHAINS_PROFILE` in
+// the environment does the same
+var PreferBuiltinProfiles bool
+
+// Config holds chains' settings. The key of each is its `toml` tag
+type Config struct {
+	Level         string        `toml:"level"`          // Used when no level is given by flags, empty for the profile's
+	FallbackLevel int           `toml:"fallback_level"` // Used when the profile has no valid level
+	DataRoot      string        `toml:"data_root"`      // See DataRoot
+	Backend       Backend       `toml:"backend"`        // Empty for bwrap when installed, see *AppImage.Backend
+	Mount         MountStrategy `toml:"mount"`
+
+	// Trust policy, see Policy
+	AllowUnsandboxed bool `toml:"allow_unsandboxed"`
+	TrustSigned      bool `toml:"trust_signed"`
+
+	// Taken away from every AppImage, unless given back by flags
+	DenySockets []string `toml:"deny_sockets"`
+	DenyDevices []string `toml:"deny_devices"`
+
+	ProfileDirs           []string `toml:"profile_dirs"` // See ProfileSearchPath
+	PreferBuiltinProfiles bool     `toml:"prefer_builtin_profiles"`
+	KeepVersions          int      `toml:"keep_versions"` // See KeepVersions
+	GitHubAPI             string   `toml:"github_api"`    // See GitHubAPI
+
+	sources map[string]string // Where each setting was read from, by key
+}
+
+// Location of the config file shared by every user
+func SystemConfigPath() string {
+	return filepath.Join(systemConfigDir, "config.toml")
+}
+
+// Location of the user's config file, see LoadConfig
+func UserConfigPath() string {
+	return filepath.Join(xdg.ConfigHome, "chains", "config.toml")
+}
+
+// DefaultConfig returns the settings chains uses without a config file
+func DefaultConfig() *Config {
+	return &Config{
+		FallbackLevel:    3,
+		Mount:            MountAuto,
+		AllowUnsandboxed: true,
+		KeepVersions:     3,
+		GitHubAPI:        "https://api.github.com",
+		sources:          make(map[string]string),
+	}
+}
+
+// LoadConfig reads the config files, neither of which has to exist, and the
+// environment on top of them
+func LoadConfig() (*Config, error) {
+	c := DefaultConfig()
+
+	for _, path := range []string{SystemConfigPath(), UserConfigPath()} {
+		locked := c.lockedValues()
+
+		md, err := toml.DecodeFile(path, c)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to read `"+path+"`"), err)
+		}
+
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, errors.Join(UnknownSetting, errors.New("`"+undecoded[0].String()+"` in `"+path+"`"))
+		}
+
+		for _, key := range md.Keys() {
+			if v, present := locked[key.String()]; present {
+				f, _ := c.field(key.String())
+				f.Set(v)
+				continue
+			}
+
+			c.sources[key.String()] = path
+		}
+	}
+
+	if n, err := strconv.Atoi(os.Getenv("CHAINS_KEEP_VERSIONS")); err == nil && n >= 0 {
+		c.KeepVersions = n
+		c.sources["keep_versions"] = "$CHAINS_KEEP_VERSIONS"
+	}
+	if api := os.Getenv("GITHUB_API_URL"); api != "" {
+		c.GitHubAPI = api
+		c.sources["github_api"] = "$GITHUB_API_URL"
+	}
+	if os.Getenv("CHAINS_FORBID_UNSANDBOXED") != "" && !c.Locked("allow_unsandboxed") {
+		c.AllowUnsandboxed = false
+		c.sources["allow_unsandboxed"] = "$CHAINS_FORBID_UNSANDBOXED"
+	}
+	if os.Getenv("CHAINS_TRUST_SIGNED") != "" && !c.Locked("trust_signed") {
+		c.TrustSigned = true
+		c.sources["trust_signed"] = "$CHAINS_TRUST_SIGNED"
+	}
+	if _, present := os.LookupEnv("PREFER_CHAINS_PROFILE"); present {
+		c.PreferBuiltinProfiles = true
+		c.sources["prefer_builtin_profiles"] = "$PREFER_CHAINS_PROFILE"
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Apply puts the settings the library acts on in effect. The others, like
+// Level, are up to the program
+func (c *Config) Apply() {
+	DataRoot = c.DataRoot
+	ProfileSearchPath = c.ProfileDirs
+	PreferBuiltinProfiles = c.PreferBuiltinProfiles
+	KeepVersions = c.KeepVersions
+	GitHubAPI = strings.TrimSuffix(c.GitHubAPI, "/")
+	CurrentPolicy.AllowUnsandboxed = c.AllowUnsandboxed
+	CurrentPolicy.TrustSigned = c.TrustSigned
+}
+
+func (c *Config) validate() error {
+	invalid := func(key string, err error) error {
+		setting := "`" + key + "`"
+		if source, present := c.sources[key]; present {
+			setting += " from " + source
+		}
+
+		return errors.Join(InvalidSetting, errors.New(setting), err)
+	}
+
+	if c.Level != "" {
+		p := &AppImagePerms{}
+		var err error
+
+		if l, atoiErr := strconv.Atoi(c.Level); atoiErr == nil {
+			err = p.SetLevel(l)
+		} else {
+			err = p.SetLevelName(c.Level)
+		}
+		if err != nil {
+			return invalid("level", err)
+		}
+	}
+
+	// Every AppImage without a profile would run unsandboxed
+	if c.FallbackLevel == 0 {
+		return invalid("fallback_level", errors.New("can't be 0, which isn't sandboxed"))
+	} else if c.FallbackLevel < 0 || c.FallbackLevel > 3 {
+		return invalid("fallback_level", InvalidLevel)
+	}
+
+	if c.Backend != "" {
+		if _, err := BackendFromString(string(c.Backend)); err != nil {
+			return invalid("backend", err)
+		}
+	}
+
+	if _, err := MountStrategyFromString(string(c.Mount)); err != nil {
+		return invalid("mount", err)
+	}
+
+	for _, s := range c.DenySockets {
+		if _, err := SocketFromString(s); err != nil {
+			return invalid("deny_sockets", err)
+		}
+	}
+
+	if c.DataRoot != "" && !filepath.IsAbs(c.DataRoot) {
+		return invalid("data_root", errors.New("must be an absolute path"))
+	}
+
+	for _, dir := range c.ProfileDirs {
+		if !filepath.IsAbs(dir) {
+			return invalid("profile_dirs", errors.New("must be absolute paths"))
+		}
+	}
+
+	if c.KeepVersions < 0 {
+		return invalid("keep_versions", errors.New("can't be negative"))
+	}
+
+	return nil
+}
+
+// ConfigKeys lists the keys of every setting
+func ConfigKeys() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+
+	for i := 0; i < t.NumField(); i++ {
+		if key := t.Field(i).Tag.Get("toml"); key != "" {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// Finds the field of the setting `key`
+func (c *Config) field(key string) (reflect.Value, error) {
+	v := reflect.ValueOf(c).Elem()
+
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("toml") == key {
+			return v.Field(i), nil
+		}
+	}
+
+	return reflect.Value{}, errors.Join(UnknownSetting, errors.New("`"+key+"`"))
+}
+
+// Get returns the setting `key` as text, lists are comma separated
+func (c *Config) Get(key string) (string, error) {
+	f, err := c.field(key)
+	if err != nil {
+		return "", err
+	}
+
+	switch f.Kind() {
+	case reflect.Bool:
+		return strconv.FormatBool(f.Bool()), nil
+	case reflect.Int:
+		return strconv.Itoa(int(f.Int())), nil
+	case reflect.Slice:
+		return strings.Join(f.Interface().([]string), ","), nil
+	}
+
+	return f.String(), nil
+}
+
+// Source says where the setting `key` came from: the path of a config file,
+// an environment variable or `default`
+func (c *Config) Source(key string) string {
+	if source, present := c.sources[key]; present {
+		return source
+	}
+
+	return "default"
+}
+
+// Copies of the values of the locked settings, by key
+func (c *Config) lockedValues() map[string]reflect.Value {
+	values := make(map[string]reflect.Value)
+
+	for _, key := range policyKeys {
+		if c.Locked(key) {
+			f, _ := c.field(key)
+			values[key] = reflect.ValueOf(f.Interface())
+		}
+	}
+
+	return values
+}
+
+// Locked says whether the setting `key` is part of the trust policy and set by
+// the system's config file, so nothing else can change it
+func (c *Config) Locked(key string) bool {
+	return slices.Contains(policyKeys, key) && c.sources[key] == SystemConfigPath()
+}
+
+// SetConfig changes the setting `key` in the config file at `path`, keeping its
+// other settings. `value` is given as Get returns it. Settings locked by the
+// system's config file can only be changed there
+func SetConfig(path string, key string, value string) error {
+	c := DefaultConfig()
+
+	f, err := c.field(key)
+	if err != nil {
+		return err
+	}
+
+	if path != SystemConfigPath() && slices.Contains(policyKeys, key) {
+		system := make(map[string]any)
+		if _, err := toml.DecodeFile(SystemConfigPath(), &system); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return errors.Join(errors.New("failed to read `"+SystemConfigPath()+"`"), err)
+		}
+
+		if _, present := system[key]; present {
+			return errors.Join(LockedSetting, errors.New("`"+key+"`"))
+		}
+	}
+
+	var v any
+
+	switch f.Kind() {
+	case reflect.Bool:
+		v, err = strconv.ParseBool(value)
+	case reflect.Int:
+		v, err = strconv.Atoi(value)
+	case reflect.Slice:
+		list := []string{}
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+		v = list
+	default:
+		v = value
+	}
+	if err != nil {
+		return errors.Join(InvalidSetting, errors.New("`"+key+"`"), err)
+	}
+
+	// Check the value on its own before writing it
+	f.Set(reflect.ValueOf(v).Convert(f.Type()))
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	settings := make(map[string]any)
+	if _, err := toml.DecodeFile(path, &settings); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return errors.Join(errors.New("failed to read `"+path+"`"), err)
+	}
+	settings[key] = v
+
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(settings); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0744); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,150 @@
+package chains
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adrg/xdg"
+)
+
+// Points the config files at temporary dirs and clears the environment
+// variables that override them
+func isolateConfig(t *testing.T) {
+	systemDir, configHome := systemConfigDir, xdg.ConfigHome
+	systemConfigDir = t.TempDir()
+	xdg.ConfigHome = t.TempDir()
+	t.Cleanup(func() { systemConfigDir, xdg.ConfigHome = systemDir, configHome })
+
+	for _, env := range []string{"CHAINS_KEEP_VERSIONS", "GITHUB_API_URL", "CHAINS_FORBID_UNSANDBOXED", "CHAINS_TRUST_SIGNED", "PREFER_CHAINS_PROFILE"} {
+		t.Setenv(env, "")
+		os.Unsetenv(env)
+	}
+}
+
+func writeConfig(t *testing.T, path string, config string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigLayers(t *testing.T) {
+	isolateConfig(t)
+
+	writeConfig(t, SystemConfigPath(), "level = \"2\"\nkeep_versions = 5\nallow_unsandboxed = false\n")
+	writeConfig(t, UserConfigPath(), "level = \"3\"\nallow_unsandboxed = true\ntrust_signed = false\n")
+	t.Setenv("CHAINS_KEEP_VERSIONS", "7")
+	t.Setenv("CHAINS_TRUST_SIGNED", "1")
+
+	c, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []struct {
+		key    string
+		value  string
+		source string
+		locked bool
+	}{
+		{"level", "3", UserConfigPath(), false},
+		{"keep_versions", "7", "$CHAINS_KEEP_VERSIONS", false},
+		{"allow_unsandboxed", "false", SystemConfigPath(), true},
+		{"trust_signed", "true", "$CHAINS_TRUST_SIGNED", false},
+		{"fallback_level", "3", "default", false},
+	} {
+		value, err := c.Get(want.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if value != want.value || c.Source(want.key) != want.source || c.Locked(want.key) != want.locked {
+			t.Errorf("%s is %s from %s, locked %t, want %s from %s, locked %t", want.key, value, c.Source(want.key), c.Locked(want.key), want.value, want.source, want.locked)
+		}
+	}
+
+	// The environment can't change the system's policy either
+	writeConfig(t, SystemConfigPath(), "trust_signed = false\n")
+
+	c, err = LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.TrustSigned || c.Source("trust_signed") != SystemConfigPath() {
+		t.Errorf("trust_signed is %t from %s", c.TrustSigned, c.Source("trust_signed"))
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	isolateConfig(t)
+
+	for _, config := range []string{
+		"fallback_level = 0\n",
+		"fallback_level = 4\n",
+		"level = \"nonexistent\"\n",
+		"keep_versions = -1\n",
+		"data_root = \"relative\"\n",
+		"unknown = true\n",
+		"level = 2\n", // Levels are strings, so they can be named
+	} {
+		writeConfig(t, UserConfigPath(), config)
+
+		if _, err := LoadConfig(); err == nil {
+			t.Errorf("loaded %q", config)
+		}
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	isolateConfig(t)
+
+	if err := SetConfig(UserConfigPath(), "keep_versions", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetConfig(UserConfigPath(), "deny_sockets", "network, pulseaudio"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		key   string
+		value string
+		err   error
+	}{
+		{"fallback_level", "0", InvalidSetting},
+		{"fallback_level", "four", InvalidSetting},
+		{"level", "9", InvalidSetting},
+		{"deny_sockets", "nonexistent", InvalidSetting},
+		{"nonexistent", "1", UnknownSetting},
+	} {
+		if err := SetConfig(UserConfigPath(), c.key, c.value); !errors.Is(err, c.err) {
+			t.Errorf("set %s to %q: %v", c.key, c.value, err)
+		}
+	}
+
+	// Settings are kept when others are set, invalid ones aren't written
+	c, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.KeepVersions != 5 || len(c.DenySockets) != 2 || c.DenySockets[1] != "pulseaudio" || c.FallbackLevel != 3 {
+		t.Errorf("config after setting: %+v", c)
+	}
+
+	// Policy the system's config file sets can only be changed there
+	if err := SetConfig(SystemConfigPath(), "allow_unsandboxed", "false"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetConfig(UserConfigPath(), "allow_unsandboxed", "true"); !errors.Is(err, LockedSetting) {
+		t.Errorf("user changed a locked setting: %v", err)
+	}
+	if err := SetConfig(UserConfigPath(), "trust_signed", "true"); err != nil {
+		t.Errorf("user couldn't change policy the system leaves alone: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package chains
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// There's no Go implementation of DwarFS, so images are mounted and extracted
+// with the tools from the DwarFS project itself
+
+var (
+	NoDwarfs        = errors.New("dwarfs is required to mount DwarFS AppImages")
+	NoDwarfsextract = errors.New("dwarfsextract is required to read DwarFS AppImages")
+)
+
+// Checks for the first section header of a DwarFS image at `offset`. Runtimes
+// able to mount DwarFS contain its magic in their own code, so the rest of
+// the header has to make sense too
+func isDwarfs(f *os.File, offset int64) bool {
+	hdr := make([]byte, 64)
+	if _, err := f.ReadAt(hdr, offset); err != nil {
+		return false
+	}
+
+	if string(hdr[0:6]) != "DWARFS" || hdr[6] != 2 {
+		return false
+	}
+
+	number := binary.LittleEndian.Uint32(hdr[48:])
+	sectionType := binary.LittleEndian.Uint16(hdr[52:])
+	compression := binary.LittleEndian.Uint16(hdr[54:])
+	length := binary.LittleEndian.Uint64(hdr[56:])
+
+	if number != 0 || sectionType > 16 || compression > 16 {
+		return false
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	next := offset + 64 + int64(length)
+	if next > info.Size() {
+		return false
+	}
+
+	// Unless it's the only one, the section must be followed by the next
+	if next+64 <= info.Size() {
+		if _, err := f.ReadAt(hdr, next); err != nil {
+			return false
+		}
+
+		return string(hdr[0:6]) == "DWARFS" && hdr[6] == 2 && binary.LittleEndian.Uint32(hdr[48:]) == 1
+	}
+
+	return true
+}
+
+// Returns where the DwarFS image at `offset` ends, by following its sections
+// until the end of the file or something that isn't one
+func dwarfsEnd(f *os.File, offset int64) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	hdr := make([]byte, 64)
+	end := offset
+
+	for end+int64(len(hdr)) <= info.Size() {
+		if _, err := f.ReadAt(hdr, end); err != nil {
+			return 0, err
+		}
+
+		if string(hdr[0:6]) != "DWARFS" || hdr[6] != 2 {
+			break
+		}
+
+		end += int64(len(hdr)) + int64(binary.LittleEndian.Uint64(hdr[56:]))
+	}
+
+	if end == offset {
+		return 0, InvalidImage
+	}
+
+	return end, nil
+}
+
+// Mounts the DwarFS image at `offset` of `src` using dwarfs
+func mountDwarfs(src string, dest string, offset int) error {
+	dwarfs, present := CommandExists("dwarfs")
+	if !present {
+		return &MountError{Path: src, Dest: dest, Err: NoDwarfs}
+	}
+
+	out, err := exec.Command(dwarfs, src, dest, "-o", "offset="+strconv.Itoa(offset)).CombinedOutput()
+	if err != nil {
+		return &MountError{Path: src, Dest: dest, Err: errors.Join(err, errors.New(strings.TrimSpace(string(out))))}
+	}
+
+	return nil
+}
+
+// Extracts the DwarFS image at `offset` of `src` into `dest` using
+// dwarfsextract
+func extractDwarfs(src string, offset int, dest string) error {
+	dwarfsextract, present := CommandExists("dwarfsextract")
+	if !present {
+		return NoDwarfsextract
+	}
+
+	out, err := exec.Command(dwarfsextract, "-i", src, "-o", dest, "-O", strconv.Itoa(offset)).CombinedOutput()
+	if err != nil {
+		return errors.Join(errors.New("failed to extract `"+src+"`"), err, errors.New(strings.TrimSpace(string(out))))
+	}
+
+	return nil
+}
+
+// dirImage reads an AppImage's files from the directory it was extracted to.
+// Symlinks are followed, as long as they stay inside of it
+type dirImage struct {
+	root string
+}
+
+func (d dirImage) resolve(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", fs.ErrInvalid
+	}
+
+	root, err := filepath.EvalSymlinks(d.root)
+	if err != nil {
+		return "", err
+	}
+
+	path, err := filepath.EvalSymlinks(filepath.Join(root, name))
+	if err != nil {
+		return "", err
+	}
+
+	if path != root && !strings.HasPrefix(path, root+"/") {
+		return "", fs.ErrNotExist
+	}
+
+	return path, nil
+}
+
+func (d dirImage) Open(name string) (fs.File, error) {
+	path, err := d.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return os.Open(path)
+}
+
+func (d dirImage) ReadFile(name string) ([]byte, error) {
+	path, err := d.resolve(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return os.ReadFile(path)
+}
+
+func (d dirImage) Close() error {
+	return nil
+}
@@ -0,0 +1,105 @@
+package chains
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A DwarFS section of `length` bytes, with a header that only sets what's
+// checked when looking for images
+func dwarfsSection(number uint32, length int) []byte {
+	hdr := make([]byte, 64)
+	copy(hdr, "DWARFS\x02")
+	binary.LittleEndian.PutUint32(hdr[48:], number)
+	binary.LittleEndian.PutUint16(hdr[52:], 1)
+	binary.LittleEndian.PutUint64(hdr[56:], uint64(length))
+
+	return append(hdr, make([]byte, length)...)
+}
+
+func TestDwarfsImage(t *testing.T) {
+	var img bytes.Buffer
+	img.WriteString("runtime code mentioning DWARFS\x02 in passing")
+	offset := int64(img.Len())
+	img.Write(dwarfsSection(0, 100))
+	img.Write(dwarfsSection(1, 30))
+	end := int64(img.Len())
+	img.WriteString("signature")
+
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+	if err := os.WriteFile(path, img.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if isDwarfs(f, 24) {
+		t.Error("magic in the runtime taken for an image")
+	}
+
+	if o, fsType, err := scanImage(f); err != nil || o != offset || fsType != DwarFS {
+		t.Errorf("found %q at %d, want %q at %d: %v", fsType, o, DwarFS, offset, err)
+	}
+
+	if e, err := dwarfsEnd(f, offset); err != nil || e != end {
+		t.Errorf("image ends at %d, want %d: %v", e, end, err)
+	}
+
+	// Cut short in the second section
+	if err := os.Truncate(path, end-10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkTruncated(f, offset, DwarFS); !errors.Is(err, TruncatedImage) {
+		t.Errorf("truncated image not reported: %v", err)
+	}
+}
+
+func TestDwarfsNeedsTools(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	if err := mountDwarfs("app.AppImage", t.TempDir(), 0); !errors.Is(err, NoDwarfs) {
+		t.Errorf("mounted without dwarfs: %v", err)
+	}
+
+	if err := extractDwarfs("app.AppImage", 0, t.TempDir()); !errors.Is(err, NoDwarfsextract) {
+		t.Errorf("extracted without dwarfsextract: %v", err)
+	}
+}
+
+func TestDirImage(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "app.png"), []byte("icon"), 0644)
+	os.Symlink("app.png", filepath.Join(root, ".DirIcon"))
+	os.Symlink("/etc/passwd", filepath.Join(root, "absolute"))
+	os.Symlink("../../../../../../etc/passwd", filepath.Join(root, "relative"))
+
+	img := dirImage{root: root}
+
+	if b, err := img.ReadFile(".DirIcon"); err != nil || string(b) != "icon" {
+		t.Errorf("read %q through a symlink: %v", b, err)
+	}
+
+	for _, name := range []string{"absolute", "relative", "../app.png", "/app.png"} {
+		if _, err := img.ReadFile(name); err == nil {
+			t.Errorf("read %s from outside of the image", name)
+		}
+
+		if _, err := img.Open(name); err == nil {
+			t.Errorf("opened %s from outside of the image", name)
+		}
+	}
+
+	if _, err := fs.Stat(img, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat of a missing file: %v", err)
+	}
+}
@@ -15,4 +15,28 @@ var (
 	InvalidIconExtension = errors.New("no valid icon extensions (svg, png) found inside bundle")
 
 	NoMountPoint = errors.New("mount point doesn't exist")
+	NoFuse       = errors.New("FUSE is unavailable (no /dev/fuse)")
+	InvalidImage = errors.New("not a valid SquashFS image")
+
+	UnsandboxedForbidden = errors.New("policy forbids running AppImages unsandboxed (level 0)")
 )
+
+// MountError is returned when mounting or unmounting an AppImage's filesystem
+// fails. `Dest` is empty when unmounting
+type MountError struct {
+	Path string
+	Dest string
+	Err  error
+}
+
+func (e *MountError) Error() string {
+	if e.Dest == "" {
+		return "failed to unmount `" + e.Path + "`: " + e.Err.Error()
+	}
+
+	return "failed to mount `" + e.Path + "` at `" + e.Dest + "`: " + e.Err.Error()
+}
+
+func (e *MountError) Unwrap() error {
+	return e.Err
+}
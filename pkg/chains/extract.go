@@ -0,0 +1,238 @@
+package chains
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+var (
+	InvalidMountStrategy = errors.New("mount strategy invalid")
+)
+
+// MountStrategy decides how the AppImage's files are made available
+type MountStrategy string
+
+const (
+	// Mount the AppImage over FUSE, falling back to extracting it when FUSE
+	// isn't available. This is the default
+	MountAuto MountStrategy = "auto"
+	// Always mount over FUSE
+	MountFuse MountStrategy = "fuse"
+	// Always extract into the cache, for hosts without FUSE (containers, CI)
+	MountExtract MountStrategy = "extract"
+)
+
+var (
+	MountStrategyMap = map[string]MountStrategy{
+		"auto":    MountAuto,
+		"fuse":    MountFuse,
+		"extract": MountExtract,
+	}
+)
+
+// Number of extracted AppImages kept in the cache, the least recently used
+// are removed when more are extracted
+var ExtractCacheSize = 5
+
+func MountStrategyFromString(strategyString string) (MountStrategy, error) {
+	strategy, present := MountStrategyMap[strategyString]
+
+	if !present {
+		return strategy, InvalidMountStrategy
+	}
+
+	return strategy, nil
+}
+
+// Set how *AppImage.Mount makes the AppImage's files available. Defaults to
+// MountAuto
+func (ai *AppImage) SetMountStrategy(s MountStrategy) {
+	ai.mountStrategy = s
+}
+
+// Returns true if the AppImage was extracted instead of mounted
+func (ai *AppImage) IsExtracted() bool {
+	return ai.extracted
+}
+
+// ExtractTo unpacks the AppImage's whole filesystem into `dest`, without
+// needing FUSE. DwarFS images need dwarfsextract
+func (ai *AppImage) ExtractTo(dest string) error {
+	if ai.FSType == DwarFS {
+		return extractDwarfs(ai.Path, ai.Offset, dest)
+	}
+
+	if ai.FSType == ISO9660 {
+		img, err := openISO(ai.Path)
+		if err != nil {
+			return err
+		}
+		defer img.Close()
+
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+
+		return img.extractTo(dest)
+	}
+
+	rdr, err := ai.openSquashfs()
+	if err != nil {
+		return err
+	}
+	defer rdr.Close()
+
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	if err := rdr.ExtractWithOptions(dest, extractOptions()); err != nil {
+		return errors.Join(errors.New("failed to extract `"+ai.Path+"`"), err)
+	}
+
+	// The squashfs library sets symlinks' permissions through os.Chmod,
+	// which follows them and leaves their targets world-writable. Put back
+	// the modes of regular files and dirs, without setuid and setgid bits as
+	// they'd belong to the user rather than whoever the image says
+	return fs.WalkDir(rdr, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// Symlinks aren't marked as such by the library, check what was
+		// actually extracted instead
+		target := filepath.Join(dest, path)
+		if st, err := os.Lstat(target); err != nil || !st.Mode().IsRegular() && !st.IsDir() {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		return os.Chmod(target, info.Mode().Perm())
+	})
+}
+
+// Directory extracted AppImages are cached in
+func extractCacheDir() string {
+	return filepath.Join(xdg.CacheHome, "chains", "extracted")
+}
+
+// Extracts the AppImage into the cache, named after the hash of its contents
+// so that it's reused by every launch until the AppImage changes. Returns the
+// directory it was extracted to
+func (ai *AppImage) extractCached() (string, error) {
+	cache := extractCacheDir()
+	dir := filepath.Join(cache, ai.sha256)
+
+	if DirExists(dir) {
+		// Mark as recently used
+		now := time.Now()
+		os.Chtimes(dir, now, now)
+
+		return dir, nil
+	}
+
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		return "", err
+	}
+
+	// Extract next to the final location so that an interrupted extraction is
+	// never mistaken for a complete one
+	tmp := dir + ".tmp-" + strconv.Itoa(os.Getpid())
+	defer forceRemoveAll(tmp)
+
+	if err := ai.ExtractTo(tmp); err != nil {
+		return "", err
+	}
+
+	// Another instance may have beaten us to it, in which case use theirs
+	if err := os.Rename(tmp, dir); err != nil && !DirExists(dir) {
+		return "", err
+	}
+
+	evictExtracted(cache, ExtractCacheSize, dir)
+
+	return dir, nil
+}
+
+// Removes the least recently used extractions until at most `keep` remain,
+// never removing `current` nor any that running instances are using
+func evictExtracted(cache string, keep int, current string) {
+	entries, err := os.ReadDir(cache)
+	if err != nil {
+		return
+	}
+
+	type extraction struct {
+		path string
+		used time.Time
+	}
+
+	var extractions []extraction
+
+	for _, e := range entries {
+		path := filepath.Join(cache, e.Name())
+		info, err := e.Info()
+
+		if err != nil || !e.IsDir() || path == current || filepath.Ext(e.Name()) != "" {
+			continue
+		}
+
+		extractions = append(extractions, extraction{path, info.ModTime()})
+	}
+
+	// Most recently used first
+	slices.SortFunc(extractions, func(a, b extraction) int {
+		return b.used.Compare(a.used)
+	})
+
+	// `current` counts towards the ones kept
+	for i, e := range extractions {
+		if i+1 >= keep {
+			removeUnusedExtraction(e.path)
+		}
+	}
+}
+
+// Removes an extraction unless instances of its AppImage are running. Its
+// registry stays locked meanwhile, so none can start using it halfway
+// through. Extractions are named after the same hash as registries
+func removeUnusedExtraction(dir string) {
+	// A registry held by someone else is being used, leave it be
+	reg, err := tryLockMountRegistry(filepath.Base(dir))
+	if err != nil {
+		return
+	}
+
+	if len(reg.holders) > 0 {
+		reg.Close()
+		return
+	}
+
+	forceRemoveAll(dir)
+	reg.delete()
+}
+
+// Removes `dir` even if some of its directories are read-only, as extracted
+// AppImages often are
+func forceRemoveAll(dir string) error {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(path, 0755)
+		}
+
+		return nil
+	})
+
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,67 @@
+package chains
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+func TestEvictExtracted(t *testing.T) {
+	runtimeDir := xdg.RuntimeDir
+	xdg.RuntimeDir = t.TempDir()
+	t.Cleanup(func() { xdg.RuntimeDir = runtimeDir })
+
+	cache := t.TempDir()
+
+	// Oldest first
+	names := []string{"held", "locked", "unused", "current"}
+	for i, name := range names {
+		dir := filepath.Join(cache, name)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		used := time.Now().Add(time.Duration(i-len(names)) * time.Hour)
+		if err := os.Chtimes(dir, used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// An instance is running from `held`
+	reg, err := lockMountRegistry("held")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.add(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reg.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// One is starting from `locked`
+	reg, err = lockMountRegistry("locked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reg.Close()
+
+	evictExtracted(cache, 1, filepath.Join(cache, "current"))
+
+	for _, c := range []struct {
+		name string
+		kept bool
+	}{
+		{"held", true},
+		{"locked", true},
+		{"unused", false},
+		{"current", true},
+	} {
+		if kept := DirExists(filepath.Join(cache, c.name)); kept != c.kept {
+			t.Errorf("%s: kept %t, want %t", c.name, kept, c.kept)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package chains
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+// GCReport lists what GC removed, or would remove
+type GCReport struct {
+	Mounts    []string // Mounts left behind by instances that exited without unmounting
+	Removed   []string // Temporary directories and caches
+	Reclaimed int64    // Bytes freed by removing them
+}
+
+// GC cleans up after AppImages that crashed or were killed, and the caches of
+// ones that have since been deleted: mounts without an instance using them
+// are lazily unmounted and their temporary directories, half finished
+// extractions and orphaned caches removed, legacy ones included. With
+// `dryRun`, only reports what would be cleaned up
+func GC(dryRun bool) (*GCReport, error) {
+	report := &GCReport{}
+
+	errs := []error{
+		gcRuntime(report, dryRun),
+		gcExtractions(report, dryRun),
+		gcCaches(report, dryRun),
+		gcLegacyCaches(report, dryRun),
+	}
+
+	return report, errors.Join(errs...)
+}
+
+// Mounts and temporary directories under `$XDG_RUNTIME_DIR/aisap`
+func gcRuntime(report *GCReport, dryRun bool) error {
+	mounts := filepath.Join(xdg.RuntimeDir, "aisap", "mount")
+	temps := filepath.Join(xdg.RuntimeDir, "aisap", "tmp")
+
+	var names []string
+
+	for _, dir := range []string{mounts, temps} {
+		entries, err := os.ReadDir(dir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		for _, e := range entries {
+			name := strings.TrimSuffix(e.Name(), ".lock")
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	var errs []error
+
+	for _, name := range names {
+		existed := FileExists(mountRegistryPath(name))
+
+		reg, err := lockMountRegistry(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if len(reg.holders) > 0 {
+			errs = append(errs, reg.Close())
+			continue
+		}
+
+		mountDir := filepath.Join(mounts, name)
+		tempDir := filepath.Join(temps, name)
+
+		// Never look inside of the mount, its server is likely gone and
+		// anything touching it would hang
+		if isMountPoint(mountDir) {
+			report.Mounts = append(report.Mounts, mountDir)
+
+			if !dryRun {
+				if err := unmountDir(mountDir); err != nil {
+					errs = append(errs, err)
+					errs = append(errs, reg.Close())
+					continue
+				}
+			}
+		}
+
+		if !dryRun {
+			os.Remove(mountDir)
+		}
+
+		if DirExists(tempDir) {
+			errs = append(errs, gcRemove(report, tempDir, dryRun))
+		}
+
+		if !dryRun || !existed {
+			errs = append(errs, reg.delete())
+		} else {
+			errs = append(errs, reg.Close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Extractions interrupted before they finished, see *AppImage.extractCached
+func gcExtractions(report *GCReport, dryRun bool) error {
+	cache := extractCacheDir()
+
+	entries, err := os.ReadDir(cache)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, e := range entries {
+		_, pidString, found := strings.Cut(e.Name(), ".tmp-")
+		if !found {
+			continue
+		}
+
+		pid, err := strconv.Atoi(pidString)
+		if err != nil {
+			continue
+		}
+
+		if _, err := processStart(pid); err == nil {
+			continue
+		}
+
+		errs = append(errs, gcRemove(report, filepath.Join(cache, e.Name()), dryRun))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Caches whose AppImages no longer exist. Only ones with owners recorded by
+// *AppImage.makeCacheDir can be told apart
+func gcCaches(report *GCReport, dryRun bool) error {
+	owners := cacheOwnersDir()
+
+	entries, err := os.ReadDir(owners)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, e := range entries {
+		record := filepath.Join(owners, e.Name())
+
+		paths, err := cacheOwners(e.Name())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if slices.ContainsFunc(paths, FileExists) {
+			continue
+		}
+
+		cache := filepath.Join(xdg.CacheHome, "appimage", e.Name())
+		if DirExists(cache) {
+			errs = append(errs, gcRemove(report, cache, dryRun))
+		}
+
+		if !dryRun {
+			errs = append(errs, os.Remove(record))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Legacy caches untouched for this long are taken to be orphaned, see
+// gcLegacyCaches
+var legacyCacheAge = 30 * 24 * time.Hour
+
+// Caches named after the MD5 of their AppImage's path, from before they were
+// named after app IDs. *AppImage.makeCacheDir moves each over the next time
+// its AppImage runs, but the path can't be recovered from the hash, so those
+// untouched for legacyCacheAge are removed unless they belong to an AppImage
+// recorded as the owner of a newer cache
+func gcLegacyCaches(report *GCReport, dryRun bool) error {
+	caches := filepath.Join(xdg.CacheHome, "appimage")
+
+	entries, err := os.ReadDir(caches)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Hashes of every AppImage known to still exist
+	known := make(map[string]bool)
+
+	records, _ := os.ReadDir(cacheOwnersDir())
+	for _, r := range records {
+		paths, _ := cacheOwners(r.Name())
+
+		for _, path := range paths {
+			if FileExists(path) {
+				known[CalculateMD5(path)] = true
+			}
+		}
+	}
+
+	var errs []error
+
+	for _, e := range entries {
+		name := e.Name()
+
+		// Caches named after app IDs have owners, see gcCaches
+		if !isMD5(name) || !e.IsDir() || known[name] || FileExists(filepath.Join(cacheOwnersDir(), name)) {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < legacyCacheAge {
+			continue
+		}
+
+		errs = append(errs, gcRemove(report, filepath.Join(caches, name), dryRun))
+	}
+
+	return errors.Join(errs...)
+}
+
+func isMD5(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Adds `path` to the report and removes it
+func gcRemove(report *GCReport, path string, dryRun bool) error {
+	report.Removed = append(report.Removed, path)
+	report.Reclaimed += dirSize(path)
+
+	if dryRun {
+		return nil
+	}
+
+	return forceRemoveAll(path)
+}
+
+// Returns the size of the files in `path`
+func dirSize(path string) int64 {
+	var size int64
+
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size
+}
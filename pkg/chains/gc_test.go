@@ -0,0 +1,67 @@
+package chains
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+func TestGCLegacyCaches(t *testing.T) {
+	cacheHome := xdg.CacheHome
+	xdg.CacheHome = t.TempDir()
+	t.Cleanup(func() { xdg.CacheHome = cacheHome })
+
+	// An AppImage that still exists, recorded as owning a newer cache
+	appImage := filepath.Join(t.TempDir(), "app.AppImage")
+	if err := os.WriteFile(appImage, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(cacheOwnersDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cacheOwnersDir(), "app"), []byte(appImage+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	old := time.Now().Add(-2 * legacyCacheAge)
+
+	cases := []struct {
+		name    string
+		used    time.Time
+		removed bool
+	}{
+		{CalculateMD5("/deleted.AppImage"), old, true},
+		{CalculateMD5("/recent.AppImage"), time.Now(), false},
+		{CalculateMD5(appImage), old, false},
+		{"app", old, false}, // Named after its app ID
+	}
+
+	for _, c := range cases {
+		dir := filepath.Join(xdg.CacheHome, "appimage", c.name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dir, c.used, c.used); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report := &GCReport{}
+	if err := gcLegacyCaches(report, false); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		if removed := !DirExists(filepath.Join(xdg.CacheHome, "appimage", c.name)); removed != c.removed {
+			t.Errorf("%s: removed %t, want %t", c.name, removed, c.removed)
+		}
+	}
+
+	if len(report.Removed) != 1 {
+		t.Errorf("reported %v as removed", report.Removed)
+	}
+}
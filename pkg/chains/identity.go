@@ -0,0 +1,347 @@
+package chains
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/adrg/xdg"
+)
+
+// An AppImage is identified in two ways. The SHA-256 of its contents names
+// everything tied to one build of it (its mount, temporary directory and
+// extraction), so those follow the file when it's moved and change when it's
+// replaced. Its app ID names what should survive updates, like its cache and
+// data dir
+//
+// The app ID is whatever the bundle names its desktop entry, so any bundle can
+// claim another app's. The first AppImage to use an ID owns it, along with
+// the key it's signed with, in `$XDG_DATA_HOME/chains/ids/<app ID>.json`.
+// Others only get its data once the user lets them, see *AppImage.CheckID
+//
+// The MD5 of its URI is still kept for thumbnails, as the freedesktop
+// thumbnail spec names them after it
+
+var (
+	IDClaimed = errors.New("app ID belongs to another AppImage")
+)
+
+// idOwners records which AppImages may use an app ID
+type idOwners struct {
+	Fingerprint string   `json:"fingerprint,omitempty"` // Key the AppImages that may are signed with
+	Paths       []string `json:"paths"`                 // AppImages that may, whether signed or not
+}
+
+// Returns the SHA-256 of the AppImage's contents as hex
+func (ai *AppImage) SHA256() string {
+	return ai.sha256
+}
+
+// Returns the MD5 of the AppImage's URI, which thumbnails are named after
+func (ai *AppImage) MD5() string {
+	return ai.md5
+}
+
+// Calculates the SHA-256 of a file's contents as hex. Hashing large
+// AppImages takes a while, so the result is cached until the file's
+// modification time, change time or size change. Trust decisions rely on it,
+// and unlike the modification time the change time can't be set back, so a
+// file can't be rewritten without its hash being calculated again
+func CalculateSHA256(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return hashFile(path)
+	}
+
+	// Files are told apart by their inode, so a cached hash stays valid when
+	// the file is renamed
+	record := filepath.Join(hashCacheDir(), strconv.FormatUint(st.Dev, 10)+"-"+strconv.FormatUint(st.Ino, 10))
+	stamp := strconv.FormatInt(info.ModTime().UnixNano(), 10) + " " +
+		strconv.FormatInt(st.Ctim.Nano(), 10) + " " +
+		strconv.FormatInt(info.Size(), 10)
+
+	if b, err := os.ReadFile(record); err == nil {
+		cachedStamp, hash, found := strings.Cut(strings.TrimSpace(string(b)), "\n")
+		if found && cachedStamp == stamp {
+			return hash, nil
+		}
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	// Failing to cache the hash only makes the next launch slower
+	if os.MkdirAll(hashCacheDir(), 0744) == nil {
+		tmp := record + ".tmp-" + strconv.Itoa(os.Getpid())
+		if os.WriteFile(tmp, []byte(stamp+"\n"+hash+"\n"), 0644) == nil {
+			os.Rename(tmp, record)
+		}
+	}
+
+	return hash, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Directory cached hashes are kept in, see CalculateSHA256
+func hashCacheDir() string {
+	return filepath.Join(xdg.CacheHome, "chains", "hashes")
+}
+
+// Makes an app ID from the name of the AppImage's desktop entry, which is
+// meant to be its reverse DNS name (`org.example.App.desktop`)
+func appID(desktopName string) string {
+	id := strings.TrimSuffix(filepath.Base(desktopName), ".desktop")
+	if id == "" || id == "." || id == ".." {
+		return ""
+	}
+
+	return id
+}
+
+// Makes an app ID for an AppImage without a desktop entry to take it from.
+// It's named after where the AppImage updates from, or else where it is,
+// both of which stay the same across updates and rollbacks
+func (ai *AppImage) fallbackID() (string, error) {
+	source := "update:" + ai.UpdateInfo
+
+	if ai.UpdateInfo == "" {
+		path, err := filepath.Abs(ai.Path)
+		if err != nil {
+			return "", err
+		}
+
+		source = "path:" + path
+	}
+
+	sum := sha256.Sum256([]byte(source))
+
+	return "appimage-" + hex.EncodeToString(sum[:8]), nil
+}
+
+// Directory recording which AppImages own each app ID
+func idOwnersDir() string {
+	return filepath.Join(xdg.DataHome, "chains", "ids")
+}
+
+// Checks that the AppImage may use the data dir, cache and versions of its
+// app ID. It may if it's been used at the same path before, or it's signed
+// with the same key as the AppImage that first used the ID. The first
+// AppImage to use an ID takes it. Otherwise, IDClaimed is returned and the
+// user has to be asked before *AppImage.ShareID lets it in
+func (ai *AppImage) CheckID() error {
+	return ai.updateIDOwners(func(owners *idOwners, path string) error {
+		if len(owners.Paths) == 0 {
+			if sig, err := ai.Verify(); err == nil {
+				owners.Fingerprint = sig.Fingerprint
+			}
+		} else if !slices.Contains(owners.Paths, path) {
+			if owners.Fingerprint == "" {
+				return errors.Join(IDClaimed, errors.New("`"+ai.ID+"`"))
+			}
+
+			sig, err := ai.Verify()
+			if err != nil || sig.Fingerprint != owners.Fingerprint {
+				return errors.Join(IDClaimed, errors.New("`"+ai.ID+"` is used by AppImages signed with "+owners.Fingerprint))
+			}
+		}
+
+		if !slices.Contains(owners.Paths, path) {
+			owners.Paths = append(owners.Paths, path)
+		}
+
+		return nil
+	})
+}
+
+// Lets the AppImage use the data dir, cache and versions of its app ID along
+// with the AppImages already using them, whoever they are
+func (ai *AppImage) ShareID() error {
+	return ai.updateIDOwners(func(owners *idOwners, path string) error {
+		if !slices.Contains(owners.Paths, path) {
+			owners.Paths = append(owners.Paths, path)
+		}
+
+		return nil
+	})
+}
+
+// Locks the owners of the AppImage's app ID so that `fn` can change them, then
+// writes them back unless it fails. `fn` is given the AppImage's absolute path
+func (ai *AppImage) updateIDOwners(fn func(owners *idOwners, path string) error) error {
+	path, err := filepath.Abs(ai.Path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(idOwnersDir(), 0744); err != nil {
+		return err
+	}
+
+	record := filepath.Join(idOwnersDir(), ai.ID+".json")
+
+	lock, err := lockFile(record + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	owners := &idOwners{}
+	if b, err := os.ReadFile(record); err == nil {
+		if err := json.Unmarshal(b, owners); err != nil {
+			return errors.Join(errors.New("failed to parse `"+record+"`"), err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := fn(owners, path); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(owners, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := record + ".tmp-" + strconv.Itoa(os.Getpid())
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, record)
+}
+
+// Directory recording which AppImages each cache in `$XDG_CACHE_HOME/appimage`
+// belongs to
+func cacheOwnersDir() string {
+	return filepath.Join(xdg.CacheHome, "chains", "owners")
+}
+
+// The AppImage's `XDG_CACHE_HOME`
+func (ai *AppImage) cacheDir() string {
+	return filepath.Join(xdg.CacheHome, "appimage", ai.ID)
+}
+
+// Where the AppImage's data dir is kept unless given another. It's named after
+// the app ID so that it follows the app when it's moved, renamed or updated
+func (ai *AppImage) defaultDataDir() string {
+	root := DataRoot
+	if root == "" {
+		root = filepath.Join(xdg.DataHome, "chains", "data")
+	}
+
+	return filepath.Join(root, ai.ID)
+}
+
+// Moves over the data dir kept next to the AppImage as `<AppImage>.home`, from
+// before data dirs were named after app IDs. One on another filesystem is
+// used where it is rather than copying the user's data around
+func (ai *AppImage) migrateDataDir() error {
+	legacy := ai.Path + ".home"
+
+	if ai.dataDir != ai.defaultDataDir() || DirExists(ai.dataDir) || !DirExists(legacy) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ai.dataDir), 0755); err != nil {
+		return err
+	}
+
+	err := os.Rename(legacy, ai.dataDir)
+	if errors.Is(err, syscall.EXDEV) {
+		ai.dataDir = legacy
+		return nil
+	}
+
+	return err
+}
+
+// Creates the AppImage's cache, moving over the one named after the MD5 of
+// its path from before caches were named after app IDs. The AppImage is
+// added to the cache's owners so GC can tell once they've all been deleted
+func (ai *AppImage) makeCacheDir() error {
+	legacy := filepath.Join(xdg.CacheHome, "appimage", ai.md5)
+
+	if !DirExists(ai.cacheDir()) && DirExists(legacy) {
+		if err := os.Rename(legacy, ai.cacheDir()); err != nil {
+			return err
+		}
+
+		os.Remove(filepath.Join(cacheOwnersDir(), ai.md5))
+	}
+
+	if err := os.MkdirAll(ai.cacheDir(), 0744); err != nil {
+		return err
+	}
+
+	path, err := filepath.Abs(ai.Path)
+	if err != nil {
+		return err
+	}
+
+	owners, err := cacheOwners(ai.ID)
+	if err != nil {
+		return err
+	}
+
+	if slices.Contains(owners, path) {
+		return nil
+	}
+
+	if err := os.MkdirAll(cacheOwnersDir(), 0744); err != nil {
+		return err
+	}
+
+	owners = append(owners, path)
+
+	return os.WriteFile(filepath.Join(cacheOwnersDir(), ai.ID), []byte(strings.Join(owners, "\n")+"\n"), 0644)
+}
+
+// Returns the paths of the AppImages that have used the cache named `name`
+func cacheOwners(name string) ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(cacheOwnersDir(), name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var owners []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line != "" {
+			owners = append(owners, line)
+		}
+	}
+
+	return owners, nil
+}
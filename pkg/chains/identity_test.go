@@ -0,0 +1,209 @@
+package chains
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/adrg/xdg"
+)
+
+func TestMigrateDataDir(t *testing.T) {
+	dataHome := xdg.DataHome
+	xdg.DataHome = t.TempDir()
+	t.Cleanup(func() { xdg.DataHome = dataHome })
+
+	ai := &AppImage{ID: "org.example.App", Path: filepath.Join(t.TempDir(), "app.AppImage")}
+	ai.dataDir = ai.defaultDataDir()
+
+	if want := filepath.Join(xdg.DataHome, "chains", "data", "org.example.App"); ai.dataDir != want {
+		t.Errorf("data dir is %s, want %s", ai.dataDir, want)
+	}
+
+	legacy := ai.Path + ".home"
+	if err := os.MkdirAll(legacy, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(legacy, "settings"), []byte("kept"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Given another one, the legacy dir is left alone
+	other := *ai
+	other.SetDataDir(t.TempDir())
+	if err := other.migrateDataDir(); err != nil {
+		t.Fatal(err)
+	}
+	if !DirExists(legacy) {
+		t.Fatal("legacy data dir moved to a data dir that was set explicitly")
+	}
+
+	if err := ai.migrateDataDir(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := os.ReadFile(filepath.Join(ai.dataDir, "settings")); err != nil || string(b) != "kept" {
+		t.Errorf("migrated data: %q, %v", b, err)
+	}
+
+	if DirExists(legacy) {
+		t.Error("legacy data dir left behind")
+	}
+}
+
+func TestSHA256CacheNoticesRewrites(t *testing.T) {
+	cacheHome := xdg.CacheHome
+	xdg.CacheHome = t.TempDir()
+	t.Cleanup(func() { xdg.CacheHome = cacheHome })
+
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+	if err := os.WriteFile(path, []byte("trusted"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trusted, err := CalculateSHA256(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Change times may be as coarse as the scheduler's tick
+	time.Sleep(20 * time.Millisecond)
+
+	// Same inode, size and modification time, different contents
+	if err := os.WriteFile(path, []byte("changed"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := CalculateSHA256(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, _ := hashFile(path); hash != want || hash == trusted {
+		t.Errorf("got cached hash %s of the old contents", hash)
+	}
+}
+
+func TestFallbackID(t *testing.T) {
+	cacheHome := xdg.CacheHome
+	xdg.CacheHome = t.TempDir()
+	t.Cleanup(func() { xdg.CacheHome = cacheHome })
+
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+
+	// A desktop entry named `.desktop` gives no ID
+	var ids []string
+	for _, version := range []string{"1", "2"} {
+		writeISOAppImage(t, path, []testISOEntry{
+			{name: ".desktop", data: "[Desktop Entry]\nName=App\nX-AppImage-Version=" + version + "\n"},
+		})
+
+		ai, err := NewAppImage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, ai.ID)
+	}
+
+	if !strings.HasPrefix(ids[0], "appimage-") || ids[0] != ids[1] {
+		t.Errorf("IDs of two versions at the same path: %v", ids)
+	}
+
+	if moved, _ := (&AppImage{Path: path + ".moved"}).fallbackID(); moved == ids[0] {
+		t.Error("AppImages at different paths got the same ID")
+	}
+
+	// Where it updates from stays the same when it's moved
+	a, _ := (&AppImage{Path: path, UpdateInfo: "zsync|https://example.com/app.zsync"}).fallbackID()
+	b, _ := (&AppImage{Path: path + ".moved", UpdateInfo: "zsync|https://example.com/app.zsync"}).fallbackID()
+	if a != b || a == ids[0] {
+		t.Errorf("IDs from update info: %s, %s", a, b)
+	}
+}
+
+func TestCheckID(t *testing.T) {
+	dataHome := xdg.DataHome
+	xdg.DataHome = t.TempDir()
+	t.Cleanup(func() { xdg.DataHome = dataHome })
+
+	dir := t.TempDir()
+	owner := &AppImage{ID: "org.example.App", Path: filepath.Join(dir, "app.AppImage")}
+	impostor := &AppImage{ID: "org.example.App", Path: filepath.Join(dir, "impostor.AppImage")}
+
+	// The first to use the ID takes it
+	if err := owner.CheckID(); err != nil {
+		t.Fatal(err)
+	}
+	if err := owner.CheckID(); err != nil {
+		t.Errorf("owner of the ID refused: %v", err)
+	}
+
+	if err := impostor.CheckID(); !errors.Is(err, IDClaimed) {
+		t.Errorf("other AppImage got the ID: %v", err)
+	}
+
+	if err := impostor.KeepVersion(); !errors.Is(err, IDClaimed) {
+		t.Errorf("other AppImage kept with the ID's versions: %v", err)
+	}
+
+	if err := impostor.ShareID(); err != nil {
+		t.Fatal(err)
+	}
+	if err := impostor.CheckID(); err != nil {
+		t.Errorf("shared ID refused: %v", err)
+	}
+}
+
+func TestCheckIDSigned(t *testing.T) {
+	dataHome := xdg.DataHome
+	xdg.DataHome = t.TempDir()
+	t.Cleanup(func() { xdg.DataHome = dataHome })
+
+	key, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := openpgp.NewEntity("Other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	signed := func(name string, key *openpgp.Entity) *AppImage {
+		ai := &AppImage{ID: "org.example.App", Path: filepath.Join(dir, name), imageType: 2}
+		signAppImage(t, ai.Path, key)
+		return ai
+	}
+
+	if err := signed("app.AppImage", key).CheckID(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Signed by the same key, wherever it is
+	if err := signed("downloaded-again.AppImage", key).CheckID(); err != nil {
+		t.Errorf("AppImage signed with the owner's key refused: %v", err)
+	}
+
+	if err := signed("impostor.AppImage", other).CheckID(); !errors.Is(err, IDClaimed) {
+		t.Errorf("AppImage signed with another key got the ID: %v", err)
+	}
+
+	unsigned := &AppImage{ID: "org.example.App", Path: filepath.Join(dir, "unsigned.AppImage"), imageType: 2}
+	writeUnsignedAppImage(t, unsigned.Path)
+	if err := unsigned.CheckID(); !errors.Is(err, IDClaimed) {
+		t.Errorf("unsigned AppImage got the ID: %v", err)
+	}
+}
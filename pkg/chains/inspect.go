@@ -0,0 +1,239 @@
+package chains
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/adrg/xdg"
+)
+
+// Inspection is everything known about an AppImage, for scripts to read as
+// JSON or YAML. Fields may be added within a version of the schema, anything
+// else bumps InspectionVersion
+type Inspection struct {
+	SchemaVersion int      `json:"schema_version" yaml:"schema_version"`
+	Path          string   `json:"path" yaml:"path"` // Absolute
+	Name          string   `json:"name" yaml:"name"`
+	ID            string   `json:"id" yaml:"id"`
+	Version       string   `json:"version" yaml:"version"`
+	SHA256        string   `json:"sha256" yaml:"sha256"`
+	Type          int      `json:"type" yaml:"type"` // See GetAppImageType
+	Filesystem    FSType   `json:"filesystem" yaml:"filesystem"`
+	Offset        int      `json:"offset" yaml:"offset"` // Of the filesystem image
+	Architectures []string `json:"architectures" yaml:"architectures"`
+	UpdateInfo    string   `json:"update_info" yaml:"update_info"`
+
+	// Keys of the `Desktop Entry` section
+	DesktopEntry map[string]string `json:"desktop_entry" yaml:"desktop_entry"`
+
+	// Path of the icon inside the AppImage, empty if it has none
+	Icon string `json:"icon" yaml:"icon"`
+
+	Permissions InspectedPerms `json:"permissions" yaml:"permissions"`
+	Trust       TrustState     `json:"trust" yaml:"trust"`
+	DataDir     string         `json:"data_dir" yaml:"data_dir"` // Where its `HOME` is kept
+	Mount       InspectedMount `json:"mount" yaml:"mount"`
+}
+
+// InspectionVersion is the version of the Inspection schema
+const InspectionVersion = 1
+
+// InspectedPerms are the permissions an AppImage would be granted, see
+// AppImagePerms
+type InspectedPerms struct {
+	Source   PermsSource `json:"source" yaml:"source"`
+	Adjusted bool        `json:"adjusted" yaml:"adjusted"` // Changed from the source's, eg: by flags
+
+	// Which layer set each field, keyed by its name here. Those that weren't
+	// changed since come from `Source`
+	Sources map[string]PermsSource `json:"sources" yaml:"sources"`
+
+	Level         int      `json:"level" yaml:"level"`
+	LevelName     string   `json:"level_name" yaml:"level_name"`
+	Files         []string `json:"files" yaml:"files"`
+	Devices       []string `json:"devices" yaml:"devices"`
+	Sockets       []string `json:"sockets" yaml:"sockets"`
+	DataDir       bool     `json:"data_dir" yaml:"data_dir"`
+	Seccomp       string   `json:"seccomp" yaml:"seccomp"`
+	DropCaps      bool     `json:"drop_caps" yaml:"drop_caps"`
+	KeepCaps      []string `json:"keep_caps" yaml:"keep_caps"`
+	Identity      string   `json:"identity" yaml:"identity"`
+	DisableUserns bool     `json:"disable_userns" yaml:"disable_userns"`
+}
+
+// InspectedMount says whether the AppImage's files are available, and where
+type InspectedMount struct {
+	Mounted   bool   `json:"mounted" yaml:"mounted"`     // With FUSE, at `Dir`
+	Extracted bool   `json:"extracted" yaml:"extracted"` // Into the cache, at `Dir`
+	Dir       string `json:"dir" yaml:"dir"`
+	Instances int    `json:"instances" yaml:"instances"` // Running, sharing the mount
+}
+
+// Inspect describes the AppImage, reporting `perms` as the permissions it
+// would be granted. If they're nil, those from ResolvePermissions are used
+func (ai *AppImage) Inspect(perms *AppImagePerms, source PermsSource) (*Inspection, error) {
+	if perms == nil {
+		var err error
+
+		perms, source, err = ai.ResolvePermissions()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	path, err := filepath.Abs(ai.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	dataDir, err := filepath.Abs(ai.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	trust, err := ai.TrustState()
+	if err != nil {
+		return nil, err
+	}
+
+	mount, err := ai.inspectMount()
+	if err != nil {
+		return nil, err
+	}
+
+	i := &Inspection{
+		SchemaVersion: InspectionVersion,
+		Path:          path,
+		Name:          ai.Name,
+		ID:            ai.ID,
+		Version:       ai.Version,
+		SHA256:        ai.sha256,
+		Type:          ai.imageType,
+		Filesystem:    ai.FSType,
+		Offset:        ai.Offset,
+		Architectures: []string{},
+		UpdateInfo:    ai.UpdateInfo,
+		DesktopEntry:  make(map[string]string),
+		Permissions:   InspectPerms(perms, source),
+		Trust:         trust,
+		DataDir:       dataDir,
+		Mount:         mount,
+	}
+
+	// Looking keys up adds them, so this has to come first
+	for _, key := range ai.Desktop.Section("Desktop Entry").Keys() {
+		i.DesktopEntry[key.Name()] = key.Value()
+	}
+
+	// Neither is worth failing over, an AppImage can run without them
+	if f, err := os.Open(ai.Path); err == nil {
+		if archs, err := GetSupportedArchitectures(f, ai.Desktop); err == nil {
+			i.Architectures = archs
+		}
+		f.Close()
+	}
+	i.Icon, _ = ai.IconPath()
+
+	return i, nil
+}
+
+// InspectPerms describes `p` as coming from `source` as a whole. Later layers
+// are added with *InspectedPerms.Apply
+func InspectPerms(p *AppImagePerms, source PermsSource) InspectedPerms {
+	i := inspectPerms(p)
+	i.Source = source
+	i.Sources = make(map[string]PermsSource)
+
+	for _, name := range i.fields() {
+		i.Sources[name] = source
+	}
+
+	return i
+}
+
+// Apply updates the inspected permissions to `p`, recording `source` as
+// where every field that changed came from
+func (i *InspectedPerms) Apply(source PermsSource, p *AppImagePerms) {
+	next := inspectPerms(p)
+	old, new := reflect.ValueOf(i).Elem(), reflect.ValueOf(next)
+
+	for n, name := range i.fields() {
+		if reflect.DeepEqual(old.Field(n).Interface(), new.Field(n).Interface()) {
+			continue
+		}
+
+		old.Field(n).Set(new.Field(n))
+		i.Sources[name] = source
+		i.Adjusted = true
+	}
+}
+
+// Returns the names of the fields describing the permissions themselves, by
+// their index in the struct
+func (i *InspectedPerms) fields() map[int]string {
+	fields := make(map[int]string)
+	t := reflect.TypeOf(*i)
+
+	for n := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(n).Tag.Get("json"), ",")
+		if name != "source" && name != "adjusted" && name != "sources" {
+			fields[n] = name
+		}
+	}
+
+	return fields
+}
+
+func inspectPerms(p *AppImagePerms) InspectedPerms {
+	return InspectedPerms{
+		Level:         p.Level,
+		LevelName:     p.LevelName,
+		Files:         orEmpty(slices.Clone(p.Files)),
+		Devices:       orEmpty(slices.Clone(p.Devices)),
+		Sockets:       orEmpty(socketStrings(p.Sockets)),
+		DataDir:       p.DataDir,
+		Seccomp:       p.Seccomp,
+		DropCaps:      p.DropCaps,
+		KeepCaps:      orEmpty(slices.Clone(p.KeepCaps)),
+		Identity:      p.Identity,
+		DisableUserns: p.DisableUserns,
+	}
+}
+
+// Finds where other instances have the AppImage mounted or extracted, or
+// where this one does
+func (ai *AppImage) inspectMount() (InspectedMount, error) {
+	var m InspectedMount
+	var err error
+
+	m.Instances, err = ai.Instances()
+	if err != nil {
+		return m, err
+	}
+
+	mountDir := filepath.Join(xdg.RuntimeDir, "aisap", "mount", ai.sha256)
+	extractDir := filepath.Join(extractCacheDir(), ai.sha256)
+
+	switch {
+	case ai.IsMounted():
+		m.Mounted, m.Extracted, m.Dir = !ai.extracted, ai.extracted, ai.mountDir
+	case isMountPoint(mountDir):
+		m.Mounted, m.Dir = true, mountDir
+	case DirExists(extractDir):
+		m.Extracted, m.Dir = true, extractDir
+	}
+
+	return m, nil
+}
+
+// Empty lists are `[]` rather than `null`, so the schema holds
+func orEmpty(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+
+	return s
+}
@@ -0,0 +1,128 @@
+package chains
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestInspectedPermsSources(t *testing.T) {
+	perms := &AppImagePerms{
+		Level:   2,
+		Files:   []string{"xdg-download:rw"},
+		Devices: []string{"dri", "input"},
+		Sockets: []Socket{"x11", "network"},
+	}
+
+	i := InspectPerms(perms, UserProfile)
+	if i.Adjusted || len(i.Sources) == 0 {
+		t.Fatalf("got %+v", i)
+	}
+
+	// Nothing changed
+	i.Apply(Settings, perms)
+
+	perms.RemoveSockets("network")
+	perms.RemoveDevices("dri")
+	i.Apply(Settings, perms)
+
+	perms.Level = 3
+	perms.AddFiles("~/Music:ro")
+	i.Apply(Flags, perms)
+
+	if !i.Adjusted || i.Source != UserProfile || i.Level != 3 || len(i.Sockets) != 1 || len(i.Devices) != 1 || len(i.Files) != 2 {
+		t.Errorf("got %+v", i)
+	}
+
+	for name, want := range map[string]PermsSource{
+		"level":   Flags,
+		"files":   Flags,
+		"sockets": Settings,
+		"devices": Settings,
+		"seccomp": UserProfile,
+	} {
+		if i.Sources[name] != want {
+			t.Errorf("%s from %s, want %s", name, i.Sources[name], want)
+		}
+	}
+
+	for _, name := range []string{"source", "adjusted", "sources"} {
+		if _, present := i.Sources[name]; present {
+			t.Errorf("%s has a source", name)
+		}
+	}
+}
+
+// The schema must only grow within a version. Fields may be added to the
+// files in testdata for it, anything else needs a new InspectionVersion and
+// files of its own
+func TestInspectionSchema(t *testing.T) {
+	p := &AppImagePerms{
+		Level:         2,
+		Files:         []string{"xdg-download:rw"},
+		Devices:       []string{"dri"},
+		Sockets:       []Socket{"x11"},
+		DataDir:       true,
+		Seccomp:       "/etc/chains/filter.bpf",
+		DropCaps:      true,
+		KeepCaps:      []string{"CAP_NET_RAW"},
+		Identity:      "nobody",
+		DisableUserns: true,
+	}
+	perms := InspectPerms(p, UserProfile)
+	p.Level = 3
+	perms.Apply(Flags, p)
+
+	i := &Inspection{
+		SchemaVersion: InspectionVersion,
+		Path:          "/home/user/Applications/App.AppImage",
+		Name:          "App",
+		ID:            "org.example.App",
+		Version:       "1.0",
+		SHA256:        "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		Type:          2,
+		Filesystem:    SquashFS,
+		Offset:        188392,
+		Architectures: []string{"x86_64"},
+		UpdateInfo:    "gh-releases-zsync|user|repo|latest|App-*x86_64.AppImage.zsync",
+		DesktopEntry:  map[string]string{"Name": "App", "Exec": "app"},
+		Icon:          "app.png",
+		Permissions:   perms,
+		Trust:         TrustValid,
+		DataDir:       "/home/user/Applications/App.AppImage.home",
+		Mount:         InspectedMount{Mounted: true, Dir: "/run/user/1000/aisap/mount/e3b0c442", Instances: 1},
+	}
+
+	var j bytes.Buffer
+	enc := json.NewEncoder(&j)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(i); err != nil {
+		t.Fatal(err)
+	}
+
+	var y bytes.Buffer
+	yenc := yaml.NewEncoder(&y)
+	yenc.SetIndent(2)
+	if err := yenc.Encode(i); err != nil {
+		t.Fatal(err)
+	}
+	yenc.Close()
+
+	for ext, got := range map[string][]byte{"json": j.Bytes(), "yaml": y.Bytes()} {
+		path := filepath.Join("testdata", "inspection-v"+strconv.Itoa(InspectionVersion)+"."+ext)
+
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s doesn't match, got:\n%s", path, got)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package chains
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/adrg/xdg"
+)
+
+// Integrating an AppImage adds it to the desktop's application menu. A copy
+// of its desktop entry that launches it through chains is installed in
+// `$XDG_DATA_HOME/applications`, and its icon in the hicolor icon theme,
+// both named `chains-<app ID>`
+
+var (
+	NotIntegrated = errors.New("AppImage isn't integrated")
+)
+
+func (ai *AppImage) integrationName() string {
+	return "chains-" + ai.ID
+}
+
+// Location of the AppImage's desktop entry once integrated
+func (ai *AppImage) DesktopEntryPath() string {
+	return filepath.Join(xdg.DataHome, "applications", ai.integrationName()+".desktop")
+}
+
+func (ai *AppImage) iconPaths() []string {
+	icons := filepath.Join(xdg.DataHome, "icons", "hicolor")
+
+	return []string{
+		filepath.Join(icons, "scalable", "apps", ai.integrationName()+".svg"),
+		filepath.Join(icons, "256x256", "apps", ai.integrationName()+".png"),
+	}
+}
+
+// Integrate installs a desktop entry for the AppImage, whose actions run
+// `launcher` (eg: `/usr/bin/chains`, `run`) followed by the AppImage's path
+// and the arguments its own entry passes
+func (ai *AppImage) Integrate(launcher ...string) error {
+	path, err := filepath.Abs(ai.Path)
+	if err != nil {
+		return err
+	}
+
+	// An AppImage without a usable icon still gets an entry
+	icon, ext, err := ai.ReadIcon()
+	if err == nil {
+		dest := ai.iconPaths()[0]
+		if ext == ".png" {
+			dest = ai.iconPaths()[1]
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(dest, icon, 0644); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, NoIcon) && !errors.Is(err, InvalidIconExtension) {
+		return err
+	}
+
+	var exec string
+	for _, arg := range append(launcher, path) {
+		exec += quoteExecArg(arg) + " "
+	}
+	exec = strings.TrimSuffix(exec, " ")
+
+	var b strings.Builder
+
+	for _, section := range ai.Desktop.Sections() {
+		name := section.Name()
+		if name != "Desktop Entry" && !strings.HasPrefix(name, "Desktop Action ") {
+			continue
+		}
+
+		b.WriteString("[" + name + "]\n")
+
+		for _, key := range section.Keys() {
+			value := key.Value()
+
+			switch key.Name() {
+			case "TryExec":
+				continue
+			case "Exec":
+				value = exec + execArgs(value)
+			case "Icon":
+				if icon == nil {
+					continue
+				}
+				value = ai.integrationName()
+			}
+
+			b.WriteString(key.Name() + "=" + value + "\n")
+		}
+
+		if name == "Desktop Entry" {
+			b.WriteString("X-Chains-AppImage=" + path + "\n")
+		}
+
+		b.WriteString("\n")
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ai.DesktopEntryPath()), 0755); err != nil {
+		return err
+	}
+
+	return os.WriteFile(ai.DesktopEntryPath(), []byte(strings.TrimSuffix(b.String(), "\n")), 0644)
+}
+
+// Removes the AppImage's desktop entry and icon
+func (ai *AppImage) Unintegrate() error {
+	removed := false
+
+	for _, path := range append(ai.iconPaths(), ai.DesktopEntryPath()) {
+		err := os.Remove(path)
+		if err == nil {
+			removed = true
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if !removed {
+		return NotIntegrated
+	}
+
+	return nil
+}
+
+// Returns the arguments after the program in an `Exec` key, eg: ` %U` for
+// `AppRun %U`
+func execArgs(exec string) string {
+	exec = strings.TrimSpace(exec)
+
+	if strings.HasPrefix(exec, "\"") {
+		if end := strings.Index(exec[1:], "\""); end >= 0 {
+			return exec[end+2:]
+		}
+
+		return ""
+	}
+
+	if i := strings.IndexAny(exec, " \t"); i >= 0 {
+		return exec[i:]
+	}
+
+	return ""
+}
+
+// Quotes an argument of an `Exec` key if it needs to be, following the
+// desktop entry spec. Values are unescaped before they're unquoted, so the
+// backslashes quoting adds have to be escaped again
+func quoteExecArg(arg string) string {
+	if !strings.ContainsAny(arg, " \t\n\"'\\><~|&;$*?#()`") {
+		return arg
+	}
+
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`", `$`, `\$`)
+
+	return strings.ReplaceAll(`"`+r.Replace(arg)+`"`, `\`, `\\`)
+}
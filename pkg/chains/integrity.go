@@ -0,0 +1,289 @@
+package chains
+
+import (
+	"bytes"
+	"crypto/md5"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+)
+
+var (
+	TruncatedImage = errors.New("AppImage is truncated, it may not have finished downloading")
+)
+
+// IntegrityReport says whether an AppImage is complete and unmodified,
+// without needing to mount it
+type IntegrityReport struct {
+	Size      int64  // Size of the AppImage
+	Offset    int64  // Where its filesystem image starts
+	FSType    FSType // Type of its filesystem image
+	ImageEnd  int64  // Where the image ends according to its own headers
+	Padding   int64  // Zeroes after the image, mksquashfs pads images to 4K
+	Signature int64  // Armored signature appended after the padding, by `gpg --armor` and the like
+	Trailing  int64  // Bytes after the image that don't belong to it
+	DigestMD5 string // The MD5 recorded in the runtime's `.digest_md5`, empty if none
+	DigestOK  bool   // The file matches DigestMD5
+}
+
+// Bytes missing from the end of the AppImage
+func (r *IntegrityReport) Missing() int64 {
+	return max(0, r.ImageEnd-r.Size)
+}
+
+// Returns true if nothing is wrong with the AppImage
+func (r *IntegrityReport) OK() bool {
+	return r.Missing() == 0 && r.Trailing == 0 && (r.DigestMD5 == "" || r.DigestOK)
+}
+
+// Checks the AppImage at `path` for truncation, trailing garbage and, if its
+// runtime records one, that it matches its `.digest_md5`
+func CheckIntegrity(path string) (*IntegrityReport, error) {
+	offset, fsType, err := GetImage(path)
+	if err != nil && !errors.Is(err, TruncatedImage) {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &IntegrityReport{
+		Size:   info.Size(),
+		Offset: int64(offset),
+		FSType: fsType,
+	}
+
+	r.ImageEnd, err = imageEnd(f, r.Offset, fsType)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.ImageEnd < r.Size {
+		r.Padding, r.Trailing, err = trailingBytes(f, r.ImageEnd, r.Size)
+		if err != nil {
+			return nil, err
+		}
+
+		if appendedSignature(f, r.Size-r.Trailing, r.Trailing) {
+			r.Signature, r.Trailing = r.Trailing, 0
+		}
+	}
+
+	if err := r.checkDigest(path); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Checks the AppImage for truncation, trailing garbage and its `.digest_md5`
+func (ai *AppImage) CheckIntegrity() (*IntegrityReport, error) {
+	return CheckIntegrity(ai.Path)
+}
+
+// Returns TruncatedImage if the image at `offset` runs past the end of the
+// file
+func checkTruncated(f *os.File, offset int64, fsType FSType) error {
+	end, err := imageEnd(f, offset, fsType)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if end > info.Size() {
+		return errors.Join(TruncatedImage, errors.New(strconv.FormatInt(end-info.Size(), 10)+" bytes are missing"))
+	}
+
+	return nil
+}
+
+// Returns where the image at `offset` ends, according to its own headers
+func imageEnd(f *os.File, offset int64, fsType FSType) (int64, error) {
+	switch fsType {
+	case ISO9660:
+		return isoEnd(f)
+	case DwarFS:
+		return dwarfsEnd(f, offset)
+	}
+
+	end, ok := squashfsEnd(f, offset)
+	if !ok {
+		return 0, InvalidImage
+	}
+
+	return end, nil
+}
+
+// Splits the bytes from `start` to `size` into the zeroes padding the image
+// and whatever follows them
+func trailingBytes(f *os.File, start int64, size int64) (int64, int64, error) {
+	buf := make([]byte, 1<<16)
+
+	for pos := start; pos < size; {
+		n, err := f.ReadAt(buf[:min(int64(len(buf)), size-pos)], pos)
+		if n == 0 && err != nil {
+			return 0, 0, err
+		}
+
+		if i := slices.IndexFunc(buf[:n], func(b byte) bool { return b != 0 }); i >= 0 {
+			return pos + int64(i) - start, size - pos - int64(i), nil
+		}
+
+		pos += int64(n)
+	}
+
+	return size - start, 0, nil
+}
+
+// Appended signatures longer than this are taken for garbage
+const maxAppendedSignature = 1 << 16
+
+// Whether the `size` bytes at `offset` are an armored PGP signature and
+// nothing else
+func appendedSignature(f *os.File, offset int64, size int64) bool {
+	if size == 0 || size > maxAppendedSignature {
+		return false
+	}
+
+	b := make([]byte, size)
+	if _, err := f.ReadAt(b, offset); err != nil {
+		return false
+	}
+
+	b = bytes.TrimRight(b, "\x00\r\n\t ")
+
+	return bytes.HasPrefix(b, []byte("-----BEGIN PGP SIGNATURE-----")) &&
+		bytes.HasSuffix(b, []byte("-----END PGP SIGNATURE-----")) &&
+		bytes.Count(b, []byte("-----BEGIN ")) == 1
+}
+
+// Compares the file against the MD5 its runtime records, if it does
+func (r *IntegrityReport) checkDigest(path string) error {
+	e, err := elf.Open(path)
+	if err != nil {
+		// Type 1 and shappimages have no ELF sections to check
+		return nil
+	}
+
+	s := e.Section(".digest_md5")
+	if s == nil {
+		e.Close()
+		return nil
+	}
+
+	b, err := s.Data()
+	e.Close()
+	if err != nil {
+		return err
+	}
+
+	recorded := parseDigest(b)
+	if recorded == nil {
+		return nil
+	}
+
+	r.DigestMD5 = hex.EncodeToString(recorded)
+
+	// The signature is added after the digest, so those sections don't count
+	// either. Older runtimes only left out the digest's own section
+	for _, zeroed := range [][]string{
+		{".digest_md5", ".sha256_sig", ".sig_key"},
+		{".digest_md5"},
+	} {
+		sum, err := digestZeroing(path, md5.New(), zeroed...)
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(sum, recorded) {
+			r.DigestOK = true
+			break
+		}
+	}
+
+	return nil
+}
+
+// The digest is stored as 16 bytes, or by some tools as hex. Returns nil if
+// the section was left empty
+func parseDigest(b []byte) []byte {
+	if len(b) >= 32 {
+		if d, err := hex.DecodeString(string(b[:32])); err == nil {
+			return d
+		}
+	}
+
+	if len(b) < md5.Size || bytes.Count(b[:md5.Size], []byte{0}) == md5.Size {
+		return nil
+	}
+
+	return b[:md5.Size]
+}
+
+// Hashes the file at `path` as if the given ELF sections were zeroed out
+func digestZeroing(path string, h hash.Hash, sections ...string) ([]byte, error) {
+	e, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var skip [][2]int64
+	for _, name := range sections {
+		if s := e.Section(name); s != nil {
+			skip = append(skip, [2]int64{int64(s.Offset), int64(s.Offset + s.Size)})
+		}
+	}
+	e.Close()
+
+	slices.SortFunc(skip, func(a, b [2]int64) int {
+		return int(a[0] - b[0])
+	})
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pos := int64(0)
+
+	for _, s := range skip {
+		if s[0] < pos {
+			continue
+		}
+
+		if _, err := io.Copy(h, io.NewSectionReader(f, pos, s[0]-pos)); err != nil {
+			return nil, err
+		}
+
+		h.Write(make([]byte, s[1]-s[0]))
+		pos = s[1]
+	}
+
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
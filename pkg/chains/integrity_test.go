@@ -0,0 +1,174 @@
+package chains
+
+import (
+	"bytes"
+	"crypto/md5"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Writes a type 2 AppImage whose runtime has a `.digest_md5` section,
+// followed by `image`. Returns where the section starts
+func writeDigestAppImage(t *testing.T, path string, image []byte) int64 {
+	names := "\x00.shstrtab\x00.digest_md5\x00"
+
+	namesOff := int64(binary.Size(elf.Header64{}))
+	digestOff := namesOff + int64(len(names))
+	shOff := digestOff + md5.Size
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     uint64(shOff),
+		Ehsize:    uint16(namesOff),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+		Shnum:     3,
+		Shstrndx:  1,
+	}
+	copy(hdr.Ident[:], "\x7fELF\x02\x01\x01\x00AI\x02")
+
+	sections := []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_STRTAB), Off: uint64(namesOff), Size: uint64(len(names))},
+		{Name: 11, Type: uint32(elf.SHT_PROGBITS), Off: uint64(digestOff), Size: md5.Size},
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, hdr)
+	b.WriteString(names)
+	b.Write(make([]byte, md5.Size))
+	binary.Write(&b, binary.LittleEndian, sections)
+	b.Write(image)
+
+	if err := os.WriteFile(path, b.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return digestOff
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	image := buildSquashfs(testSquashfsEntries()[:2])
+	signature := "-----BEGIN PGP SIGNATURE-----\n\nnot really one\n-----END PGP SIGNATURE-----\n"
+
+	for _, c := range []struct {
+		name      string
+		file      []byte // After the runtime
+		before    int64  // Bytes before the image
+		ok        bool
+		missing   int64
+		padding   int64
+		signature int64
+		trailing  int64
+	}{
+		{name: "complete", file: image, ok: true},
+		{name: "signature before the image", file: append([]byte(signature), image...), before: int64(len(signature)), ok: true},
+		{name: "padded", file: append(bytes.Clone(image), make([]byte, 4096)...), ok: true, padding: 4096},
+		{name: "truncated", file: image[:len(image)-100], missing: 100},
+		{name: "trailing garbage", file: append(bytes.Clone(image), "garbage"...), trailing: 7},
+		{
+			name:      "appended signature",
+			file:      append(append(bytes.Clone(image), make([]byte, 10)...), signature...),
+			ok:        true,
+			padding:   10,
+			signature: int64(len(signature)),
+		},
+		{
+			name:     "garbage after a signature",
+			file:     append(append(bytes.Clone(image), signature...), "garbage"...),
+			trailing: int64(len(signature) + 7),
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "app.AppImage")
+			offset := writeType2AppImage(t, path, c.file) + c.before
+
+			r, err := CheckIntegrity(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if r.Offset != offset || r.FSType != SquashFS || r.ImageEnd != offset+int64(len(image)) {
+				t.Errorf("found %s from %d to %d", r.FSType, r.Offset, r.ImageEnd)
+			}
+
+			if r.OK() != c.ok || r.Missing() != c.missing || r.Padding != c.padding || r.Signature != c.signature || r.Trailing != c.trailing {
+				t.Errorf("got report %+v, missing %d", r, r.Missing())
+			}
+		})
+	}
+}
+
+func TestCheckIntegrityDigest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+	digestOff := writeDigestAppImage(t, path, buildSquashfs(testSquashfsEntries()[:2]))
+
+	r, err := CheckIntegrity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Left empty, as when appimagetool isn't asked for one
+	if r.DigestMD5 != "" || !r.OK() {
+		t.Errorf("got report %+v", r)
+	}
+
+	sum, err := digestZeroing(path, md5.New(), ".digest_md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeDigest := func(digest []byte) {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		if _, err := f.WriteAt(digest, digestOff); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeDigest(sum)
+
+	if r, err := CheckIntegrity(path); err != nil || !r.DigestOK || r.DigestMD5 != hex.EncodeToString(sum) || !r.OK() {
+		t.Errorf("matching digest not accepted: %+v %v", r, err)
+	}
+
+	// Not what the file hashes to
+	bad := bytes.Clone(sum)
+	bad[0] ^= 0xff
+	writeDigest(bad)
+
+	if r, err := CheckIntegrity(path); err != nil || r.DigestOK || r.DigestMD5 != hex.EncodeToString(bad) || r.OK() {
+		t.Errorf("mismatched digest accepted: %+v %v", r, err)
+	}
+}
+
+func TestCheckIntegritySigned(t *testing.T) {
+	key, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+	signAppImage(t, path, key)
+
+	// The signature lives in the runtime's sections, not after the image
+	r, err := CheckIntegrity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !r.OK() || r.Trailing != 0 || r.Signature != 0 || r.FSType != SquashFS {
+		t.Errorf("signed AppImage reported as %+v", r)
+	}
+}
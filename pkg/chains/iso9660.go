@@ -0,0 +1,717 @@
+package chains
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type 1 AppImages are ISO 9660 images with Rock Ridge extensions, which give
+// them POSIX names, permissions and symlinks. Only reading is supported, and
+// only what AppImages use (no Joliet, multi-extent files or sparse files)
+
+const isoSectorSize = 2048
+
+var (
+	InvalidISO = errors.New("not a valid ISO 9660 image")
+	NoFuseiso  = errors.New("fuseiso is required to mount type 1 AppImages")
+)
+
+// isoImage is a read only fs.FS over an ISO 9660 image
+type isoImage struct {
+	r    io.ReaderAt
+	f    *os.File
+	root *isoEntry
+
+	// Bytes to skip at the start of each directory record's system use area,
+	// set by the root's SUSP `SP` entry. -1 when the image has no SUSP
+	suspSkip int
+
+	mu sync.Mutex
+}
+
+type isoEntry struct {
+	name    string
+	mode    fs.FileMode
+	size    int64
+	extent  int64 // Offset of the data in the image
+	modTime time.Time
+	target  string // Symlink target
+
+	children []*isoEntry
+	listed   bool
+}
+
+// Opens the ISO 9660 image at `src`
+func openISO(src string) (*isoImage, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := newISO(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	img.f = f
+
+	return img, nil
+}
+
+// Returns where the ISO 9660 image in `f` ends, according to its primary
+// volume descriptor
+func isoEnd(f *os.File) (int64, error) {
+	for sector := int64(16); ; sector++ {
+		vd := make([]byte, isoSectorSize)
+		if _, err := f.ReadAt(vd, sector*isoSectorSize); err != nil {
+			return 0, errors.Join(InvalidISO, err)
+		}
+
+		if string(vd[1:6]) != "CD001" || vd[0] == 255 {
+			return 0, InvalidISO
+		}
+
+		if vd[0] == 1 {
+			blocks := binary.LittleEndian.Uint32(vd[80:])
+			blockSize := binary.LittleEndian.Uint16(vd[128:])
+
+			return int64(blocks) * int64(blockSize), nil
+		}
+	}
+}
+
+func newISO(r io.ReaderAt) (*isoImage, error) {
+	img := &isoImage{r: r, suspSkip: -1}
+
+	// Volume descriptors start at sector 16, look for the primary one
+	for sector := int64(16); ; sector++ {
+		vd := make([]byte, isoSectorSize)
+		if _, err := r.ReadAt(vd, sector*isoSectorSize); err != nil {
+			return nil, errors.Join(InvalidISO, err)
+		}
+
+		if string(vd[1:6]) != "CD001" || vd[0] == 255 {
+			return nil, InvalidISO
+		}
+
+		if vd[0] != 1 {
+			continue
+		}
+
+		root, _, err := img.parseRecord(vd[156:190])
+		if err != nil {
+			return nil, err
+		}
+
+		root.name = "."
+		img.root = root
+		break
+	}
+
+	// SUSP is announced by an `SP` entry in the root's `.` record
+	dot := make([]byte, 255)
+	if _, err := r.ReadAt(dot, img.root.extent); err != nil {
+		return nil, errors.Join(InvalidISO, err)
+	}
+
+	if su := systemUse(dot); len(su) >= 7 && string(su[0:2]) == "SP" && su[4] == 0xbe && su[5] == 0xef {
+		img.suspSkip = int(su[6])
+	}
+
+	return img, nil
+}
+
+// Returns the system use area of a directory record
+func systemUse(rec []byte) []byte {
+	if len(rec) < 34 || int(rec[0]) > len(rec) {
+		return nil
+	}
+
+	end := 33 + int(rec[32])
+	if end%2 != 0 {
+		end++
+	}
+
+	if end > int(rec[0]) {
+		return nil
+	}
+
+	return rec[end:rec[0]]
+}
+
+// Parses a directory record. Returns whether it should be skipped, which is
+// the case for `.`, `..` and Rock Ridge relocated directories
+func (img *isoImage) parseRecord(rec []byte) (*isoEntry, bool, error) {
+	if len(rec) < 34 || 33+int(rec[32]) > len(rec) {
+		return nil, false, InvalidISO
+	}
+
+	e := &isoEntry{
+		extent: int64(binary.LittleEndian.Uint32(rec[2:6])) * isoSectorSize,
+		size:   int64(binary.LittleEndian.Uint32(rec[10:14])),
+	}
+
+	d := rec[18:25]
+	e.modTime = time.Date(1900+int(d[0]), time.Month(d[1]), int(d[2]), int(d[3]), int(d[4]), int(d[5]), 0,
+		time.FixedZone("", int(int8(d[6]))*15*60))
+
+	if rec[25]&2 != 0 {
+		e.mode = fs.ModeDir | 0755
+	} else {
+		e.mode = 0644
+	}
+
+	id := string(rec[33 : 33+int(rec[32])])
+	if id == "\x00" || id == "\x01" {
+		return e, true, nil
+	}
+
+	// Plain ISO 9660 names, used when there's no Rock Ridge `NM`
+	e.name, _, _ = strings.Cut(id, ";")
+	if e.mode.IsRegular() {
+		e.name = strings.TrimSuffix(e.name, ".")
+	}
+
+	var skip bool
+
+	if su := systemUse(rec); img.suspSkip >= 0 && img.suspSkip <= len(su) {
+		var err error
+		if skip, err = img.parseSUSP(e, su[img.suspSkip:]); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// Names end up in paths on the host when extracting
+	if !skip && (e.name == "" || e.name == "." || e.name == ".." || strings.ContainsAny(e.name, "/\x00")) {
+		return nil, false, errors.Join(InvalidISO, errors.New("invalid name `"+e.name+"`"))
+	}
+
+	return e, skip, nil
+}
+
+// Applies the Rock Ridge entries of a record's system use area to `e`
+func (img *isoImage) parseSUSP(e *isoEntry, su []byte) (bool, error) {
+	var name []byte
+	var link []string
+	var linkDone = true
+	var skip bool
+
+	// Continuation areas may chain, don't follow them forever
+	for hops := 0; len(su) > 0 && hops < 32; hops++ {
+		var next []byte
+
+		for len(su) >= 4 {
+			sig, length := string(su[0:2]), int(su[2])
+			if length < 4 || length > len(su) {
+				break
+			}
+
+			data := su[4:length]
+			su = su[length:]
+
+			switch sig {
+			case "PX":
+				if len(data) < 4 {
+					break
+				}
+
+				m := binary.LittleEndian.Uint32(data[0:4])
+				e.mode = fs.FileMode(m & 0777)
+
+				switch m & 0170000 {
+				case 0040000:
+					e.mode |= fs.ModeDir
+				case 0120000:
+					e.mode |= fs.ModeSymlink
+				}
+
+				if m&04000 != 0 {
+					e.mode |= fs.ModeSetuid
+				}
+
+				if m&02000 != 0 {
+					e.mode |= fs.ModeSetgid
+				}
+			case "NM":
+				// Flags 2 and 4 are `.` and `..`, which are already skipped
+				if len(data) >= 1 && data[0]&6 == 0 {
+					name = append(name, data[1:]...)
+				}
+			case "SL":
+				if len(data) < 1 {
+					break
+				}
+
+				linkDone = parseSL(&link, data[1:], linkDone)
+			case "CL":
+				// A directory relocated to keep the tree shallow enough for
+				// plain ISO 9660, the real one lives at the given sector
+				if len(data) < 4 {
+					break
+				}
+
+				loc := int64(binary.LittleEndian.Uint32(data[0:4])) * isoSectorSize
+				if err := img.relocate(e, loc); err != nil {
+					return false, err
+				}
+			case "RE":
+				// The relocated directory itself, reached through its `CL`
+				skip = true
+			case "CE":
+				if len(data) < 24 {
+					break
+				}
+
+				loc := int64(binary.LittleEndian.Uint32(data[0:4]))*isoSectorSize +
+					int64(binary.LittleEndian.Uint32(data[8:12]))
+				next = make([]byte, binary.LittleEndian.Uint32(data[16:20]))
+
+				if _, err := img.r.ReadAt(next, loc); err != nil {
+					return false, errors.Join(InvalidISO, err)
+				}
+			case "ST":
+				su = nil
+			}
+		}
+
+		su = next
+	}
+
+	if len(name) > 0 {
+		e.name = string(name)
+	}
+
+	if e.mode&fs.ModeSymlink != 0 {
+		// The root is an empty component, so absolute links start with `/`
+		e.target = strings.Join(link, "/")
+		if e.target == "" && len(link) > 0 {
+			e.target = "/"
+		}
+
+		e.size = int64(len(e.target))
+	}
+
+	return skip, nil
+}
+
+// Parses the component records of an `SL` entry into `link`. Returns whether
+// the last component is complete
+func parseSL(link *[]string, data []byte, prevDone bool) bool {
+	done := prevDone
+
+	for len(data) >= 2 {
+		flags, length := data[0], int(data[1])
+		if 2+length > len(data) {
+			break
+		}
+
+		var c string
+
+		switch {
+		case flags&2 != 0:
+			c = "."
+		case flags&4 != 0:
+			c = ".."
+		case flags&8 != 0:
+			c = ""
+		default:
+			c = string(data[2 : 2+length])
+		}
+
+		if !done && len(*link) > 0 {
+			(*link)[len(*link)-1] += c
+		} else {
+			*link = append(*link, c)
+		}
+
+		done = flags&1 == 0
+		data = data[2+length:]
+	}
+
+	return done
+}
+
+// Points `e` at the relocated directory whose `.` record is at `loc`
+func (img *isoImage) relocate(e *isoEntry, loc int64) error {
+	dot := make([]byte, 255)
+	if _, err := img.r.ReadAt(dot, loc); err != nil {
+		return errors.Join(InvalidISO, err)
+	}
+
+	if int(dot[0]) < 34 {
+		return InvalidISO
+	}
+
+	e.extent = loc
+	e.size = int64(binary.LittleEndian.Uint32(dot[10:14]))
+	e.mode = fs.ModeDir | e.mode.Perm()
+
+	return nil
+}
+
+// Reads a directory's entries, sorted by name
+func (img *isoImage) list(dir *isoEntry) ([]*isoEntry, error) {
+	img.mu.Lock()
+	defer img.mu.Unlock()
+
+	if dir.listed {
+		return dir.children, nil
+	}
+
+	data := make([]byte, dir.size)
+	if _, err := img.r.ReadAt(data, dir.extent); err != nil && err != io.EOF {
+		return nil, errors.Join(InvalidISO, err)
+	}
+
+	var children []*isoEntry
+
+	for off := 0; off < len(data); {
+		length := int(data[off])
+
+		// Records never cross sectors, the rest of this one is padding
+		if length == 0 {
+			off = (off/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+
+		if off+length > len(data) {
+			return nil, InvalidISO
+		}
+
+		e, skip, err := img.parseRecord(data[off : off+length])
+		if err != nil {
+			return nil, err
+		}
+
+		if !skip {
+			children = append(children, e)
+		}
+
+		off += length
+	}
+
+	slices.SortFunc(children, func(a, b *isoEntry) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	for i := 1; i < len(children); i++ {
+		if children[i].name == children[i-1].name {
+			return nil, errors.Join(InvalidISO, errors.New("duplicate name `"+children[i].name+"`"))
+		}
+	}
+
+	dir.children, dir.listed = children, true
+
+	return children, nil
+}
+
+// Finds the entry at `name`. Symlinks in the middle of the path are always
+// followed, the last component only if `follow` is set. Symlinks can't point
+// outside of the image
+func (img *isoImage) lookup(name string, follow bool) (*isoEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+
+	e := img.root
+	var dir []string
+	parts := strings.Split(name, "/")
+
+	for hops := 0; len(parts) > 0; {
+		part := parts[0]
+		parts = parts[1:]
+
+		if part == "." || part == "" {
+			continue
+		}
+
+		if part == ".." {
+			if len(dir) > 0 {
+				dir = dir[:len(dir)-1]
+			}
+
+			e = img.root
+			parts = append(append([]string{}, dir...), parts...)
+			dir = nil
+
+			continue
+		}
+
+		if !e.mode.IsDir() {
+			return nil, fs.ErrNotExist
+		}
+
+		children, err := img.list(e)
+		if err != nil {
+			return nil, err
+		}
+
+		i, found := slices.BinarySearchFunc(children, part, func(c *isoEntry, name string) int {
+			return strings.Compare(c.name, name)
+		})
+		if !found {
+			return nil, fs.ErrNotExist
+		}
+
+		child := children[i]
+
+		if child.mode&fs.ModeSymlink != 0 && (len(parts) > 0 || follow) {
+			if hops++; hops > 40 {
+				return nil, errors.New("too many levels of symbolic links")
+			}
+
+			target := child.target
+			if path.IsAbs(target) {
+				return nil, fs.ErrNotExist
+			}
+
+			// Resolve again from the root, relative to the link's directory
+			parts = append(strings.Split(path.Join(append(dir, target)...), "/"), parts...)
+			e, dir = img.root, nil
+
+			if strings.HasPrefix(parts[0], "..") {
+				return nil, fs.ErrNotExist
+			}
+
+			continue
+		}
+
+		e = child
+		dir = append(dir, part)
+	}
+
+	return e, nil
+}
+
+func (img *isoImage) Open(name string) (fs.File, error) {
+	e, err := img.lookup(name, true)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	f := &isoFile{img: img, e: e}
+	if !e.mode.IsDir() {
+		f.r = io.NewSectionReader(img.r, e.extent, e.size)
+	}
+
+	return f, nil
+}
+
+func (img *isoImage) ReadFile(name string) ([]byte, error) {
+	f, err := img.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// Returns information about the entry at `name`, without following it if it's
+// a symlink
+func (img *isoImage) lstat(name string) (fs.FileInfo, error) {
+	e, err := img.lookup(name, false)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+
+	return isoInfo{e}, nil
+}
+
+func (img *isoImage) readlink(name string) (string, error) {
+	e, err := img.lookup(name, false)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+
+	if e.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+
+	return e.target, nil
+}
+
+func (img *isoImage) Close() error {
+	if img.f != nil {
+		return img.f.Close()
+	}
+
+	return nil
+}
+
+// Copies the whole image into `dest`, keeping permissions and symlinks. The
+// tree is walked entry by entry rather than by path, so symlinks in the image
+// are never followed, and nothing is created over what already exists, so
+// neither are symlinks on the host
+func (img *isoImage) extractTo(dest string) error {
+	dirs := []string{dest}
+	modes := []fs.FileMode{img.root.mode.Perm()}
+
+	// Relocated directories could point back up the tree
+	visited := make(map[int64]bool)
+
+	var extract func(dir *isoEntry, target string) error
+	extract = func(dir *isoEntry, target string) error {
+		if visited[dir.extent] {
+			return errors.Join(InvalidISO, errors.New("directory loop at `"+target+"`"))
+		}
+		visited[dir.extent] = true
+
+		children, err := img.list(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range children {
+			name := filepath.Join(target, e.name)
+
+			switch {
+			case e.mode&fs.ModeSymlink != 0:
+				err = os.Symlink(e.target, name)
+			case e.mode.IsDir():
+				if err = os.Mkdir(name, 0755); err != nil {
+					break
+				}
+
+				// Set once its contents are in place, they may not be
+				// writable otherwise
+				dirs = append(dirs, name)
+				modes = append(modes, e.mode.Perm())
+
+				err = extract(e, name)
+			default:
+				err = img.extractFile(e, name)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if err := extract(img.root, dest); err != nil {
+		return err
+	}
+
+	// Deepest first, so parents are still writable when their children are
+	// changed
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i], modes[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Extracts a regular file. Setuid and setgid bits are dropped, the file would
+// belong to the user rather than whoever the image says
+func (img *isoImage) extractFile(e *isoEntry, target string) error {
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, e.mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, io.NewSectionReader(img.r, e.extent, e.size)); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// Mounts an ISO 9660 image using fuseiso
+func mountISO(src string, dest string) error {
+	fuseiso, present := CommandExists("fuseiso")
+	if !present {
+		return &MountError{Path: src, Dest: dest, Err: NoFuseiso}
+	}
+
+	out, err := exec.Command(fuseiso, src, dest).CombinedOutput()
+	if err != nil {
+		return &MountError{Path: src, Dest: dest, Err: errors.Join(err, errors.New(strings.TrimSpace(string(out))))}
+	}
+
+	return nil
+}
+
+// isoFile is an open file or directory
+type isoFile struct {
+	img *isoImage
+	e   *isoEntry
+	r   *io.SectionReader
+	off int
+}
+
+func (f *isoFile) Stat() (fs.FileInfo, error) {
+	return isoInfo{f.e}, nil
+}
+
+func (f *isoFile) Read(b []byte) (int, error) {
+	if f.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.e.name, Err: fs.ErrInvalid}
+	}
+
+	return f.r.Read(b)
+}
+
+func (f *isoFile) ReadAt(b []byte, off int64) (int, error) {
+	if f.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.e.name, Err: fs.ErrInvalid}
+	}
+
+	return f.r.ReadAt(b, off)
+}
+
+func (f *isoFile) Close() error {
+	return nil
+}
+
+func (f *isoFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	children, err := f.img.list(f.e)
+	if err != nil {
+		return nil, err
+	}
+
+	children = children[min(f.off, len(children)):]
+	if n > 0 && len(children) > n {
+		children = children[:n]
+	}
+
+	if n > 0 && len(children) == 0 {
+		return nil, io.EOF
+	}
+
+	entries := make([]fs.DirEntry, len(children))
+	for i, c := range children {
+		entries[i] = fs.FileInfoToDirEntry(isoInfo{c})
+	}
+
+	f.off += len(children)
+
+	return entries, nil
+}
+
+type isoInfo struct {
+	e *isoEntry
+}
+
+func (i isoInfo) Name() string       { return i.e.name }
+func (i isoInfo) Size() int64        { return i.e.size }
+func (i isoInfo) Mode() fs.FileMode  { return i.e.mode }
+func (i isoInfo) ModTime() time.Time { return i.e.modTime }
+func (i isoInfo) IsDir() bool        { return i.e.mode.IsDir() }
+func (i isoInfo) Sys() any           { return nil }
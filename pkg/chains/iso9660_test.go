@@ -0,0 +1,277 @@
+package chains
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// An entry of an image built by buildISO
+type testISOEntry struct {
+	name     string
+	data     string // Contents of a file
+	link     string // Target of a symlink
+	dir      bool
+	mode     uint32 // Permissions, 0644 for files and 0755 for dirs if 0
+	children []testISOEntry
+}
+
+// A directory record, padded as ISO 9660 wants before its system use area
+func isoRecord(id string, extent int, size int, dir bool, su []byte) []byte {
+	n := 33 + len(id)
+	if n%2 != 0 {
+		n++
+	}
+
+	rec := make([]byte, n+len(su))
+	rec[0] = byte(len(rec))
+	binary.LittleEndian.PutUint32(rec[2:], uint32(extent))
+	binary.LittleEndian.PutUint32(rec[10:], uint32(size))
+	if dir {
+		rec[25] = 2
+	}
+	rec[32] = byte(len(id))
+	copy(rec[33:], id)
+	copy(rec[n:], su)
+
+	return rec
+}
+
+func suspEntry(sig string, data ...byte) []byte {
+	return append([]byte{sig[0], sig[1], byte(4 + len(data)), 1}, data...)
+}
+
+func pxEntry(mode uint32) []byte {
+	return suspEntry("PX", binary.LittleEndian.AppendUint32(nil, mode)...)
+}
+
+// Builds a Rock Ridge image holding `root`. Every directory fits in a sector
+func buildISO(entries []testISOEntry) []byte {
+	img := make([]byte, 18*isoSectorSize)
+
+	alloc := func(data []byte) int {
+		sector := len(img) / isoSectorSize
+		img = append(img, data...)
+		img = append(img, make([]byte, (isoSectorSize-len(data)%isoSectorSize)%isoSectorSize)...)
+
+		return sector
+	}
+
+	var writeDir func(entries []testISOEntry, self int, parent int)
+	writeDir = func(entries []testISOEntry, self int, parent int) {
+		var su []byte
+		if self == parent {
+			su = suspEntry("SP", 0xbe, 0xef, 0)
+		}
+
+		records := isoRecord("\x00", self, isoSectorSize, true, su)
+		records = append(records, isoRecord("\x01", parent, isoSectorSize, true, nil)...)
+
+		for i, e := range entries {
+			id := "E" + string(rune('A'+i)) + ";1"
+			su := suspEntry("NM", append([]byte{0}, e.name...)...)
+
+			switch {
+			case e.dir:
+				sector := alloc(make([]byte, isoSectorSize))
+				writeDir(e.children, sector, self)
+				su = append(su, pxEntry(0040000|cmp.Or(e.mode, 0755))...)
+				records = append(records, isoRecord(id, sector, isoSectorSize, true, su)...)
+			case e.link != "":
+				sl := []byte{0}
+				for _, c := range strings.Split(e.link, "/") {
+					if c == "" {
+						sl = append(sl, 8, 0)
+					} else {
+						sl = append(append(sl, 0, byte(len(c))), c...)
+					}
+				}
+
+				su = append(su, pxEntry(0120777)...)
+				su = append(su, suspEntry("SL", sl...)...)
+				records = append(records, isoRecord(id, 0, 0, false, su)...)
+			default:
+				sector := alloc([]byte(e.data))
+				su = append(su, pxEntry(0100000|cmp.Or(e.mode, 0644))...)
+				records = append(records, isoRecord(id, sector, len(e.data), false, su)...)
+			}
+		}
+
+		copy(img[self*isoSectorSize:(self+1)*isoSectorSize], records)
+	}
+
+	root := alloc(make([]byte, isoSectorSize))
+
+	pvd := img[16*isoSectorSize:]
+	pvd[0] = 1
+	copy(pvd[1:6], "CD001")
+	copy(pvd[156:190], isoRecord("\x00", root, isoSectorSize, true, nil))
+
+	terminator := img[17*isoSectorSize:]
+	terminator[0] = 255
+	copy(terminator[1:6], "CD001")
+
+	writeDir(entries, root, root)
+
+	binary.LittleEndian.PutUint32(pvd[80:], uint32(len(img)/isoSectorSize))
+	binary.BigEndian.PutUint32(pvd[84:], uint32(len(img)/isoSectorSize))
+	binary.LittleEndian.PutUint16(pvd[128:], isoSectorSize)
+	binary.BigEndian.PutUint16(pvd[130:], isoSectorSize)
+
+	return img
+}
+
+// Writes a type 1 AppImage holding `entries` to `path`. Its runtime is only
+// as much of an ELF header as it takes to be told apart
+func writeISOAppImage(t *testing.T, path string, entries []testISOEntry) {
+	img := buildISO(entries)
+	copy(img, "\x7fELF\x02\x01\x01\x00AI\x01")
+
+	if err := os.WriteFile(path, img, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestISORead(t *testing.T) {
+	img, err := newISO(bytes.NewReader(buildISO([]testISOEntry{
+		{name: "file", data: "hello"},
+		{name: "dir", dir: true, children: []testISOEntry{
+			{name: "nested", data: "nested file"},
+		}},
+		{name: "link", link: "dir/nested"},
+		{name: "escape", link: "/etc/passwd"},
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"file":       "hello",
+		"dir/nested": "nested file",
+		"link":       "nested file",
+	} {
+		if b, err := img.ReadFile(name); err != nil || string(b) != want {
+			t.Errorf("%s: read %q, %v", name, b, err)
+		}
+	}
+
+	if _, err := img.ReadFile("escape"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("absolute symlink was followed: %v", err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "extracted")
+	if err := os.Mkdir(dest, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := img.extractTo(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := os.ReadFile(filepath.Join(dest, "dir", "nested")); err != nil || string(b) != "nested file" {
+		t.Errorf("extracted dir/nested: %q, %v", b, err)
+	}
+
+	if target, err := os.Readlink(filepath.Join(dest, "escape")); err != nil || target != "/etc/passwd" {
+		t.Errorf("extracted escape: %q, %v", target, err)
+	}
+}
+
+func TestISOInvalidNames(t *testing.T) {
+	for _, entries := range [][]testISOEntry{
+		{{name: "a/b", data: "slash"}},
+		{{name: "..", data: "parent"}},
+		{{name: ".", data: "self"}},
+		{{name: "a", data: "first"}, {name: "a", data: "second"}},
+		// Extracting the link first would have the directory land outside
+		{{name: "a", link: "/tmp"}, {name: "a", dir: true, children: []testISOEntry{{name: "f", data: "escaped"}}}},
+	} {
+		img, err := newISO(bytes.NewReader(buildISO(entries)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fs.ReadDir(img, "."); !errors.Is(err, InvalidISO) {
+			t.Errorf("%+v: listed, %v", entries, err)
+		}
+
+		if err := img.extractTo(t.TempDir()); !errors.Is(err, InvalidISO) {
+			t.Errorf("%+v: extracted, %v", entries, err)
+		}
+	}
+}
+
+func TestISOTruncatedRecord(t *testing.T) {
+	rec := isoRecord("NAME;1", 0, 0, false, nil)
+	rec[32] = 200
+
+	img := &isoImage{suspSkip: -1}
+	if _, _, err := img.parseRecord(rec); !errors.Is(err, InvalidISO) {
+		t.Errorf("parsed record with an identifier past its end: %v", err)
+	}
+}
+
+func TestISOExtractDoesntFollowSymlinks(t *testing.T) {
+	img, err := newISO(bytes.NewReader(buildISO([]testISOEntry{
+		{name: "dir", dir: true, children: []testISOEntry{{name: "f", data: "escaped"}}},
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outside := t.TempDir()
+	dest := t.TempDir()
+
+	if err := os.Symlink(outside, filepath.Join(dest, "dir")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := img.extractTo(dest); err == nil {
+		t.Error("extracted over a symlink")
+	}
+
+	if FileExists(filepath.Join(outside, "f")) {
+		t.Error("file written through a symlink")
+	}
+}
+
+func TestISOExtractDropsSetuid(t *testing.T) {
+	img, err := newISO(bytes.NewReader(buildISO([]testISOEntry{
+		{name: "suid", data: "#!/bin/sh", mode: 04755},
+		{name: "sgid", data: "#!/bin/sh", mode: 02755},
+		{name: "dir", dir: true, mode: 02775},
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := fs.Stat(img, "suid"); err != nil || info.Mode()&fs.ModeSetuid == 0 {
+		t.Fatalf("setuid bit wasn't read: %v", err)
+	}
+
+	dest := t.TempDir()
+	if err := img.extractTo(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]fs.FileMode{
+		"suid": 0755,
+		"sgid": 0755,
+		"dir":  fs.ModeDir | 0775,
+	} {
+		info, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode() != want {
+			t.Errorf("%s extracted with mode %v, want %v", name, info.Mode(), want)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package chains
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Under bwrap and OCI runtimes, chains binds itself into the sandbox here and
+// runs the app through it so the Landlock ruleset can be applied from inside.
+// See NativeInit
+const landlockHelperPath = "/.chains-landlock"
+
+// Where the helper finds the sandbox's seccomp filter, which it loads itself
+// once the ruleset is applied
+const landlockSeccompPath = "/.chains-seccomp"
+
+// LandlockHelper lets bwrap and OCI sandboxes apply the Landlock ruleset, by
+// binding the running program into them as the helper. It's off unless the
+// program opts in, as it must call NativeInit for the helper to run. The
+// native backend applies the ruleset itself either way
+var LandlockHelper bool
+
+// Landlock is a second layer of filesystem confinement on top of the mount
+// namespace. Even if something goes wrong setting up the mounts, or the app
+// inherits a file descriptor from the host, only the paths listed in `Rules`
+// can be accessed. Paths are as seen from inside of the sandbox
+type Landlock struct {
+	Rules []LandlockRule `json:"rules"`
+}
+
+type LandlockRule struct {
+	Path     string `json:"path"`
+	Writable bool   `json:"writable,omitempty"`
+	Devices  bool   `json:"devices,omitempty"` // Files can be written to, but not created or removed
+}
+
+// Builds the ruleset from the spec's mounts and devices, so that Landlock
+// allows exactly what has been mounted into the sandbox. Only writable binds,
+// tmpfs mounts, created dirs the sandbox may write to and `/dev/shm`, which
+// hold nothing but the sandbox's own files, can be written to. Landlock can't
+// take access away from beneath a rule, so read-only binds inside of writable
+// ones are only kept read-only by their mount
+func (s *SandboxSpec) landlockRules() *Landlock {
+	l := &Landlock{}
+
+	for _, m := range s.Mounts {
+		r := LandlockRule{Path: m.Dest}
+
+		switch m.Type {
+		case BindMount, TmpfsMount:
+			r.Writable = true
+		case DirMount:
+			r.Writable = m.Mode == 0 || m.Mode&0200 != 0
+		case DevMount:
+			r.Devices = true
+
+			// Shared memory, see shm_open(3)
+			l.Rules = append(l.Rules, LandlockRule{Path: path.Join(m.Dest, "shm"), Writable: true})
+		}
+
+		l.Rules = append(l.Rules, r)
+	}
+
+	for _, d := range s.Devices {
+		l.Rules = append(l.Rules, LandlockRule{Path: d.Dest, Devices: true})
+	}
+
+	return l
+}
+
+// What the helper is given as its first argument
+type landlockHelperArgs struct {
+	*Landlock
+	Seccomp string `json:"seccomp,omitempty"` // Filter to load after the ruleset
+}
+
+// Returns the program to bind into sandboxes as the Landlock helper, empty if
+// LandlockHelper isn't set or the running program can't be found
+func landlockHelperBinary() string {
+	if !LandlockHelper {
+		return ""
+	}
+
+	self, err := os.Executable()
+	if err != nil || !FileExists(self) {
+		return ""
+	}
+
+	return self
+}
+
+// Returns a copy of the spec that runs the app through `helper`, which
+// applies the Landlock ruleset then loads the seccomp filter. bwrap and OCI
+// runtimes would load the filter before the helper runs, where it may not
+// allow the Landlock syscalls. If the spec doesn't use Landlock or there's no
+// helper, the spec is returned untouched
+func (s *SandboxSpec) withLandlockHelper(helper string) *SandboxSpec {
+	if s.Landlock == nil || helper == "" {
+		return s
+	}
+
+	wrapped := *s
+	wrapped.Landlock = nil
+	wrapped.Seccomp = nil
+	wrapped.Mounts = append(append([]Mount{}, s.Mounts...), Mount{
+		Type:   ROBindMount,
+		Source: helper,
+		Dest:   landlockHelperPath,
+	})
+
+	args := landlockHelperArgs{Landlock: s.Landlock}
+	if s.Seccomp != nil {
+		wrapped.Mounts = append(wrapped.Mounts, Mount{
+			Type:   ROBindMount,
+			Source: s.Seccomp.Filter,
+			Dest:   landlockSeccompPath,
+		})
+		args.Seccomp = landlockSeccompPath
+	}
+
+	b, err := json.Marshal(args)
+	if err != nil {
+		return s
+	}
+
+	wrapped.Exec = Exec{
+		Path: landlockHelperPath,
+		Args: append([]string{string(b), s.Exec.Path}, s.Exec.Args...),
+	}
+
+	return &wrapped
+}
+
+// Says whether the AppImage's sandbox can apply a Landlock ruleset
+func (ai *AppImage) landlockSupported() bool {
+	return ai.Backend() == Native || landlockHelperBinary() != ""
+}
+
+// Runs as `/.chains-landlock <args> <program> [args...]` inside of the
+// sandbox, restricts itself then executes the program
+func landlockHelper() error {
+	if len(os.Args) < 3 {
+		return errors.New("usage: " + landlockHelperPath + " <args> <program> [args...]")
+	}
+
+	args := &landlockHelperArgs{Landlock: &Landlock{}}
+	if err := json.Unmarshal([]byte(os.Args[1]), args); err != nil {
+		return err
+	}
+
+	// The ruleset doesn't cover the filter
+	var filter []unix.SockFilter
+	if args.Seccomp != "" {
+		var err error
+		if filter, err = readSeccomp(args.Seccomp); err != nil {
+			return err
+		}
+	}
+
+	// Landlock only applies to the calling thread, so the exec must happen
+	// from the same one
+	runtime.LockOSThread()
+
+	// Normally already set by bwrap, but Landlock refuses to work without it
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return err
+	}
+
+	if err := applyLandlock(args.Landlock); err != nil {
+		return err
+	}
+
+	if filter != nil {
+		if err := loadSeccomp(filter); err != nil {
+			return err
+		}
+	}
+
+	return syscall.Exec(os.Args[2], os.Args[2:], os.Environ())
+}
+
+// Returns the Landlock ABI version supported by the kernel, 0 if Landlock
+// isn't available at all
+func landlockABI() int {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0
+	}
+
+	return int(abi)
+}
+
+// Access rights that only make sense on directories
+const landlockDirAccess = unix.LANDLOCK_ACCESS_FS_READ_DIR |
+	unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+	unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+	unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+	unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+	unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+	unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+	unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+	unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+	unix.LANDLOCK_ACCESS_FS_MAKE_SYM |
+	unix.LANDLOCK_ACCESS_FS_REFER
+
+const landlockReadAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE |
+	unix.LANDLOCK_ACCESS_FS_READ_FILE |
+	unix.LANDLOCK_ACCESS_FS_READ_DIR
+
+// Everything but creating device nodes
+const landlockWriteAccess = landlockReadAccess |
+	unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+	unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+	unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+	unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+	unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+	unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+	unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+	unix.LANDLOCK_ACCESS_FS_MAKE_SYM |
+	unix.LANDLOCK_ACCESS_FS_REFER |
+	unix.LANDLOCK_ACCESS_FS_TRUNCATE |
+	unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+
+// Using device files, without creating or removing any
+const landlockDeviceAccess = landlockReadAccess |
+	unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+	unix.LANDLOCK_ACCESS_FS_TRUNCATE |
+	unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+
+// Returns the filesystem access rights the given ABI version knows about
+func landlockHandledAccess(abi int) uint64 {
+	// ABI 1 covers everything up to creating symlinks
+	access := uint64(unix.LANDLOCK_ACCESS_FS_MAKE_SYM<<1 - 1)
+
+	if abi >= 2 {
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+
+	if abi >= 3 {
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+
+	if abi >= 5 {
+		access |= unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+
+	return access
+}
+
+// Restricts the calling thread (and anything it executes) to the ruleset.
+// On kernels without Landlock this does nothing, older ABI versions restrict
+// whatever they're able to. no_new_privs must already be set
+func applyLandlock(l *Landlock) error {
+	abi := landlockABI()
+	if abi < 1 {
+		return nil
+	}
+
+	handled := landlockHandledAccess(abi)
+
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create landlock ruleset: %w", errno)
+	}
+	defer unix.Close(int(fd))
+
+	// There's no rule for `/`, as access to a directory extends to everything
+	// beneath it. Paths can still be looked up through it
+	for _, r := range l.Rules {
+		if err := landlockAddRule(int(fd), r, handled); err != nil {
+			return err
+		}
+	}
+
+	_, _, errno = unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to apply landlock ruleset: %w", errno)
+	}
+
+	return nil
+}
+
+func landlockAddRule(ruleset int, r LandlockRule, handled uint64) error {
+	fd, err := unix.Open(r.Path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if errors.Is(err, unix.ENOENT) {
+		// Optional mounts that weren't there
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("landlock: can't open `%s`: %w", r.Path, err)
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+
+	access := uint64(landlockReadAccess)
+	if r.Writable {
+		access = landlockWriteAccess
+	} else if r.Devices {
+		access = landlockDeviceAccess
+	}
+
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &^= landlockDirAccess
+	}
+
+	attr := unix.LandlockPathBeneathAttr{
+		Allowed_access: access & handled,
+		Parent_fd:      int32(fd),
+	}
+
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: failed to add rule for `%s`: %w", r.Path, errno)
+	}
+
+	return nil
+}
+
+// Enable or disable Landlock restrictions for the AppImage's sandbox. They're
+// on by default, but have no effect on kernels without Landlock support, nor
+// under bwrap unless LandlockHelper is set
+func (ai *AppImage) SetLandlock(enabled bool) {
+	ai.noLandlock = !enabled
+}
@@ -0,0 +1,135 @@
+package chains
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/adrg/xdg"
+	"golang.org/x/sys/unix"
+)
+
+func TestLandlockRules(t *testing.T) {
+	ai := fakeAppImage(t)
+
+	spec, err := ai.Spec(&AppImagePerms{Level: 2, DataDir: true, Devices: []string{"dri"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules := make(map[string]LandlockRule)
+	for _, r := range spec.Landlock.Rules {
+		rules[r.Path] = r
+	}
+
+	if _, present := rules["/"]; present {
+		t.Error("`/` has a rule, which would cover the whole sandbox")
+	}
+
+	for _, c := range []struct {
+		path     string
+		writable bool
+		devices  bool
+	}{
+		{"/tmp", true, false},   // Bind of the temp dir
+		{xdg.Home, true, false}, // Bind of the data dir
+		{"/app", true, false},   // Created dir
+		{xdg.RuntimeDir, true, false},
+		{"/proc", false, false},
+		{"/usr/share/fonts", false, false},
+		{"/dev", false, true},
+		{"/dev/shm", true, false},
+		{"/dev/dri", false, true},
+	} {
+		r, present := rules[c.path]
+		if !present {
+			t.Errorf("no rule for %s", c.path)
+			continue
+		}
+
+		if r.Writable != c.writable || r.Devices != c.devices {
+			t.Errorf("%s: writable %t, devices %t, want %t, %t", c.path, r.Writable, r.Devices, c.writable, c.devices)
+		}
+	}
+}
+
+func TestLandlockHelperOptIn(t *testing.T) {
+	helper := LandlockHelper
+	t.Cleanup(func() { LandlockHelper = helper })
+
+	ai := fakeAppImage(t)
+	ai.SetBackend(Bwrap)
+
+	LandlockHelper = false
+	spec, err := ai.Spec(&AppImagePerms{Level: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Landlock != nil || slices.Contains(spec.BwrapArgs(), landlockHelperPath) {
+		t.Error("bwrap sandbox uses the Landlock helper without opting in")
+	}
+
+	// The native backend applies the ruleset itself
+	ai.SetBackend(Native)
+	if spec, err := ai.Spec(&AppImagePerms{Level: 2}, nil); err != nil || spec.Landlock == nil {
+		t.Errorf("native sandbox without a Landlock ruleset: %v", err)
+	}
+
+	LandlockHelper = true
+	ai.SetBackend(Bwrap)
+	spec, err = ai.Spec(&AppImagePerms{Level: 2, Seccomp: "/filter.bpf"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := spec.BwrapArgs()
+	if !slices.Contains(args, landlockHelperPath) {
+		t.Errorf("bwrap sandbox doesn't use the Landlock helper: %v", args)
+	}
+
+	// Loaded by the helper once the ruleset is applied
+	if slices.Contains(args, "--seccomp") || !slices.Contains(args, landlockSeccompPath) {
+		t.Errorf("seccomp filter loaded before the Landlock ruleset: %v", args)
+	}
+}
+
+func TestLandlockHelperLoadsSeccompLast(t *testing.T) {
+	if landlockABI() < 1 {
+		t.Skip("Landlock isn't supported by the kernel")
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A filter that doesn't allow the Landlock syscalls
+	filter := filepath.Join(t.TempDir(), "filter.bpf")
+	deny := denySyscalls(unix.SYS_UNAME, unix.SYS_LANDLOCK_CREATE_RULESET, unix.SYS_LANDLOCK_ADD_RULE, unix.SYS_LANDLOCK_RESTRICT_SELF)
+	if err := os.WriteFile(filter, deny, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := landlockHelperArgs{Landlock: &Landlock{}, Seccomp: filter}
+	for _, dir := range []string{"/bin", "/usr", "/lib", "/lib64"} {
+		if src, err := filepath.EvalSymlinks(dir); err == nil {
+			args.Rules = append(args.Rules, LandlockRule{Path: src})
+		}
+	}
+
+	b, err := json.Marshal(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := &exec.Cmd{
+		Path: self,
+		Args: []string{landlockHelperPath, string(b), "/bin/sh", "-c", `! uname 2>/dev/null && ! ls ` + t.TempDir() + ` 2>/dev/null`},
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("%v: %s", err, out)
+	}
+}
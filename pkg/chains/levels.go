@@ -0,0 +1,396 @@
+package chains
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/adrg/xdg"
+	"gopkg.in/ini.v1"
+)
+
+var (
+	InvalidLevel = errors.New("level invalid")
+)
+
+// Level is a base set of system files given to the sandbox before the
+// AppImage's own files, devices and sockets are added on top. Levels 1 - 3
+// are built in, but users may define their own (or override the built in
+// ones) in $XDG_CONFIG_HOME/chains/levels/[name]. Custom levels have to
+// extend a built in one, directly or through other custom levels
+//
+// Paths starting with `/` are taken from the root dir (see
+// *AppImage.SetRootDir) with symlinks resolved, while XDG shorthands such as
+// `xdg-config/gtk-3.0` or `~/.themes` are taken from the user's real home
+type Level struct {
+	Name      string
+	Extends   string   // Level to inherit binds and env vars from
+	ReadOnly  []string // Files bound read-only into the sandbox
+	ReadWrite []string // Files bound read-write into the sandbox
+	Devices   []string // Device files under /dev
+	Env       []string // `KEY=value` pairs set in the sandbox
+
+	// Files and devices of the above that must exist for the sandbox to
+	// start, the rest are skipped when missing. Only set by built in levels
+	Required []string
+}
+
+// Files shared by levels 1 and 2 so apps can pick up the user's theme
+var themeFiles = []string{
+	"xdg-data/fonts",
+	"xdg-data/themes",
+	"xdg-data/icons",
+	"xdg-config/fontconfig",
+	"xdg-config/gtk-3.0",
+	"xdg-config/gtk-4.0",
+	"xdg-config/qt5ct",
+	"xdg-config/qt6ct",
+	"xdg-config/Kvantum",
+	"xdg-config/kdeglobals",
+	"xdg-config/lxde/lxde.conf",
+}
+
+var builtinLevels = map[string]*Level{
+	// Level 1 is minimal sandboxing, grants access to most system files, all
+	// devices and only really attempts to isolate home files
+	"1": {
+		Name: "1",
+		ReadOnly: append([]string{
+			"/sys",
+			"/usr",
+			"/etc",
+			"/run/systemd",
+		}, themeFiles...),
+		Devices:  []string{"/dev"},
+		Required: []string{"/dev", "/sys"},
+	},
+	// Level 2 grants access to fewer system files, and all themes
+	// Likely to add more files here for compatability.
+	// This should be the standard level for GUI profiles
+	"2": {
+		Name: "2",
+		ReadOnly: append([]string{
+			"/etc/fonts",
+			"/etc/ld.so.cache",
+			"/etc/mime.types",
+			"/etc/xdg",
+			"/usr/share/fontconfig",
+			"/usr/share/fonts",
+			"/usr/share/icons",
+			"/usr/share/themes",
+			"/usr/share/applications",
+			"/usr/share/mime",
+			"/usr/share/libdrm",
+			"/usr/share/vulkan",
+			"/usr/share/glvnd",
+			"/usr/share/glib-2.0",
+			"/usr/share/terminfo",
+		}, themeFiles...),
+	},
+	// Level 3 only gets the files every level gets (see getMainWrapArgs)
+	"3": {
+		Name: "3",
+	},
+}
+
+// Variables chains sets itself, levels are not allowed to change them
+var reservedEnv = []string{
+	"HOME",
+	"TMPDIR",
+	"APPDIR",
+	"APPIMAGE",
+	"ARGV0",
+}
+
+var envKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// LoadLevel returns the level called `name`, preferring the user's level
+// directory over the built in levels. Custom levels that don't end up
+// extending a built in one are refused, there's no telling what they're
+// meant to be based on
+func LoadLevel(name string) (*Level, error) {
+	return loadLevel(name, map[string]bool{})
+}
+
+func loadLevel(name string, seen map[string]bool) (*Level, error) {
+	if seen[name] {
+		return nil, errors.New("level `" + name + "` extends itself")
+	}
+	seen[name] = true
+
+	if name == "" || strings.ContainsRune(name, '/') {
+		return nil, InvalidLevel
+	}
+
+	var l *Level
+
+	f, err := os.ReadFile(filepath.Join(xdg.ConfigHome, "chains", "levels", name))
+	if err == nil {
+		l, err = LevelFromReader(name, bytes.NewReader(f))
+		if err != nil {
+			return nil, err
+		}
+	} else if builtin, present := builtinLevels[name]; present {
+		l = builtin
+	} else {
+		return nil, errors.New("cannot find level `" + name + "`")
+	}
+
+	if l.Extends == "" {
+		if _, err := strconv.Atoi(name); err != nil {
+			return nil, errors.Join(InvalidLevel, errors.New("level `"+name+"` must extend one of the built in levels, or a level that does"))
+		}
+
+		return l, nil
+	}
+
+	base, err := loadLevel(l.Extends, seen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Level{
+		Name:      l.Name,
+		Extends:   l.Extends,
+		ReadOnly:  append(append([]string{}, base.ReadOnly...), l.ReadOnly...),
+		ReadWrite: append(append([]string{}, base.ReadWrite...), l.ReadWrite...),
+		Devices:   append(append([]string{}, base.Devices...), l.Devices...),
+		Env:       append(append([]string{}, base.Env...), l.Env...),
+		Required:  append(append([]string{}, base.Required...), l.Required...),
+	}, nil
+}
+
+// LevelFromReader parses a level definition. These use the same INI format
+// as profiles, for example:
+//
+//	[X-Chains Level]
+//	Extends=2
+//	ReadOnly=/etc/vulkan;/usr/share/steam;
+//	ReadWrite=~/Games;
+//	Devices=dri;input;
+//	Env=SDL_VIDEODRIVER=wayland;
+func LevelFromReader(name string, r io.Reader) (*Level, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	b = bytes.ReplaceAll(b, []byte(";"), []byte("；"))
+
+	e, err := ini.Load(b)
+	if err != nil {
+		return nil, err
+	}
+
+	section := e.Section("X-Chains Level")
+
+	// Refuse keys we don't understand, a typo should never go unnoticed when
+	// it comes to what a sandbox is allowed to access
+	for _, key := range section.KeyStrings() {
+		switch key {
+		case "Extends", "ReadOnly", "ReadWrite", "Devices", "Env":
+		default:
+			return nil, errors.New("level `" + name + "` has unknown key `" + key + "`")
+		}
+	}
+
+	l := &Level{
+		Name:      name,
+		Extends:   section.Key("Extends").Value(),
+		ReadOnly:  SplitKey(section.Key("ReadOnly").Value()),
+		ReadWrite: SplitKey(section.Key("ReadWrite").Value()),
+		Devices:   SplitKey(section.Key("Devices").Value()),
+		Env:       SplitKey(section.Key("Env").Value()),
+	}
+
+	for i := range l.Devices {
+		if !strings.HasPrefix(l.Devices[i], "/dev/") && l.Devices[i] != "/dev" {
+			l.Devices[i] = filepath.Join("/dev", l.Devices[i])
+		}
+	}
+
+	return l, l.Validate()
+}
+
+// Validate makes sure a level only grants what it explicitly lists. Devices
+// must be declared as devices, files can't expose the home directory as a
+// whole, system directories can't be writable and env vars can't override
+// the ones chains uses to set up the app. Levels named after a number must
+// be one of the built in ones, so that none of them end up as level 0
+func (l *Level) Validate() error {
+	if l.Name == "" || strings.ContainsRune(l.Name, '/') {
+		return InvalidLevel
+	}
+
+	for _, name := range []string{l.Name, l.Extends} {
+		if n, err := strconv.Atoi(name); err == nil && (n < 1 || n > 3) {
+			return errors.New("level `" + l.Name + "`: `" + name + "` isn't a level that can be defined or extended")
+		}
+	}
+
+	for _, f := range append(append([]string{}, l.ReadOnly...), l.ReadWrite...) {
+		if err := validateLevelPath(f); err != nil {
+			return errors.New("level `" + l.Name + "`: " + err.Error())
+		}
+
+		if f == "/dev" || strings.HasPrefix(f, "/dev/") {
+			return errors.New("level `" + l.Name + "`: `" + f + "` must be listed under Devices")
+		}
+	}
+
+	for _, f := range l.ReadWrite {
+		if tooBroadWritable(ExpandDir(f)) {
+			return errors.New("level `" + l.Name + "`: `" + f + "` can't be writable")
+		}
+	}
+
+	for _, d := range l.Devices {
+		if err := validateLevelPath(d); err != nil {
+			return errors.New("level `" + l.Name + "`: " + err.Error())
+		}
+
+		if d != "/dev" && !strings.HasPrefix(d, "/dev/") {
+			return errors.New("level `" + l.Name + "`: device `" + d + "` is not under /dev")
+		}
+	}
+
+	for _, env := range l.Env {
+		key, _, found := strings.Cut(env, "=")
+		if !found || !envKeyRegex.MatchString(key) {
+			return errors.New("level `" + l.Name + "`: invalid env var `" + env + "`")
+		}
+
+		if _, present := Contains(reservedEnv, key); present || strings.HasPrefix(key, "XDG_") {
+			return errors.New("level `" + l.Name + "`: env var `" + key + "` is set by chains and cannot be changed")
+		}
+	}
+
+	return nil
+}
+
+func validateLevelPath(f string) error {
+	if !strings.HasPrefix(f, "/") && !strings.HasPrefix(f, "~") && !strings.HasPrefix(f, "xdg-") {
+		return errors.New("`" + f + "` must be absolute or start with `~` or `xdg-`")
+	}
+
+	for _, elem := range strings.Split(f, "/") {
+		if elem == ".." {
+			return errors.New("`" + f + "` must not contain `..`")
+		}
+	}
+
+	if tooBroad(ExpandDir(f)) {
+		return errors.New("`" + f + "` would expose the home directory")
+	}
+
+	return nil
+}
+
+// Returns true if binding `f` would give access to the whole of the user's
+// real home directory
+func tooBroad(f string) bool {
+	home, err := RealHome()
+	if err != nil {
+		return true
+	}
+
+	f = filepath.Clean(f)
+
+	return f == "/" || f == home || strings.HasPrefix(home, f+"/")
+}
+
+// Returns true if binding `f` writable would let the app change the system
+// or other apps' runtime files
+func tooBroadWritable(f string) bool {
+	if tooBroad(f) {
+		return true
+	}
+
+	f = filepath.Clean(f)
+
+	for _, dir := range []string{xdg.RuntimeDir, "/var", "/etc", "/usr", "/proc"} {
+		if f == dir || strings.HasPrefix(dir, f+"/") {
+			return true
+		}
+	}
+
+	// Nothing in these should ever be changed by an app
+	for _, dir := range []string{"/etc", "/usr", "/proc"} {
+		if strings.HasPrefix(f, dir+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Number is the built in level this level is based on. LoadLevel makes sure
+// there is one, levels whose bases can't be loaded anymore are treated as
+// level 3
+func (l *Level) Number() int {
+	if n, err := strconv.Atoi(l.Name); err == nil {
+		return n
+	}
+
+	for name := l.Extends; name != ""; {
+		if n, err := strconv.Atoi(name); err == nil {
+			return n
+		}
+
+		base, err := LoadLevel(name)
+		if err != nil {
+			break
+		}
+
+		name = base.Extends
+	}
+
+	return 3
+}
+
+// Adds everything granted by the level to the spec
+func (ai *AppImage) applyLevel(spec *SandboxSpec, l *Level) error {
+	binds := []struct {
+		t     MountType
+		files []string
+	}{
+		{ROBindMount, l.ReadOnly},
+		{BindMount, l.ReadWrite},
+	}
+
+	for _, b := range binds {
+		for _, f := range b.files {
+			src, dest := ai.resolve(f), f
+
+			if !strings.HasPrefix(f, "/") {
+				src, dest = ExpandDir(f), ExpandGenericDir(f)
+			}
+
+			// A symlink in the root dir could point somewhere the level never
+			// asked for, catch the worst case of this happening
+			if tooBroad(src) || (b.t == BindMount && tooBroadWritable(src)) {
+				return errors.New("level `" + l.Name + "`: `" + f + "` resolves to `" + src + "`")
+			}
+
+			_, required := Contains(l.Required, f)
+			spec.bind(b.t, src, dest, !required)
+		}
+	}
+
+	for _, d := range l.Devices {
+		_, required := Contains(l.Required, d)
+		spec.device(d, d, !required)
+	}
+
+	for _, env := range l.Env {
+		key, val, _ := strings.Cut(env, "=")
+		spec.setenv(key, val)
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package chains
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/adrg/xdg"
+)
+
+// Writes a custom level definition for LoadLevel to find
+func writeLevel(t *testing.T, name string, body string) {
+	dir := filepath.Join(xdg.ConfigHome, "chains", "levels")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("[X-Chains Level]\n"+body), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadLevel(t *testing.T) {
+	isolateConfig(t)
+	// Expanding paths reloads the XDG dirs
+	t.Setenv("XDG_CONFIG_HOME", xdg.ConfigHome)
+
+	writeLevel(t, "games", "Extends=2\nReadOnly=/usr/share/steam;\nDevices=input;\n")
+	writeLevel(t, "emulators", "Extends=games\nEnv=SDL_VIDEODRIVER=wayland;\n")
+	writeLevel(t, "standalone", "ReadOnly=/usr/share/steam;\n")
+	writeLevel(t, "via-standalone", "Extends=standalone\n")
+	writeLevel(t, "loop-a", "Extends=loop-b\n")
+	writeLevel(t, "loop-b", "Extends=loop-a\n")
+
+	l, err := LoadLevel("emulators")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.Number() != 2 {
+		t.Errorf("based on level %d, want 2", l.Number())
+	}
+
+	for _, f := range []string{"/usr/share/steam", "/usr/share/fonts"} {
+		if !slices.Contains(l.ReadOnly, f) {
+			t.Errorf("%s not inherited", f)
+		}
+	}
+
+	if !slices.Equal(l.Devices, []string{"/dev/input"}) || !slices.Equal(l.Env, []string{"SDL_VIDEODRIVER=wayland"}) {
+		t.Errorf("got devices %v and env %v", l.Devices, l.Env)
+	}
+
+	// Nothing says what these are based on
+	for _, name := range []string{"standalone", "via-standalone"} {
+		if _, err := LoadLevel(name); !errors.Is(err, InvalidLevel) {
+			t.Errorf("%s loaded without extending a built in level: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{"loop-a", "missing", "../games", ""} {
+		if _, err := LoadLevel(name); err == nil {
+			t.Errorf("loaded %q", name)
+		}
+	}
+
+	// Built in levels can be overridden as they are
+	writeLevel(t, "3", "ReadOnly=/usr/share/fonts;\n")
+
+	if l, err := LoadLevel("3"); err != nil || !slices.Equal(l.ReadOnly, []string{"/usr/share/fonts"}) {
+		t.Errorf("override of level 3 not used: %+v %v", l, err)
+	}
+
+	perms := &AppImagePerms{}
+	if err := perms.SetLevelName("games"); err != nil || perms.Level != 2 || perms.LevelName != "games" {
+		t.Errorf("got level %d (%s): %v", perms.Level, perms.LevelName, err)
+	}
+}
+
+func TestLevelFromReader(t *testing.T) {
+	for _, c := range []struct {
+		body string
+		ok   bool
+	}{
+		{"Extends=2\nReadOnly=/etc/vulkan;\nReadWrite=~/Games;\nDevices=dri;\n", true},
+		{"Extends=0\n", false},
+		{"Extends=4\n", false},
+		{"Extend=2\n", false},
+		{"ReadOnly=etc/vulkan;\n", false},
+		{"ReadOnly=/usr/../home;\n", false},
+		{"ReadOnly=~;\n", false},
+		{"ReadOnly=/dev/dri;\n", false},
+		{"ReadWrite=/etc;\n", false},
+		{"ReadWrite=/usr/share/fonts;\n", false},
+		{"Devices=../sda;\n", false},
+		{"Env=HOME=/tmp;\n", false},
+		{"Env=XDG_CONFIG_HOME=/tmp;\n", false},
+		{"Env=NOT A KEY=1;\n", false},
+	} {
+		_, err := LevelFromReader("custom", strings.NewReader("[X-Chains Level]\n"+c.body))
+		if c.ok && err != nil {
+			t.Errorf("%q refused: %v", c.body, err)
+		} else if !c.ok && err == nil {
+			t.Errorf("%q accepted", c.body)
+		}
+	}
+
+	if _, err := LevelFromReader("0", strings.NewReader("[X-Chains Level]\nExtends=1\n")); err == nil {
+		t.Error("level 0 defined")
+	}
+}
@@ -0,0 +1,344 @@
+package chains
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/adrg/xdg"
+	"golang.org/x/sys/unix"
+)
+
+// Every launch of the same AppImage shares its mount and temporary directory.
+// The instances using them are recorded in `$XDG_RUNTIME_DIR/aisap/mount/<sha256>.lock`,
+// one per line as their PID and start time, and the file is flock'd while
+// it's read or changed. The last instance to leave cleans up. SquashFS images
+// are served by a detached process rather than whichever instance mounted
+// them, so that it can exit before the others, see mountDetached
+
+// The mount server re-executes the running program under this name. See
+// NativeInit
+const mountServerName = "chains-mount-server"
+
+// How often the mount server checks whether every instance has exited
+var mountHolderPoll = 500 * time.Millisecond
+
+// mountHolder identifies a running instance. The start time guards against
+// PIDs being reused after an instance crashed
+type mountHolder struct {
+	pid   int
+	start string
+}
+
+// mountRegistry is a locked registry file
+type mountRegistry struct {
+	f       *os.File
+	holders []mountHolder
+}
+
+func mountRegistryPath(hash string) string {
+	return filepath.Join(xdg.RuntimeDir, "aisap", "mount", hash+".lock")
+}
+
+// Locks and reads the registry of the AppImage with the given hash, blocking
+// until no other instance holds it. Instances that exited without leaving
+// are dropped
+func lockMountRegistry(hash string) (*mountRegistry, error) {
+	return openMountRegistry(hash, unix.LOCK_EX)
+}
+
+// Like lockMountRegistry, but fails with unix.EWOULDBLOCK instead of waiting
+// if another instance holds the registry. For locking the registries of
+// other AppImages while holding one's own, which could otherwise deadlock
+func tryLockMountRegistry(hash string) (*mountRegistry, error) {
+	return openMountRegistry(hash, unix.LOCK_EX|unix.LOCK_NB)
+}
+
+func openMountRegistry(hash string, how int) (*mountRegistry, error) {
+	path := mountRegistryPath(hash)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0744); err != nil {
+		return nil, err
+	}
+
+	f, err := flockFile(path, how)
+	if err != nil {
+		return nil, errors.Join(errors.New("failed to lock `"+path+"`"), err)
+	}
+
+	r := &mountRegistry{f: f}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		pid, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+
+		h := mountHolder{pid: pid, start: fields[1]}
+		if h.alive() {
+			r.holders = append(r.holders, h)
+		}
+	}
+
+	return r, nil
+}
+
+// Opens and flocks `path`. The registry is removed by GC while locked, so
+// retry until the file locked is still the one at `path`
+func lockFile(path string) (*os.File, error) {
+	return flockFile(path, unix.LOCK_EX)
+}
+
+func flockFile(path string, how int) (*os.File, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			err = unix.Flock(int(f.Fd()), how)
+			if err != unix.EINTR {
+				break
+			}
+		}
+
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+
+		f.Close()
+	}
+}
+
+// Removes the registry and unlocks it
+func (r *mountRegistry) delete() error {
+	err := os.Remove(r.f.Name())
+	return errors.Join(err, r.f.Close())
+}
+
+// Writes the registry back and unlocks it
+func (r *mountRegistry) Close() error {
+	var sb strings.Builder
+	for _, h := range r.holders {
+		sb.WriteString(strconv.Itoa(h.pid) + " " + h.start + "\n")
+	}
+
+	err := r.f.Truncate(0)
+	if err == nil {
+		_, err = r.f.WriteAt([]byte(sb.String()), 0)
+	}
+
+	// Closing the file releases the lock
+	return errors.Join(err, r.f.Close())
+}
+
+// Adds the current process to the registry
+func (r *mountRegistry) add() error {
+	h, err := currentMountHolder()
+	if err != nil {
+		return err
+	}
+
+	r.holders = append(r.holders, h)
+
+	return nil
+}
+
+// Removes one entry of the current process from the registry, returning how
+// many instances are left
+func (r *mountRegistry) leave() int {
+	h, err := currentMountHolder()
+	if err != nil {
+		return len(r.holders)
+	}
+
+	for i := range r.holders {
+		if r.holders[i] == h {
+			r.holders = append(r.holders[:i], r.holders[i+1:]...)
+			break
+		}
+	}
+
+	return len(r.holders)
+}
+
+// Returns how many running instances are using the AppImage's shared mount
+func (ai *AppImage) Instances() (int, error) {
+	if !FileExists(mountRegistryPath(ai.sha256)) {
+		return 0, nil
+	}
+
+	reg, err := lockMountRegistry(ai.sha256)
+	if err != nil {
+		return 0, err
+	}
+	defer reg.Close()
+
+	return len(reg.holders), nil
+}
+
+func currentMountHolder() (mountHolder, error) {
+	pid := os.Getpid()
+
+	start, err := processStart(pid)
+	if err != nil {
+		return mountHolder{}, err
+	}
+
+	return mountHolder{pid: pid, start: start}, nil
+}
+
+func (h mountHolder) alive() bool {
+	start, err := processStart(h.pid)
+	return err == nil && start == h.start
+}
+
+// Returns when a process started, in clock ticks since boot
+func processStart(pid int) (string, error) {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return "", err
+	}
+
+	// The command name may contain spaces, skip past it
+	stat := string(b)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+
+	// starttime is the 22nd field, 20th after the command name
+	if len(fields) < 20 {
+		return "", errors.New("failed to parse `/proc/" + strconv.Itoa(pid) + "/stat`")
+	}
+
+	return fields[19], nil
+}
+
+// Mounts the SquashFS image of the AppImage at `dest` from a new process that
+// outlives this one, serving the mount until no instance is left
+func (ai *AppImage) mountDetached(dest string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return &MountError{Path: ai.Path, Dest: dest, Err: err}
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return &MountError{Path: ai.Path, Dest: dest, Err: err}
+	}
+	defer r.Close()
+
+	cmd := exec.Command(self)
+	cmd.Args = []string{mountServerName, ai.Path, strconv.Itoa(ai.Offset), dest, ai.sha256}
+	cmd.ExtraFiles = []*os.File{w}
+
+	// Its own session, so that interrupting the app from the terminal
+	// doesn't take the mount down with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return &MountError{Path: ai.Path, Dest: dest, Err: err}
+	}
+
+	// The server says `ready` once mounted, or why it failed
+	b, _ := io.ReadAll(r)
+	if msg := strings.TrimSpace(string(b)); msg != "ready" {
+		cmd.Wait()
+
+		if msg == "" {
+			msg = "mount server exited"
+		}
+
+		return &MountError{Path: ai.Path, Dest: dest, Err: errors.New(msg)}
+	}
+
+	return cmd.Process.Release()
+}
+
+// Runs as the process started by mountDetached. Mounts the image, then serves
+// it until it's unmounted by the last instance to leave, or no instance is
+// left, which happens if they crashed
+func mountServer() error {
+	ready := os.NewFile(3, "ready")
+
+	if len(os.Args) != 5 {
+		ready.Close()
+		return errors.New("usage: " + mountServerName + " <path> <offset> <dest> <sha256>")
+	}
+
+	src, dest, hash := os.Args[1], os.Args[3], os.Args[4]
+
+	offset, err := strconv.Atoi(os.Args[2])
+	if err != nil {
+		ready.Close()
+		return err
+	}
+
+	server, f, err := mountSquashfs(src, dest, offset)
+	if err != nil {
+		fmt.Fprintln(ready, err)
+		ready.Close()
+		return err
+	}
+	defer f.Close()
+
+	fmt.Fprintln(ready, "ready")
+	ready.Close()
+
+	unmounted := make(chan struct{})
+	go func() {
+		server.Wait()
+		close(unmounted)
+	}()
+
+	for {
+		select {
+		case <-unmounted:
+			return nil
+		case <-time.After(mountHolderPoll):
+		}
+
+		// The instance that started us holds the registry until it has
+		// joined it, so it's never seen empty before then
+		reg, err := lockMountRegistry(hash)
+		if err != nil {
+			continue
+		}
+
+		// Files may still be open by whatever the app left running, in which
+		// case try again later
+		if len(reg.holders) == 0 && server.Unmount() == nil {
+			reg.Close()
+			return nil
+		}
+
+		reg.Close()
+	}
+}
@@ -0,0 +1,134 @@
+package chains
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/adrg/xdg"
+	"golang.org/x/sys/unix"
+)
+
+func isolateRuntimeDir(t *testing.T) {
+	runtimeDir, cacheHome := xdg.RuntimeDir, xdg.CacheHome
+	xdg.RuntimeDir, xdg.CacheHome = t.TempDir(), t.TempDir()
+	t.Cleanup(func() { xdg.RuntimeDir, xdg.CacheHome = runtimeDir, cacheHome })
+}
+
+func TestMountRegistry(t *testing.T) {
+	isolateRuntimeDir(t)
+
+	ai := &AppImage{sha256: "hash"}
+
+	if n, err := ai.Instances(); err != nil || n != 0 {
+		t.Errorf("%d instances before any started: %v", n, err)
+	}
+
+	reg, err := lockMountRegistry(ai.sha256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Waiting on the registry while holding another could deadlock
+	if _, err := tryLockMountRegistry(ai.sha256); !errors.Is(err, unix.EWOULDBLOCK) {
+		t.Errorf("locked a registry that's already held: %v", err)
+	}
+
+	reg.add()
+	reg.add()
+	if err := reg.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Left behind by an instance that crashed, its PID since reused
+	f, err := os.OpenFile(mountRegistryPath(ai.sha256), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("1 0\nnot a holder\n")
+	f.Close()
+
+	if n, err := ai.Instances(); err != nil || n != 2 {
+		t.Errorf("got %d instances, want 2: %v", n, err)
+	}
+
+	reg, err = tryLockMountRegistry(ai.sha256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := reg.leave(); n != 1 {
+		t.Errorf("%d instances left, want 1", n)
+	}
+	reg.Close()
+
+	if n, err := ai.Instances(); err != nil || n != 1 {
+		t.Errorf("got %d instances, want 1: %v", n, err)
+	}
+}
+
+func TestSharedMount(t *testing.T) {
+	isolateRuntimeDir(t)
+
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+	offset := writeType2AppImage(t, path, buildSquashfs(testSquashfsEntries()[:2]))
+
+	// Launched at once, as from a script
+	instances := make([]*AppImage, 4)
+	errs := make([]error, len(instances))
+
+	var wg sync.WaitGroup
+	for i := range instances {
+		instances[i] = &AppImage{Path: path, sha256: "hash", FSType: SquashFS, Offset: int(offset)}
+		instances[i].SetMountStrategy(MountExtract)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = instances[i].Mount()
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+
+	first := instances[0]
+	for _, ai := range instances[1:] {
+		if ai.MountDir() != first.MountDir() || ai.TempDir() != first.TempDir() {
+			t.Errorf("instance uses %s and %s, not %s and %s", ai.MountDir(), ai.TempDir(), first.MountDir(), first.TempDir())
+		}
+	}
+
+	if n, err := first.Instances(); err != nil || n != len(instances) {
+		t.Errorf("got %d instances, want %d: %v", n, len(instances), err)
+	}
+
+	// Those still running keep their files
+	for _, ai := range instances[:len(instances)-1] {
+		if err := ai.Destroy(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	last := instances[len(instances)-1]
+	if !FileExists(filepath.Join(last.MountDir(), "app.png")) || !DirExists(last.TempDir()) {
+		t.Error("files went away while an instance was running")
+	}
+
+	tempDir := last.TempDir()
+	if err := last.Destroy(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := last.Instances(); err != nil || n != 0 {
+		t.Errorf("%d instances left: %v", n, err)
+	}
+
+	if DirExists(tempDir) {
+		t.Error("last instance left its temporary directory behind")
+	}
+}
@@ -0,0 +1,704 @@
+package chains
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/adrg/xdg"
+	"golang.org/x/sys/unix"
+)
+
+// The native backend re-executes the running program under this name inside
+// of fresh namespaces, where it sets up the filesystem before starting the
+// AppImage. See NativeInit
+const nativeHelperName = "chains-native-init"
+
+// What the native helper receives from chains over its pipe
+type nativeRequest struct {
+	Root string       `json:"root"` // Where to build the new root on the host
+	Spec *SandboxSpec `json:"spec"`
+}
+
+// Returns the flags needed to create the namespaces the spec asks for. A user
+// and mount namespace is always needed for the native backend to work
+func cloneFlags(ns Namespaces) uintptr {
+	flags := uintptr(syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS)
+
+	namespaces := []struct {
+		unshared bool
+		flag     uintptr
+	}{
+		{ns.Cgroup, syscall.CLONE_NEWCGROUP},
+		{ns.Ipc, syscall.CLONE_NEWIPC},
+		{ns.Net, syscall.CLONE_NEWNET},
+		{ns.Pid, syscall.CLONE_NEWPID},
+		{ns.Uts, syscall.CLONE_NEWUTS},
+	}
+
+	for _, n := range namespaces {
+		if n.unshared {
+			flags |= n.flag
+		}
+	}
+
+	return flags
+}
+
+// Runs the sandbox described by `spec` without bwrap
+func runNative(spec *SandboxSpec) error {
+	root, err := MakeTemp(filepath.Join(xdg.RuntimeDir, "aisap", "root"), strconv.Itoa(os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(root)
+
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	uid, gid := os.Getuid(), os.Getgid()
+	sandboxUid, sandboxGid := uid, gid
+
+	if spec.Identity != nil {
+		sandboxUid, sandboxGid = spec.Identity.Uid, spec.Identity.Gid
+	}
+
+	// Keep just enough privileges in the new user namespace to build the
+	// sandbox. These are ambient so they survive executing the helper, which
+	// clears them from its ambient, bounding, permitted and effective sets
+	// before starting the app (see dropPrivileges), so the app only gets
+	// `KeepCaps`
+	caps := []uintptr{
+		unix.CAP_SYS_ADMIN,
+		unix.CAP_NET_ADMIN,
+		unix.CAP_SETPCAP,
+	}
+
+	if spec.DisableUserns {
+		caps = append(caps, unix.CAP_SYS_RESOURCE)
+	}
+
+	for _, c := range spec.keptCaps() {
+		if n, present := CapabilityMap[c]; present {
+			caps = append(caps, uintptr(n))
+		}
+	}
+
+	cmd := exec.Command(self)
+	cmd.Args = []string{nativeHelperName}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	cmd.ExtraFiles = []*os.File{r}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: cloneFlags(spec.Namespaces),
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: sandboxUid, HostID: uid, Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: sandboxGid, HostID: gid, Size: 1},
+		},
+		GidMappingsEnableSetgroups: false,
+		AmbientCaps:                caps,
+	}
+
+	if spec.DieWithParent {
+		cmd.SysProcAttr.Pdeathsig = syscall.SIGKILL
+	}
+
+	defer w.Close()
+
+	return runForwardingSignals(cmd, func() error {
+		defer w.Close()
+		return json.NewEncoder(w).Encode(nativeRequest{Root: root, Spec: spec})
+	})
+}
+
+// NativeInit must be called at the very start of main() by any program using
+// the native backend or mounting AppImages. In the normal case it returns
+// immediately, but when the program has been re-executed as the sandbox
+// helper it sets up the sandbox, runs the AppImage and exits without
+// returning. Likewise as the mount server, see *AppImage.mountDetached
+func NativeInit() {
+	if len(os.Args) == 0 {
+		return
+	}
+
+	if os.Args[0] == mountServerName {
+		if err := mountServer(); err != nil {
+			fmt.Fprintln(os.Stderr, "chains: mount server:", err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	if os.Args[0] == landlockHelperPath {
+		err := landlockHelper()
+		fmt.Fprintln(os.Stderr, "chains: landlock:", err)
+		os.Exit(1)
+	}
+
+	if os.Args[0] != nativeHelperName {
+		return
+	}
+
+	code, err := nativeHelper()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "chains: native backend:", err)
+		os.Exit(1)
+	}
+
+	os.Exit(code)
+}
+
+func nativeHelper() (int, error) {
+	// Capabilities, no_new_privs and friends are per-thread, the app must be
+	// started from the same thread they're changed on
+	runtime.LockOSThread()
+
+	req := &nativeRequest{}
+	f := os.NewFile(3, "spec")
+	err := json.NewDecoder(f).Decode(req)
+	f.Close()
+	if err != nil {
+		return 1, err
+	}
+
+	spec := req.Spec
+
+	// User sysctls belong to the user namespace of whoever writes them, so
+	// this only limits the sandbox
+	if spec.DisableUserns {
+		err := os.WriteFile("/proc/sys/user/max_user_namespaces", []byte("0"), 0644)
+		if err != nil {
+			return 1, fmt.Errorf("failed to disable user namespaces: %w", err)
+		}
+	}
+
+	// The filter is on the host, which is gone once the root is built
+	var filter []unix.SockFilter
+	if spec.Seccomp != nil {
+		if filter, err = readSeccomp(spec.Seccomp.Filter); err != nil {
+			return 1, err
+		}
+	}
+
+	if err := buildRoot(req.Root, spec); err != nil {
+		return 1, err
+	}
+
+	var keep []int
+	for _, c := range spec.keptCaps() {
+		if n, present := CapabilityMap[c]; present {
+			keep = append(keep, n)
+		}
+	}
+
+	if err := dropPrivileges(keep); err != nil {
+		return 1, err
+	}
+
+	// Before seccomp, in case the filter doesn't allow the Landlock syscalls
+	if spec.Landlock != nil {
+		if err := applyLandlock(spec.Landlock); err != nil {
+			return 1, err
+		}
+	}
+
+	if filter != nil {
+		if err := loadSeccomp(filter); err != nil {
+			return 1, err
+		}
+	}
+
+	env := os.Environ()
+	for _, e := range spec.Env {
+		env = setEnv(env, e.Name+"="+e.Value)
+	}
+
+	dir := "/"
+	for _, e := range env {
+		if home, found := strings.CutPrefix(e, "HOME="); found && DirExists(home) {
+			dir = home
+		}
+	}
+
+	cmd := exec.Command(spec.Exec.Path, spec.Exec.Args...)
+	cmd.Env = env
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid:    spec.NewSession,
+		Pdeathsig: syscall.SIGKILL,
+	}
+
+	if err := cmd.Start(); err != nil {
+		return 1, err
+	}
+
+	// Pass signals on to the app
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, forwardedSignals...)
+	go func() {
+		for sig := range sigs {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	// We may be PID 1 of the sandbox, so reap anything orphaned inside of it
+	// until the app itself exits
+	for {
+		var ws syscall.WaitStatus
+
+		pid, err := syscall.Wait4(-1, &ws, 0, nil)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return 1, err
+		}
+
+		if pid != cmd.Process.Pid {
+			continue
+		}
+
+		if ws.Signaled() {
+			return 128 + int(ws.Signal()), nil
+		}
+
+		return ws.ExitStatus(), nil
+	}
+}
+
+// Replaces or adds a `KEY=value` pair to an environment
+func setEnv(env []string, pair string) []string {
+	key, _, _ := strings.Cut(pair, "=")
+
+	for i := range env {
+		if strings.HasPrefix(env[i], key+"=") {
+			env[i] = pair
+			return env
+		}
+	}
+
+	return append(env, pair)
+}
+
+// Builds the sandbox's filesystem on a tmpfs at `root` and switches to it
+func buildRoot(root string, spec *SandboxSpec) error {
+	// Don't let anything done here leak back out to the host
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	if err := unix.Mount("tmpfs", root, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=0755"); err != nil {
+		return fmt.Errorf("failed to mount root tmpfs: %w", err)
+	}
+
+	for _, m := range spec.Mounts {
+		if err := applyMount(root, m, spec.Namespaces.Pid); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range spec.Devices {
+		err := bindMount(d.Source, filepath.Join(root, d.Dest), d.Optional, unix.MS_NOSUID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if spec.Namespaces.Net {
+		if err := loopbackUp(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Chdir(root); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(".oldroot", 0700); err != nil {
+		return err
+	}
+
+	if err := unix.PivotRoot(".", ".oldroot"); err != nil {
+		return fmt.Errorf("failed to pivot root: %w", err)
+	}
+
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+
+	if err := unix.Unmount("/.oldroot", unix.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount old root: %w", err)
+	}
+
+	return os.Remove("/.oldroot")
+}
+
+func applyMount(root string, m Mount, ownPid bool) error {
+	dest := filepath.Join(root, m.Dest)
+
+	mode := os.FileMode(0755)
+	if m.Mode != 0 {
+		mode = os.FileMode(m.Mode)
+	}
+
+	switch m.Type {
+	case DirMount:
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+
+		return os.Chmod(dest, mode)
+	case TmpfsMount:
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+
+		opts := "mode=" + strconv.FormatUint(uint64(mode), 8)
+		return unix.Mount("tmpfs", dest, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, opts)
+	case ProcMount:
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+
+		// A fresh proc can only be mounted when we own the PID namespace
+		if ownPid {
+			return unix.Mount("proc", dest, "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "")
+		}
+
+		return unix.Mount("/proc", dest, "", unix.MS_BIND|unix.MS_REC, "")
+	case DevMount:
+		return mountDev(dest)
+	case BindMount:
+		return bindMount(m.Source, dest, m.Optional, unix.MS_NOSUID|unix.MS_NODEV)
+	case ROBindMount:
+		return bindMount(m.Source, dest, m.Optional, unix.MS_NOSUID|unix.MS_NODEV|unix.MS_RDONLY)
+	}
+
+	return errors.New("unknown mount type `" + string(m.Type) + "`")
+}
+
+// Recursively binds `src` to `dest`, adding `flags` to every mount
+func bindMount(src string, dest string, optional bool, flags uintptr) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		if optional {
+			return nil
+		}
+
+		return fmt.Errorf("can't find `%s`: %w", src, err)
+	}
+
+	if err := makeMountPoint(dest, info.IsDir()); err != nil {
+		return err
+	}
+
+	if err := unix.Mount(src, dest, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return fmt.Errorf("failed to bind `%s`: %w", src, err)
+	}
+
+	return remountTree(dest, flags)
+}
+
+// Creates an empty file or directory to mount on top of
+func makeMountPoint(dest string, dir bool) error {
+	if dir {
+		return os.MkdirAll(dest, 0755)
+	}
+
+	if FileExists(dest) {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// Adds `flags` to the mount at `dest` and every mount below it. Flags the
+// mounts already have must be kept, as the kernel won't let us clear them
+// from inside of a user namespace
+func remountTree(dest string, flags uintptr) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var mounts []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), " ")
+		if len(fields) < 5 {
+			continue
+		}
+
+		// Spaces and friends are octal escaped in mountinfo
+		mnt, _ := strconv.Unquote(`"` + strings.ReplaceAll(fields[4], `"`, `\"`) + `"`)
+		if mnt == dest || strings.HasPrefix(mnt, dest+"/") {
+			mounts = append(mounts, mnt)
+		}
+	}
+
+	for _, mnt := range mounts {
+		var st unix.Statfs_t
+		if err := unix.Statfs(mnt, &st); err != nil {
+			// Submounts we can't access aren't reachable by the app either
+			continue
+		}
+
+		err := unix.Mount("", mnt, "", unix.MS_BIND|unix.MS_REMOUNT|flags|lockedFlags(st.Flags), "")
+		if err != nil && mnt == dest {
+			return fmt.Errorf("failed to remount `%s`: %w", dest, err)
+		}
+	}
+
+	return nil
+}
+
+// Converts the flags returned by statfs into their mount flag equivalents
+func lockedFlags(stFlags int64) uintptr {
+	var flags uintptr
+
+	conv := map[int64]uintptr{
+		unix.ST_RDONLY:      unix.MS_RDONLY,
+		unix.ST_NOSUID:      unix.MS_NOSUID,
+		unix.ST_NODEV:       unix.MS_NODEV,
+		unix.ST_NOEXEC:      unix.MS_NOEXEC,
+		unix.ST_NOATIME:     unix.MS_NOATIME,
+		unix.ST_NODIRATIME:  unix.MS_NODIRATIME,
+		unix.ST_RELATIME:    unix.MS_RELATIME,
+		unix.ST_SYNCHRONOUS: unix.MS_SYNCHRONOUS,
+	}
+
+	for st, ms := range conv {
+		if stFlags&st != 0 {
+			flags |= ms
+		}
+	}
+
+	return flags
+}
+
+// Creates a minimal /dev, same as bwrap's `--dev`
+func mountDev(dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	if err := unix.Mount("tmpfs", dest, "tmpfs", unix.MS_NOSUID, "mode=0755"); err != nil {
+		return err
+	}
+
+	for _, node := range []string{"null", "zero", "full", "random", "urandom", "tty"} {
+		src := filepath.Join("/dev", node)
+		if !FileExists(src) {
+			continue
+		}
+
+		if err := makeMountPoint(filepath.Join(dest, node), false); err != nil {
+			return err
+		}
+
+		if err := unix.Mount(src, filepath.Join(dest, node), "", unix.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to bind `%s`: %w", src, err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(dest, "pts"), 0755); err != nil {
+		return err
+	}
+
+	err := unix.Mount("devpts", filepath.Join(dest, "pts"), "devpts", unix.MS_NOSUID|unix.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=620")
+	if err != nil {
+		return fmt.Errorf("failed to mount devpts: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Join(dest, "shm"), 01777); err != nil {
+		return err
+	}
+
+	links := map[string]string{
+		"ptmx":   "pts/ptmx",
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+		"core":   "/proc/kcore",
+	}
+
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dest, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A new network namespace starts with its loopback interface down
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr); err != nil {
+		return fmt.Errorf("failed to bring up loopback: %w", err)
+	}
+
+	return nil
+}
+
+// Makes sure nothing started from this thread keeps any capabilities other
+// than `keep` or can gain new ones. Must be called right before executing
+// the app, as the helper can't build the sandbox afterwards
+func dropPrivileges(keep []int) error {
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return err
+	}
+
+	lastCap := unix.CAP_LAST_CAP
+	if b, err := os.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		if n, err := strconv.Atoi(strings.TrimSpace(string(b))); err == nil {
+			lastCap = n
+		}
+	}
+
+	for c := 0; c <= lastCap; c++ {
+		if slices.Contains(keep, c) {
+			continue
+		}
+
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("failed to drop capability %d: %w", c, err)
+		}
+	}
+
+	if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0, 0, 0); err != nil {
+		return err
+	}
+
+	// Inheritable capabilities would otherwise be handed straight back to
+	// the app if it runs as root inside of the sandbox. Everything else is
+	// dropped from the permitted and effective sets too, so the helper
+	// itself holds nothing more than the app will
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	data := [2]unix.CapUserData{}
+
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return err
+	}
+
+	for i := range data {
+		data[i].Inheritable = 0
+		data[i].Permitted = 0
+		data[i].Effective = 0
+	}
+
+	for _, c := range keep {
+		data[c/32].Inheritable |= 1 << (c % 32)
+		data[c/32].Permitted |= 1 << (c % 32)
+		data[c/32].Effective |= 1 << (c % 32)
+	}
+
+	if err := unix.Capset(&hdr, &data[0]); err != nil {
+		return err
+	}
+
+	// Ambient capabilities are what survive executing the app as a non-root
+	// user
+	for _, c := range keep {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(c), 0, 0); err != nil {
+			return fmt.Errorf("failed to keep capability %d: %w", c, err)
+		}
+	}
+
+	return nil
+}
+
+// Reads a compiled seccomp filter
+func readSeccomp(filter string) ([]unix.SockFilter, error) {
+	b, err := os.ReadFile(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) == 0 || len(b)%8 != 0 || len(b)/8 > unix.BPF_MAXINSNS {
+		return nil, errors.New("seccomp filter `" + filter + "` is not a valid BPF program")
+	}
+
+	prog := make([]unix.SockFilter, len(b)/8)
+	for i := range prog {
+		ins := b[i*8 : i*8+8]
+		prog[i] = unix.SockFilter{
+			Code: binary.NativeEndian.Uint16(ins[0:2]),
+			Jt:   ins[2],
+			Jf:   ins[3],
+			K:    binary.NativeEndian.Uint32(ins[4:8]),
+		}
+	}
+
+	return prog, nil
+}
+
+// Loads a seccomp filter, which will apply to everything started from this
+// thread. no_new_privs must already be set
+func loadSeccomp(prog []unix.SockFilter) error {
+	fprog := unix.SockFprog{
+		Len:    uint16(len(prog)),
+		Filter: &prog[0],
+	}
+
+	err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&fprog)), 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to load seccomp filter: %w", err)
+	}
+
+	return nil
+}
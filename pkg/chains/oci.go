@@ -0,0 +1,309 @@
+package chains
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	SeccompNotExportable = errors.New("seccomp filters are compiled BPF, which OCI configs can't hold")
+)
+
+// OCIConfig renders the spec as an OCI runtime config (config.json), for use
+// with runc, crun, podman and friends. `rootfs` is the container's root
+//
+// OCI has no concept of optional mounts, so any whose source doesn't exist
+// right now are left out. Its seccomp profiles are lists of syscall rules,
+// so a compiled filter can only be kept by having the Landlock helper load
+// it, which fails with SeccompNotExportable otherwise. Disabling nested user
+// namespaces becomes a profile denying unshare and clone with
+// CLONE_NEWUSER. Capabilities are always dropped, except `KeepCaps` when
+// `DropCaps` is set, which are only kept in the bounding, permitted and
+// effective sets as runc does
+func (s *SandboxSpec) OCIConfig(rootfs string) (*specs.Spec, error) {
+	return s.ociConfig(rootfs, landlockHelperBinary())
+}
+
+// Builds the config with `helper` as the Landlock helper, if any
+func (s *SandboxSpec) ociConfig(rootfs string, helper string) (*specs.Spec, error) {
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	sandboxUid, sandboxGid := uid, gid
+
+	if s.Identity != nil {
+		sandboxUid, sandboxGid = uint32(s.Identity.Uid), uint32(s.Identity.Gid)
+	}
+
+	s = s.withLandlockHelper(helper)
+
+	if s.Seccomp != nil {
+		return nil, errors.Join(SeccompNotExportable, errors.New("`"+s.Seccomp.Filter+"` would be left out, use Landlock with the helper to keep it"))
+	}
+
+	cfg := &specs.Spec{
+		Version: specs.Version,
+		Root: &specs.Root{
+			Path: rootfs,
+		},
+		Process: &specs.Process{
+			User: specs.User{UID: sandboxUid, GID: sandboxGid},
+			Args: append([]string{s.Exec.Path}, s.Exec.Args...),
+			Cwd:  "/",
+			Capabilities: &specs.LinuxCapabilities{
+				Bounding:  s.keptCaps(),
+				Effective: s.keptCaps(),
+				Permitted: s.keptCaps(),
+			},
+			NoNewPrivileges: true,
+		},
+		Linux: &specs.Linux{},
+		Annotations: map[string]string{
+			"org.chains.spec.version": strconv.Itoa(s.Version),
+		},
+	}
+
+	for _, e := range s.Env {
+		cfg.Process.Env = append(cfg.Process.Env, e.Name+"="+e.Value)
+
+		if e.Name == "HOME" {
+			cfg.Process.Cwd = e.Value
+		}
+	}
+
+	for _, m := range s.Mounts {
+		if m.Optional && !FileExists(m.Source) {
+			continue
+		}
+
+		mode := "mode=0755"
+		if m.Mode != 0 {
+			mode = "mode=0" + strconv.FormatUint(uint64(m.Mode), 8)
+		}
+
+		switch m.Type {
+		case BindMount:
+			cfg.Mounts = append(cfg.Mounts, specs.Mount{
+				Destination: m.Dest,
+				Type:        "bind",
+				Source:      m.Source,
+				Options:     []string{"rbind", "nosuid", "nodev"},
+			})
+		case ROBindMount:
+			cfg.Mounts = append(cfg.Mounts, specs.Mount{
+				Destination: m.Dest,
+				Type:        "bind",
+				Source:      m.Source,
+				Options:     []string{"rbind", "nosuid", "nodev", "ro"},
+			})
+		case TmpfsMount:
+			cfg.Mounts = append(cfg.Mounts, specs.Mount{
+				Destination: m.Dest,
+				Type:        "tmpfs",
+				Source:      "tmpfs",
+				Options:     []string{"nosuid", "nodev", mode},
+			})
+		case ProcMount:
+			cfg.Mounts = append(cfg.Mounts, specs.Mount{
+				Destination: m.Dest,
+				Type:        "proc",
+				Source:      "proc",
+			})
+		case DevMount:
+			// The runtime itself adds the basic device nodes
+			cfg.Mounts = append(cfg.Mounts,
+				specs.Mount{
+					Destination: m.Dest,
+					Type:        "tmpfs",
+					Source:      "tmpfs",
+					Options:     []string{"nosuid", "strictatime", "mode=0755", "size=65536k"},
+				},
+				specs.Mount{
+					Destination: filepath.Join(m.Dest, "pts"),
+					Type:        "devpts",
+					Source:      "devpts",
+					Options:     []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"},
+				},
+				specs.Mount{
+					Destination: filepath.Join(m.Dest, "shm"),
+					Type:        "tmpfs",
+					Source:      "shm",
+					Options:     []string{"nosuid", "noexec", "nodev", "mode=1777"},
+				},
+			)
+		}
+		// Directories are created in the rootfs when the bundle is written
+	}
+
+	for _, d := range s.Devices {
+		if d.Optional && !FileExists(d.Source) {
+			continue
+		}
+
+		cfg.Mounts = append(cfg.Mounts, specs.Mount{
+			Destination: d.Dest,
+			Type:        "bind",
+			Source:      d.Source,
+			Options:     []string{"rbind", "nosuid"},
+		})
+	}
+
+	cfg.Linux.Namespaces = []specs.LinuxNamespace{
+		{Type: specs.MountNamespace},
+	}
+
+	// Rootless runtimes can't work without a user namespace
+	if s.Namespaces.User || s.Identity != nil || uid != 0 {
+		cfg.Linux.Namespaces = append(cfg.Linux.Namespaces, specs.LinuxNamespace{Type: specs.UserNamespace})
+		cfg.Linux.UIDMappings = []specs.LinuxIDMapping{{ContainerID: sandboxUid, HostID: uid, Size: 1}}
+		cfg.Linux.GIDMappings = []specs.LinuxIDMapping{{ContainerID: sandboxGid, HostID: gid, Size: 1}}
+	}
+
+	namespaces := []struct {
+		unshared bool
+		ns       specs.LinuxNamespaceType
+	}{
+		{s.Namespaces.Cgroup, specs.CgroupNamespace},
+		{s.Namespaces.Ipc, specs.IPCNamespace},
+		{s.Namespaces.Net, specs.NetworkNamespace},
+		{s.Namespaces.Pid, specs.PIDNamespace},
+		{s.Namespaces.Uts, specs.UTSNamespace},
+	}
+
+	for _, n := range namespaces {
+		if n.unshared {
+			cfg.Linux.Namespaces = append(cfg.Linux.Namespaces, specs.LinuxNamespace{Type: n.ns})
+		}
+	}
+
+	if s.Namespaces.Uts {
+		cfg.Hostname = "chains"
+	}
+
+	if s.DisableUserns {
+		cfg.Linux.Seccomp = denyUsernsProfile()
+	}
+
+	return cfg, nil
+}
+
+// A seccomp profile that only stops new user namespaces from being made.
+// clone3 takes its flags in a struct seccomp can't look into, so it claims
+// not to exist and libc falls back on clone
+func denyUsernsProfile() *specs.LinuxSeccomp {
+	eperm, enosys := uint(unix.EPERM), uint(unix.ENOSYS)
+	newUser := []specs.LinuxSeccompArg{{
+		Index:    0,
+		Value:    unix.CLONE_NEWUSER,
+		ValueTwo: unix.CLONE_NEWUSER,
+		Op:       specs.OpMaskedEqual,
+	}}
+
+	return &specs.LinuxSeccomp{
+		DefaultAction: specs.ActAllow,
+		Syscalls: []specs.LinuxSyscall{
+			{Names: []string{"unshare", "clone"}, Action: specs.ActErrno, ErrnoRet: &eperm, Args: newUser},
+			{Names: []string{"clone3"}, Action: specs.ActErrno, ErrnoRet: &enosys},
+		},
+	}
+}
+
+// ExportOCI writes an OCI runtime bundle (`config.json` and `rootfs`) for the
+// AppImage to `dir`, using the same permissions *AppImage.Sandbox would.
+// The AppImage must be mounted first. Its files are extracted into the
+// bundle, as its mount point goes away once it's no longer in use
+func (ai *AppImage) ExportOCI(perms *AppImagePerms, dir string, args []string) error {
+	spec, err := ai.Spec(perms, args)
+	if err != nil {
+		return err
+	}
+
+	// Before anything is extracted
+	if _, err := spec.OCIConfig("rootfs"); err != nil {
+		return err
+	}
+
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	appDir := filepath.Join(dir, "appdir")
+
+	if err := ai.ExtractTo(appDir); err != nil {
+		return err
+	}
+
+	for i, m := range spec.Mounts {
+		// The temp dir is removed once chains exits, give the container its
+		// own instead
+		if m.Source == ai.tempDir {
+			spec.Mounts[i] = Mount{Type: TmpfsMount, Dest: m.Dest}
+		}
+
+		if m.Source == ai.mountDir {
+			spec.Mounts[i].Type = ROBindMount
+			spec.Mounts[i].Source = appDir
+		}
+	}
+
+	rootfs := filepath.Join(dir, "rootfs")
+
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return err
+	}
+
+	for _, m := range spec.Mounts {
+		if m.Type != DirMount {
+			continue
+		}
+
+		mode := os.FileMode(0755)
+		if m.Mode != 0 {
+			mode = os.FileMode(m.Mode)
+		}
+
+		// Only the directory itself gets the mount's mode, its parents are
+		// left for everyone to look through
+		dest := filepath.Join(rootfs, m.Dest)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+
+		if err := os.Mkdir(dest, mode); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+
+	// The bundle carries its own copy of the helper, so it keeps working if
+	// the program is moved or replaced
+	helper := landlockHelperBinary()
+	if helper != "" && spec.Landlock != nil {
+		if err := linkOrCopy(helper, filepath.Join(dir, "chains-landlock")); err != nil {
+			return err
+		}
+
+		helper = filepath.Join(dir, "chains-landlock")
+	}
+
+	cfg, err := spec.ociConfig("rootfs", helper)
+	if err != nil {
+		return err
+	}
+
+	cfg.Annotations["org.appimage.path"] = ai.Path
+	cfg.Annotations["org.appimage.name"] = ai.Name
+	cfg.Annotations["org.appimage.version"] = ai.Version
+
+	b, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, "config.json"), append(b, '\n'), 0644)
+}
@@ -0,0 +1,163 @@
+package chains
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/adrg/xdg"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"golang.org/x/sys/unix"
+)
+
+func TestOCIConfig(t *testing.T) {
+	spec := &SandboxSpec{
+		Version:       SpecVersion,
+		Namespaces:    Namespaces{User: true},
+		DisableUserns: true,
+		Mounts: []Mount{
+			{Type: ROBindMount, Source: "/usr", Dest: "/usr"},
+			{Type: BindMount, Source: "/nonexistent", Dest: "/optional", Optional: true},
+			{Type: TmpfsMount, Dest: "/tmp", Mode: 0700},
+		},
+		Exec: Exec{Path: "/app/AppRun", Args: []string{"--arg"}},
+	}
+
+	cfg, err := spec.ociConfig("rootfs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dests []string
+	for _, m := range cfg.Mounts {
+		dests = append(dests, m.Destination)
+	}
+
+	if !slices.Equal(dests, []string{"/usr", "/tmp"}) {
+		t.Errorf("got mounts %v", dests)
+	}
+
+	if !slices.Contains(cfg.Mounts[1].Options, "mode=0700") {
+		t.Errorf("tmpfs mounted with %v", cfg.Mounts[1].Options)
+	}
+
+	// Nested user namespaces are denied, and nothing else
+	seccomp := cfg.Linux.Seccomp
+	if seccomp == nil || seccomp.DefaultAction != specs.ActAllow {
+		t.Fatalf("got seccomp profile %+v", seccomp)
+	}
+
+	var denied []string
+	for _, s := range seccomp.Syscalls {
+		denied = append(denied, s.Names...)
+
+		for _, a := range s.Args {
+			if a.Op != specs.OpMaskedEqual || a.Value != unix.CLONE_NEWUSER {
+				t.Errorf("%v denied on %+v", s.Names, a)
+			}
+		}
+	}
+
+	if !slices.Equal(denied, []string{"unshare", "clone", "clone3"}) {
+		t.Errorf("denied %v", denied)
+	}
+
+	// Compiled filters can't be put in the config
+	spec.Seccomp = &Seccomp{Filter: "/filter"}
+	if _, err := spec.ociConfig("rootfs", ""); !errors.Is(err, SeccompNotExportable) {
+		t.Errorf("seccomp filter left out: %v", err)
+	}
+
+	// Unless the Landlock helper loads it
+	spec.Landlock = &Landlock{}
+	cfg, err = spec.ociConfig("rootfs", "/chains")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Process.Args[0] != landlockHelperPath || !slices.ContainsFunc(cfg.Mounts, func(m specs.Mount) bool {
+		return m.Source == "/filter" && m.Destination == landlockSeccompPath
+	}) {
+		t.Errorf("seccomp filter not given to the helper: %v %+v", cfg.Process.Args, cfg.Mounts)
+	}
+}
+
+func TestExportOCI(t *testing.T) {
+	isolateVersions(t)
+
+	ai := fakeAppImage(t)
+	ai.Path = filepath.Join(t.TempDir(), "app.AppImage")
+	ai.FSType = SquashFS
+	ai.Offset = int(writeType2AppImage(t, ai.Path, buildSquashfs([]testISOEntry{
+		{name: "org.example.App.desktop", data: "[Desktop Entry]\nName=App\n"},
+		{name: "AppRun", data: "#!/bin/sh\n", mode: 0755},
+	})))
+
+	perms := &AppImagePerms{Level: 2, DisableUserns: true, Seccomp: "/filter"}
+	dir := filepath.Join(t.TempDir(), "app.oci")
+
+	// Nothing would load the filter
+	helper := LandlockHelper
+	LandlockHelper = false
+	t.Cleanup(func() { LandlockHelper = helper })
+
+	if err := ai.ExportOCI(perms, dir, nil); !errors.Is(err, SeccompNotExportable) {
+		t.Fatalf("seccomp filter left out: %v", err)
+	}
+
+	if DirExists(dir) {
+		t.Error("bundle written without its seccomp filter")
+	}
+
+	perms.Seccomp = ""
+	if err := ai.ExportOCI(perms, dir, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg specs.Spec
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Root.Path != "rootfs" || cfg.Linux.Seccomp == nil {
+		t.Errorf("got config %s", b)
+	}
+
+	// The AppImage's files are in the bundle, and read-only
+	if !FileExists(filepath.Join(dir, "appdir", "AppRun")) {
+		t.Error("AppImage not extracted into the bundle")
+	}
+
+	for _, m := range cfg.Mounts {
+		if m.Source == ai.mountDir || m.Source == ai.tempDir {
+			t.Errorf("%s bound from outside of the bundle", m.Source)
+		}
+
+		if m.Source == filepath.Join(dir, "appdir") && !slices.Contains(m.Options, "ro") {
+			t.Errorf("AppImage's files mounted with %v", m.Options)
+		}
+	}
+
+	// Only the runtime directory itself is private
+	runtimeDir := filepath.Join(dir, "rootfs", xdg.RuntimeDir)
+	for path, want := range map[string]os.FileMode{
+		runtimeDir:                          0700,
+		filepath.Dir(runtimeDir):            0755,
+		filepath.Join(dir, "rootfs", "app"): 0755,
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Error(err)
+		} else if info.Mode().Perm() != want {
+			t.Errorf("%s created with %v, want %v", path, info.Mode().Perm(), want)
+		}
+	}
+}
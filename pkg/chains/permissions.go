@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -72,10 +73,17 @@ var (
 )
 
 type AppImagePerms struct {
-	Level   int      `json:"level"`      // How much access to system files
-	Files   []string `json:"filesystem"` // Grant permission to access files
-	Devices []string `json:"devices"`    // Access device files (eg: dri, input)
-	Sockets []Socket `json:"sockets"`    // Use sockets (eg: x11, pulseaudio, network)
+	Level     int      `json:"level"`                // How much access to system files
+	LevelName string   `json:"level_name,omitempty"` // Custom level to use, if any (see LoadLevel)
+	Files     []string `json:"filesystem"`           // Grant permission to access files
+	Devices   []string `json:"devices"`              // Access device files (eg: dri, input)
+	Sockets   []Socket `json:"sockets"`              // Use sockets (eg: x11, pulseaudio, network)
+	Seccomp   string   `json:"seccomp,omitempty"`    // Compiled seccomp filter to load
+
+	DropCaps      bool     `json:"drop_caps"`                // Drop all capabilities except `KeepCaps`
+	KeepCaps      []string `json:"keep_caps,omitempty"`      // Capabilities to keep (eg: CAP_NET_RAW)
+	Identity      string   `json:"identity,omitempty"`       // Who to run as, see ParseIdentity
+	DisableUserns bool     `json:"disable_userns,omitempty"` // Forbid creating nested user namespaces
 
 	// TODO: rename to PersistentHome or something
 	DataDir bool `json:"data_dir"` // Whether or not a data dir should be created (only
@@ -96,6 +104,11 @@ func FromIni(e *ini.File) (*AppImagePerms, error) {
 	filePerms := e.Section("X-App Permissions").Key("Files").Value()
 	devicePerms := e.Section("X-App Permissions").Key("Devices").Value()
 	socketPerms := e.Section("X-App Permissions").Key("Sockets").Value()
+	p.Seccomp = e.Section("X-App Permissions").Key("Seccomp").Value()
+	capPerms := e.Section("X-App Permissions").Key("KeepCaps").Value()
+	identity := e.Section("X-App Permissions").Key("Identity").Value()
+	p.DropCaps = e.Section("X-App Permissions").Key("DropCaps").Value() == "true"
+	p.DisableUserns = e.Section("X-App Permissions").Key("DisableUserns").Value() == "true"
 
 	// Enable saving to a data dir by default
 	if e.Section("X-App Permissions").Key("DataDir").Value() == "false" {
@@ -105,7 +118,14 @@ func FromIni(e *ini.File) (*AppImagePerms, error) {
 	}
 
 	l, err := strconv.Atoi(level)
-	if err != nil || l < 0 || l > 3 {
+	if err != nil {
+		// Not a number, so try to find a custom level of the same name
+		err = p.SetLevelName(level)
+		if err != nil {
+			p.Level = -1
+			return p, err
+		}
+	} else if l < 0 || l > 3 {
 		p.Level = -1
 		return p, err
 	} else {
@@ -117,11 +137,22 @@ func FromIni(e *ini.File) (*AppImagePerms, error) {
 	p.AddDevices(SplitKey(devicePerms)...)
 	p.AddSockets(SplitKey(socketPerms)...)
 
+	if err := p.AddCaps(SplitKey(capPerms)...); err != nil {
+		p.Level = -1
+		return p, err
+	}
+
+	if err := p.SetIdentity(identity); err != nil {
+		p.Level = -1
+		return p, err
+	}
+
 	return p, nil
 }
 
 // FromSystem attempts to read permissions from a provided desktop entry at
-// ~/.local/share/chains/profiles/[ai.Name]
+// ~/.local/share/chains/profiles/[ai.Name], or in the directories of
+// ProfileSearchPath
 // This should be the preferred way to get permissions and gives maximum power
 // to the user (provided they use a tool to easily edit these permissions, which
 // I'm also planning on making)
@@ -129,11 +160,17 @@ func FromSystem(name string) (*AppImagePerms, error) {
 	p := &AppImagePerms{}
 	var e string
 
-	fp := filepath.Join(xdg.DataHome, "chains", "profiles", name)
-	f, err := os.Open(fp)
+	f, err := os.Open(ProfilePath(name))
+	for _, dir := range ProfileSearchPath {
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		f, err = os.Open(filepath.Join(dir, name))
+	}
 	if err != nil {
 		return p, err
 	}
+	defer f.Close()
 
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
@@ -166,6 +203,65 @@ func FromReader(r io.Reader) (*AppImagePerms, error) {
 	return FromIni(e)
 }
 
+// Directory the user's profiles are kept in, see FromSystem
+func ProfileDir() string {
+	return filepath.Join(xdg.DataHome, "chains", "profiles")
+}
+
+// Location of the user's profile for the app named `name`
+func ProfilePath(name string) string {
+	return filepath.Join(ProfileDir(), name)
+}
+
+// WriteIni writes the permissions as an `X-App Permissions` section, which
+// FromSystem and FromReader can read back
+func (p *AppImagePerms) WriteIni(w io.Writer) error {
+	level := strconv.Itoa(p.Level)
+	if p.LevelName != "" {
+		level = p.LevelName
+	}
+
+	sockets := make([]string, len(p.Sockets))
+	for i := range p.Sockets {
+		sockets[i] = string(p.Sockets[i])
+	}
+
+	list := func(s []string) string {
+		if len(s) == 0 {
+			return ""
+		}
+
+		return strings.Join(s, ";") + ";"
+	}
+
+	var b strings.Builder
+	b.WriteString("[X-App Permissions]\n")
+	b.WriteString("Level=" + level + "\n")
+	b.WriteString("Files=" + list(p.Files) + "\n")
+	b.WriteString("Devices=" + list(p.Devices) + "\n")
+	b.WriteString("Sockets=" + list(sockets) + "\n")
+	b.WriteString("DataDir=" + strconv.FormatBool(p.DataDir) + "\n")
+
+	if p.Seccomp != "" {
+		b.WriteString("Seccomp=" + p.Seccomp + "\n")
+	}
+	if p.DropCaps {
+		b.WriteString("DropCaps=true\n")
+	}
+	if len(p.KeepCaps) > 0 {
+		b.WriteString("KeepCaps=" + list(p.KeepCaps) + "\n")
+	}
+	if p.Identity != "" {
+		b.WriteString("Identity=" + p.Identity + "\n")
+	}
+	if p.DisableUserns {
+		b.WriteString("DisableUserns=true\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
 func (p *AppImagePerms) AddFiles(s ...string) {
 	// Remove previous files of the same name if they exist
 	p.RemoveFiles(s...)
@@ -199,6 +295,23 @@ func (p *AppImagePerms) AddSockets(socketStrings ...string) error {
 	return nil
 }
 
+// Capabilities to keep when `DropCaps` is set. Names are normalized, so
+// `net_raw` and `CAP_NET_RAW` are the same
+func (p *AppImagePerms) AddCaps(capStrings ...string) error {
+	p.RemoveCaps(capStrings...)
+
+	for i := range capStrings {
+		c, err := CapabilityFromString(capStrings[i])
+		if err != nil {
+			return err
+		}
+
+		p.KeepCaps = append(p.KeepCaps, c)
+	}
+
+	return nil
+}
+
 func (p *AppImagePerms) removeFile(str string) {
 	// Done this way to ensure there is an `extension` eg: `:ro` on the string,
 	// it will then be used to detect if that file already exists
@@ -245,6 +358,43 @@ func (p *AppImagePerms) RemoveSockets(s ...string) {
 	}
 }
 
+func (p *AppImagePerms) RemoveCaps(s ...string) {
+	for i := range s {
+		c, _ := CapabilityFromString(s[i])
+
+		if i, present := Contains(p.KeepCaps, c); present {
+			p.KeepCaps = append(p.KeepCaps[:i], p.KeepCaps[i+1:]...)
+		}
+	}
+}
+
+// Set who the app runs as inside of the sandbox, see ParseIdentity for the
+// accepted values
+func (p *AppImagePerms) SetIdentity(s string) error {
+	if _, err := ParseIdentity(s); err != nil {
+		return err
+	}
+
+	p.Identity = s
+
+	return nil
+}
+
+// GetIdentity returns the user and group the app will run as inside of the
+// sandbox
+func (p *AppImagePerms) GetIdentity() (Identity, error) {
+	id, err := ParseIdentity(p.Identity)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	if id == nil {
+		return Identity{Uid: os.Getuid(), Gid: os.Getgid()}, nil
+	}
+
+	return *id, nil
+}
+
 // Set sandbox base permission level
 func (p *AppImagePerms) SetLevel(l int) error {
 	if l < 0 || l > 3 {
@@ -252,88 +402,65 @@ func (p *AppImagePerms) SetLevel(l int) error {
 	}
 
 	p.Level = l
+	p.LevelName = ""
 
 	return nil
 }
 
-// Set the trusted status
-func (ai *AppImage) SetTrusted(trusted bool) error {
-	configPath := filepath.Join(xdg.DataHome, "chains", "profiles", ai.Name)
-
-	if trusted {
-		if !FileExists(configPath) {
-			err := os.MkdirAll(filepath.Dir(configPath), 0744)
-			if err != nil {
-				return err
-			}
-
-			info, err := os.Stat(ai.Path)
-			if err != nil {
-				return err
-			}
-
-			err = os.Chmod(ai.Path, info.Mode()|0100)
-			if err != nil {
-				return err
-			}
-		} else {
-			return errors.New("entry already exists in chains config dir")
-		}
-	} else {
-		os.Remove(configPath)
+// Set sandbox base permission level by name, which may either be one of the
+// built in levels or a custom one from the user's level directory
+func (p *AppImagePerms) SetLevelName(name string) error {
+	l, err := LoadLevel(name)
+	if err != nil {
+		return err
 	}
 
+	p.Level = l.Number()
+	p.LevelName = name
+
 	return nil
 }
 
-// IsTrusted checks if the AppImage is trusted by verifying its permissions
-func IsTrusted(name, path string) bool {
-	configPath := filepath.Join(xdg.DataHome, "chains", "profiles", name)
-
-	if FileExists(configPath) {
-		info, err := os.Stat(path)
-		if err == nil && info.Mode()&0100 != 0 {
-			return true
-		}
+// GetLevel returns the *Level the permissions are based on
+func (p *AppImagePerms) GetLevel() (*Level, error) {
+	if p.LevelName != "" {
+		return LoadLevel(p.LevelName)
 	}
-	return false
+
+	return LoadLevel(strconv.Itoa(p.Level))
 }
 
-func SetTrusted(name, path string, ai *AppImage, trusted bool) error {
-	configPath := filepath.Join(xdg.DataHome, "chains", "profiles", name)
+// IsTrusted checks if the AppImage at `path` is trusted
+//
+// Deprecated: use *AppImage.Trusted
+func IsTrusted(name, path string) bool {
+	hash, err := CalculateSHA256(path)
+	if err != nil {
+		return false
+	}
 
-	if trusted {
-		if !DirExists(filepath.Dir(configPath)) {
-			os.MkdirAll(filepath.Dir(configPath), 0744)
-		}
+	db, err := LoadTrustDB()
 
-		info, err := os.Stat(path)
-		if err != nil {
-			return err
-		}
-		os.Chmod(path, info.Mode()|0100)
+	return err == nil && db.Lookup(hash) != nil
+}
 
-		if FileExists(configPath) {
-			return errors.New("entry already exists in chains config dir")
-		}
+// Deprecated: use *AppImage.SetTrusted
+func SetTrusted(name, path string, ai *AppImage, trusted bool) error {
+	return ai.SetTrusted(trusted)
+}
 
-		desktopFile := ai.Desktop
-		permFile, err := os.Create(configPath)
-		if err != nil {
-			return err
-		}
-		defer permFile.Close()
+// PermsSource says which layer an AppImage's permissions came from
+type PermsSource string
 
-		var buf bytes.Buffer
-		if _, err := desktopFile.WriteTo(&buf); err != nil {
-			return err
-		}
-		_, err = io.Copy(permFile, &buf)
-		return err
-	} else {
-		return os.Remove(configPath)
-	}
-}
+const (
+	UserProfile     PermsSource = "user-profile"     // See FromSystem
+	BuiltinProfile  PermsSource = "built-in-profile" // See FromName
+	DesktopEntry    PermsSource = "desktop-entry"    // The AppImage's own `X-App Permissions`
+	ProfileFile     PermsSource = "profile-file"     // A profile given by its path
+	FallbackProfile PermsSource = "fallback-profile" // Used when the others have no valid level
+	Settings        PermsSource = "settings"         // chains' own config file
+	Flags           PermsSource = "flags"            // Given on the command line
+)
 
 // GetPermissions retrieves the permissions of the AppImage
 // Retrieve permissions from the AppImage in the following order:
@@ -342,8 +469,16 @@ func SetTrusted(name, path string, ai *AppImage, trusted bool) error {
 //	2: chains internal permissions library
 //	3: Permissions defined in the AppImage's desktop file
 func (ai AppImage) GetPermissions() (*AppImagePerms, error) {
+	perms, _, err := ai.ResolvePermissions()
+	return perms, err
+}
+
+// ResolvePermissions is GetPermissions, also returning which layer the
+// permissions came from
+func (ai AppImage) ResolvePermissions() (*AppImagePerms, PermsSource, error) {
 	var perms *AppImagePerms
 	var err error
+	var source PermsSource
 
 	// If PREFER_chains_PROFILE is set, attempt to use it over the AppImage's
 	// suggested permissions. If no profile exists in chains, fall back on saved
@@ -351,24 +486,40 @@ func (ai AppImage) GetPermissions() (*AppImagePerms, error) {
 	// entry
 	// Typically this should be unset unless testing a custom profile against
 	// chains's
-	if _, present := os.LookupEnv("PREFER_CHAINS_PROFILE"); present {
+	if _, present := os.LookupEnv("PREFER_CHAINS_PROFILE"); present || PreferBuiltinProfiles {
 		perms, err = FromName(ai.Name)
+		source = BuiltinProfile
 
 		if err != nil {
 			perms, err = FromSystem(ai.Name)
+			source = UserProfile
 		}
 	} else {
 		perms, err = FromSystem(ai.Name)
+		source = UserProfile
 
 		if err != nil {
 			perms, err = FromName(ai.Name)
+			source = BuiltinProfile
 		}
 	}
 
 	// Fall back to permissions inside AppImage if all else fails
 	if err != nil {
-		return FromIni(ai.Desktop)
+		perms, err = FromIni(ai.Desktop)
+		perms.dropPrivileged()
+		return perms, DesktopEntry, err
 	}
 
-	return perms, nil
+	return perms, source, nil
+}
+
+// Clears what only the user's and the system's profiles may set, from
+// permissions the AppImage asked for itself: capabilities and identities
+// grant privileges, and seccomp filters are files on the host. Whatever
+// only takes privileges away, like `DisableUserns`, is left alone
+func (p *AppImagePerms) dropPrivileged() {
+	p.Seccomp = ""
+	p.KeepCaps = nil
+	p.Identity = ""
 }
@@ -0,0 +1,30 @@
+package chains
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestWriteIniRoundTrip(t *testing.T) {
+	for _, p := range []*AppImagePerms{
+		{Level: 2, DataDir: true, Sockets: []Socket{Network}},
+		{Level: 3, DropCaps: true, KeepCaps: []string{"CAP_NET_RAW"}},
+		{Level: 3, KeepCaps: []string{"CAP_NET_RAW"}}, // Kept for when caps are dropped again
+		{Level: 1, Identity: "nobody", DisableUserns: true},
+	} {
+		var b bytes.Buffer
+		if err := p.WriteIni(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := FromReader(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, p) {
+			t.Errorf("read back %+v, wrote %+v", got, p)
+		}
+	}
+}
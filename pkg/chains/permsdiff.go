@@ -0,0 +1,208 @@
+package chains
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PermsDiff lists how an AppImage's permissions changed since it was trusted.
+// An update may ask for more through its own `X-App Permissions`, which are
+// used whenever no profile overrides them
+type PermsDiff struct {
+	OldLevel string // Level or custom level name when trusted
+	NewLevel string // Level or custom level name now
+
+	AddedFiles     []string
+	RemovedFiles   []string
+	AddedDevices   []string
+	RemovedDevices []string
+	AddedSockets   []Socket
+	RemovedSockets []Socket
+	AddedCaps      []string
+	RemovedCaps    []string
+
+	// Any other setting that grants more than before, eg: `seccomp: removed`
+	Other []string
+}
+
+// Compares the permissions granted when trusted with the new ones
+func DiffPermissions(old *AppImagePerms, new *AppImagePerms) *PermsDiff {
+	d := &PermsDiff{
+		OldLevel: levelString(old),
+		NewLevel: levelString(new),
+	}
+
+	d.AddedFiles, d.RemovedFiles = diffLists(old.Files, new.Files)
+	d.AddedDevices, d.RemovedDevices = diffLists(old.Devices, new.Devices)
+	d.AddedSockets, d.RemovedSockets = diffLists(old.Sockets, new.Sockets)
+
+	// Kept capabilities only matter once the rest are dropped, but are
+	// compared anyway so that dropping them again can't bring back ones
+	// that were never approved
+	d.AddedCaps, d.RemovedCaps = diffLists(old.KeepCaps, new.KeepCaps)
+
+	if old.DropCaps && !new.DropCaps {
+		d.Other = append(d.Other, "capabilities: no longer dropped")
+	}
+	if old.Seccomp != "" && new.Seccomp == "" {
+		d.Other = append(d.Other, "seccomp: filter removed")
+	} else if old.Seccomp != new.Seccomp && new.Seccomp != "" {
+		d.Other = append(d.Other, "seccomp: "+new.Seccomp)
+	}
+	if old.Identity != new.Identity {
+		d.Other = append(d.Other, "identity: "+orDefault(old.Identity)+" -> "+orDefault(new.Identity))
+	}
+	if old.DisableUserns && !new.DisableUserns {
+		d.Other = append(d.Other, "user namespaces: no longer disabled")
+	}
+
+	return d
+}
+
+// Returns true if nothing changed
+func (d *PermsDiff) Empty() bool {
+	return d.OldLevel == d.NewLevel &&
+		len(d.AddedFiles)+len(d.RemovedFiles) == 0 &&
+		len(d.AddedDevices)+len(d.RemovedDevices) == 0 &&
+		len(d.AddedSockets)+len(d.RemovedSockets) == 0 &&
+		len(d.AddedCaps)+len(d.RemovedCaps) == 0 &&
+		len(d.Other) == 0
+}
+
+// Returns true if the AppImage is granted anything it wasn't before. Only
+// having less access doesn't need to be approved again
+func (d *PermsDiff) Escalates() bool {
+	return d.levelLowered() ||
+		len(d.AddedFiles) > 0 ||
+		len(d.AddedDevices) > 0 ||
+		len(d.AddedSockets) > 0 ||
+		len(d.AddedCaps) > 0 ||
+		len(d.Other) > 0
+}
+
+// Levels go from 0 (unsandboxed) to 3 (most restricted), so a lower one gives
+// more access. Custom levels can't be compared, so any change counts
+func (d *PermsDiff) levelLowered() bool {
+	if d.OldLevel == d.NewLevel {
+		return false
+	}
+
+	old, err1 := strconv.Atoi(d.OldLevel)
+	new, err2 := strconv.Atoi(d.NewLevel)
+
+	return err1 != nil || err2 != nil || new < old
+}
+
+// Lists the changes one per line, `+` for what was added and `-` for what
+// was removed
+func (d *PermsDiff) String() string {
+	var lines []string
+
+	if d.OldLevel != d.NewLevel {
+		lines = append(lines, "  level: "+d.OldLevel+" -> "+d.NewLevel)
+	}
+
+	for _, s := range []struct {
+		kind           string
+		added, removed []string
+	}{
+		{"file", d.AddedFiles, d.RemovedFiles},
+		{"device", d.AddedDevices, d.RemovedDevices},
+		{"socket", socketStrings(d.AddedSockets), socketStrings(d.RemovedSockets)},
+		{"capability", d.AddedCaps, d.RemovedCaps},
+	} {
+		for _, v := range s.added {
+			lines = append(lines, "+ "+s.kind+" "+v)
+		}
+		for _, v := range s.removed {
+			lines = append(lines, "- "+s.kind+" "+v)
+		}
+	}
+
+	for _, v := range d.Other {
+		lines = append(lines, "  "+v)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Compares `perms`, the permissions the AppImage is about to be granted, with
+// those it had when trusted. If nil, those from its profile are used. The
+// entry for its current contents is preferred, then the one for its path,
+// which is where an update replacing it ends up. Returns nil if it was never
+// trusted, or was trusted before permissions were recorded
+func (ai *AppImage) PermissionChanges(perms *AppImagePerms) (*PermsDiff, error) {
+	db, err := LoadTrustDB()
+	if err != nil {
+		return nil, err
+	}
+
+	entry := db.Lookup(ai.sha256)
+	if entry == nil {
+		path, err := filepath.Abs(ai.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		entry = db.LookupPath(path)
+	}
+
+	if entry == nil || entry.Permissions == nil {
+		return nil, nil
+	}
+
+	if perms == nil {
+		perms, err = ai.GetPermissions()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return DiffPermissions(entry.Permissions, perms), nil
+}
+
+func levelString(p *AppImagePerms) string {
+	if p.LevelName != "" {
+		return p.LevelName
+	}
+
+	return strconv.Itoa(p.Level)
+}
+
+func orDefault(s string) string {
+	if s == "" {
+		return "default"
+	}
+
+	return s
+}
+
+func socketStrings(sockets []Socket) []string {
+	s := make([]string, len(sockets))
+	for i := range sockets {
+		s[i] = string(sockets[i])
+	}
+
+	return s
+}
+
+// Returns what's in `new` but not `old`, and what's in `old` but not `new`
+func diffLists[T comparable](old []T, new []T) ([]T, []T) {
+	var added, removed []T
+
+	for _, v := range new {
+		if !slices.Contains(old, v) && !slices.Contains(added, v) {
+			added = append(added, v)
+		}
+	}
+
+	for _, v := range old {
+		if !slices.Contains(new, v) && !slices.Contains(removed, v) {
+			removed = append(removed, v)
+		}
+	}
+
+	return added, removed
+}
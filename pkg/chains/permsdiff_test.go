@@ -0,0 +1,57 @@
+package chains
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/adrg/xdg"
+)
+
+func TestDiffKeepCaps(t *testing.T) {
+	old := &AppImagePerms{Level: 2}
+	new := &AppImagePerms{Level: 2, KeepCaps: []string{"CAP_NET_RAW"}}
+
+	// Not in effect without DropCaps, but approving them now would let a
+	// later profile turn them on unnoticed
+	d := DiffPermissions(old, new)
+	if !slices.Equal(d.AddedCaps, []string{"CAP_NET_RAW"}) || !d.Escalates() {
+		t.Errorf("added caps %v, escalates %t", d.AddedCaps, d.Escalates())
+	}
+}
+
+func TestPermissionChangesUsesGivenPermissions(t *testing.T) {
+	dataHome := xdg.DataHome
+	xdg.DataHome = t.TempDir()
+	t.Cleanup(func() { xdg.DataHome = dataHome })
+
+	ai := fakeAppImage(t)
+	ai.Path = filepath.Join(ai.tempDir, "app.AppImage")
+	if err := os.WriteFile(ai.Path, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	trusted := &AppImagePerms{Level: 2, Sockets: []Socket{X11}}
+	if err := ai.SetTrustedWith(trusted); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same, as flags may leave them
+	d, err := ai.PermissionChanges(&AppImagePerms{Level: 2, Sockets: []Socket{X11}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || !d.Empty() {
+		t.Errorf("unchanged permissions differ: %v", d)
+	}
+
+	// Lowered by a flag
+	d, err = ai.PermissionChanges(&AppImagePerms{Level: 1, Sockets: []Socket{X11, Network}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d == nil || !d.Escalates() || !slices.Equal(d.AddedSockets, []Socket{Network}) {
+		t.Errorf("escalation not noticed: %v", d)
+	}
+}
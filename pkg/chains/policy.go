@@ -0,0 +1,23 @@
+package chains
+
+import (
+	"os"
+)
+
+// Policy contains restrictions that apply to every AppImage chains runs,
+// regardless of what the AppImage or its profile asks for
+type Policy struct {
+	// Allow level 0, which runs the AppImage without any sandbox at all
+	AllowUnsandboxed bool
+	// Trust AppImages signed by a key in the keyring (see KeyringDir)
+	// without them having to be approved one by one
+	TrustSigned bool
+}
+
+// CurrentPolicy is consulted by *AppImage.Sandbox before running anything.
+// Setting `CHAINS_FORBID_UNSANDBOXED` in the environment disables level 0,
+// and `CHAINS_TRUST_SIGNED` enables TrustSigned
+var CurrentPolicy = Policy{
+	AllowUnsandboxed: os.Getenv("CHAINS_FORBID_UNSANDBOXED") == "",
+	TrustSigned:      os.Getenv("CHAINS_TRUST_SIGNED") != "",
+}
@@ -0,0 +1,342 @@
+package chains
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/adrg/xdg"
+)
+
+// A LaunchPlan spells out what running an AppImage comes down to, so it can
+// be looked over, tweaked and rerun by hand. chains mounts AppImages itself,
+// so the mount is given as the equivalent command with external tools
+
+var (
+	NoMountCommand = errors.New("no external tool can mount this AppImage")
+)
+
+// LaunchPlan is what *AppImage.Sandbox would do, see *AppImage.Plan
+type LaunchPlan struct {
+	Name      string
+	Version   string
+	Path      string   // Absolute path of the AppImage
+	MountDir  string   // Where the AppImage's files are
+	TempDir   string   // Bound to `/tmp` in the sandbox
+	Extracted bool     // MountDir is an extraction rather than a mount
+	Mount     []string // Mounts or extracts the AppImage at MountDir
+	Unmount   []string // Empty for extractions, which are kept
+	Dirs      []string // Have to exist before the sandbox starts
+
+	// Set at every level but 0, which runs AppRun with `Env` added to the
+	// environment instead
+	Spec *SandboxSpec
+
+	Env     []EnvVar
+	Command []string // bwrap and its arguments, or AppRun at level 0
+
+	fsType FSType
+	offset int
+}
+
+// Plan works out how the AppImage would be mounted and sandboxed, without
+// doing either. Where it'd be mounted is where *AppImage.Mount puts it,
+// unless it's mounted already. The command is always for bwrap, as the
+// native backend is part of chains
+func (ai *AppImage) Plan(perms *AppImagePerms, args []string) (*LaunchPlan, error) {
+	if perms.Level < 0 || perms.Level > 3 {
+		return nil, errors.New("permissions level must be 0 - 3")
+	}
+
+	if perms.Level == 0 && !CurrentPolicy.AllowUnsandboxed {
+		return nil, UnsandboxedForbidden
+	}
+
+	// The spec is built from a copy, pointed at where the AppImage would be
+	// mounted
+	a := *ai
+
+	var err error
+	a.Path, err = filepath.Abs(ai.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	a.dataDir, err = filepath.Abs(ai.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !a.IsMounted() {
+		a.tempDir = filepath.Join(xdg.RuntimeDir, "aisap", "tmp", ai.sha256)
+
+		if a.mountStrategy == MountExtract {
+			a.mountDir, a.extracted = filepath.Join(extractCacheDir(), ai.sha256), true
+		} else {
+			a.mountDir = filepath.Join(xdg.RuntimeDir, "aisap", "mount", ai.sha256)
+		}
+	}
+
+	p := &LaunchPlan{
+		Name:      a.Name,
+		Version:   a.Version,
+		Path:      a.Path,
+		MountDir:  a.mountDir,
+		TempDir:   a.tempDir,
+		Extracted: a.extracted,
+		Dirs:      []string{a.tempDir, a.cacheDir()},
+		fsType:    a.FSType,
+		offset:    a.Offset,
+	}
+
+	p.Mount, p.Unmount, err = mountCommands(p.fsType, p.offset, p.Path, p.MountDir, p.Extracted)
+	if err != nil {
+		return nil, err
+	}
+
+	if perms.DataDir {
+		p.Dirs = append(p.Dirs, filepath.Join(a.dataDir, ".local/share/appimagekit"))
+	}
+
+	if perms.Level == 0 {
+		home := a.dataDir
+		if !perms.DataDir {
+			home = filepath.Join(a.tempDir, "home")
+			p.Dirs = append(p.Dirs, home)
+		}
+
+		p.Env = []EnvVar{
+			{"HOME", home},
+			{"TMPDIR", a.tempDir},
+			{"APPDIR", a.mountDir},
+			{"APPIMAGE", a.Path},
+			{"ARGV0", path.Base(a.Path)},
+		}
+		p.Command = append([]string{filepath.Join(a.mountDir, "AppRun")}, args...)
+
+		return p, nil
+	}
+
+	p.Spec, err = a.Spec(perms, args)
+	if err != nil {
+		return nil, err
+	}
+
+	p.Env = p.Spec.Env
+	p.Command = append([]string{"bwrap"}, p.Spec.BwrapArgs()...)
+
+	return p, nil
+}
+
+// Returns commands that mount the image in the file at `src` on `dir` and
+// unmount it, or extract it there
+func mountCommands(fsType FSType, offset int, src string, dir string, extract bool) ([]string, []string, error) {
+	off := strconv.Itoa(offset)
+
+	if extract {
+		switch fsType {
+		case SquashFS:
+			return []string{"unsquashfs", "-q", "-o", off, "-d", dir, src}, nil, nil
+		case DwarFS:
+			return []string{"dwarfsextract", "-i", src, "-O", off, "-o", dir}, nil, nil
+		}
+	} else {
+		unmount := []string{"fusermount", "-u", dir}
+
+		switch fsType {
+		case SquashFS:
+			return []string{"squashfuse", "-o", "offset=" + off, src, dir}, unmount, nil
+		case DwarFS:
+			return []string{"dwarfs", src, dir, "-o", "offset=" + off}, unmount, nil
+		case ISO9660:
+			return []string{"fuseiso", src, dir}, unmount, nil
+		}
+	}
+
+	return nil, nil, errors.Join(NoMountCommand, errors.New("for "+string(fsType)))
+}
+
+// WriteDryRun lists the plan's commands and the sandbox's environment,
+// shell quoted
+func (p *LaunchPlan) WriteDryRun(w io.Writer) error {
+	var b strings.Builder
+
+	if p.Extracted {
+		b.WriteString("# Extract the AppImage, unless it's in the cache already\n")
+	} else {
+		b.WriteString("# Mount the AppImage (chains does this itself, this is the equivalent)\n")
+	}
+	b.WriteString(shellJoin(p.Mount, nil) + "\n\n")
+
+	b.WriteString("# Create the directories the sandbox needs\n")
+	b.WriteString(shellJoin(append([]string{"mkdir", "-p"}, p.Dirs...), nil) + "\n\n")
+
+	b.WriteString("# Environment\n")
+	for _, e := range p.Env {
+		b.WriteString(e.Name + "=" + shellQuote(e.Value) + "\n")
+	}
+	b.WriteString("\n")
+
+	if p.Spec == nil {
+		b.WriteString("# Run the app, NOT sandboxed (level 0)\n")
+		b.WriteString(shellJoin(p.Command, nil) + "\n")
+	} else {
+		b.WriteString("# Run the sandbox\n")
+		b.WriteString(p.commandLine(p.Command, nil) + "\n")
+	}
+
+	if len(p.Unmount) > 0 {
+		b.WriteString("\n# Unmount once the app exits\n")
+		b.WriteString(shellJoin(p.Unmount, nil) + "\n")
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteScript writes a POSIX shell script that mounts the AppImage, runs it
+// as planned and cleans up, without needing chains. It uses directories of
+// its own instead of those chains shares between launches, and passes its
+// arguments on to the app. Landlock rules are left out, as they're applied
+// by chains inside of the sandbox
+func (p *LaunchPlan) WriteScript(w io.Writer) error {
+	vars := map[string]string{
+		p.MountDir: "mnt",
+		p.TempDir:  "tmp",
+	}
+
+	// Extractions are kept in the cache, the script mounts its own copy
+	// instead
+	mount, unmount, err := mountCommands(p.fsType, p.offset, p.Path, p.MountDir, false)
+	if err != nil {
+		return err
+	}
+
+	command := p.Command
+	if p.Spec != nil && p.Spec.Landlock != nil {
+		fmt.Fprintln(os.Stderr, "WARNING: the script can't apply the Landlock rules of `"+p.Name+"`, it'll be less confined than when run by chains!")
+
+		spec := *p.Spec
+		spec.Landlock = nil
+		command = append([]string{"bwrap"}, spec.BwrapArgs()...)
+	}
+
+	var b strings.Builder
+
+	b.WriteString("#!/bin/sh\n")
+	fmt.Fprintf(&b, "# Runs %s %s as chains would, generated by `chains run --emit-script`\n", p.Name, p.Version)
+	fmt.Fprintf(&b, "# Needs %s and bwrap. Landlock rules aren't applied without chains\n", mount[0])
+	b.WriteString("set -eu\n\n")
+
+	b.WriteString("mnt=$(mktemp -d)\n")
+	b.WriteString("tmp=$(mktemp -d)\n\n")
+
+	b.WriteString("cleanup() {\n")
+	fmt.Fprintf(&b, "\t%s || true\n", shellJoin(unmount, vars))
+	b.WriteString("\trmdir \"$mnt\"\n")
+	b.WriteString("\trm -rf \"$tmp\"\n")
+	b.WriteString("}\n")
+	b.WriteString("trap cleanup EXIT\n")
+	b.WriteString("trap 'exit 130' INT TERM HUP\n\n")
+
+	b.WriteString(shellJoin(mount, vars) + "\n")
+	b.WriteString(shellJoin(append([]string{"mkdir", "-p"}, p.Dirs...), vars) + "\n")
+
+	for _, dir := range p.Dirs {
+		if strings.HasSuffix(dir, "appimagekit") {
+			b.WriteString(": > " + quoteVars(filepath.Join(dir, "no_desktopintegration"), vars) + "\n")
+		}
+	}
+	b.WriteString("\n")
+
+	if p.Spec == nil {
+		b.WriteString("# Level 0, the app is NOT sandboxed\n")
+		b.WriteString("env \\\n")
+		for _, e := range p.Env {
+			b.WriteString("\t" + quoteVars(e.Name+"="+e.Value, vars) + " \\\n")
+		}
+		b.WriteString("\t" + shellJoin(command, vars) + " \"$@\"\n")
+	} else {
+		b.WriteString(p.commandLine(command, vars) + " \"$@\"")
+		if p.Spec.Seccomp != nil {
+			b.WriteString(" 3< " + shellQuote(p.Spec.Seccomp.Filter))
+		}
+		b.WriteString("\n")
+	}
+
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// Formats a bwrap command line with one option per line
+func (p *LaunchPlan) commandLine(command []string, vars map[string]string) string {
+	var b strings.Builder
+
+	for i, arg := range command {
+		if i > 0 && strings.HasPrefix(arg, "--") {
+			b.WriteString(" \\\n\t")
+		} else if i > 0 {
+			b.WriteString(" ")
+		}
+
+		b.WriteString(quoteVars(arg, vars))
+	}
+
+	return b.String()
+}
+
+func shellJoin(args []string, vars map[string]string) string {
+	quoted := make([]string, len(args))
+	for i := range args {
+		quoted[i] = quoteVars(args[i], vars)
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// Quotes `s` for the shell, replacing any of the directories in `vars` it
+// starts with by the shell variable named after it
+func quoteVars(s string, vars map[string]string) string {
+	for dir, name := range vars {
+		if s == dir {
+			return `"$` + name + `"`
+		}
+
+		if rest, found := strings.CutPrefix(s, dir+"/"); found {
+			return `"$` + name + `"` + shellQuote("/"+rest)
+		}
+
+		// Environment assignments, eg: `APPDIR=<dir>`
+		if key, value, found := strings.Cut(s, "="); found && !strings.Contains(key, "/") && (value == dir || strings.HasPrefix(value, dir+"/")) {
+			return shellQuote(key+"=") + quoteVars(value, vars)
+		}
+	}
+
+	return shellQuote(s)
+}
+
+// Quotes `s` for POSIX shells if it needs to be
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+
+	safe := true
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./:,+=@%", c)) {
+			safe = false
+			break
+		}
+	}
+
+	if safe {
+		return s
+	}
+
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
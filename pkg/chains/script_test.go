@@ -0,0 +1,63 @@
+package chains
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Runs `f`, returning what it wrote to stderr
+func captureStderr(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	stderr := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = stderr }()
+
+	f()
+	w.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+func TestWriteScriptWarnsOfLandlock(t *testing.T) {
+	for _, landlock := range []bool{false, true} {
+		p := &LaunchPlan{
+			Name:     "chains-test-app",
+			Path:     "/tmp/chains-test.AppImage",
+			MountDir: "/tmp/mnt",
+			TempDir:  "/tmp/tmp",
+			Spec:     scriptSpec("true"),
+			Command:  []string{"bwrap"},
+			fsType:   SquashFS,
+		}
+		if landlock {
+			p.Spec.Landlock = p.Spec.landlockRules()
+		}
+
+		var script strings.Builder
+		var err error
+		warning := captureStderr(t, func() { err = p.WriteScript(&script) })
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if warned := strings.Contains(warning, "Landlock"); warned != landlock {
+			t.Errorf("landlock %t: warning %q", landlock, warning)
+		}
+
+		if !strings.HasPrefix(script.String(), "#!/bin/sh\n") {
+			t.Errorf("landlock %t: script %q", landlock, script.String())
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package chains
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/adrg/xdg"
+)
+
+// Type 2 AppImages may be signed by appimagetool, which stores a detached
+// GPG signature in the runtime's `.sha256_sig` section and the public key
+// that made it in `.sig_key`. What's signed is the hex SHA-256 of the whole
+// file, with both of those sections zeroed out
+
+var (
+	NotSigned        = errors.New("AppImage isn't signed")
+	InvalidSignature = errors.New("signature doesn't match the AppImage's contents")
+	UnknownSigner    = errors.New("signed by a key that isn't in the keyring or embedded in the AppImage")
+	WeakSignature    = errors.New("signature made with a broken hash (MD5, SHA-1 or RIPEMD-160)")
+	ExpiredSignature = errors.New("signature or the key that made it has expired")
+	RevokedKey       = errors.New("signed by a key that has been revoked")
+)
+
+// Hashes that can no longer be trusted to tie a signature to what's signed
+var weakHashes = []crypto.Hash{crypto.MD5, crypto.SHA1, crypto.RIPEMD160}
+
+// Signature describes who signed an AppImage
+type Signature struct {
+	KeyID       string   // Long ID of the key that made the signature
+	Fingerprint string   // Fingerprint of the key's primary key
+	Identities  []string // User IDs of the key (eg: `Name <mail@example.com>`)
+	Approved    bool     // The key is in the chains keyring
+}
+
+// Directory holding the keys approved to sign AppImages, one per file
+func KeyringDir() string {
+	return filepath.Join(xdg.DataHome, "chains", "keyring")
+}
+
+// Reads every key in the keyring, armored or not
+func LoadKeyring() (openpgp.EntityList, error) {
+	entries, err := os.ReadDir(KeyringDir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var keyring openpgp.EntityList
+
+	for _, e := range entries {
+		// Keys still being written by ApproveKey
+		if e.IsDir() || strings.Contains(e.Name(), ".tmp-") {
+			continue
+		}
+
+		b, err := os.ReadFile(filepath.Join(KeyringDir(), e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		keys, err := readKeys(b)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to read key `"+e.Name()+"`"), err)
+		}
+
+		keyring = append(keyring, keys...)
+	}
+
+	return keyring, nil
+}
+
+// Adds the public keys in `key` to the keyring, returning their fingerprints
+func ApproveKey(key []byte) ([]string, error) {
+	keys, err := readKeys(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(KeyringDir(), 0700); err != nil {
+		return nil, err
+	}
+
+	var fingerprints []string
+
+	for _, k := range keys {
+		fingerprint := strings.ToUpper(hex.EncodeToString(k.PrimaryKey.Fingerprint[:]))
+
+		// Only ever store the public parts
+		var b bytes.Buffer
+		if err := k.Serialize(&b); err != nil {
+			return fingerprints, err
+		}
+
+		if err := writeKey(filepath.Join(KeyringDir(), strings.ToLower(fingerprint)+".gpg"), b.Bytes()); err != nil {
+			return fingerprints, err
+		}
+
+		fingerprints = append(fingerprints, fingerprint)
+	}
+
+	return fingerprints, nil
+}
+
+// Replaces the key at `path` in one go, so that it's never read half written,
+// not even after a crash
+func writeKey(path string, b []byte) error {
+	tmp := path + ".tmp-" + strconv.Itoa(os.Getpid())
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// Removes the key with the given fingerprint from the keyring
+func RevokeKey(fingerprint string) error {
+	return os.Remove(filepath.Join(KeyringDir(), strings.ToLower(fingerprint)+".gpg"))
+}
+
+func readKeys(b []byte) (openpgp.EntityList, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN")) {
+		return openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	}
+
+	return openpgp.ReadKeyRing(bytes.NewReader(b))
+}
+
+// Returns the public key embedded in the AppImage by whoever signed it. It
+// proves nothing by itself, as anyone re-signing the AppImage can swap it out
+func (ai *AppImage) SigningKey() ([]byte, error) {
+	_, key, err := ai.signatureSections()
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		return nil, NotSigned
+	}
+
+	return key, nil
+}
+
+// Verifies the AppImage's signature. Signatures made by a key in the keyring
+// are Approved. Otherwise, the key embedded in the AppImage is used and the
+// Signature only says who claims to have signed it. Signatures made with a
+// weak hash or by an expired or revoked key are refused either way
+func (ai *AppImage) Verify() (*Signature, error) {
+	sig, embeddedKey, err := ai.signatureSections()
+	if err != nil {
+		return nil, err
+	}
+
+	if sig == nil {
+		return nil, NotSigned
+	}
+
+	digest, err := ai.signedDigest()
+	if err != nil {
+		return nil, err
+	}
+
+	keyring, err := LoadKeyring()
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := checkSignature(keyring, digest, sig)
+	if err == nil {
+		return newSignature(signer, true), nil
+	} else if !errors.Is(err, pgperrors.ErrUnknownIssuer) {
+		return nil, err
+	}
+
+	if embeddedKey != nil {
+		keys, err := readKeys(embeddedKey)
+		if err != nil {
+			return nil, errors.Join(errors.New("failed to read the AppImage's `.sig_key`"), err)
+		}
+
+		signer, err = checkSignature(keys, digest, sig)
+		if err == nil {
+			return newSignature(signer, false), nil
+		} else if !errors.Is(err, pgperrors.ErrUnknownIssuer) {
+			return nil, err
+		}
+	}
+
+	return nil, UnknownSigner
+}
+
+// Returns the key in `keyring` that made `sig`. Expiry and revocation are
+// checked as of now
+func checkSignature(keyring openpgp.KeyRing, digest string, sig []byte) (*openpgp.Entity, error) {
+	r := io.Reader(bytes.NewReader(sig))
+	if bytes.HasPrefix(sig, []byte("-----BEGIN")) {
+		block, err := armor.Decode(r)
+		if err != nil {
+			return nil, errors.Join(InvalidSignature, err)
+		}
+
+		r = block.Body
+	}
+
+	s, signer, err := openpgp.VerifyDetachedSignature(keyring, strings.NewReader(digest), r, nil)
+	switch {
+	case errors.Is(err, pgperrors.ErrUnknownIssuer):
+		return nil, err
+	case errors.Is(err, pgperrors.ErrKeyRevoked):
+		return nil, RevokedKey
+	case errors.Is(err, pgperrors.ErrKeyExpired), errors.Is(err, pgperrors.ErrSignatureExpired):
+		return nil, ExpiredSignature
+	case err != nil:
+		return nil, errors.Join(InvalidSignature, err)
+	case slices.Contains(weakHashes, s.Hash):
+		return nil, errors.Join(WeakSignature, errors.New(s.Hash.String()))
+	}
+
+	return signer, nil
+}
+
+func newSignature(e *openpgp.Entity, approved bool) *Signature {
+	s := &Signature{
+		KeyID:       e.PrimaryKey.KeyIdString(),
+		Fingerprint: strings.ToUpper(hex.EncodeToString(e.PrimaryKey.Fingerprint[:])),
+		Approved:    approved,
+	}
+
+	for name := range e.Identities {
+		s.Identities = append(s.Identities, name)
+	}
+	slices.Sort(s.Identities)
+
+	return s
+}
+
+// Returns the contents of the `.sha256_sig` and `.sig_key` sections, nil if
+// missing or empty. The sections are fixed size, padded with zeroes
+func (ai *AppImage) signatureSections() ([]byte, []byte, error) {
+	if ai.imageType != 2 {
+		return nil, nil, nil
+	}
+
+	e, err := elf.Open(ai.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer e.Close()
+
+	var sections [2][]byte
+
+	for i, name := range []string{".sha256_sig", ".sig_key"} {
+		s := e.Section(name)
+		if s == nil {
+			continue
+		}
+
+		b, err := s.Data()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		b = bytes.TrimRight(b, "\x00")
+		if len(b) > 0 {
+			sections[i] = b
+		}
+	}
+
+	return sections[0], sections[1], nil
+}
+
+// Returns the hex SHA-256 of the AppImage, with its signature sections
+// zeroed out
+func (ai *AppImage) signedDigest() (string, error) {
+	sum, err := digestZeroing(ai.Path, sha256.New(), ".sha256_sig", ".sig_key")
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum), nil
+}
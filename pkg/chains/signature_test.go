@@ -0,0 +1,286 @@
+package chains
+
+import (
+	"bytes"
+	"crypto"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/adrg/xdg"
+)
+
+// Writes a type 2 AppImage with empty signature sections, as appimagetool
+// leaves them before signing, followed by a SquashFS image. Returns where
+// each section starts
+func writeUnsignedAppImage(t *testing.T, path string) (sigOff int64, keyOff int64) {
+	names := "\x00.shstrtab\x00.sha256_sig\x00.sig_key\x00"
+	payload := []byte("the rest of the AppImage")
+
+	const sigSize, keySize = 1024, 8192
+
+	namesOff := int64(binary.Size(elf.Header64{}))
+	sigOff = namesOff + int64(len(names))
+	keyOff = sigOff + sigSize
+	payloadOff := keyOff + keySize
+	shOff := payloadOff + int64(len(payload))
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     uint64(shOff),
+		Ehsize:    uint16(namesOff),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+		Shnum:     4,
+		Shstrndx:  1,
+	}
+	copy(hdr.Ident[:], "\x7fELF\x02\x01\x01\x00AI\x02")
+
+	sections := []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_STRTAB), Off: uint64(namesOff), Size: uint64(len(names))},
+		{Name: 11, Type: uint32(elf.SHT_PROGBITS), Off: uint64(sigOff), Size: sigSize},
+		{Name: 23, Type: uint32(elf.SHT_PROGBITS), Off: uint64(keyOff), Size: keySize},
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, hdr)
+	b.WriteString(names)
+	b.Write(make([]byte, sigSize+keySize))
+	b.Write(payload)
+	binary.Write(&b, binary.LittleEndian, sections)
+	b.Write(buildSquashfs([]testISOEntry{
+		{name: "org.example.App.desktop", data: "[Desktop Entry]\nName=App\nX-AppImage-Version=1\n"},
+	}))
+
+	if err := os.WriteFile(path, b.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return sigOff, keyOff
+}
+
+// Signs the AppImage at `path` like appimagetool does, embedding the public
+// key. Returns it armored
+func signAppImage(t *testing.T, path string, key *openpgp.Entity) []byte {
+	return signAppImageWith(t, path, key, nil)
+}
+
+// Signs the AppImage at `path` with the hash and time given by `config`
+func signAppImageWith(t *testing.T, path string, key *openpgp.Entity, config *packet.Config) []byte {
+	sigOff, keyOff := writeUnsignedAppImage(t, path)
+
+	digest, err := (&AppImage{Path: path, imageType: 2}).signedDigest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Made by hand, as openpgp refuses to sign with SHA-1 or keys that have
+	// expired or been revoked
+	packetSig := &packet.Signature{
+		SigType:      packet.SigTypeBinary,
+		PubKeyAlgo:   key.PrivateKey.PubKeyAlgo,
+		Hash:         config.Hash(),
+		CreationTime: config.Now(),
+		IssuerKeyId:  &key.PrivateKey.KeyId,
+	}
+	if lifetime := config.SigLifetime(); lifetime != 0 {
+		packetSig.SigLifetimeSecs = &lifetime
+	}
+
+	h, err := packetSig.PrepareSign(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte(digest))
+	if err := packetSig.Sign(h, key.PrivateKey, config); err != nil {
+		t.Fatal(err)
+	}
+
+	var sig bytes.Buffer
+	sw, err := armor.Encode(&sig, openpgp.SignatureType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := packetSig.Serialize(sw); err != nil {
+		t.Fatal(err)
+	}
+	sw.Close()
+
+	var pub bytes.Buffer
+	w, err := armor.Encode(&pub, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt(sig.Bytes(), sigOff); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(pub.Bytes(), keyOff); err != nil {
+		t.Fatal(err)
+	}
+
+	return pub.Bytes()
+}
+
+func TestSignature(t *testing.T) {
+	dataHome := xdg.DataHome
+	xdg.DataHome = t.TempDir()
+	t.Cleanup(func() { xdg.DataHome = dataHome })
+
+	policy := CurrentPolicy
+	CurrentPolicy.TrustSigned = true
+	t.Cleanup(func() { CurrentPolicy = policy })
+
+	key, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+
+	unsigned := &AppImage{Path: filepath.Join(dir, "unsigned.AppImage"), imageType: 2}
+	writeUnsignedAppImage(t, unsigned.Path)
+
+	if _, err := unsigned.Verify(); !errors.Is(err, NotSigned) {
+		t.Errorf("unsigned AppImage verified: %v", err)
+	}
+
+	ai := &AppImage{Path: filepath.Join(dir, "signed.AppImage"), imageType: 2, sha256: "signed"}
+	pub := signAppImage(t, ai.Path, key)
+
+	// Only signed by the key it carries, which proves nothing
+	sig, err := ai.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Approved || sig.Identities[0] != "Test <test@example.com>" {
+		t.Errorf("signature by embedded key: %+v", sig)
+	}
+	if ai.Trusted() {
+		t.Error("trusted without the key being approved")
+	}
+
+	fingerprints, err := ApproveKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fingerprints) != 1 || fingerprints[0] != sig.Fingerprint {
+		t.Errorf("approved %v, signed by %s", fingerprints, sig.Fingerprint)
+	}
+
+	entries, err := os.ReadDir(KeyringDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != strings.ToLower(sig.Fingerprint)+".gpg" {
+		t.Errorf("keyring holds %v", entries)
+	}
+
+	if info, err := os.Stat(KeyringDir()); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("keyring dir: %v, %v", info.Mode(), err)
+	}
+
+	sig, err = ai.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sig.Approved {
+		t.Error("signature by approved key isn't approved")
+	}
+
+	if state, err := ai.TrustState(); err != nil || state != TrustSignature {
+		t.Errorf("trust state %s, %v", state, err)
+	}
+
+	CurrentPolicy.TrustSigned = false
+	if ai.Trusted() {
+		t.Error("trusted by signature, but the policy doesn't allow it")
+	}
+
+	// Anything changed outside of the signature sections breaks it
+	b, err := os.ReadFile(ai.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[bytes.Index(b, []byte("the rest"))] = 'T'
+	if err := os.WriteFile(ai.Path, b, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ai.Verify(); !errors.Is(err, InvalidSignature) {
+		t.Errorf("tampered AppImage verified: %v", err)
+	}
+}
+
+func TestSignatureRefused(t *testing.T) {
+	dataHome := xdg.DataHome
+	xdg.DataHome = t.TempDir()
+	t.Cleanup(func() { xdg.DataHome = dataHome })
+
+	past := &packet.Config{Time: func() time.Time { return time.Now().Add(-48 * time.Hour) }}
+
+	for _, c := range []struct {
+		name string
+		key  *packet.Config // Used to generate the key
+		sig  *packet.Config // Used to sign
+		want error
+	}{
+		// Without the salt notation, which SHA-1 can't make
+		{"sha1", nil, &packet.Config{DefaultHash: crypto.SHA1, NonDeterministicSignaturesViaNotation: new(bool)}, WeakSignature},
+		{"expired key", &packet.Config{Time: past.Time, KeyLifetimeSecs: 3600}, past, ExpiredSignature},
+		{"expired signature", nil, &packet.Config{Time: past.Time, SigLifetimeSecs: 3600}, ExpiredSignature},
+		{"revoked key", nil, nil, RevokedKey},
+		{"sha512", nil, &packet.Config{DefaultHash: crypto.SHA512}, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			key, err := openpgp.NewEntity("Test", "", "test@example.com", c.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.want == RevokedKey {
+				if err := key.RevokeKey(packet.KeyCompromised, "", nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ai := &AppImage{Path: filepath.Join(t.TempDir(), "signed.AppImage"), imageType: 2}
+			pub := signAppImageWith(t, ai.Path, key, c.sig)
+
+			if _, err := ai.Verify(); !errors.Is(err, c.want) {
+				t.Errorf("verified by the embedded key: %v, want %v", err, c.want)
+			}
+
+			// Approving the key changes nothing
+			if _, err := ApproveKey(pub); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.RemoveAll(KeyringDir()) })
+
+			if _, err := ai.Verify(); !errors.Is(err, c.want) {
+				t.Errorf("verified by the keyring: %v, want %v", err, c.want)
+			}
+		})
+	}
+}
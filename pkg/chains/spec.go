@@ -0,0 +1,234 @@
+package chains
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// Version of the SandboxSpec format, bumped whenever its meaning changes
+const SpecVersion = 1
+
+// SandboxSpec is a backend-neutral description of a sandbox. *AppImagePerms
+// are compiled into one by *AppImage.Spec, which backends (bwrap, native,
+// OCI...) then render into whatever form they need. It serializes to JSON so
+// it can be diffed, cached and stored
+type SandboxSpec struct {
+	Version       int        `json:"version"`
+	Mounts        []Mount    `json:"mounts"`  // Applied in order
+	Devices       []Device   `json:"devices"` // Applied after all mounts
+	Env           []EnvVar   `json:"env"`
+	Namespaces    Namespaces `json:"namespaces"`
+	Seccomp       *Seccomp   `json:"seccomp,omitempty"`
+	Landlock      *Landlock  `json:"landlock,omitempty"`
+	Identity      *Identity  `json:"identity,omitempty"` // Map the user to this uid/gid, needs a user namespace
+	DropCaps      bool       `json:"drop_caps"`          // Drop all capabilities except `KeepCaps`
+	KeepCaps      []string   `json:"keep_caps,omitempty"`
+	DisableUserns bool       `json:"disable_userns"` // Forbid nested user namespaces, needs a user namespace
+	DieWithParent bool       `json:"die_with_parent"`
+	NewSession    bool       `json:"new_session"` // Detach from the controlling terminal
+	Exec          Exec       `json:"exec"`
+}
+
+type MountType string
+
+const (
+	BindMount   MountType = "bind"    // Read-write bind mount of `Source`
+	ROBindMount MountType = "ro-bind" // Read-only bind mount of `Source`
+	TmpfsMount  MountType = "tmpfs"   // Empty tmpfs
+	DirMount    MountType = "dir"     // Create an empty directory
+	ProcMount   MountType = "proc"    // Fresh procfs
+	DevMount    MountType = "dev"     // Minimal /dev with only basic device nodes
+)
+
+type Mount struct {
+	Type     MountType `json:"type"`
+	Source   string    `json:"source,omitempty"`
+	Dest     string    `json:"dest"`
+	Optional bool      `json:"optional,omitempty"` // Skip if `Source` doesn't exist
+	Mode     uint32    `json:"mode,omitempty"`     // Permissions of a created dir or tmpfs
+}
+
+// Device is a device file (or directory of them) bound from the host
+type Device struct {
+	Source   string `json:"source"`
+	Dest     string `json:"dest"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+type EnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Namespaces lists which namespaces the sandbox gets its own copy of. The
+// mount namespace is always unshared
+type Namespaces struct {
+	User   bool `json:"user"`
+	Cgroup bool `json:"cgroup"`
+	Ipc    bool `json:"ipc"`
+	Net    bool `json:"net"`
+	Pid    bool `json:"pid"`
+	Uts    bool `json:"uts"`
+}
+
+// Seccomp points to a compiled (classic BPF) seccomp filter loaded before
+// running the app. chains loads it after the Landlock ruleset is applied, so
+// it doesn't have to allow the Landlock syscalls. Anything else that runs the
+// spec and loads the filter first needs it to allow landlock_create_ruleset,
+// landlock_add_rule and landlock_restrict_self
+type Seccomp struct {
+	Filter string `json:"filter"`
+}
+
+// Exec is what gets run once the sandbox is set up
+type Exec struct {
+	Path string   `json:"path"`
+	Args []string `json:"args"`
+}
+
+// ReadSpec decodes a JSON *SandboxSpec, as written by *SandboxSpec.WriteTo
+func ReadSpec(r io.Reader) (*SandboxSpec, error) {
+	s := &SandboxSpec{}
+	err := json.NewDecoder(r).Decode(s)
+
+	return s, err
+}
+
+// WriteTo encodes the spec as indented JSON
+func (s *SandboxSpec) WriteTo(w io.Writer) (int64, error) {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(append(b, '\n'))
+
+	return int64(n), err
+}
+
+func (s *SandboxSpec) bind(t MountType, src string, dest string, optional bool) {
+	s.Mounts = append(s.Mounts, Mount{
+		Type:     t,
+		Source:   src,
+		Dest:     dest,
+		Optional: optional,
+	})
+}
+
+func (s *SandboxSpec) device(src string, dest string, optional bool) {
+	s.Devices = append(s.Devices, Device{
+		Source:   src,
+		Dest:     dest,
+		Optional: optional,
+	})
+}
+
+// Capabilities the app keeps. `KeepCaps` only means anything along with
+// `DropCaps`
+func (s *SandboxSpec) keptCaps() []string {
+	if !s.DropCaps {
+		return nil
+	}
+
+	return s.KeepCaps
+}
+
+func (s *SandboxSpec) setenv(name string, value string) {
+	s.Env = append(s.Env, EnvVar{Name: name, Value: value})
+}
+
+// BwrapArgs renders the spec as arguments to bwrap. If the spec has a
+// seccomp filter, bwrap expects it to be passed as file descriptor 3, unless
+// it has a Landlock ruleset and LandlockHelper is set. The helper, which is
+// the running program bound into the sandbox, loads the filter then
+func (s *SandboxSpec) BwrapArgs() []string {
+	var args []string
+
+	s = s.withLandlockHelper(landlockHelperBinary())
+
+	for _, e := range s.Env {
+		args = append(args, "--setenv", e.Name, e.Value)
+	}
+
+	if s.DieWithParent {
+		args = append(args, "--die-with-parent")
+	}
+
+	if s.NewSession {
+		args = append(args, "--new-session")
+	}
+
+	namespaces := []struct {
+		unshared bool
+		flag     string
+	}{
+		{s.Namespaces.User && !s.DisableUserns, "--unshare-user-try"},
+		{s.Namespaces.User && s.DisableUserns, "--unshare-user"}, // bwrap won't disable them in a namespace it only tries to make
+		{s.Namespaces.Cgroup, "--unshare-cgroup-try"},
+		{s.Namespaces.Ipc, "--unshare-ipc"},
+		{s.Namespaces.Net, "--unshare-net"},
+		{s.Namespaces.Pid, "--unshare-pid"},
+		{s.Namespaces.Uts, "--unshare-uts"},
+	}
+
+	for _, ns := range namespaces {
+		if ns.unshared {
+			args = append(args, ns.flag)
+		}
+	}
+
+	if s.Identity != nil {
+		args = append(args,
+			"--uid", strconv.Itoa(s.Identity.Uid),
+			"--gid", strconv.Itoa(s.Identity.Gid),
+		)
+	}
+
+	if s.DisableUserns {
+		args = append(args, "--disable-userns")
+	}
+
+	if s.DropCaps {
+		args = append(args, "--cap-drop", "ALL")
+	}
+
+	for _, c := range s.keptCaps() {
+		args = append(args, "--cap-add", c)
+	}
+
+	for _, m := range s.Mounts {
+		if m.Mode != 0 {
+			args = append(args, "--perms", "0"+strconv.FormatUint(uint64(m.Mode), 8))
+		}
+
+		try := ""
+		if m.Optional {
+			try = "-try"
+		}
+
+		switch m.Type {
+		case BindMount, ROBindMount:
+			args = append(args, "--"+string(m.Type)+try, m.Source, m.Dest)
+		default:
+			args = append(args, "--"+string(m.Type), m.Dest)
+		}
+	}
+
+	for _, d := range s.Devices {
+		flag := "--dev-bind"
+		if d.Optional {
+			flag = "--dev-bind-try"
+		}
+
+		args = append(args, flag, d.Source, d.Dest)
+	}
+
+	if s.Seccomp != nil {
+		args = append(args, "--seccomp", "3")
+	}
+
+	args = append(args, "--", s.Exec.Path)
+
+	return append(args, s.Exec.Args...)
+}
@@ -0,0 +1,502 @@
+package chains
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/CalebQ42/squashfs"
+	squashfslow "github.com/CalebQ42/squashfs/low"
+	"github.com/CalebQ42/squashfs/low/data"
+	"github.com/CalebQ42/squashfs/low/directory"
+	"github.com/CalebQ42/squashfs/low/inode"
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Opens the SquashFS image found at `offset` of `r`. Supports every
+// compression SquashFS does (gzip, lzma, lzo, xz, lz4 and zstd)
+func openSquashfs(r io.ReaderAt, offset int64) (*squashfs.Reader, error) {
+	rdr, err := squashfs.NewReaderAtOffset(r, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return rdr, prepareSquashfs(rdr)
+}
+
+func prepareSquashfs(rdr *squashfs.Reader) error {
+	// The reader fills its ID and fragment tables lazily, which isn't safe to
+	// do from multiple goroutines at once (as FUSE requests are served).
+	// Filling them up front avoids it
+	low := &rdr.Low
+
+	if low.Superblock.IdCount > 0 {
+		if _, err := low.Id(low.Superblock.IdCount - 1); err != nil {
+			return err
+		}
+	}
+
+	if low.Superblock.FragCount > 0 {
+		f := inode.File{}
+		f.FragInd = low.Superblock.FragCount - 1
+		f.Size = 1
+
+		b := squashfslow.FileBase{Inode: inode.Inode{
+			Header: inode.Header{Type: inode.Fil},
+			Data:   f,
+		}}
+
+		if _, err := b.GetReader(low); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// squashfsImage is an AppImage's SquashFS image, usable as an fs.FS
+type squashfsImage struct {
+	*squashfs.Reader
+	f *os.File
+}
+
+func (s *squashfsImage) Close() error {
+	return s.f.Close()
+}
+
+// ReadFile reads a file from the image, following symlinks as long as they
+// stay inside of it. `.DirIcon` and the desktop entry are usually symlinks
+func (s *squashfsImage) ReadFile(name string) ([]byte, error) {
+	f, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Give up on symlink loops
+	for range 40 {
+		sf, ok := f.(*squashfs.File)
+		if !ok || !sf.IsSymlink() {
+			break
+		}
+
+		target := sf.GetSymlinkFile()
+		sf.Close()
+
+		if target == nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+
+		f = target
+	}
+	defer f.Close()
+
+	return io.ReadAll(f)
+}
+
+// Opens the AppImage's SquashFS image for reading
+func (ai *AppImage) openSquashfs() (*squashfsImage, error) {
+	if ai.FSType != SquashFS {
+		return nil, errors.New("AppImage doesn't contain a SquashFS image")
+	}
+
+	f, err := os.Open(ai.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	rdr, err := openSquashfs(f, int64(ai.Offset))
+	if err != nil {
+		f.Close()
+		return nil, errors.Join(InvalidImage, err)
+	}
+
+	return &squashfsImage{Reader: rdr, f: f}, nil
+}
+
+// Extraction options that can't hang. The library's defaults give zero
+// goroutines to work with on single core machines
+func extractOptions() *squashfs.ExtractionOptions {
+	opts := squashfs.DefaultOptions()
+	opts.UnbreakSymlink = true
+
+	opts.SimultaneousFiles = max(opts.SimultaneousFiles, 1)
+	opts.ExtractionRoutines = max(opts.ExtractionRoutines, 1)
+
+	return opts
+}
+
+// mountSquashfs serves the SquashFS image at `offset` of `src` over FUSE at
+// `dest`. The filesystem is served from the calling process, so stays mounted
+// only until the returned server is unmounted or the process exits. Only root
+// can mount FUSE filesystems directly, everyone else still needs fusermount,
+// which go-fuse runs itself
+func mountSquashfs(src string, dest string, offset int) (*fuse.Server, *os.File, error) {
+	if !FileExists("/dev/fuse") {
+		return nil, nil, &MountError{Path: src, Dest: dest, Err: NoFuse}
+	}
+
+	f, err := os.Open(src)
+	if err != nil {
+		return nil, nil, &MountError{Path: src, Dest: dest, Err: err}
+	}
+
+	rdr, err := openSquashfs(f, int64(offset))
+	if err != nil {
+		f.Close()
+		return nil, nil, &MountError{Path: src, Dest: dest, Err: errors.Join(InvalidImage, err)}
+	}
+
+	root := &squashNode{
+		r:    &rdr.Low,
+		base: rdr.Low.Root.FileBase,
+	}
+
+	// Nothing in the image can ever change, so the kernel may cache freely
+	timeout := time.Hour
+	server, err := gofs.Mount(dest, root, &gofs.Options{
+		EntryTimeout: &timeout,
+		AttrTimeout:  &timeout,
+		MountOptions: fuse.MountOptions{
+			FsName:        src,
+			Name:          "squashfs",
+			Options:       []string{"ro"},
+			DirectMount:   true,
+			DisableXAttrs: true,
+		},
+	})
+	if err != nil {
+		f.Close()
+		return nil, nil, &MountError{Path: src, Dest: dest, Err: err}
+	}
+
+	return server, f, nil
+}
+
+type squashNode struct {
+	gofs.Inode
+
+	r    *squashfslow.Reader
+	base squashfslow.FileBase
+
+	once    sync.Once
+	entries []directory.Entry
+	dirErr  error
+}
+
+var (
+	_ = (gofs.NodeGetattrer)((*squashNode)(nil))
+	_ = (gofs.NodeLookuper)((*squashNode)(nil))
+	_ = (gofs.NodeReaddirer)((*squashNode)(nil))
+	_ = (gofs.NodeReadlinker)((*squashNode)(nil))
+	_ = (gofs.NodeOpener)((*squashNode)(nil))
+	_ = (gofs.NodeReader)((*squashNode)(nil))
+)
+
+// Converts an inode type to the `S_IF*` bits of its mode. Extended types
+// directly follow the basic ones
+func squashType(t uint16) uint32 {
+	if t > inode.Sock {
+		t -= inode.Sock
+	}
+
+	switch t {
+	case inode.Dir:
+		return syscall.S_IFDIR
+	case inode.Sym:
+		return syscall.S_IFLNK
+	case inode.Block:
+		return syscall.S_IFBLK
+	case inode.Char:
+		return syscall.S_IFCHR
+	case inode.Fifo:
+		return syscall.S_IFIFO
+	case inode.Sock:
+		return syscall.S_IFSOCK
+	}
+
+	return syscall.S_IFREG
+}
+
+func (n *squashNode) dir() ([]directory.Entry, error) {
+	n.once.Do(func() {
+		d, err := n.base.ToDir(n.r)
+		n.entries, n.dirErr = d.Entries, err
+	})
+
+	return n.entries, n.dirErr
+}
+
+func (n *squashNode) fillAttr(out *fuse.Attr) {
+	i := n.base.Inode
+
+	out.Ino = uint64(i.Num)
+	out.Mode = squashType(i.Type) | uint32(i.Perm)
+	out.Size = i.Size()
+	out.Blocks = (out.Size + 511) / 512
+	out.Nlink = max(i.LinkCount(), 1)
+	out.Mtime = uint64(i.ModTime)
+	out.Atime = out.Mtime
+	out.Ctime = out.Mtime
+
+	if uid, err := n.base.Uid(n.r); err == nil {
+		out.Uid = uid
+	}
+
+	if gid, err := n.base.Gid(n.r); err == nil {
+		out.Gid = gid
+	}
+
+	switch d := i.Data.(type) {
+	case inode.Symlink:
+		out.Size = uint64(len(d.Target))
+	case inode.ESymlink:
+		out.Size = uint64(len(d.Target))
+	}
+}
+
+func (n *squashNode) Getattr(ctx context.Context, fh gofs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.fillAttr(&out.Attr)
+	return 0
+}
+
+func (n *squashNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*gofs.Inode, syscall.Errno) {
+	entries, err := n.dir()
+	if err != nil {
+		return nil, syscall.EIO
+	}
+
+	i, found := slices.BinarySearchFunc(entries, name, func(e directory.Entry, name string) int {
+		return strings.Compare(e.Name, name)
+	})
+	if !found {
+		return nil, syscall.ENOENT
+	}
+
+	b, err := n.r.BaseFromEntry(entries[i])
+	if err != nil {
+		return nil, syscall.EIO
+	}
+
+	child := &squashNode{r: n.r, base: b}
+	child.fillAttr(&out.Attr)
+
+	return n.NewInode(ctx, child, gofs.StableAttr{
+		Mode: squashType(b.Inode.Type),
+		Ino:  uint64(b.Inode.Num),
+	}), 0
+}
+
+func (n *squashNode) Readdir(ctx context.Context) (gofs.DirStream, syscall.Errno) {
+	entries, err := n.dir()
+	if err != nil {
+		return nil, syscall.EIO
+	}
+
+	list := make([]fuse.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, fuse.DirEntry{
+			Name: e.Name,
+			Ino:  uint64(e.Num),
+			Mode: squashType(e.InodeType),
+		})
+	}
+
+	return gofs.NewListDirStream(list), 0
+}
+
+func (n *squashNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	switch d := n.base.Inode.Data.(type) {
+	case inode.Symlink:
+		return d.Target, 0
+	case inode.ESymlink:
+		return d.Target, 0
+	}
+
+	return nil, syscall.EINVAL
+}
+
+func (n *squashNode) Open(ctx context.Context, flags uint32) (gofs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR|syscall.O_TRUNC|syscall.O_APPEND) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+
+	if !n.base.IsRegular() {
+		return nil, 0, syscall.EINVAL
+	}
+
+	return &squashFile{node: n}, fuse.FOPEN_KEEP_CACHE, 0
+}
+
+func (n *squashNode) Read(ctx context.Context, fh gofs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	f, ok := fh.(*squashFile)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	read, err := f.readAt(dest, off)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+
+	return fuse.ReadResultData(dest[:read]), 0
+}
+
+// squashFile is an open file. SquashFS data can only be read sequentially, so
+// reads continue from where the last one left off when possible and otherwise
+// start over from the block containing the requested offset
+type squashFile struct {
+	mu   sync.Mutex
+	node *squashNode
+	rdr  *data.Reader
+	pos  int64
+}
+
+func (f *squashFile) readAt(dest []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	size := int64(f.node.base.Inode.Size())
+	if off >= size {
+		return 0, nil
+	}
+
+	if f.rdr == nil || off != f.pos {
+		blockSize := int64(f.node.r.Superblock.BlockSize)
+		block := off / blockSize
+
+		b, err := fromBlock(f.node.base, int(block), uint64(blockSize))
+		if err != nil {
+			return 0, err
+		}
+
+		rdr, err := b.GetReader(f.node.r)
+		if err != nil {
+			return 0, err
+		}
+
+		if f.rdr != nil {
+			f.rdr.Close()
+		}
+
+		f.rdr, f.pos = rdr, block*blockSize
+
+		if _, err := io.CopyN(io.Discard, f.rdr, off-f.pos); err != nil {
+			f.rdr = nil
+			return 0, err
+		}
+
+		f.pos = off
+	}
+
+	n, err := io.ReadFull(f.rdr, dest[:min(int64(len(dest)), size-off)])
+	f.pos += int64(n)
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (f *squashFile) Release(ctx context.Context) syscall.Errno {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.rdr != nil {
+		f.rdr.Close()
+		f.rdr = nil
+	}
+
+	return 0
+}
+
+// Returns a copy of a regular file whose data begins at `block`, so it can be
+// read from the middle without decompressing everything before it
+func fromBlock(b squashfslow.FileBase, block int, blockSize uint64) (squashfslow.FileBase, error) {
+	if block == 0 {
+		return b, nil
+	}
+
+	var start, size uint64
+	var sizes []uint32
+	var fragInd, fragOffset uint32
+
+	switch d := b.Inode.Data.(type) {
+	case inode.File:
+		start, size, sizes = uint64(d.BlockStart), uint64(d.Size), d.BlockSizes
+		fragInd, fragOffset = d.FragInd, d.FragOffset
+	case inode.EFile:
+		start, size, sizes = d.BlockStart, d.Size, d.BlockSizes
+		fragInd, fragOffset = d.FragInd, d.FragOffset
+	default:
+		return b, syscall.EINVAL
+	}
+
+	if block > len(sizes) {
+		return b, io.EOF
+	}
+
+	// Skip over the blocks' data, the high bit only marks them uncompressed
+	for _, s := range sizes[:block] {
+		start += uint64(s &^ (1 << 24))
+	}
+
+	f := inode.EFile{BlockSizes: sizes[block:]}
+	f.BlockStart = start
+	f.Size = size - uint64(block)*blockSize
+	f.FragInd = fragInd
+	f.FragOffset = fragOffset
+
+	i := b.Inode
+	i.Type = inode.EFil
+	i.Data = f
+
+	return squashfslow.FileBase{Inode: i, Name: b.Name}, nil
+}
+
+// Unmounts a directory, lazily in case the process is finishing up
+func unmountDir(mntPt string) error {
+	return unmount(mntPt, true)
+}
+
+// Unmounts a directory. Lazy unmounts succeed even if the filesystem is busy,
+// it's detached right away and cleaned up once no longer in use. Mounts that
+// are still served should go through their server's Unmount instead, this is
+// for lazy unmounts and mounts left behind by instances that are gone. Like
+// mounting, it needs fusermount unless running as root
+func unmount(mntPt string, lazy bool) error {
+	flags, fuserFlags := 0, "-u"
+	if lazy {
+		flags, fuserFlags = syscall.MNT_DETACH, "-uz"
+	}
+
+	err := syscall.Unmount(mntPt, flags)
+	if err == nil {
+		return nil
+	}
+
+	// Unprivileged users can only unmount FUSE filesystems through
+	// fusermount, as it's what mounted them in the first place
+	for _, bin := range []string{"fusermount3", "fusermount"} {
+		if fusermount, present := CommandExists(bin); present {
+			out, err := exec.Command(fusermount, fuserFlags, mntPt).CombinedOutput()
+			if err != nil {
+				return &MountError{Path: filepath.Clean(mntPt), Err: errors.New(strings.TrimSpace(string(out)))}
+			}
+
+			return nil
+		}
+	}
+
+	return &MountError{Path: filepath.Clean(mntPt), Err: err}
+}
@@ -0,0 +1,434 @@
+package chains
+
+import (
+	"bytes"
+	"cmp"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Block size of test images, the smallest SquashFS allows
+const testSquashfsBlockSize = 4096
+
+// Builds an uncompressed SquashFS image holding `entries`, which are given as
+// for ISO images. Blocks are stored as is, so the image can be written without
+// any compressor. Files smaller than a block share a single fragment
+func buildSquashfs(entries []testISOEntry) []byte {
+	const superblockSize = 96
+
+	var data, frag, inodes, dirs bytes.Buffer
+	var num uint32
+
+	// Metadata is kept to a single block per table, more than enough for the
+	// tests
+	metaBlock := func(b []byte) []byte {
+		if len(b) > 8192 {
+			panic("test SquashFS table doesn't fit in a metadata block")
+		}
+
+		return binary.LittleEndian.AppendUint16(nil, uint16(len(b))|0x8000)
+	}
+
+	type written struct {
+		name   string
+		typ    uint16
+		num    uint32
+		offset uint16
+	}
+
+	header := func(typ uint16, mode uint32) {
+		num++
+		binary.Write(&inodes, binary.LittleEndian, testInodeHeader{Type: typ, Perm: uint16(mode), Num: num})
+	}
+
+	var write func(e testISOEntry) written
+	writeDir := func(children []testISOEntry, mode uint32) written {
+		// Children come first, as the listing points at their inodes
+		var list []written
+		for _, c := range children {
+			list = append(list, write(c))
+		}
+
+		slices.SortFunc(list, func(a, b written) int { return strings.Compare(a.name, b.name) })
+
+		listing := &bytes.Buffer{}
+		if len(list) > 0 {
+			binary.Write(listing, binary.LittleEndian, []uint32{uint32(len(list) - 1), 0, list[0].num})
+			for _, w := range list {
+				binary.Write(listing, binary.LittleEndian, []uint16{w.offset, uint16(int16(w.num - list[0].num)), w.typ, uint16(len(w.name) - 1)})
+				listing.WriteString(w.name)
+			}
+		}
+
+		listOffset := dirs.Len()
+		dirs.Write(listing.Bytes())
+
+		offset := uint16(inodes.Len())
+		header(1, mode)
+		binary.Write(&inodes, binary.LittleEndian, struct {
+			BlockStart uint32
+			LinkCount  uint32
+			Size       uint16
+			Offset     uint16
+			Parent     uint32 // Not needed to read the image, so left out
+		}{0, uint32(2 + len(list)), uint16(listing.Len() + 3), uint16(listOffset), 0})
+
+		return written{typ: 1, num: num, offset: offset}
+	}
+
+	write = func(e testISOEntry) written {
+		var w written
+
+		switch {
+		case e.dir:
+			w = writeDir(e.children, cmp.Or(e.mode, 0755))
+		case e.link != "":
+			w = written{typ: 3, offset: uint16(inodes.Len())}
+			header(3, 0777)
+			binary.Write(&inodes, binary.LittleEndian, []uint32{1, uint32(len(e.link))})
+			inodes.WriteString(e.link)
+		default:
+			w = written{typ: 2, offset: uint16(inodes.Len())}
+			start := superblockSize + data.Len()
+
+			// The blocks, or where the file is in the fragment
+			var sizes []uint32
+			fragInd, fragOffset := uint32(0xFFFFFFFF), uint32(0)
+			if len(e.data) > 0 && len(e.data) < testSquashfsBlockSize {
+				fragInd, fragOffset = 0, uint32(frag.Len())
+				frag.WriteString(e.data)
+			} else {
+				for b := []byte(e.data); len(b) > 0; b = b[min(len(b), testSquashfsBlockSize):] {
+					block := b[:min(len(b), testSquashfsBlockSize)]
+					data.Write(block)
+					sizes = append(sizes, uint32(len(block))|1<<24)
+				}
+			}
+
+			header(2, cmp.Or(e.mode, 0644))
+			binary.Write(&inodes, binary.LittleEndian, []uint32{uint32(start), fragInd, fragOffset, uint32(len(e.data))})
+			binary.Write(&inodes, binary.LittleEndian, sizes)
+		}
+
+		w.name, w.num = e.name, num
+		return w
+	}
+
+	root := writeDir(entries, 0755)
+
+	var img bytes.Buffer
+	img.Write(make([]byte, superblockSize))
+	img.Write(data.Bytes())
+
+	fragStart := img.Len()
+	img.Write(frag.Bytes())
+
+	inodeStart := img.Len()
+	img.Write(metaBlock(inodes.Bytes()))
+	img.Write(inodes.Bytes())
+
+	dirStart := img.Len()
+	img.Write(metaBlock(dirs.Bytes()))
+	img.Write(dirs.Bytes())
+
+	// A single ID, the user's, pointed at by the lookup table
+	ids := binary.LittleEndian.AppendUint32(nil, uint32(os.Getuid()))
+	idBlock := img.Len()
+	img.Write(metaBlock(ids))
+	img.Write(ids)
+
+	idStart := img.Len()
+	binary.Write(&img, binary.LittleEndian, uint64(idBlock))
+
+	// Likewise for the fragment
+	none := ^uint64(0)
+	fragCount, fragTable := uint32(0), none
+	if frag.Len() > 0 {
+		var entry bytes.Buffer
+		binary.Write(&entry, binary.LittleEndian, struct {
+			Start  uint64
+			Size   uint32
+			Unused uint32
+		}{uint64(fragStart), uint32(frag.Len()) | 1<<24, 0})
+
+		fragBlock := img.Len()
+		img.Write(metaBlock(entry.Bytes()))
+		img.Write(entry.Bytes())
+
+		fragCount, fragTable = 1, uint64(img.Len())
+		binary.Write(&img, binary.LittleEndian, uint64(fragBlock))
+	}
+
+	sb := []any{
+		uint32(0x73717368), num, uint32(0), uint32(testSquashfsBlockSize), fragCount,
+		uint16(1), uint16(12), uint16(0x1 | 0x2 | 0x8 | 0x200 | 0x800), uint16(1), uint16(4), uint16(0),
+		uint64(root.offset), uint64(img.Len()), uint64(idStart), none,
+		uint64(inodeStart), uint64(dirStart), fragTable, none,
+	}
+
+	var b bytes.Buffer
+	for _, v := range sb {
+		binary.Write(&b, binary.LittleEndian, v)
+	}
+	copy(img.Bytes(), b.Bytes())
+
+	return img.Bytes()
+}
+
+// Header shared by every SquashFS inode
+type testInodeHeader struct {
+	Type    uint16
+	Perm    uint16
+	Uid     uint16
+	Gid     uint16
+	ModTime uint32
+	Num     uint32
+}
+
+// Writes a type 2 AppImage: an ELF runtime with just enough of a section
+// table to find where it ends, followed by `image`
+func writeType2AppImage(t *testing.T, path string, image []byte) int64 {
+	names := "\x00.shstrtab\x00"
+
+	namesOff := int64(binary.Size(elf.Header64{}))
+	shOff := namesOff + int64(len(names))
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_X86_64),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     uint64(shOff),
+		Ehsize:    uint16(namesOff),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+		Shnum:     2,
+		Shstrndx:  1,
+	}
+	copy(hdr.Ident[:], "\x7fELF\x02\x01\x01\x00AI\x02")
+
+	sections := []elf.Section64{
+		{},
+		{Name: 1, Type: uint32(elf.SHT_STRTAB), Off: uint64(namesOff), Size: uint64(len(names))},
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, hdr)
+	b.WriteString(names)
+	binary.Write(&b, binary.LittleEndian, sections)
+
+	offset := int64(b.Len())
+	b.Write(image)
+
+	if err := os.WriteFile(path, b.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return offset
+}
+
+// Enough blocks to read from the middle of
+var testSquashfsBig = strings.Repeat("0123456789abcdef", 3*testSquashfsBlockSize/16+100)
+
+func testSquashfsEntries() []testISOEntry {
+	return []testISOEntry{
+		{name: "org.example.App.desktop", data: "[Desktop Entry]\nName=App\nX-AppImage-Version=2\n"},
+		{name: "app.png", data: "not really a PNG"},
+		{name: ".DirIcon", link: "app.png"},
+		{name: "usr", dir: true, children: []testISOEntry{
+			{name: "bin", dir: true, children: []testISOEntry{
+				{name: "app", data: "#!/bin/sh\n", mode: 04755},
+			}},
+			{name: "big", data: testSquashfsBig},
+			{name: "empty", data: ""},
+		}},
+		{name: "escape", link: "../../etc/passwd"},
+	}
+}
+
+func TestSquashfsRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+	offset := writeType2AppImage(t, path, buildSquashfs(testSquashfsEntries()))
+
+	ai, err := NewAppImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ai.FSType != SquashFS || int64(ai.Offset) != offset {
+		t.Errorf("image found as %s at %d, want %s at %d", ai.FSType, ai.Offset, SquashFS, offset)
+	}
+
+	if ai.ID != "org.example.App" || ai.Name != "App" || ai.Version != "2" {
+		t.Errorf("read %q %q %q from the desktop entry", ai.ID, ai.Name, ai.Version)
+	}
+
+	img, err := ai.openSquashfs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer img.Close()
+
+	for name, want := range map[string]string{
+		".DirIcon":  "not really a PNG",
+		"usr/big":   testSquashfsBig,
+		"usr/empty": "",
+	} {
+		b, err := img.ReadFile(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if string(b) != want {
+			t.Errorf("%s: read %d bytes, want %d", name, len(b), len(want))
+		}
+	}
+
+	// Symlinks can't lead out of the image
+	if _, err := img.ReadFile("escape"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("read through a symlink out of the image: %v", err)
+	}
+}
+
+func TestSquashfsExtract(t *testing.T) {
+	// Symlinks are extracted along with their targets, which have to be in
+	// the image
+	entries := slices.DeleteFunc(testSquashfsEntries(), func(e testISOEntry) bool {
+		return e.name == "escape"
+	})
+
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+	writeType2AppImage(t, path, buildSquashfs(entries))
+
+	ai, err := NewAppImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "root")
+	if err := ai.ExtractTo(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := os.ReadFile(filepath.Join(dest, "usr/big")); err != nil || string(b) != testSquashfsBig {
+		t.Errorf("usr/big wasn't extracted whole: %v", err)
+	}
+
+	if target, err := os.Readlink(filepath.Join(dest, ".DirIcon")); err != nil || target != "app.png" {
+		t.Errorf(".DirIcon extracted as a link to %q: %v", target, err)
+	}
+
+	for name, want := range map[string]fs.FileMode{
+		"app.png":     0644,
+		"usr/bin/app": 0755,
+		"usr/bin":     fs.ModeDir | 0755,
+	} {
+		info, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode() != want {
+			t.Errorf("%s extracted with mode %v, want %v", name, info.Mode(), want)
+		}
+	}
+}
+
+func TestSquashfsMount(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+	offset := writeType2AppImage(t, path, buildSquashfs(testSquashfsEntries()))
+
+	dest := t.TempDir()
+	server, f, err := mountSquashfs(path, dest, int(offset))
+	if errors.Is(err, NoFuse) || errors.Is(err, os.ErrPermission) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	unmounted := false
+	t.Cleanup(func() {
+		if !unmounted {
+			server.Unmount()
+		}
+	})
+
+	big, err := os.Open(filepath.Join(dest, "usr/big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Out of order and across blocks, so reads have to start over from the
+	// middle of the file
+	for _, off := range []int64{2*testSquashfsBlockSize + 10, 5, testSquashfsBlockSize - 3, int64(len(testSquashfsBig)) - 7} {
+		b := make([]byte, 16)
+		n, err := big.ReadAt(b, off)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+
+		if want := testSquashfsBig[off:min(off+16, int64(len(testSquashfsBig)))]; string(b[:n]) != want {
+			t.Errorf("read %q at %d, want %q", b[:n], off, want)
+		}
+	}
+	big.Close()
+
+	if target, err := os.Readlink(filepath.Join(dest, ".DirIcon")); err != nil || target != "app.png" {
+		t.Errorf(".DirIcon is a link to %q: %v", target, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dest, "app.png"), nil, 0644); err == nil {
+		t.Error("wrote to the image")
+	}
+
+	// The server unmounts it itself, without fusermount as root
+	if err := server.Unmount(); err != nil {
+		t.Fatal(err)
+	}
+	unmounted = true
+
+	if isMountPoint(dest) {
+		t.Error("still mounted")
+	}
+}
+
+func TestSquashfsQuiet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+	offset := writeType2AppImage(t, path, buildSquashfs(testSquashfsEntries()))
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	// Reading the fragment table used to print
+	rdr, err := openSquashfs(f, offset)
+	os.Stdout = stdout
+	w.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	} else if rdr.Low.Superblock.FragCount == 0 {
+		t.Fatal("image has no fragments")
+	}
+
+	if b, _ := io.ReadAll(r); len(b) > 0 {
+		t.Errorf("printed %q", b)
+	}
+}
@@ -0,0 +1,268 @@
+package chains
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+// Trusting an AppImage records exactly what was trusted in
+// `$XDG_DATA_HOME/chains/trust.json`, so that it stops being trusted as soon
+// as its contents change
+
+var (
+	NotTrustedEntry = errors.New("no trust entry matches")
+)
+
+// TrustState says whether an AppImage is trusted
+type TrustState string
+
+const (
+	// Never trusted, or trust was revoked
+	TrustNone TrustState = "untrusted"
+	// Trusted as it is now
+	TrustValid TrustState = "trusted"
+	// Signed by a key in the keyring, while CurrentPolicy.TrustSigned is set
+	TrustSignature TrustState = "signed"
+	// A file was trusted at the same path, but its contents changed since
+	TrustChanged TrustState = "changed"
+)
+
+// TrustEntry is a snapshot of an AppImage taken when it was trusted
+type TrustEntry struct {
+	Path        string         `json:"path"`
+	SHA256      string         `json:"sha256"`
+	Size        int64          `json:"size"`
+	Name        string         `json:"name"`
+	Version     string         `json:"version"`
+	Permissions *AppImagePerms `json:"permissions"`
+	Time        time.Time      `json:"time"`
+}
+
+// TrustDB holds every trusted AppImage
+type TrustDB struct {
+	Entries []TrustEntry `json:"entries"`
+}
+
+// Location of the trust database
+func TrustDBPath() string {
+	return filepath.Join(xdg.DataHome, "chains", "trust.json")
+}
+
+// Reads the trust database. If it doesn't exist yet, it's empty
+func LoadTrustDB() (*TrustDB, error) {
+	db := &TrustDB{}
+
+	b, err := os.ReadFile(TrustDBPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return db, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, db); err != nil {
+		return nil, errors.Join(errors.New("failed to parse `"+TrustDBPath()+"`"), err)
+	}
+
+	return db, nil
+}
+
+// Locks the trust database, so that `fn` can change it without racing any
+// other instance, and writes it back unless `fn` fails
+func UpdateTrustDB(fn func(db *TrustDB) error) error {
+	if err := os.MkdirAll(filepath.Dir(TrustDBPath()), 0744); err != nil {
+		return err
+	}
+
+	lock, err := lockFile(TrustDBPath() + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	db, err := LoadTrustDB()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(db); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(db, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Replace the database in one go, so that it's never read half written
+	tmp := TrustDBPath() + ".tmp-" + strconv.Itoa(os.Getpid())
+	if err := os.WriteFile(tmp, append(b, '\n'), 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, TrustDBPath())
+}
+
+// Returns the entry trusting `hash`, or nil
+func (db *TrustDB) Lookup(hash string) *TrustEntry {
+	for i := range db.Entries {
+		if db.Entries[i].SHA256 == hash {
+			return &db.Entries[i]
+		}
+	}
+
+	return nil
+}
+
+// Returns the entry recorded for the file at `path`, or nil. Its contents may
+// have changed since
+func (db *TrustDB) LookupPath(path string) *TrustEntry {
+	for i := range db.Entries {
+		if db.Entries[i].Path == path {
+			return &db.Entries[i]
+		}
+	}
+
+	return nil
+}
+
+// Adds an entry, replacing any previous one for the same file
+func (db *TrustDB) Add(e TrustEntry) {
+	db.Revoke(e.Path)
+	db.Entries = append(db.Entries, e)
+}
+
+// Removes the entries for the file at `pathOrHash`, or for the contents
+// with that hash. Returns how many were removed
+func (db *TrustDB) Revoke(pathOrHash string) int {
+	kept := []TrustEntry{}
+
+	for _, e := range db.Entries {
+		if e.Path != pathOrHash && e.SHA256 != pathOrHash {
+			kept = append(kept, e)
+		}
+	}
+
+	n := len(db.Entries) - len(kept)
+	db.Entries = kept
+
+	return n
+}
+
+// Takes a snapshot of the AppImage as it is now, with the permissions its
+// profile grants it
+func (ai *AppImage) TrustEntry() (TrustEntry, error) {
+	perms, err := ai.GetPermissions()
+	if err != nil {
+		return TrustEntry{}, err
+	}
+
+	return ai.trustEntry(perms)
+}
+
+func (ai *AppImage) trustEntry(perms *AppImagePerms) (TrustEntry, error) {
+	path, err := filepath.Abs(ai.Path)
+	if err != nil {
+		return TrustEntry{}, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return TrustEntry{}, err
+	}
+
+	return TrustEntry{
+		Path:        path,
+		SHA256:      ai.sha256,
+		Size:        info.Size(),
+		Name:        ai.Name,
+		Version:     ai.Version,
+		Permissions: perms,
+		Time:        time.Now().UTC(),
+	}, nil
+}
+
+// Returns whether the AppImage is trusted, see TrustState
+func (ai *AppImage) TrustState() (TrustState, error) {
+	db, err := LoadTrustDB()
+	if err != nil {
+		return TrustNone, err
+	}
+
+	if db.Lookup(ai.sha256) != nil {
+		return TrustValid, nil
+	}
+
+	if CurrentPolicy.TrustSigned {
+		if sig, err := ai.Verify(); err == nil && sig.Approved {
+			return TrustSignature, nil
+		}
+	}
+
+	path, err := filepath.Abs(ai.Path)
+	if err != nil {
+		return TrustNone, err
+	}
+
+	if db.LookupPath(path) != nil {
+		return TrustChanged, nil
+	}
+
+	return TrustNone, nil
+}
+
+// Returns `true` if the AppImage's contents are in the trust database, or
+// it's signed by an approved key and the policy allows that. This is to
+// ensure the AppImage can't change under the user's feet, through an update
+// or otherwise, without being approved again
+func (ai *AppImage) Trusted() bool {
+	state, err := ai.TrustState()
+	return err == nil && (state == TrustValid || state == TrustSignature)
+}
+
+// Trust the AppImage as it is now, or revoke trust from both its path and
+// its contents
+func (ai *AppImage) SetTrusted(trusted bool) error {
+	if !trusted {
+		path, err := filepath.Abs(ai.Path)
+		if err != nil {
+			return err
+		}
+
+		return UpdateTrustDB(func(db *TrustDB) error {
+			if db.Revoke(path)+db.Revoke(ai.sha256) == 0 {
+				return NotTrustedEntry
+			}
+
+			return nil
+		})
+	}
+
+	perms, err := ai.GetPermissions()
+	if err != nil {
+		return err
+	}
+
+	return ai.SetTrustedWith(perms)
+}
+
+// Trust the AppImage as it is now, recording `perms` as the permissions it was
+// approved with. They're what *AppImage.PermissionChanges compares against, so
+// should be those it's actually run with, flags and all
+func (ai *AppImage) SetTrustedWith(perms *AppImagePerms) error {
+	entry, err := ai.trustEntry(perms)
+	if err != nil {
+		return err
+	}
+
+	return UpdateTrustDB(func(db *TrustDB) error {
+		db.Add(entry)
+		return nil
+	})
+}
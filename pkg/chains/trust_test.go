@@ -0,0 +1,116 @@
+package chains
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestTrustState(t *testing.T) {
+	isolateVersions(t)
+
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+	if err := os.WriteFile(path, []byte("version 1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ai := &AppImage{Path: path, Name: "App", sha256: "v1"}
+	perms := &AppImagePerms{Level: 2}
+
+	if state, err := ai.TrustState(); err != nil || state != TrustNone || ai.Trusted() {
+		t.Errorf("new AppImage is %s: %v", state, err)
+	}
+
+	if err := ai.SetTrustedWith(perms); err != nil {
+		t.Fatal(err)
+	}
+
+	if state, err := ai.TrustState(); err != nil || state != TrustValid || !ai.Trusted() {
+		t.Errorf("trusted AppImage is %s: %v", state, err)
+	}
+
+	db, err := LoadTrustDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e := db.Lookup("v1"); e == nil || e.Path != path || e.Size != 9 || e.Permissions.Level != 2 {
+		t.Errorf("recorded %+v", e)
+	}
+
+	// Replaced in place, as by an update
+	changed := &AppImage{Path: path, Name: "App", sha256: "v2"}
+
+	if state, err := changed.TrustState(); err != nil || state != TrustChanged || changed.Trusted() {
+		t.Errorf("changed AppImage is %s: %v", state, err)
+	}
+
+	if err := changed.SetTrustedWith(perms); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one entry per file
+	if state, err := ai.TrustState(); err != nil || state != TrustChanged {
+		t.Errorf("replaced contents are %s: %v", state, err)
+	}
+
+	if err := changed.SetTrusted(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if state, err := changed.TrustState(); err != nil || state != TrustNone {
+		t.Errorf("revoked AppImage is %s: %v", state, err)
+	}
+
+	if err := changed.SetTrusted(false); !errors.Is(err, NotTrustedEntry) {
+		t.Errorf("revoked trust twice: %v", err)
+	}
+}
+
+func TestUpdateTrustDB(t *testing.T) {
+	isolateVersions(t)
+
+	// None of the entries may be lost to another instance writing at once
+	var wg sync.WaitGroup
+	errs := make([]error, 16)
+
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = UpdateTrustDB(func(db *TrustDB) error {
+				db.Add(TrustEntry{Path: "/app-" + string(rune('a'+i)), SHA256: string(rune('a' + i))})
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+
+	// Left as it was when the change fails
+	failed := errors.New("failed")
+	if err := UpdateTrustDB(func(db *TrustDB) error {
+		db.Entries = nil
+		return failed
+	}); !errors.Is(err, failed) {
+		t.Errorf("got %v", err)
+	}
+
+	db, err := LoadTrustDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(db.Entries) != len(errs) {
+		t.Errorf("got %d entries, want %d", len(db.Entries), len(errs))
+	}
+
+	if n := db.Revoke("/app-a") + db.Revoke("b"); n != 2 || db.Lookup("a") != nil || db.LookupPath("/app-b") != nil {
+		t.Errorf("revoked %d entries, left %+v", n, db.Entries)
+	}
+}
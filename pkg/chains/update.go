@@ -0,0 +1,475 @@
+package chains
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AppImages say where to get newer versions of themselves in their update
+// information, eg: `gh-releases-zsync|user|repo|latest|App-*x86_64.AppImage.zsync`
+// See <https://github.com/AppImage/AppImageSpec/blob/master/draft.md#update-information>
+
+var (
+	NoUpdateInfo       = errors.New("AppImage has no update information")
+	InvalidUpdateInfo  = errors.New("update information invalid")
+	InvalidTransport   = errors.New("update transport not supported")
+	NoReleaseAsset     = errors.New("no release asset matches the update information")
+	UpdateMismatch     = errors.New("downloaded update doesn't match its checksum")
+	UpdateNotAvailable = errors.New("AppImage is up to date")
+	SignerChanged      = errors.New("update isn't signed by the key that signed the AppImage")
+)
+
+// GitHubAPI is where GitHub releases are looked up. It can be changed
+// through `GITHUB_API_URL`, like for GitHub Enterprise
+var GitHubAPI = "https://api.github.com"
+
+func init() {
+	if api := os.Getenv("GITHUB_API_URL"); api != "" {
+		GitHubAPI = strings.TrimSuffix(api, "/")
+	}
+}
+
+type UpdateTransport string
+
+const (
+	// `zsync|<url of the .zsync file>`
+	ZsyncTransport UpdateTransport = "zsync"
+	// `gh-releases-zsync|<user>|<repo>|<tag>|<.zsync file name pattern>`
+	GitHubZsyncTransport UpdateTransport = "gh-releases-zsync"
+	// `gh-releases-direct|<user>|<repo>|<tag>|<AppImage file name pattern>`
+	GitHubDirectTransport UpdateTransport = "gh-releases-direct"
+)
+
+var (
+	UpdateTransportMap = map[string]UpdateTransport{
+		"zsync":              ZsyncTransport,
+		"gh-releases-zsync":  GitHubZsyncTransport,
+		"gh-releases-direct": GitHubDirectTransport,
+	}
+)
+
+func UpdateTransportFromString(s string) (UpdateTransport, error) {
+	transport, present := UpdateTransportMap[s]
+
+	if !present {
+		return transport, InvalidTransport
+	}
+
+	return transport, nil
+}
+
+// UpdateSource is parsed update information
+type UpdateSource struct {
+	Transport UpdateTransport
+	URL       string // URL of the .zsync file, for ZsyncTransport
+
+	// For the GitHub transports. `Tag` can also be `latest`, `latest-pre`
+	// (the newest pre-release) or `latest-all` (the newest release of any
+	// kind), `Pattern` is matched against the names of the release's assets
+	User    string
+	Repo    string
+	Tag     string
+	Pattern string
+}
+
+// Parses update information, see UpdateTransport for its formats
+func ParseUpdateInfo(info string) (*UpdateSource, error) {
+	if info == "" {
+		return nil, NoUpdateInfo
+	}
+
+	fields := strings.Split(info, "|")
+
+	transport, err := UpdateTransportFromString(fields[0])
+	if err != nil {
+		return nil, errors.Join(err, errors.New("`"+fields[0]+"`"))
+	}
+
+	s := &UpdateSource{Transport: transport}
+
+	switch transport {
+	case ZsyncTransport:
+		if len(fields) != 2 || fields[1] == "" {
+			return nil, InvalidUpdateInfo
+		}
+		s.URL = fields[1]
+	default:
+		if len(fields) != 5 || slices.Contains(fields[1:], "") {
+			return nil, InvalidUpdateInfo
+		}
+		s.User, s.Repo, s.Tag, s.Pattern = fields[1], fields[2], fields[3], fields[4]
+
+		if _, err := path.Match(s.Pattern, ""); err != nil {
+			return nil, errors.Join(InvalidUpdateInfo, err)
+		}
+	}
+
+	return s, nil
+}
+
+// Update describes the newest version of an AppImage, see CheckUpdate
+type Update struct {
+	Source    *UpdateSource
+	Available bool   // The newest version may differ from the local file
+	Name      string // File name of the newest version
+	Tag       string // Release it's from, for the GitHub transports
+	URL       string // Where it's downloaded from
+	Size      int64  // Its size, if known
+
+	zsync  *zsyncControl
+	sha256 string // Published by GitHub for the direct transport, if at all
+}
+
+// Looks up the newest version of the AppImage. Whether it differs from the
+// local file is told by the SHA-1 in its zsync control file, or for direct
+// downloads by the SHA-256 GitHub publishes. Releases too old to have one
+// are always Available, Update tells once it has downloaded them
+func (ai *AppImage) CheckUpdate() (*Update, error) {
+	source, err := ParseUpdateInfo(ai.UpdateInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &Update{Source: source}
+	controlURL := source.URL
+
+	if source.Transport != ZsyncTransport {
+		release, err := fetchRelease(source)
+		if err != nil {
+			return nil, err
+		}
+
+		asset := release.asset(source.Pattern)
+		if asset == nil {
+			return nil, errors.Join(NoReleaseAsset, errors.New("`"+source.Pattern+"` in release `"+release.TagName+"`"))
+		}
+
+		u.Tag = release.TagName
+		controlURL = asset.URL
+
+		if source.Transport == GitHubDirectTransport {
+			u.Name, u.URL, u.Size = asset.Name, asset.URL, asset.Size
+			u.sha256 = strings.TrimPrefix(asset.Digest, "sha256:")
+			u.Available = u.sha256 == "" || u.sha256 != ai.sha256
+
+			return u, nil
+		}
+	}
+
+	u.zsync, err = fetchZsync(controlURL)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Name, u.URL, u.Size = u.zsync.Filename, u.zsync.URL, u.zsync.Length
+
+	sum, err := fileSHA1(ai.Path)
+	if err != nil {
+		return nil, err
+	}
+	u.Available = sum != u.zsync.SHA1
+
+	return u, nil
+}
+
+// Replaces the AppImage with the version found by CheckUpdate. With zsync,
+// only the blocks the AppImage doesn't already have are downloaded. The new
+// version is checked before it replaces the old one, which is left alone if
+// anything fails, and kept as a previous version otherwise (see KeepVersion).
+// If the AppImage is signed, the new version must be signed by the same key.
+// Otherwise trust is tied to its contents, so it has to be trusted again
+func (ai *AppImage) Update(u *Update) (*UpdateStats, error) {
+	if !u.Available {
+		return nil, UpdateNotAvailable
+	}
+
+	info, err := os.Stat(ai.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp := ai.Path + ".tmp-" + strconv.Itoa(os.Getpid())
+	out, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	var stats *UpdateStats
+	if u.zsync != nil {
+		stats, err = ai.updateZsync(u, out)
+	} else {
+		stats, err = updateDirect(u, out)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a published SHA-256, this is the first time it's known
+	if stats.sha256 != "" && stats.sha256 == ai.sha256 {
+		return nil, UpdateNotAvailable
+	}
+
+	if err := out.Close(); err != nil {
+		return nil, err
+	}
+
+	report, err := CheckIntegrity(tmp)
+	if err != nil {
+		return nil, errors.Join(errors.New("update isn't a valid AppImage"), err)
+	}
+	if !report.OK() {
+		return nil, errors.Join(UpdateMismatch, errors.New("update is damaged, see `chains verify`"))
+	}
+
+	if err := ai.checkSigner(tmp); err != nil {
+		return nil, err
+	}
+
+	if err := ai.KeepVersion(); err != nil {
+		return nil, errors.Join(errors.New("failed to keep the previous version"), err)
+	}
+
+	return stats, os.Rename(tmp, ai.Path)
+}
+
+func (ai *AppImage) updateZsync(u *Update, out *os.File) (*UpdateStats, error) {
+	local, err := os.Open(ai.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer local.Close()
+
+	return u.zsync.assemble(local, out)
+}
+
+func updateDirect(u *Update, out *os.File) (*UpdateStats, error) {
+	resp, err := httpGet(u.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, h), resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if u.sha256 != "" && sum != u.sha256 {
+		return nil, errors.Join(UpdateMismatch, errors.New("SHA-256 doesn't match the one GitHub published"))
+	}
+
+	return &UpdateStats{Downloaded: n, sha256: sum}, nil
+}
+
+// Refuses the update at `path` unless it's signed by the same key as the
+// AppImage, if that's signed at all
+func (ai *AppImage) checkSigner(path string) error {
+	sig, err := ai.Verify()
+	if err != nil {
+		return nil
+	}
+
+	imageType, err := GetAppImageType(path)
+	if err != nil {
+		return err
+	}
+
+	update := &AppImage{Path: path, imageType: imageType}
+	newSig, err := update.Verify()
+	if err != nil {
+		return errors.Join(SignerChanged, err)
+	}
+
+	if newSig.Fingerprint != sig.Fingerprint {
+		return errors.Join(SignerChanged, errors.New("signed by "+newSig.Fingerprint+" instead of "+sig.Fingerprint))
+	}
+
+	return nil
+}
+
+type githubRelease struct {
+	TagName    string        `json:"tag_name"`
+	Prerelease bool          `json:"prerelease"`
+	Draft      bool          `json:"draft"`
+	Assets     []githubAsset `json:"assets"`
+}
+
+type githubAsset struct {
+	Name   string `json:"name"`
+	URL    string `json:"browser_download_url"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"` // eg: `sha256:<hex>`, missing from older releases
+}
+
+// Returns the first asset whose name matches `pattern`
+func (r *githubRelease) asset(pattern string) *githubAsset {
+	for i := range r.Assets {
+		if ok, _ := path.Match(pattern, r.Assets[i].Name); ok {
+			return &r.Assets[i]
+		}
+	}
+
+	return nil
+}
+
+// Looks up the release named by the source's tag
+func fetchRelease(s *UpdateSource) (*githubRelease, error) {
+	repo := GitHubAPI + "/repos/" + s.User + "/" + s.Repo + "/releases"
+
+	switch s.Tag {
+	case "latest":
+		return githubGet[*githubRelease](repo + "/latest")
+	case "latest-pre", "latest-all":
+		releases, err := githubGet[[]*githubRelease](repo)
+		if err != nil {
+			return nil, err
+		}
+
+		// Releases are listed newest first
+		for _, r := range releases {
+			if !r.Draft && (r.Prerelease || s.Tag == "latest-all") {
+				return r, nil
+			}
+		}
+
+		return nil, errors.Join(NoReleaseAsset, errors.New("no matching release in "+s.User+"/"+s.Repo))
+	}
+
+	return githubGet[*githubRelease](repo + "/tags/" + s.Tag)
+}
+
+// Fetches and decodes a GitHub API response, authenticating with
+// `GITHUB_TOKEN` if set to avoid being rate limited
+func githubGet[T any](url string) (T, error) {
+	var v T
+
+	header := http.Header{"Accept": {"application/vnd.github+json"}}
+	if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := httpGet(url, header)
+	if err != nil {
+		return v, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return v, errors.Join(errors.New("failed to parse `"+url+"`"), err)
+	}
+
+	return v, nil
+}
+
+// How long a server may take to answer, or leave a download hanging, before
+// it's given up on. Downloads themselves can take however long they need
+var HTTPTimeout = 30 * time.Second
+
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return (&net.Dialer{Timeout: HTTPTimeout}).DialContext(ctx, network, addr)
+		},
+		TLSHandshakeTimeout: HTTPTimeout,
+		ForceAttemptHTTP2:   true,
+	},
+}
+
+// Makes a GET request, failing on anything but a successful response
+func httpGet(url string, header http.Header) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if header != nil {
+		req.Header = header
+	}
+	req.Header.Set("User-Agent", "chains")
+
+	// Cancels the request once the server stalls, which the timer is reset
+	// for every time the body is read from
+	stalled := time.AfterFunc(HTTPTimeout, cancel)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		stalled.Stop()
+		cancel()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		stalled.Stop()
+		cancel()
+		return nil, errors.New("`" + url + "`: " + resp.Status)
+	}
+
+	resp.Body = &stallBody{ReadCloser: resp.Body, timer: stalled, cancel: cancel}
+
+	return resp, nil
+}
+
+// stallBody gives up on a response once nothing has been read from it for
+// HTTPTimeout
+type stallBody struct {
+	io.ReadCloser
+	timer  *time.Timer
+	cancel context.CancelFunc
+}
+
+func (b *stallBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(HTTPTimeout)
+	}
+
+	if errors.Is(err, context.Canceled) {
+		err = errors.New("server stopped responding")
+	}
+
+	return n, err
+}
+
+func (b *stallBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// Calculates the SHA-1 of a file's contents as hex, which zsync uses
+func fileSHA1(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
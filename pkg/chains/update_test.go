@@ -0,0 +1,386 @@
+package chains
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+func TestParseUpdateInfo(t *testing.T) {
+	s, err := ParseUpdateInfo("gh-releases-zsync|user|repo|latest|App-*x86_64.AppImage.zsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := UpdateSource{Transport: GitHubZsyncTransport, User: "user", Repo: "repo", Tag: "latest", Pattern: "App-*x86_64.AppImage.zsync"}
+	if *s != want {
+		t.Errorf("got %+v", s)
+	}
+
+	for _, info := range []string{
+		"",
+		"zsync",
+		"bintray-zsync|a|b|c|d",
+		"gh-releases-zsync|user|repo|latest",
+		"gh-releases-direct|user||latest|*.AppImage",
+		"gh-releases-direct|user|repo|latest|[",
+	} {
+		if _, err := ParseUpdateInfo(info); err == nil {
+			t.Errorf("parsed %q", info)
+		}
+	}
+}
+
+// A fake GitHub API serving releases of `user/repo`, whose assets it also
+// serves
+func githubServer(t *testing.T, releases []githubRelease, files map[string][]byte) *httptest.Server {
+	var srv *httptest.Server
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the API is sent the token, not downloads
+		if strings.HasPrefix(r.URL.Path, "/repos/") && r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "no token", http.StatusUnauthorized)
+			return
+		}
+
+		// Point the assets at this server
+		var rs []githubRelease
+		for _, rel := range releases {
+			rel.Assets = append([]githubAsset{}, rel.Assets...)
+			for i := range rel.Assets {
+				rel.Assets[i].URL = srv.URL + "/download/" + rel.Assets[i].Name
+			}
+			rs = append(rs, rel)
+		}
+
+		switch path := r.URL.Path; {
+		case path == "/repos/user/repo/releases":
+			json.NewEncoder(w).Encode(rs)
+		case path == "/repos/user/repo/releases/latest":
+			for _, rel := range rs {
+				if !rel.Draft && !rel.Prerelease {
+					json.NewEncoder(w).Encode(rel)
+					return
+				}
+			}
+			http.NotFound(w, r)
+		case strings.HasPrefix(path, "/repos/user/repo/releases/tags/"):
+			for _, rel := range rs {
+				if "/repos/user/repo/releases/tags/"+rel.TagName == path {
+					json.NewEncoder(w).Encode(rel)
+					return
+				}
+			}
+			http.NotFound(w, r)
+		default:
+			b, present := files[filepath.Base(path)]
+			if !present {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeContent(w, r, filepath.Base(path), time.Time{}, bytes.NewReader(b))
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	api := GitHubAPI
+	GitHubAPI = srv.URL
+	t.Cleanup(func() { GitHubAPI = api })
+
+	t.Setenv("GITHUB_TOKEN", "token")
+
+	return srv
+}
+
+func TestFetchRelease(t *testing.T) {
+	githubServer(t, []githubRelease{
+		{TagName: "v3-draft", Draft: true, Prerelease: true},
+		{TagName: "v3-beta", Prerelease: true},
+		{TagName: "v2"},
+		{TagName: "v1"},
+	}, nil)
+
+	for tag, want := range map[string]string{
+		"latest":     "v2",
+		"latest-pre": "v3-beta",
+		"latest-all": "v3-beta",
+		"v1":         "v1",
+	} {
+		r, err := fetchRelease(&UpdateSource{User: "user", Repo: "repo", Tag: tag})
+		if err != nil {
+			t.Errorf("%s: %v", tag, err)
+		} else if r.TagName != want {
+			t.Errorf("%s: got release %s, want %s", tag, r.TagName, want)
+		}
+	}
+
+	if _, err := fetchRelease(&UpdateSource{User: "user", Repo: "repo", Tag: "v0"}); err == nil {
+		t.Error("found a release that doesn't exist")
+	}
+}
+
+func TestCheckUpdateZsync(t *testing.T) {
+	local := testData(0, 8*testBlocksize)
+	target := append(bytes.Clone(local), testData(1, 2*testBlocksize)...)
+
+	files := map[string][]byte{"App-x86_64.AppImage": target}
+	srv := githubServer(t, []githubRelease{{
+		TagName: "v2",
+		Assets: []githubAsset{
+			{Name: "App-x86_64.AppImage"},
+			{Name: "App-x86_64.AppImage.zsync"},
+		},
+	}}, files)
+	files["App-x86_64.AppImage.zsync"] = makeZsync(target, "App-x86_64.AppImage")
+
+	ai := &AppImage{
+		Path:       filepath.Join(t.TempDir(), "App.AppImage"),
+		UpdateInfo: "gh-releases-zsync|user|repo|latest|App-*x86_64.AppImage.zsync",
+	}
+	if err := os.WriteFile(ai.Path, local, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := ai.CheckUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !u.Available || u.Tag != "v2" || u.URL != srv.URL+"/download/App-x86_64.AppImage" || u.Size != int64(len(target)) {
+		t.Errorf("got update %+v", u)
+	}
+
+	// Already up to date
+	if err := os.WriteFile(ai.Path, target, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if u, err := ai.CheckUpdate(); err != nil || u.Available {
+		t.Errorf("update available for the newest version: %v", err)
+	}
+}
+
+func TestCheckUpdateDirect(t *testing.T) {
+	target := testData(0, 1000)
+	sum := sha256.Sum256(target)
+
+	githubServer(t, []githubRelease{{
+		TagName: "v2",
+		Assets: []githubAsset{
+			{Name: "App-x86_64.AppImage", Size: int64(len(target)), Digest: "sha256:" + hex.EncodeToString(sum[:])},
+		},
+	}}, map[string][]byte{"App-x86_64.AppImage": target})
+
+	ai := &AppImage{
+		Path:       filepath.Join(t.TempDir(), "App.AppImage"),
+		UpdateInfo: "gh-releases-direct|user|repo|latest|App-*.AppImage",
+		sha256:     "old",
+	}
+	if err := os.WriteFile(ai.Path, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := ai.CheckUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !u.Available || u.zsync != nil {
+		t.Fatalf("got update %+v", u)
+	}
+
+	out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	stats, err := updateDirect(u, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Downloaded != int64(len(target)) {
+		t.Errorf("downloaded %d bytes of %d", stats.Downloaded, len(target))
+	}
+
+	// Not what GitHub published
+	u.sha256 = hex.EncodeToString(make([]byte, sha256.Size))
+	if _, err := updateDirect(u, out); !errors.Is(err, UpdateMismatch) {
+		t.Errorf("download with the wrong SHA-256 accepted: %v", err)
+	}
+
+	u.Source.Pattern = "Other-*.AppImage"
+	ai.UpdateInfo = "gh-releases-direct|user|repo|latest|Other-*.AppImage"
+	if _, err := ai.CheckUpdate(); !errors.Is(err, NoReleaseAsset) {
+		t.Errorf("found an asset that doesn't match: %v", err)
+	}
+}
+
+func TestUpdateSigner(t *testing.T) {
+	key, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := openpgp.NewEntity("Other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name          string
+		local, update *openpgp.Entity
+		ok            bool
+	}{
+		{"same key", key, key, true},
+		{"other key", key, other, false},
+		{"unsigned update", key, nil, false},
+		{"unsigned", nil, nil, true},
+		{"newly signed", nil, key, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			isolateVersions(t)
+			KeepVersions = 0
+
+			dir := t.TempDir()
+			sign := func(path string, key *openpgp.Entity) []byte {
+				if key == nil {
+					writeUnsignedAppImage(t, path)
+				} else {
+					signAppImage(t, path, key)
+				}
+
+				b, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return b
+			}
+
+			target := sign(filepath.Join(dir, "update"), c.update)
+			githubServer(t, []githubRelease{{
+				TagName: "v2",
+				Assets:  []githubAsset{{Name: "App-x86_64.AppImage", Size: int64(len(target))}},
+			}}, map[string][]byte{"App-x86_64.AppImage": target})
+
+			ai := &AppImage{
+				Path:       filepath.Join(dir, "App.AppImage"),
+				UpdateInfo: "gh-releases-direct|user|repo|latest|App-*.AppImage",
+				imageType:  2,
+				sha256:     "old",
+			}
+			local := sign(ai.Path, c.local)
+
+			u, err := ai.CheckUpdate()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = ai.Update(u)
+			if c.ok && err != nil {
+				t.Fatalf("update refused: %v", err)
+			} else if !c.ok && !errors.Is(err, SignerChanged) {
+				t.Fatalf("update signed by someone else accepted: %v", err)
+			}
+
+			want := local
+			if c.ok {
+				want = target
+			}
+
+			if b, _ := os.ReadFile(ai.Path); !bytes.Equal(b, want) {
+				t.Error("AppImage not left as it should be")
+			}
+		})
+	}
+}
+
+func TestUpdateDirectWithoutDigest(t *testing.T) {
+	isolateVersions(t)
+	KeepVersions = 0
+
+	ai := &AppImage{
+		Path:       filepath.Join(t.TempDir(), "App.AppImage"),
+		UpdateInfo: "gh-releases-direct|user|repo|latest|App-*.AppImage",
+		imageType:  2,
+	}
+	writeUnsignedAppImage(t, ai.Path)
+
+	target, err := os.ReadFile(ai.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ai.sha256, _ = CalculateSHA256(ai.Path)
+
+	// The same size says nothing about the contents
+	githubServer(t, []githubRelease{{
+		TagName: "v2",
+		Assets:  []githubAsset{{Name: "App-x86_64.AppImage", Size: int64(len(target))}},
+	}}, map[string][]byte{"App-x86_64.AppImage": target})
+
+	u, err := ai.CheckUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !u.Available {
+		t.Fatal("update without a digest not available")
+	}
+
+	if _, err := ai.Update(u); !errors.Is(err, UpdateNotAvailable) {
+		t.Errorf("identical update applied: %v", err)
+	}
+
+	if matches, _ := filepath.Glob(ai.Path + ".tmp-*"); len(matches) > 0 {
+		t.Errorf("left %v behind", matches)
+	}
+}
+
+func TestHTTPStall(t *testing.T) {
+	timeout := HTTPTimeout
+	HTTPTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { HTTPTimeout = timeout })
+
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/headers" {
+			<-done
+			return
+		}
+
+		w.Write([]byte("a bit"))
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(done) })
+
+	if _, err := httpGet(srv.URL+"/headers", nil); err == nil {
+		t.Error("server that never answered not given up on")
+	}
+
+	resp, err := httpGet(srv.URL+"/body", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err == nil || string(b) != "a bit" {
+		t.Errorf("read %q from a stalled download: %v", b, err)
+	}
+}
@@ -21,23 +21,174 @@ import (
 
 // --- AppImage detection & Offset calculation logic --- //
 
+// FSType is the filesystem an AppImage's files are stored in
+type FSType string
+
+const (
+	// Type 2 AppImages and shappimages
+	SquashFS FSType = "squashfs"
+	// Type 1 AppImages
+	ISO9660 FSType = "iso9660"
+	// Type 2 AppImages made for newer runtimes, such as uruntime
+	DwarFS FSType = "dwarfs"
+)
+
+var (
+	NoImage = errors.New("no SquashFS or DwarFS image found inside of AppImage")
+)
+
 // GetOffset takes an AppImage (either ELF or shappimage), returning the offset
-// of its SquashFS archive
+// of its filesystem image. See GetImage
 func GetOffset(src string) (int, error) {
+	offset, _, err := GetImage(src)
+	return offset, err
+}
+
+// GetImage returns the offset and type of the filesystem image inside of an
+// AppImage. The offset given by the AppImage's headers is checked for a valid
+// SquashFS or DwarFS image, if there isn't one (eg: the runtime has a
+// signature appended after its section headers) the file is searched for one
+// instead. Type 1 AppImages are an ISO 9660 image as a whole
+func GetImage(src string) (int, FSType, error) {
 	format, err := GetAppImageType(src)
 	if err != nil {
-		return -1, err
+		return -1, "", err
 	}
 
+	var offset int
+
 	if format == -2 {
-		return getShappImageSize(src)
+		offset, err = getShappImageSize(src)
 	} else if format == 2 {
-		return getElfSize(src)
+		offset, err = getElfSize(src)
+	} else if format == 1 {
+		f, err := os.Open(src)
+		if err != nil {
+			return -1, "", err
+		}
+		defer f.Close()
+
+		return 0, ISO9660, checkTruncated(f, 0, ISO9660)
 	} else if format == 0 {
-		return -1, errors.New("AppImage missing `AI\\0x02` magic at offset 0x08!")
+		return -1, "", errors.New("AppImage missing `AI\\0x02` magic at offset 0x08!")
+	} else {
+		return -1, "", errors.New("unsupported AppImage type")
+	}
+
+	f, openErr := os.Open(src)
+	if openErr != nil {
+		return -1, "", openErr
 	}
+	defer f.Close()
+
+	if err == nil {
+		if fsType := imageAt(f, int64(offset)); fsType != "" {
+			return offset, fsType, checkTruncated(f, int64(offset), fsType)
+		}
 
-	return -1, errors.New("unsupported AppImage type")
+		// The image is there but cut short, searching for another would only
+		// make for a confusing error
+		if _, ok := squashfsEnd(f, int64(offset)); ok {
+			return offset, SquashFS, checkTruncated(f, int64(offset), SquashFS)
+		}
+	}
+
+	o, fsType, scanErr := scanImage(f)
+	if scanErr == nil {
+		return int(o), fsType, checkTruncated(f, o, fsType)
+	}
+
+	// Why the headers didn't point at an image says the most
+	return -1, "", errors.Join(err, scanErr)
+}
+
+// Returns the type of the filesystem image at `offset`, if any
+func imageAt(f *os.File, offset int64) FSType {
+	if isSquashfs(f, offset) {
+		return SquashFS
+	} else if isDwarfs(f, offset) {
+		return DwarFS
+	}
+
+	return ""
+}
+
+// Checks for a plausible SquashFS 4.0 superblock at `offset`. The `hsqs`
+// magic alone isn't enough, as runtimes contain it in their own code
+func isSquashfs(f *os.File, offset int64) bool {
+	end, ok := squashfsEnd(f, offset)
+	if !ok {
+		return false
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return end <= info.Size()
+}
+
+// Returns where the SquashFS image at `offset` ends according to its
+// superblock, and whether the superblock is valid at all
+func squashfsEnd(f *os.File, offset int64) (int64, bool) {
+	sb := make([]byte, 48)
+	if _, err := f.ReadAt(sb, offset); err != nil {
+		return 0, false
+	}
+
+	if string(sb[0:4]) != "hsqs" {
+		return 0, false
+	}
+
+	blockSize := binary.LittleEndian.Uint32(sb[12:])
+	blockLog := binary.LittleEndian.Uint16(sb[22:])
+	major := binary.LittleEndian.Uint16(sb[28:])
+	bytesUsed := binary.LittleEndian.Uint64(sb[40:])
+
+	if major != 4 || blockLog < 12 || blockLog > 20 || blockSize != 1<<blockLog {
+		return 0, false
+	}
+
+	return offset + int64(bytesUsed), true
+}
+
+// Searches the file for the first valid SquashFS or DwarFS image, failing
+// with NoImage if there isn't one
+func scanImage(f *os.File) (int64, FSType, error) {
+	const chunkSize = 1 << 16
+	buf := make([]byte, chunkSize+5)
+	magics := [][]byte{[]byte("hsqs"), []byte("DWARFS")}
+
+	for pos := int64(0); ; pos += chunkSize {
+		n, err := f.ReadAt(buf, pos)
+
+		// Check candidates in order, so the first image wins
+		for i := 0; i < n; {
+			next := -1
+			for _, magic := range magics {
+				if j := bytes.Index(buf[i:n], magic); j >= 0 && (next < 0 || j < next) {
+					next = j
+				}
+			}
+
+			if next < 0 {
+				break
+			}
+
+			if fsType := imageAt(f, pos+int64(i+next)); fsType != "" {
+				return pos + int64(i+next), fsType, nil
+			}
+
+			i += next + 1
+		}
+
+		if err == io.EOF {
+			return -1, "", NoImage
+		} else if err != nil {
+			return -1, "", err
+		}
+	}
 }
 
 // Takes a src file as argument, returning the size of the shImg header and
@@ -76,7 +227,10 @@ func getShappImageSize(src string) (int, error) {
 // getElfSize takes a src file as argument, returning its size as an int
 // and an error if unsuccessful
 func getElfSize(src string) (int, error) {
-	f, _ := os.Open(src)
+	f, err := os.Open(src)
+	if err != nil {
+		return -1, err
+	}
 	defer f.Close()
 	e, err := elf.NewFile(f)
 	if err != nil {
@@ -119,7 +273,7 @@ func getElfSize(src string) (int, error) {
 		shnum = int(hdr.Shnum)
 		shentsize = int(hdr.Shentsize)
 	default:
-		return 0, nil
+		return -1, errors.New("unknown ELF class " + e.Class.String())
 	}
 
 	return shoff + (shentsize * shnum), nil
@@ -148,6 +302,10 @@ func GetAppImageType(src string) (int, error) {
 		} else if HasMagic(f, "AI\x02", 8) {
 			// AppImage type is type 2 (standard)
 			return 2, nil
+		} else if HasMagic(f, "CD001", 0x8001) {
+			// Early type 1 AppImages predate the magic, but are still an ISO
+			// 9660 image with the runtime in its system area
+			return 1, nil
 		}
 		// Unknown AppImage, but valid ELF
 		return 0, nil
@@ -0,0 +1,50 @@
+package chains
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetImage(t *testing.T) {
+	image := buildSquashfs(testSquashfsEntries()[:2])
+
+	// Where the image starts once the runtime is written
+	runtimeEnd := writeType2AppImage(t, filepath.Join(t.TempDir(), "empty"), nil)
+
+	for _, c := range []struct {
+		name string
+		junk []byte // Between the runtime and the image
+	}{
+		{"at the runtime's end", nil},
+		{"after an appended signature", []byte("-----BEGIN PGP SIGNATURE-----\n\nnot really one\n-----END PGP SIGNATURE-----\n")},
+		{"after a lookalike", append([]byte("hsqs"), make([]byte, 100)...)},
+		{"across chunks", bytes.Repeat([]byte{'h'}, 1<<16-2-int(runtimeEnd))},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "app.AppImage")
+			want := int(writeType2AppImage(t, path, append(bytes.Clone(c.junk), image...))) + len(c.junk)
+
+			offset, fsType, err := GetImage(path)
+			if err != nil || offset != want || fsType != SquashFS {
+				t.Errorf("found %q at %d, want %q at %d: %v", fsType, offset, SquashFS, want, err)
+			}
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+	writeType2AppImage(t, path, []byte(strings.Repeat("no image in here, hsqs ", 10000)))
+
+	if _, _, err := GetImage(path); !errors.Is(err, NoImage) {
+		t.Errorf("found an image in an AppImage without one: %v", err)
+	}
+
+	// Cut short, rather than missing
+	writeType2AppImage(t, path, image[:len(image)-10])
+
+	if _, _, err := GetImage(path); !errors.Is(err, TruncatedImage) {
+		t.Errorf("truncated image not reported: %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package chains
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adrg/xdg"
+)
+
+// Before an AppImage is replaced by an update or a rollback, the version
+// being replaced is kept in `$XDG_DATA_HOME/chains/versions/<app ID>/`, so it
+// can be restored if the update turns out to be broken. Restoring a version
+// puts it back where it was, and its data dir and cache, which follow the app
+// ID, are the same ones it used before
+
+var (
+	NoVersions      = errors.New("no previous versions are kept")
+	VersionNotFound = errors.New("no kept version matches")
+)
+
+// KeepVersions is how many previous versions are kept for each app, older
+// ones are deleted. It can be set through `CHAINS_KEEP_VERSIONS`, 0 keeps none
+var KeepVersions = 3
+
+func init() {
+	if n, err := strconv.Atoi(os.Getenv("CHAINS_KEEP_VERSIONS")); err == nil && n >= 0 {
+		KeepVersions = n
+	}
+}
+
+// Version is a previous version of an AppImage
+type Version struct {
+	File    string      `json:"file"` // Name of the copy in the app's versions directory
+	Path    string      `json:"path"` // Where it was when it was replaced
+	SHA256  string      `json:"sha256"`
+	Version string      `json:"version"`
+	Time    time.Time   `json:"time"`            // When it was replaced
+	Trust   *TrustEntry `json:"trust,omitempty"` // Its trust entry, if it was trusted
+}
+
+// Directory the previous versions of the app with ID `id` are kept in
+func VersionsDir(id string) string {
+	return filepath.Join(xdg.DataHome, "chains", "versions", id)
+}
+
+// Returns the versions kept for the app with ID `id`, newest first
+func ListVersions(id string) ([]Version, error) {
+	b, err := os.ReadFile(filepath.Join(VersionsDir(id), "versions.json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var versions []Version
+	if err := json.Unmarshal(b, &versions); err != nil {
+		return nil, errors.Join(errors.New("failed to parse the versions of `"+id+"`"), err)
+	}
+
+	return versions, nil
+}
+
+// Locks the app's list of versions so that `fn` can change it, then writes
+// it back and deletes the copies of versions it dropped
+func updateVersions(id string, fn func(versions []Version) ([]Version, error)) error {
+	dir := VersionsDir(id)
+	if err := os.MkdirAll(dir, 0744); err != nil {
+		return err
+	}
+
+	lock, err := lockFile(filepath.Join(dir, "versions.json.lock"))
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	versions, err := ListVersions(id)
+	if err != nil {
+		return err
+	}
+
+	kept, err := fn(versions)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(kept, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, "versions.json.tmp-"+strconv.Itoa(os.Getpid()))
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(dir, "versions.json")); err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		if !containsVersionFile(kept, v.File) {
+			os.Remove(filepath.Join(dir, v.File))
+		}
+	}
+
+	return nil
+}
+
+func containsVersionFile(versions []Version, file string) bool {
+	for _, v := range versions {
+		if v.File == file {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keeps a copy of the AppImage as it is now, before it gets replaced. Does
+// nothing if KeepVersions is 0. It's kept with the versions of its app ID, so
+// it has to own the ID, see *AppImage.CheckID
+func (ai *AppImage) KeepVersion() error {
+	if KeepVersions <= 0 {
+		return nil
+	}
+
+	if err := ai.CheckID(); err != nil {
+		return err
+	}
+
+	v, err := ai.version()
+	if err != nil {
+		return err
+	}
+
+	return updateVersions(ai.ID, func(versions []Version) ([]Version, error) {
+		return keepVersion(ai.ID, versions, v)
+	})
+}
+
+// Describes the AppImage as a previous version, with its trust entry if it's
+// trusted
+func (ai *AppImage) version() (Version, error) {
+	path, err := filepath.Abs(ai.Path)
+	if err != nil {
+		return Version{}, err
+	}
+
+	db, err := LoadTrustDB()
+	if err != nil {
+		return Version{}, err
+	}
+
+	return Version{
+		File:    ai.sha256 + ".AppImage",
+		Path:    path,
+		SHA256:  ai.sha256,
+		Version: ai.Version,
+		Time:    time.Now().UTC(),
+		Trust:   db.Lookup(ai.sha256),
+	}, nil
+}
+
+// Copies the file at `v.Path` into the app's versions, dropping the oldest
+// ones past KeepVersions
+func keepVersion(id string, versions []Version, v Version) ([]Version, error) {
+	if err := linkOrCopy(v.Path, filepath.Join(VersionsDir(id), v.File)); err != nil {
+		return nil, err
+	}
+
+	// The same contents are only kept once
+	kept := []Version{v}
+	for _, old := range versions {
+		if old.SHA256 != v.SHA256 {
+			kept = append(kept, old)
+		}
+	}
+
+	return kept[:min(len(kept), KeepVersions)], nil
+}
+
+// Puts back the kept version of the app with ID `id` whose hash starts with
+// `hash`, or the newest one if `hash` is empty. What's at its path is kept in
+// turn, so the rollback can be undone. If the version was trusted when it
+// was replaced, it's trusted again
+func Rollback(id string, hash string) (*Version, error) {
+	var restored Version
+
+	err := updateVersions(id, func(versions []Version) ([]Version, error) {
+		if len(versions) == 0 {
+			return nil, errors.Join(NoVersions, errors.New("for app ID `"+id+"`"))
+		}
+
+		v, err := findVersion(versions, hash)
+		if err != nil {
+			return nil, err
+		}
+		restored = *v
+
+		// It's no longer a previous version once it's back
+		var kept []Version
+		for _, old := range versions {
+			if old.SHA256 != v.SHA256 {
+				kept = append(kept, old)
+			}
+		}
+
+		tmp := v.Path + ".tmp-" + strconv.Itoa(os.Getpid())
+		if err := linkOrCopy(filepath.Join(VersionsDir(id), v.File), tmp); err != nil {
+			os.Remove(tmp)
+			return nil, err
+		}
+		defer os.Remove(tmp)
+
+		// Whatever replaced the version is kept in its place. If it's too
+		// broken to open, there's nothing worth keeping
+		if current, err := NewAppImage(v.Path); err == nil && KeepVersions > 0 {
+			if current.sha256 == v.SHA256 {
+				return nil, errors.New("version " + v.Version + " is already at `" + v.Path + "`")
+			}
+
+			cv, err := current.version()
+			if err != nil {
+				return nil, err
+			}
+
+			if kept, err = keepVersion(id, kept, cv); err != nil {
+				return nil, err
+			}
+		}
+
+		return kept, os.Rename(tmp, v.Path)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if restored.Trust != nil {
+		entry := *restored.Trust
+		entry.Path = restored.Path
+
+		err = UpdateTrustDB(func(db *TrustDB) error {
+			db.Add(entry)
+			return nil
+		})
+	}
+
+	return &restored, err
+}
+
+func findVersion(versions []Version, hash string) (*Version, error) {
+	if hash == "" {
+		return &versions[0], nil
+	}
+
+	var match *Version
+	for i := range versions {
+		if strings.HasPrefix(versions[i].SHA256, strings.ToLower(hash)) {
+			if match != nil {
+				return nil, errors.New("`" + hash + "` matches more than one version")
+			}
+			match = &versions[i]
+		}
+	}
+
+	if match == nil {
+		return nil, errors.Join(VersionNotFound, errors.New("`"+hash+"`"))
+	}
+
+	return match, nil
+}
+
+// Hard links `src` to `dest`, or copies it if they're on different
+// filesystems. Either way, `dest` is left alone when `src` is replaced
+func linkOrCopy(src string, dest string) error {
+	os.Remove(dest)
+	if os.Link(src, dest) == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,175 @@
+package chains
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adrg/xdg"
+)
+
+// Replaces the AppImage at `path` with `version` of it, as an update does
+func writeVersion(t *testing.T, path string, desktop string, version string) *AppImage {
+	tmp := path + ".tmp"
+	writeISOAppImage(t, tmp, []testISOEntry{
+		{name: desktop, data: "[Desktop Entry]\nName=App\nX-AppImage-Version=" + version + "\n"},
+	})
+
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+
+	ai, err := NewAppImage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ai
+}
+
+func isolateVersions(t *testing.T) {
+	dataHome, cacheHome, keep := xdg.DataHome, xdg.CacheHome, KeepVersions
+	xdg.DataHome = t.TempDir()
+	xdg.CacheHome = t.TempDir()
+	t.Cleanup(func() { xdg.DataHome, xdg.CacheHome, KeepVersions = dataHome, cacheHome, keep })
+}
+
+func TestRollback(t *testing.T) {
+	for _, desktop := range []string{"org.example.App.desktop", ".desktop"} {
+		t.Run(desktop, func(t *testing.T) {
+			isolateVersions(t)
+			KeepVersions = 3
+
+			path := filepath.Join(t.TempDir(), "app.AppImage")
+
+			v1 := writeVersion(t, path, desktop, "1")
+			err := UpdateTrustDB(func(db *TrustDB) error {
+				db.Add(TrustEntry{Path: path, SHA256: v1.sha256, Version: v1.Version})
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := v1.KeepVersion(); err != nil {
+				t.Fatal(err)
+			}
+			v2 := writeVersion(t, path, desktop, "2")
+
+			// Rollbacks find the versions through whatever is at the path now
+			if v2.ID != v1.ID {
+				t.Fatalf("ID changed from %s to %s across the update", v1.ID, v2.ID)
+			}
+
+			versions, err := ListVersions(v2.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != 1 || versions[0].SHA256 != v1.sha256 || versions[0].Trust == nil {
+				t.Fatalf("kept versions: %+v", versions)
+			}
+
+			restored, err := Rollback(v2.ID, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restored.Version != "1" {
+				t.Errorf("rolled back to version %s", restored.Version)
+			}
+
+			current, err := NewAppImage(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if current.sha256 != v1.sha256 {
+				t.Error("the old version isn't back at its path")
+			}
+			if !current.Trusted() {
+				t.Error("the old version's trust wasn't restored")
+			}
+
+			// The version rolled back from is kept in turn
+			versions, err = ListVersions(v2.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != 1 || versions[0].SHA256 != v2.sha256 || versions[0].Trust != nil {
+				t.Errorf("kept versions after rollback: %+v", versions)
+			}
+		})
+	}
+}
+
+func TestKeepVersionsTrims(t *testing.T) {
+	isolateVersions(t)
+	KeepVersions = 2
+
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+
+	var kept []*AppImage
+	for _, version := range []string{"1", "2", "3", "4"} {
+		ai := writeVersion(t, path, "org.example.App.desktop", version)
+		if err := ai.KeepVersion(); err != nil {
+			t.Fatal(err)
+		}
+
+		kept = append(kept, ai)
+	}
+
+	// Keeping the same contents again doesn't push another out
+	if err := kept[3].KeepVersion(); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := ListVersions("org.example.App")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(versions) != 2 || versions[0].Version != "4" || versions[1].Version != "3" {
+		t.Fatalf("kept versions: %+v", versions)
+	}
+
+	entries, err := os.ReadDir(VersionsDir("org.example.App"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range entries {
+		for _, dropped := range kept[:2] {
+			if e.Name() == dropped.sha256+".AppImage" {
+				t.Errorf("copy of dropped version %s left behind", dropped.Version)
+			}
+		}
+	}
+
+	KeepVersions = 0
+	if err := writeVersion(t, path, "org.example.App.desktop", "5").KeepVersion(); err != nil {
+		t.Fatal(err)
+	}
+	if versions, _ := ListVersions("org.example.App"); len(versions) != 2 {
+		t.Errorf("version kept with KeepVersions at 0: %+v", versions)
+	}
+}
+
+func TestRollbackErrors(t *testing.T) {
+	isolateVersions(t)
+
+	if _, err := Rollback("org.example.None", ""); err == nil {
+		t.Error("rolled back an app without versions")
+	}
+
+	path := filepath.Join(t.TempDir(), "app.AppImage")
+	ai := writeVersion(t, path, "org.example.App.desktop", "1")
+	if err := ai.KeepVersion(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Rollback(ai.ID, "not-a-hash"); err == nil {
+		t.Error("rolled back to a version that isn't kept")
+	}
+
+	if _, err := Rollback(ai.ID, ""); err == nil {
+		t.Error("rolled back to the version already in place")
+	}
+}
@@ -2,29 +2,46 @@ package chains
 
 import (
 	"errors"
+	"fmt"
+	"maps"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/adrg/xdg"
 )
 
-// Executes AppImage through bwrap and creates a portable home if one doesn't
+// Executes AppImage through the sandbox backend (bwrap unless set otherwise
+// with *AppImage.SetBackend) and creates a portable home if one doesn't
 // already exist
-// Returns error if AppImagePerms.Level < 1
+// Level 0 runs the AppImage directly with only a portable home, see
+// *AppImage.runUnsandboxed
 func (ai *AppImage) Sandbox(perms *AppImagePerms, args []string) error {
-	if perms.Level < 1 || perms.Level > 3 {
-		return errors.New("permissions level must be 1 - 3")
+	if perms.Level < 0 || perms.Level > 3 {
+		return errors.New("permissions level must be 0 - 3")
 	}
 
-	if !DirExists(filepath.Join(xdg.CacheHome, "appimage", ai.md5)) {
-		err := os.MkdirAll(filepath.Join(xdg.CacheHome, "appimage", ai.md5), 0744)
-		if err != nil {
-			return err
-		}
+	// Checked before anything is created for the app
+	if perms.Level == 0 && !CurrentPolicy.AllowUnsandboxed {
+		return UnsandboxedForbidden
+	}
+
+	if err := ai.CheckID(); err != nil {
+		return err
+	}
+
+	if err := ai.makeCacheDir(); err != nil {
+		return err
+	}
+
+	if err := ai.migrateDataDir(); err != nil {
+		return err
 	}
 
 	// Tell AppImages not to ask for integration
@@ -40,163 +57,249 @@ func (ai *AppImage) Sandbox(perms *AppImagePerms, args []string) error {
 		noIntegrate.Close()
 	}
 
-	cmdArgs, err := ai.GetWrapArgs(perms, args)
+	if perms.Level == 0 {
+		return ai.runUnsandboxed(perms, args)
+	}
+
+	spec, err := ai.Spec(perms, args)
 	if err != nil {
 		return err
 	}
 
+	if ai.Backend() == Native {
+		return runNative(spec)
+	}
+
+	return runBwrap(spec)
+}
+
+// Runs the sandbox described by `spec` through bwrap
+func runBwrap(spec *SandboxSpec) error {
 	bwrapStr, present := CommandExists("bwrap")
 	if !present {
-		return errors.New("failed to find bwrap! unable to sandbox application")
+		return errors.New("failed to find bwrap! unable to sandbox application, try the native backend")
 	}
 
-	bwrap := exec.Command(bwrapStr, cmdArgs...)
+	spec = spec.withLandlockHelper(landlockHelperBinary())
+
+	bwrap := exec.Command(bwrapStr, spec.BwrapArgs()...)
 	bwrap.Stdout = os.Stdout
 	bwrap.Stderr = os.Stderr
 	bwrap.Stdin = os.Stdin
 
-	return bwrap.Run()
+	if spec.Seccomp != nil {
+		f, err := os.Open(spec.Seccomp.Filter)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bwrap.ExtraFiles = []*os.File{f}
+	}
+
+	return runForwardingSignals(bwrap, nil)
 }
 
-// Returns the bwrap arguments to sandbox the AppImage
-func (ai AppImage) GetWrapArgs(perms *AppImagePerms, args []string) ([]string, error) {
+// Signals passed on to the app, so it gets to quit before anything it uses
+// is unmounted
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+
+// Runs `cmd`, passing forwardedSignals on to it until it exits. `started`, if
+// set, is called once it's running, and it's killed if that fails
+func runForwardingSignals(cmd *exec.Cmd, started func() error) error {
+	// Before starting it, so none are missed
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, forwardedSignals...)
+	defer signal.Stop(sigs)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			select {
+			case sig := <-sigs:
+				cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if started != nil {
+		if err := started(); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+	}
+
+	return cmd.Wait()
+}
+
+// Runs AppRun straight from the mount point without bwrap. The only thing
+// separating the app from the rest of the system is that `HOME` points to its
+// data dir, so this is just a "portable home" and offers NO security
+func (ai *AppImage) runUnsandboxed(perms *AppImagePerms, args []string) error {
+	if !CurrentPolicy.AllowUnsandboxed {
+		return UnsandboxedForbidden
+	}
+
 	if !ai.IsMounted() {
-		return []string{}, errors.New("AppImage must be mounted before getting its wrap arguments! call *AppImage.Mount() first")
+		return errors.New("AppImage must be mounted before running it! call *AppImage.Mount() first")
 	}
 
-	home, present := unsetHome()
-	defer restoreHome(home, present)
+	fmt.Fprintln(os.Stderr, "WARNING: running `"+ai.Name+"` at level 0, the application is NOT sandboxed!")
+
+	home := ai.dataDir
+	if !perms.DataDir {
+		home = filepath.Join(ai.tempDir, "home")
+	}
 
+	err := os.MkdirAll(home, 0744)
+	if err != nil {
+		return err
+	}
+
+	// The working directory is kept, like the AppImage runtime does, so that
+	// relative paths given as arguments still work
+	cmd := exec.Command(filepath.Join(ai.mountDir, "AppRun"), args...)
+	cmd.Env = append(os.Environ(),
+		"HOME="+home,
+		"TMPDIR="+ai.tempDir,
+		"APPDIR="+ai.mountDir,
+		"APPIMAGE="+ai.Path,
+		"ARGV0="+path.Base(ai.Path),
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+
+	return runForwardingSignals(cmd, nil)
+}
+
+// Returns the bwrap arguments to sandbox the AppImage. With LandlockHelper
+// set, they bind the running program into the sandbox, so they only work
+// while it's where it is now
+func (ai AppImage) GetWrapArgs(perms *AppImagePerms, args []string) ([]string, error) {
 	if perms.Level == 0 {
 		return args, nil
 	}
 
-	cmdArgs := ai.getMainWrapArgs(perms)
+	spec, err := ai.Spec(perms, args)
+	if err != nil {
+		return []string{}, err
+	}
 
-	// Append console arguments provided by the user
-	return append(cmdArgs, args...), nil
+	return spec.BwrapArgs(), nil
 }
 
-func (ai *AppImage) getMainWrapArgs(perms *AppImagePerms) []string {
+// Spec compiles the permissions into a *SandboxSpec, which can then be run
+// by any backend. `args` are passed on to the AppImage
+func (ai *AppImage) Spec(perms *AppImagePerms, args []string) (*SandboxSpec, error) {
+	if !ai.IsMounted() {
+		return nil, errors.New("AppImage must be mounted before getting its sandbox spec! call *AppImage.Mount() first")
+	}
+
+	if perms.Level < 1 || perms.Level > 3 {
+		return nil, errors.New("permissions level must be 1 - 3")
+	}
+
 	home, present := unsetHome()
 	defer restoreHome(home, present)
 
-	// Basic arguments to be used at all sandboxing levels
-	cmdArgs := []string{
-		"--setenv", "TMPDIR", "/tmp",
-		"--setenv", "HOME", xdg.Home,
-		"--setenv", "APPDIR", "/tmp/.mount_" + ai.md5,
-		"--setenv", "APPIMAGE", filepath.Join("/app", path.Base(ai.Path)),
-		"--setenv", "ARGV0", filepath.Join(path.Base(ai.Path)),
-		"--setenv", "XDG_DESKTOP_DIR", xdg.UserDirs.Desktop,
-		"--setenv", "XDG_DOWNLOAD_DIR", xdg.UserDirs.Download,
-		"--setenv", "XDG_DOCUMENTS_DIR", xdg.UserDirs.Documents,
-		"--setenv", "XDG_MUSIC_DIR", xdg.UserDirs.Music,
-		"--setenv", "XDG_PICTURES_DIR", xdg.UserDirs.Pictures,
-		"--setenv", "XDG_VIDEOS_DIR", xdg.UserDirs.Videos,
-		"--setenv", "XDG_TEMPLATES_DIR", xdg.UserDirs.Templates,
-		"--setenv", "XDG_PUBLICSHARE_DIR", xdg.UserDirs.PublicShare,
-		"--setenv", "XDG_DATA_HOME", xdg.DataHome,
-		"--setenv", "XDG_CONFIG_HOME", xdg.ConfigHome,
-		"--setenv", "XDG_CACHE_HOME", xdg.CacheHome,
-		"--setenv", "XDG_STATE_HOME", xdg.StateHome,
-		"--setenv", "XDG_RUNTIME_DIR", xdg.RuntimeDir,
-		"--die-with-parent",
-		"--perms", "0700",
-		"--dir", filepath.Join(xdg.RuntimeDir),
-		"--dev", "/dev",
-		"--proc", "/proc",
-		"--bind", filepath.Join(xdg.CacheHome, "appimage", ai.md5), xdg.CacheHome,
-		"--ro-bind-try", ai.resolve("opt"), "/opt",
-		"--ro-bind-try", ai.resolve("bin"), "/bin",
-		"--ro-bind-try", ai.resolve("sbin"), "/sbin",
-		"--ro-bind-try", ai.resolve("lib"), "/lib",
-		"--ro-bind-try", ai.resolve("lib32"), "/lib32",
-		"--ro-bind-try", ai.resolve("lib64"), "/lib64",
-		"--ro-bind-try", ai.resolve("usr/bin"), "/usr/bin",
-		"--ro-bind-try", ai.resolve("usr/sbin"), "/usr/sbin",
-		"--ro-bind-try", ai.resolve("usr/lib"), "/usr/lib",
-		"--ro-bind-try", ai.resolve("usr/lib32"), "/usr/lib32",
-		"--ro-bind-try", ai.resolve("usr/lib64"), "/usr/lib64",
-		"--dir", "/app",
-		"--bind", ai.Path, filepath.Join("/app", path.Base(ai.Path)),
-	}
-
-	// Level 1 is minimal sandboxing, grants access to most system files, all devices and only really attempts to isolate home files
-	if perms.Level == 1 {
-		cmdArgs = append(cmdArgs, []string{
-			"--dev-bind", "/dev", "/dev",
-			"--ro-bind", "/sys", "/sys",
-			"--ro-bind-try", ai.resolve("usr"), "/usr",
-			"--ro-bind-try", ai.resolve("etc"), "/etc",
-			"--ro-bind-try", ai.resolve("/run/systemd"), "/run/systemd",
-			"--ro-bind-try", filepath.Join(xdg.DataHome, "fonts"), filepath.Join(xdg.DataHome, "fonts"),
-			"--ro-bind-try", filepath.Join(xdg.DataHome, "themes"), filepath.Join(xdg.DataHome, "themes"),
-			"--ro-bind-try", filepath.Join(xdg.DataHome, "icons"), filepath.Join(xdg.DataHome, "icons"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "fontconfig"), filepath.Join(xdg.ConfigHome, "fontconfig"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "gtk-3.0"), filepath.Join(xdg.ConfigHome, "gtk-3.0"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "gtk-4.0"), filepath.Join(xdg.ConfigHome, "gtk-4.0"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "qt5ct"), filepath.Join(xdg.ConfigHome, "qt5ct"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "qt6ct"), filepath.Join(xdg.ConfigHome, "qt6ct"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "Kvantum"), filepath.Join(xdg.ConfigHome, "Kvantum"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "kdeglobals"), filepath.Join(xdg.ConfigHome, "kdeglobals"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "lxde", "lxde.conf"), filepath.Join(xdg.ConfigHome, "lxde", "lxde.conf"),
-		}...)
-		// Level 2 grants access to fewer system files, and all themes
-		// Likely to add more files here for compatability.
-		// This should be the standard level for GUI profiles
-	} else if perms.Level == 2 {
-		cmdArgs = append(cmdArgs, []string{
-			"--ro-bind-try", ai.resolve("etc/fonts"), "/etc/fonts",
-			"--ro-bind-try", ai.resolve("etc/ld.so.cache"), "/etc/ld.so.cache",
-			"--ro-bind-try", ai.resolve("etc/mime.types"), "/etc/mime.types",
-			"--ro-bind-try", ai.resolve("etc/xdg"), "/etc/xdg",
-			"--ro-bind-try", ai.resolve("usr/share/fontconfig"), "/usr/share/fontconfig",
-			"--ro-bind-try", ai.resolve("usr/share/fonts"), "/usr/share/fonts",
-			"--ro-bind-try", ai.resolve("usr/share/icons"), "/usr/share/icons",
-			"--ro-bind-try", ai.resolve("usr/share/themes"), "/usr/share/themes",
-			"--ro-bind-try", ai.resolve("usr/share/applications"), "/usr/share/applications",
-			"--ro-bind-try", ai.resolve("usr/share/mime"), "/usr/share/mime",
-			"--ro-bind-try", ai.resolve("usr/share/libdrm"), "/usr/share/libdrm",
-			"--ro-bind-try", ai.resolve("usr/share/vulkan"), "/usr/share/vulkan",
-			"--ro-bind-try", ai.resolve("usr/share/glvnd"), "/usr/share/glvnd",
-			"--ro-bind-try", ai.resolve("usr/share/glib-2.0"), "/usr/share/glib-2.0",
-			"--ro-bind-try", ai.resolve("usr/share/terminfo"), "/usr/share/terminfo",
-			"--ro-bind-try", filepath.Join(xdg.DataHome, "fonts"), filepath.Join(xdg.DataHome, "fonts"),
-			"--ro-bind-try", filepath.Join(xdg.DataHome, "themes"), filepath.Join(xdg.DataHome, "themes"),
-			"--ro-bind-try", filepath.Join(xdg.DataHome, "icons"), filepath.Join(xdg.DataHome, "icons"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "fontconfig"), filepath.Join(xdg.ConfigHome, "fontconfig"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "gtk-3.0"), filepath.Join(xdg.ConfigHome, "gtk-3.0"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "gtk-4.0"), filepath.Join(xdg.ConfigHome, "gtk-4.0"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "qt5ct"), filepath.Join(xdg.ConfigHome, "qt5ct"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "qt6ct"), filepath.Join(xdg.ConfigHome, "qt6ct"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "Kvantum"), filepath.Join(xdg.ConfigHome, "Kvantum"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "kdeglobals"), filepath.Join(xdg.ConfigHome, "kdeglobals"),
-			"--ro-bind-try", filepath.Join(xdg.ConfigHome, "lxde", "lxde.conf"), filepath.Join(xdg.ConfigHome, "lxde", "lxde.conf"),
-		}...)
-	}
-
-	cmdArgs = append(cmdArgs, parseFiles(perms)...)
-	cmdArgs = append(cmdArgs, parseSockets(ai, perms)...)
-	cmdArgs = append(cmdArgs, parseDevices(ai, perms)...)
-	cmdArgs = append(cmdArgs, "--", "/tmp/.mount_"+ai.md5+"/AppRun")
+	spec := &SandboxSpec{
+		Version:       SpecVersion,
+		DieWithParent: true,
+		Exec: Exec{
+			Path: "/tmp/.mount_" + ai.md5 + "/AppRun",
+			Args: args,
+		},
+	}
+
+	// Basic environment to be used at all sandboxing levels
+	spec.setenv("TMPDIR", "/tmp")
+	spec.setenv("HOME", xdg.Home)
+	spec.setenv("APPDIR", "/tmp/.mount_"+ai.md5)
+	spec.setenv("APPIMAGE", filepath.Join("/app", path.Base(ai.Path)))
+	spec.setenv("ARGV0", filepath.Join(path.Base(ai.Path)))
+	spec.setenv("XDG_DESKTOP_DIR", xdg.UserDirs.Desktop)
+	spec.setenv("XDG_DOWNLOAD_DIR", xdg.UserDirs.Download)
+	spec.setenv("XDG_DOCUMENTS_DIR", xdg.UserDirs.Documents)
+	spec.setenv("XDG_MUSIC_DIR", xdg.UserDirs.Music)
+	spec.setenv("XDG_PICTURES_DIR", xdg.UserDirs.Pictures)
+	spec.setenv("XDG_VIDEOS_DIR", xdg.UserDirs.Videos)
+	spec.setenv("XDG_TEMPLATES_DIR", xdg.UserDirs.Templates)
+	spec.setenv("XDG_PUBLICSHARE_DIR", xdg.UserDirs.PublicShare)
+	spec.setenv("XDG_DATA_HOME", xdg.DataHome)
+	spec.setenv("XDG_CONFIG_HOME", xdg.ConfigHome)
+	spec.setenv("XDG_CACHE_HOME", xdg.CacheHome)
+	spec.setenv("XDG_STATE_HOME", xdg.StateHome)
+	spec.setenv("XDG_RUNTIME_DIR", xdg.RuntimeDir)
+
+	spec.bind(BindMount, ai.tempDir, "/tmp", false)
+	// Extractions are shared by every launch, don't let the app modify them
+	if ai.extracted {
+		spec.bind(ROBindMount, ai.mountDir, "/tmp/.mount_"+ai.md5, false)
+	} else {
+		spec.bind(BindMount, ai.mountDir, "/tmp/.mount_"+ai.md5, false)
+	}
 
 	if perms.DataDir {
-		cmdArgs = append([]string{
-			"--bind", ai.dataDir, xdg.Home,
-		}, cmdArgs...)
+		spec.bind(BindMount, ai.dataDir, xdg.Home, false)
 	} else {
-		cmdArgs = append([]string{
-			"--tmpfs", xdg.Home,
-		}, cmdArgs...)
+		spec.Mounts = append(spec.Mounts, Mount{Type: TmpfsMount, Dest: xdg.Home})
+	}
+
+	// Basic files to be used at all sandboxing levels
+	spec.Mounts = append(spec.Mounts,
+		Mount{Type: DirMount, Dest: xdg.RuntimeDir, Mode: 0700},
+		Mount{Type: DevMount, Dest: "/dev"},
+		Mount{Type: ProcMount, Dest: "/proc"},
+	)
+
+	spec.bind(BindMount, ai.cacheDir(), xdg.CacheHome, false)
+
+	for _, dir := range []string{
+		"opt", "bin", "sbin", "lib", "lib32", "lib64",
+		"usr/bin", "usr/sbin", "usr/lib", "usr/lib32", "usr/lib64",
+	} {
+		spec.bind(ROBindMount, ai.resolve(dir), "/"+dir, true)
+	}
+
+	spec.Mounts = append(spec.Mounts, Mount{Type: DirMount, Dest: "/app"})
+	spec.bind(BindMount, ai.Path, filepath.Join("/app", path.Base(ai.Path)), false)
+
+	lvl, err := perms.GetLevel()
+	if err != nil {
+		return nil, err
 	}
 
-	cmdArgs = append([]string{
-		"--bind", ai.tempDir, "/tmp",
-		"--bind", ai.mountDir, "/tmp/.mount_" + ai.md5,
-	}, cmdArgs...)
+	if err := ai.applyLevel(spec, lvl); err != nil {
+		return nil, err
+	}
+
+	parseFiles(spec, perms)
+	parseSockets(spec, ai, perms)
+	parseDevices(spec, ai, perms)
+
+	if err := parseIdentity(spec, perms); err != nil {
+		return nil, err
+	}
 
-	return cmdArgs
+	if perms.Seccomp != "" {
+		spec.Seccomp = &Seccomp{Filter: ExpandDir(perms.Seccomp)}
+	}
+
+	if !ai.noLandlock && ai.landlockSupported() {
+		spec.Landlock = spec.landlockRules()
+	}
+
+	return spec, nil
 }
 
 // Returns the location of the requested directory on the host filesystem with
@@ -212,64 +315,75 @@ func (ai AppImage) resolve(src string) string {
 	return s
 }
 
-func parseFiles(perms *AppImagePerms) []string {
-	var s []string
-
-	// Convert requested files/ dirs to brap flags
+func parseFiles(spec *SandboxSpec, perms *AppImagePerms) {
+	// Convert requested files/ dirs to mounts
 	for _, val := range perms.Files {
 		sl := strings.Split(val, ":")
 		ex := sl[len(sl)-1]
 		dir := strings.Join(sl[:len(sl)-1], ":")
 
 		if ex == "rw" {
-			s = append(s, "--bind-try", ExpandDir(dir), ExpandGenericDir(dir))
+			spec.bind(BindMount, ExpandDir(dir), ExpandGenericDir(dir), true)
 		} else if ex == "ro" {
-			s = append(s, "--ro-bind-try", ExpandDir(dir), ExpandGenericDir(dir))
+			spec.bind(ROBindMount, ExpandDir(dir), ExpandGenericDir(dir), true)
 		}
 	}
-
-	return s
 }
 
-// Give all requried flags to add the devices
-func parseDevices(ai *AppImage, perms *AppImagePerms) []string {
-	var d []string
+// Capabilities, uid/gid mapping and nested user namespaces
+func parseIdentity(spec *SandboxSpec, perms *AppImagePerms) error {
+	id, err := ParseIdentity(perms.Identity)
+	if err != nil {
+		return err
+	}
+
+	spec.Identity = id
+	spec.DropCaps = perms.DropCaps
+	spec.KeepCaps = perms.KeepCaps
+	spec.DisableUserns = perms.DisableUserns
+
+	// Both only work from inside of a user namespace we own
+	if (id != nil || perms.DisableUserns) && !spec.Namespaces.User {
+		return errors.New("`Identity` and `DisableUserns` need a user namespace, remove the `user` socket to use them")
+	}
 
-	// Convert device perms to bwrap format
+	return nil
+}
+
+// Give all requried mounts to add the devices
+func parseDevices(spec *SandboxSpec, ai *AppImage, perms *AppImagePerms) {
 	for _, v := range perms.Devices {
 		if len(v) < 5 || v[0:5] != "/dev/" {
 			v = filepath.Join("/dev", v)
 		}
 
-		d = append(d, "--dev-bind-try", v, v)
+		spec.device(v, v, true)
 	}
 
 	// Required files to go along with them
-	var devices = map[string][]string{
-		"dri": {
-			"--ro-bind", "/sys/dev/char", "/sys/dev/char",
-			"--ro-bind", "/sys/devices/pci0000:00", "/sys/devices/pci0000:00",
-			"--dev-bind-try", "/dev/nvidiactl", "/dev/nvidiactl",
-			"--dev-bind-try", "/dev/nvidia0", "/dev/nvidia0",
-			"--dev-bind-try", "/dev/nvidia-modeset", "/dev/nvidia-modeset",
-			"--ro-bind-try", ai.resolve("usr/share/glvnd"), "/usr/share/glvnd",
+	var devices = map[string]func(){
+		"dri": func() {
+			spec.bind(ROBindMount, "/sys/dev/char", "/sys/dev/char", false)
+			spec.bind(ROBindMount, "/sys/devices/pci0000:00", "/sys/devices/pci0000:00", false)
+			spec.device("/dev/nvidiactl", "/dev/nvidiactl", true)
+			spec.device("/dev/nvidia0", "/dev/nvidia0", true)
+			spec.device("/dev/nvidia-modeset", "/dev/nvidia-modeset", true)
+			spec.bind(ROBindMount, ai.resolve("usr/share/glvnd"), "/usr/share/glvnd", true)
 		},
-		"input": {
-			"--ro-bind", "/sys/class/input", "/sys/class/input",
+		"input": func() {
+			spec.bind(ROBindMount, "/sys/class/input", "/sys/class/input", false)
 		},
 	}
 
-	for device := range devices {
+	// Sorted so the spec comes out the same every time
+	for _, device := range slices.Sorted(maps.Keys(devices)) {
 		if _, present := Contains(perms.Devices, device); present {
-			d = append(d, devices[device]...)
+			devices[device]()
 		}
 	}
-
-	return d
 }
 
-func parseSockets(ai *AppImage, perms *AppImagePerms) []string {
-	var s []string
+func parseSockets(spec *SandboxSpec, ai *AppImage, perms *AppImagePerms) {
 	uid := strconv.Itoa(os.Getuid())
 
 	// These vars will only be used if x11 socket is granted access
@@ -289,95 +403,100 @@ func parseSockets(ai *AppImage, perms *AppImagePerms) []string {
 	// Using different Wayland display sessions currently not tested
 	wDisplay, waylandEnabled := os.LookupEnv("WAYLAND_DISPLAY")
 
-	// Args if socket is enabled
-	var sockets = map[string][]string{
+	ro := func(src string, dest string) {
+		spec.bind(ROBindMount, src, dest, true)
+	}
+
+	// Mounts if socket is enabled
+	var sockets = map[Socket]func(){
 		// Encompasses ALSA, Pulse and pipewire. Easiest for convience, but for
 		// more security, specify the specific audio system
-		"alsa": {
-			"--ro-bind-try", ai.resolve("/usr/share/alsa"), "/usr/share/alsa",
-			"--ro-bind-try", ai.resolve("/etc/alsa"), "/etc/alsa",
-			"--ro-bind-try", ai.resolve("/etc/group"), "/etc/group",
-			"--dev-bind", ai.resolve("/dev/snd"), "/dev/snd",
+		Alsa: func() {
+			ro(ai.resolve("/usr/share/alsa"), "/usr/share/alsa")
+			ro(ai.resolve("/etc/alsa"), "/etc/alsa")
+			ro(ai.resolve("/etc/group"), "/etc/group")
+			spec.device(ai.resolve("/dev/snd"), "/dev/snd", false)
 		},
-		"audio": {
-			"--ro-bind-try", filepath.Join(xdg.RuntimeDir, "pulse"), "/run/user/" + uid + "/pulse",
-			"--ro-bind-try", ai.resolve("/usr/share/alsa"), "/usr/share/alsa",
-			"--ro-bind-try", ai.resolve("/usr/share/pulseaudio"), "/usr/share/pulseaudio",
-			"--ro-bind-try", ai.resolve("/etc/alsa"), "/etc/alsa",
-			"--ro-bind-try", ai.resolve("/etc/group"), "/etc/group",
-			"--ro-bind-try", ai.resolve("/etc/pulse"), "/etc/pulse",
-			"--dev-bind", ai.resolve("/dev/snd"), "/dev/snd",
+		Audio: func() {
+			ro(filepath.Join(xdg.RuntimeDir, "pulse"), "/run/user/"+uid+"/pulse")
+			ro(ai.resolve("/usr/share/alsa"), "/usr/share/alsa")
+			ro(ai.resolve("/usr/share/pulseaudio"), "/usr/share/pulseaudio")
+			ro(ai.resolve("/etc/alsa"), "/etc/alsa")
+			ro(ai.resolve("/etc/group"), "/etc/group")
+			ro(ai.resolve("/etc/pulse"), "/etc/pulse")
+			spec.device(ai.resolve("/dev/snd"), "/dev/snd", false)
 		},
-		"cgroup": {},
-		"dbus": {
-			"--ro-bind-try", filepath.Join(xdg.RuntimeDir, "bus"), "/run/user/" + uid + "/bus",
+		Cgroup: func() {},
+		Dbus: func() {
+			ro(filepath.Join(xdg.RuntimeDir, "bus"), "/run/user/"+uid+"/bus")
 		},
-		"ipc": {},
-		"network": {
-			"--share-net",
-			"--ro-bind-try", ai.resolve("/etc/ca-certificates"), "/etc/ca-certificates",
-			"--ro-bind-try", ai.resolve("/etc/resolv.conf"), "/etc/resolv.conf",
-			"--ro-bind-try", ai.resolve("/etc/ssl"), "/etc/ssl",
-			"--ro-bind-try", ai.resolve("/etc/pki"), "/etc/pki",
-			"--ro-bind-try", ai.resolve("/usr/share/ca-certificates"), "/usr/share/ca-certificates",
+		"ipc": func() {},
+		Network: func() {
+			// If level 1, do not try to share /etc files again
+			if perms.Level == 1 {
+				return
+			}
+
+			ro(ai.resolve("/etc/ca-certificates"), "/etc/ca-certificates")
+			ro(ai.resolve("/etc/resolv.conf"), "/etc/resolv.conf")
+			ro(ai.resolve("/etc/ssl"), "/etc/ssl")
+			ro(ai.resolve("/etc/pki"), "/etc/pki")
+			ro(ai.resolve("/usr/share/ca-certificates"), "/usr/share/ca-certificates")
 		},
-		"pid": {},
-		"pipewire": {
-			"--ro-bind-try", filepath.Join(xdg.RuntimeDir, "pipewire-0"), "/run/user/" + uid + "/pipewire-0",
+		Pid: func() {},
+		Pipewire: func() {
+			ro(filepath.Join(xdg.RuntimeDir, "pipewire-0"), "/run/user/"+uid+"/pipewire-0")
 		},
-		"pulseaudio": {
-			"--ro-bind-try", filepath.Join(xdg.RuntimeDir, "pulse"), "/run/user/" + uid + "/pulse",
+		PulseAudio: func() {
+			ro(filepath.Join(xdg.RuntimeDir, "pulse"), "/run/user/"+uid+"/pulse")
 			// TODO: fix bwrap error when running in level 1
-			"--ro-bind-try", ai.resolve("/etc/pulse"), "/etc/pulse",
+			ro(ai.resolve("/etc/pulse"), "/etc/pulse")
 		},
-		"session": {},
-		"user":    {},
-		"uts":     {},
-		"wayland": {
-			"--ro-bind-try", filepath.Join(xdg.RuntimeDir, wDisplay), "/run/user/" + uid + "/wayland-0",
-			"--ro-bind-try", ai.resolve("/usr/share/X11"), "/usr/share/X11",
+		Session: func() {},
+		User:    func() {},
+		Uts:     func() {},
+		Wayland: func() {
+			ro(filepath.Join(xdg.RuntimeDir, wDisplay), "/run/user/"+uid+"/wayland-0")
+			ro(ai.resolve("/usr/share/X11"), "/usr/share/X11")
 			// TODO: Add more enviornment variables for app compatability
 			// maybe theres a better way to do this?
-			"--setenv", "WAYLAND_DISPLAY", "wayland-0",
-			"--setenv", "_JAVA_AWT_WM_NONREPARENTING", "1",
-			"--setenv", "MOZ_ENABLE_WAYLAND", "1",
-			"--setenv", "XDG_SESSION_TYPE", "wayland",
+			spec.setenv("WAYLAND_DISPLAY", "wayland-0")
+			spec.setenv("_JAVA_AWT_WM_NONREPARENTING", "1")
+			spec.setenv("MOZ_ENABLE_WAYLAND", "1")
+			spec.setenv("XDG_SESSION_TYPE", "wayland")
 		},
 		// For some reason sometimes it doesn't work when binding X0 to another
 		// socket ...but sometimes it does. X11 should be avoided if looking
 		// for security anyway, as it easilly allows control of the keyboard
 		// and mouse
-		"x11": {
-			"--ro-bind-try", xAuthority, xdg.Home + "/.Xauthority",
-			"--ro-bind-try", tempDir + "/.X11-unix/X" + xDisplay, "/tmp/.X11-unix/X" + xDisplay,
-			"--ro-bind-try", ai.resolve("/usr/share/X11"), "/usr/share/X11",
-			//"--setenv",      "DISPLAY",         ":"+xDisplay,
-			"--setenv", "QT_QPA_PLATFORM", "xcb",
-			"--setenv", "XAUTHORITY", xdg.Home + "/.Xauthority",
+		X11: func() {
+			ro(xAuthority, xdg.Home+"/.Xauthority")
+			ro(tempDir+"/.X11-unix/X"+xDisplay, "/tmp/.X11-unix/X"+xDisplay)
+			ro(ai.resolve("/usr/share/X11"), "/usr/share/X11")
+			//spec.setenv("DISPLAY", ":"+xDisplay)
+			spec.setenv("QT_QPA_PLATFORM", "xcb")
+			spec.setenv("XAUTHORITY", xdg.Home+"/.Xauthority")
 		},
 	}
 
-	// Args to disable sockets if not given
-	var unsocks = map[string][]string{
-		"alsa":       {},
-		"audio":      {},
-		"cgroup":     {"--unshare-cgroup-try"},
-		"ipc":        {"--unshare-ipc"},
-		"network":    {"--unshare-net"},
-		"pid":        {"--unshare-pid"},
-		"pipewire":   {},
-		"pulseaudio": {},
-		"session":    {"--new-session"},
-		"user":       {"--unshare-user-try"},
-		"uts":        {"--unshare-uts"},
-		"wayland":    {},
-		"x11":        {},
-	}
-
-	for socketString := range sockets {
+	// Namespaces to unshare if sockets aren't given
+	var unsocks = map[Socket]*bool{
+		Cgroup:  &spec.Namespaces.Cgroup,
+		"ipc":   &spec.Namespaces.Ipc,
+		Network: &spec.Namespaces.Net,
+		Pid:     &spec.Namespaces.Pid,
+		Session: &spec.NewSession,
+		User:    &spec.Namespaces.User,
+		Uts:     &spec.Namespaces.Uts,
+	}
+
+	// Sorted so the spec comes out the same every time
+	for _, socket := range slices.Sorted(maps.Keys(sockets)) {
+		add := sockets[socket]
+
 		var present = false
 		for _, sock := range perms.Sockets {
-			if sock == Socket(socketString) {
+			if sock == socket {
 				present = true
 			}
 		}
@@ -387,28 +506,20 @@ func parseSockets(ai *AppImage, perms *AppImagePerms) []string {
 			// and the app supports it
 			var waylandApp = false
 			for _, sock := range perms.Sockets {
-				if sock == Socket("wayland") {
+				if sock == Wayland {
 					waylandApp = true
 				}
 			}
 
-			if waylandEnabled && waylandApp && socketString == "x11" {
+			if waylandEnabled && waylandApp && socket == X11 {
 				continue
 			}
 
-			// If level 1, do not try to share /etc files again
-			if socketString == "network" && perms.Level == 1 {
-				s = append(s, "--share-net")
-				continue
-			}
-
-			s = append(s, sockets[socketString]...)
-		} else {
-			s = append(s, unsocks[socketString]...)
+			add()
+		} else if unshare, present := unsocks[socket]; present {
+			*unshare = true
 		}
 	}
-
-	return s
 }
 
 // Unset HOME in case the program using aisap is an AppImage using a portable
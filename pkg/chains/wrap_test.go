@@ -0,0 +1,230 @@
+package chains
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+// An AppImage that looks mounted, without any file behind it
+func fakeAppImage(t *testing.T) *AppImage {
+	return &AppImage{
+		Name:     "chains-test-app",
+		ID:       "chains-test-app",
+		Path:     "/tmp/chains-test.AppImage",
+		md5:      "0123456789abcdef0123456789abcdef",
+		rootDir:  "/",
+		mountDir: t.TempDir(),
+		tempDir:  t.TempDir(),
+		dataDir:  t.TempDir(),
+	}
+}
+
+func allSockets() []Socket {
+	var sockets []Socket
+	for _, s := range SocketMap {
+		sockets = append(sockets, s)
+	}
+
+	return sockets
+}
+
+func specJSON(t *testing.T, ai *AppImage, perms *AppImagePerms) []byte {
+	spec, err := ai.Spec(perms, []string{"--arg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if _, err := spec.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	return b.Bytes()
+}
+
+func TestSpecIsDeterministic(t *testing.T) {
+	ai := fakeAppImage(t)
+
+	for level := 1; level <= 3; level++ {
+		perms := &AppImagePerms{
+			Level:   level,
+			Sockets: allSockets(),
+			Devices: []string{"dri", "input"},
+			Files:   []string{"xdg-download:rw", "~/Music:ro"},
+			DataDir: true,
+		}
+
+		first := specJSON(t, ai, perms)
+
+		for i := 0; i < 20; i++ {
+			// Permissions come from profiles in no particular order either
+			slices.Reverse(perms.Sockets)
+
+			if again := specJSON(t, ai, perms); !bytes.Equal(first, again) {
+				t.Fatalf("level %d: spec changed between runs:\n%s\n%s", level, first, again)
+			}
+		}
+	}
+}
+
+func TestSpecNamespaces(t *testing.T) {
+	ai := fakeAppImage(t)
+
+	spec, err := ai.Spec(&AppImagePerms{Level: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Namespaces{User: true, Cgroup: true, Ipc: true, Net: true, Pid: true, Uts: true}
+	if spec.Namespaces != want || !spec.NewSession {
+		t.Errorf("no sockets: got %+v, new session %t", spec.Namespaces, spec.NewSession)
+	}
+
+	spec, err = ai.Spec(&AppImagePerms{Level: 2, Sockets: []Socket{Network, Pid}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spec.Namespaces.Net || spec.Namespaces.Pid || !spec.Namespaces.Ipc {
+		t.Errorf("network and pid sockets: got %+v", spec.Namespaces)
+	}
+}
+
+func TestSpecLevels(t *testing.T) {
+	ai := fakeAppImage(t)
+
+	for _, c := range []struct {
+		level int
+		dest  string
+		want  bool
+	}{
+		{1, "/etc", true},
+		{1, "/sys", true},
+		{2, "/etc/fonts", true},
+		{2, "/etc", false},
+		{3, "/etc/fonts", false},
+	} {
+		spec, err := ai.Spec(&AppImagePerms{Level: c.level}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := slices.ContainsFunc(spec.Mounts, func(m Mount) bool {
+			return m.Dest == c.dest
+		})
+		if found != c.want {
+			t.Errorf("level %d: mount of %s is %t, want %t", c.level, c.dest, found, c.want)
+		}
+	}
+}
+
+func TestBundleCantSetPrivileged(t *testing.T) {
+	ai := fakeAppImage(t)
+
+	var err error
+	ai.Desktop, err = ini.Load([]byte(`[X-App Permissions]
+Level=2
+Seccomp=/tmp/filter
+DropCaps=true
+KeepCaps=CAP_SYS_ADMIN
+Identity=0:0
+DisableUserns=true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	perms, source, err := ai.ResolvePermissions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if source != DesktopEntry {
+		t.Fatalf("permissions from %s", source)
+	}
+
+	if perms.Seccomp != "" || len(perms.KeepCaps) > 0 || perms.Identity != "" {
+		t.Errorf("bundle set seccomp %q, caps %v, identity %q", perms.Seccomp, perms.KeepCaps, perms.Identity)
+	}
+
+	// Only take privileges away, so they're honoured
+	if !perms.DropCaps || !perms.DisableUserns {
+		t.Errorf("bundle couldn't drop caps (%t) or disable user namespaces (%t)", perms.DropCaps, perms.DisableUserns)
+	}
+
+	spec, err := ai.Spec(perms, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spec.Seccomp != nil {
+		t.Errorf("spec has seccomp filter %q", spec.Seccomp.Filter)
+	}
+
+	if !spec.DisableUserns {
+		t.Error("spec allows nested user namespaces")
+	}
+}
+
+func TestBwrapCaps(t *testing.T) {
+	for _, c := range []struct {
+		drop bool
+		want []string
+	}{
+		{false, nil},
+		{true, []string{"--cap-drop", "ALL", "--cap-add", "CAP_NET_RAW"}},
+	} {
+		s := &SandboxSpec{DropCaps: c.drop, KeepCaps: []string{"CAP_NET_RAW"}}
+
+		args := slices.DeleteFunc(s.BwrapArgs(), func(arg string) bool {
+			return !strings.HasPrefix(arg, "--cap") && !strings.HasPrefix(arg, "CAP_") && arg != "ALL"
+		})
+		if !slices.Equal(args, c.want) {
+			t.Errorf("drop caps %t: got %v, want %v", c.drop, args, c.want)
+		}
+	}
+}
+
+func TestBwrapDisableUserns(t *testing.T) {
+	s := &SandboxSpec{Namespaces: Namespaces{User: true}}
+	if !slices.Contains(s.BwrapArgs(), "--unshare-user-try") {
+		t.Errorf("user namespace isn't unshared: %v", s.BwrapArgs())
+	}
+
+	s.DisableUserns = true
+	args := s.BwrapArgs()
+	if !slices.Contains(args, "--unshare-user") || slices.Contains(args, "--unshare-user-try") || !slices.Contains(args, "--disable-userns") {
+		t.Errorf("nested user namespaces aren't disabled: %v", args)
+	}
+}
+
+func TestSignalsForwarded(t *testing.T) {
+	cmd := exec.Command("sh", "-c", `trap "exit 7" TERM; echo ready; while :; do sleep 0.01; done`)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runForwardingSignals(cmd, func() error {
+		// Once it's ready to handle it
+		if _, err := bufio.NewReader(out).ReadString('\n'); err != nil {
+			return err
+		}
+
+		return syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	})
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 7 {
+		t.Errorf("app didn't get to handle the signal: %v", err)
+	}
+}
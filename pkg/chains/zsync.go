@@ -0,0 +1,447 @@
+package chains
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/md4"
+)
+
+// zsync publishes a control file next to each release, holding a weak
+// rolling checksum and a truncated MD4 of each of its blocks. Blocks the
+// local file already has are found by sliding the weak checksum over it,
+// so only the rest have to be downloaded, with HTTP range requests
+
+var (
+	InvalidZsync = errors.New("zsync control file invalid")
+)
+
+// zsyncControl is a parsed `.zsync` file
+type zsyncControl struct {
+	Filename      string
+	Blocksize     int
+	Length        int64
+	SeqMatches    int
+	RsumBytes     int
+	ChecksumBytes int
+	URL           string // Where the target file is downloaded from
+	SHA1          string
+
+	blocks []zsyncBlock
+}
+
+type zsyncBlock struct {
+	rsum     uint32
+	checksum []byte
+}
+
+// How much was reused from the local file and how much was downloaded
+type UpdateStats struct {
+	Reused     int64
+	Downloaded int64
+
+	sha256 string // Of the new version, when it's worked out while downloading
+}
+
+// Downloads and parses the control file at `controlURL`
+func fetchZsync(controlURL string) (*zsyncControl, error) {
+	resp, err := httpGet(controlURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	base, err := url.Parse(controlURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseZsync(resp.Body, base)
+}
+
+// Parses a control file, resolving the URL of the target file against
+// `base`, where the control file came from
+func parseZsync(r io.Reader, base *url.URL) (*zsyncControl, error) {
+	c := &zsyncControl{SeqMatches: 1, RsumBytes: 4, ChecksumBytes: 16}
+	br := bufio.NewReader(r)
+
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, errors.Join(InvalidZsync, err)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		key, value, found := strings.Cut(line, ": ")
+		if !found {
+			return nil, errors.Join(InvalidZsync, errors.New("malformed header `"+line+"`"))
+		}
+
+		switch key {
+		case "Filename":
+			c.Filename = value
+		case "Blocksize":
+			c.Blocksize, err = strconv.Atoi(value)
+		case "Length":
+			c.Length, err = strconv.ParseInt(value, 10, 64)
+		case "Hash-Lengths":
+			_, err = parseInts(value, &c.SeqMatches, &c.RsumBytes, &c.ChecksumBytes)
+		case "URL":
+			// Only the first URL is used, the rest are mirrors
+			if c.URL == "" {
+				var u *url.URL
+				if u, err = base.Parse(value); err == nil {
+					c.URL = u.String()
+				}
+			}
+		case "SHA-1":
+			c.SHA1 = strings.ToLower(value)
+		}
+
+		if err != nil {
+			return nil, errors.Join(InvalidZsync, errors.New("bad `"+key+"`"), err)
+		}
+	}
+
+	if c.URL == "" {
+		return nil, errors.Join(InvalidZsync, errors.New("no uncompressed `URL` for the target file"))
+	}
+
+	if c.Blocksize <= 0 || c.Length < 0 || c.SHA1 == "" ||
+		c.SeqMatches < 1 || c.SeqMatches > 2 ||
+		c.RsumBytes < 1 || c.RsumBytes > 4 ||
+		c.ChecksumBytes < 3 || c.ChecksumBytes > md4.Size {
+		return nil, InvalidZsync
+	}
+
+	n := (c.Length + int64(c.Blocksize) - 1) / int64(c.Blocksize)
+	c.blocks = make([]zsyncBlock, n)
+
+	buf := make([]byte, c.RsumBytes+c.ChecksumBytes)
+	for i := range c.blocks {
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, errors.Join(InvalidZsync, err)
+		}
+
+		// Only the last bytes of the big endian checksum are stored
+		var rsum [4]byte
+		copy(rsum[4-c.RsumBytes:], buf[:c.RsumBytes])
+
+		c.blocks[i] = zsyncBlock{
+			rsum:     binary.BigEndian.Uint32(rsum[:]),
+			checksum: bytes.Clone(buf[c.RsumBytes:]),
+		}
+	}
+
+	return c, nil
+}
+
+// Parses comma separated integers into `v`, eg: `Hash-Lengths: 2,2,5`
+func parseInts(s string, v ...*int) (int, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != len(v) {
+		return 0, errors.New("expected " + strconv.Itoa(len(v)) + " values")
+	}
+
+	for i := range fields {
+		n, err := strconv.Atoi(strings.TrimSpace(fields[i]))
+		if err != nil {
+			return i, err
+		}
+		*v[i] = n
+	}
+
+	return len(v), nil
+}
+
+// The weak checksum of a block, as zsync calculates it. `a` is the sum of
+// its bytes and `b` the sum of each byte times its distance from the end
+func rsum(data []byte) (uint16, uint16) {
+	var a, b uint16
+
+	for i, c := range data {
+		a += uint16(c)
+		b += uint16(len(data)-i) * uint16(c)
+	}
+
+	return a, b
+}
+
+func (c *zsyncControl) rsumMask() uint32 {
+	if c.RsumBytes == 4 {
+		return 0xffffffff
+	}
+
+	return 1<<(8*c.RsumBytes) - 1
+}
+
+func (c *zsyncControl) checksum(data []byte) []byte {
+	h := md4.New()
+	h.Write(data)
+
+	return h.Sum(nil)[:c.ChecksumBytes]
+}
+
+// Looks for the target's blocks in the local file, returning where each
+// one was found, -1 for those that weren't
+func (c *zsyncControl) match(local *os.File) ([]int64, error) {
+	found := make([]int64, len(c.blocks))
+	for i := range found {
+		found[i] = -1
+	}
+
+	if len(c.blocks) == 0 {
+		return found, nil
+	}
+
+	mask := c.rsumMask()
+	byRsum := make(map[uint32][]int)
+	for i, b := range c.blocks {
+		byRsum[b.rsum&mask] = append(byRsum[b.rsum&mask], i)
+	}
+
+	bs := c.Blocksize
+
+	// Zeroes are added past the end of the file, as the target's last block
+	// is padded with them. With SeqMatches, a match is only accepted if the
+	// block after it matches too, so twice the block size has to be kept
+	// ahead of the window
+	w := &window{r: local, keep: 2 * bs, pad: 2 * bs}
+	if err := w.fill(); err != nil {
+		return nil, err
+	}
+
+	a, b := rsum(w.at(0, bs))
+
+	for w.pos < w.end {
+		if ids, ok := byRsum[(uint32(a)<<16|uint32(b))&mask]; ok {
+			if i := c.matchAt(w, ids, found); i >= 0 {
+				// Skip over the block and start the checksum afresh
+				if err := w.advance(bs); err != nil {
+					return nil, err
+				}
+				a, b = rsum(w.at(0, bs))
+				continue
+			}
+		}
+
+		out, in := w.at(0, 1)[0], w.at(bs, 1)[0]
+		if err := w.advance(1); err != nil {
+			return nil, err
+		}
+
+		a += uint16(in) - uint16(out)
+		b += a - uint16(bs)*uint16(out)
+	}
+
+	return found, nil
+}
+
+// Checks the blocks in `ids` against the data at the window's position,
+// recording any that match. Returns the last one that did, or -1
+func (c *zsyncControl) matchAt(w *window, ids []int, found []int64) int {
+	bs := c.Blocksize
+	var sum []byte
+	matched := -1
+
+	for _, i := range ids {
+		if found[i] >= 0 {
+			continue
+		}
+
+		if sum == nil {
+			sum = c.checksum(w.at(0, bs))
+		}
+
+		if !bytes.Equal(sum, c.blocks[i].checksum) {
+			continue
+		}
+
+		if c.SeqMatches > 1 && i+1 < len(c.blocks) {
+			next := w.at(bs, bs)
+			na, nb := rsum(next)
+			if (uint32(na)<<16|uint32(nb))&c.rsumMask() != c.blocks[i+1].rsum&c.rsumMask() ||
+				!bytes.Equal(c.checksum(next), c.blocks[i+1].checksum) {
+				continue
+			}
+
+			found[i+1] = w.offset() + int64(bs)
+		}
+
+		found[i] = w.offset()
+		matched = i
+	}
+
+	return matched
+}
+
+// Builds the target file in `out`, copying the blocks found in the local
+// file and downloading the rest. Fails if the result doesn't match the
+// control file's SHA-1
+func (c *zsyncControl) assemble(local *os.File, out *os.File) (*UpdateStats, error) {
+	found, err := c.match(local)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &UpdateStats{}
+	bs := int64(c.Blocksize)
+	buf := make([]byte, bs)
+
+	for i := 0; i < len(found); {
+		start := int64(i) * bs
+
+		if found[i] >= 0 {
+			n := min(bs, c.Length-start)
+			clear(buf)
+			if _, err := local.ReadAt(buf[:n], found[i]); err != nil && !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			if _, err := out.WriteAt(buf[:n], start); err != nil {
+				return nil, err
+			}
+
+			stats.Reused += n
+			i++
+			continue
+		}
+
+		// Download every missing block in a row at once
+		j := i
+		for j < len(found) && found[j] < 0 {
+			j++
+		}
+		end := min(int64(j)*bs, c.Length)
+
+		n, whole, err := c.download(out, start, end)
+		if err != nil {
+			return nil, err
+		}
+
+		stats.Downloaded += n
+		if whole {
+			// The server sent the whole file instead of the range
+			stats.Reused = 0
+			break
+		}
+
+		i = j
+	}
+
+	if err := out.Truncate(c.Length); err != nil {
+		return nil, err
+	}
+
+	h := sha1.New()
+	if _, err := io.Copy(h, io.NewSectionReader(out, 0, c.Length)); err != nil {
+		return nil, err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != c.SHA1 {
+		return nil, errors.Join(UpdateMismatch, errors.New("SHA-1 doesn't match the zsync control file"))
+	}
+
+	return stats, nil
+}
+
+// Downloads bytes `start` to `end` of the target into `out`. Returns true if
+// the server ignored the range and sent the whole file instead
+func (c *zsyncControl) download(out *os.File, start int64, end int64) (int64, bool, error) {
+	resp, err := httpGet(c.URL, http.Header{
+		"Range": {"bytes=" + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end-1, 10)},
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		n, err := io.Copy(io.NewOffsetWriter(out, 0), resp.Body)
+		return n, true, err
+	}
+
+	n, err := io.Copy(io.NewOffsetWriter(out, start), io.LimitReader(resp.Body, end-start))
+	if err == nil && n != end-start {
+		err = errors.New("server sent " + strconv.FormatInt(n, 10) + " bytes instead of " + strconv.FormatInt(end-start, 10))
+	}
+
+	return n, false, err
+}
+
+// window reads through a file, keeping enough of it in memory to look at
+// `keep` bytes ahead of the current position. Past the end of the file, it
+// reads `pad` zeroes
+type window struct {
+	r    io.Reader
+	keep int
+	pad  int
+
+	buf  []byte
+	base int64 // File offset of buf[0]
+	pos  int   // Current position in buf
+	end  int   // Position in buf of the end of the file, once known
+	eof  bool
+}
+
+func (w *window) offset() int64 {
+	return w.base + int64(w.pos)
+}
+
+// Returns `n` bytes, `off` bytes after the current position
+func (w *window) at(off int, n int) []byte {
+	return w.buf[w.pos+off : w.pos+off+n]
+}
+
+func (w *window) advance(n int) error {
+	w.pos += n
+	if w.pos+w.keep > len(w.buf) && !w.eof {
+		return w.fill()
+	}
+
+	return nil
+}
+
+// Drops what's behind the current position and reads more of the file
+func (w *window) fill() error {
+	w.base += int64(w.pos)
+	w.buf = append(w.buf[:0], w.buf[w.pos:]...)
+	w.end -= w.pos
+	w.pos = 0
+
+	chunk := max(w.keep*8, 1<<20)
+	w.buf = slices.Grow(w.buf, chunk-len(w.buf))
+
+	for len(w.buf) < chunk && !w.eof {
+		n, err := w.r.Read(w.buf[len(w.buf):chunk])
+		w.buf = w.buf[:len(w.buf)+n]
+
+		if errors.Is(err, io.EOF) {
+			w.eof = true
+			w.end = len(w.buf)
+			w.buf = append(w.buf, make([]byte, w.pad)...)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if !w.eof {
+		w.end = len(w.buf)
+	}
+
+	return nil
+}
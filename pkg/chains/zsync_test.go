@@ -0,0 +1,195 @@
+package chains
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/md4"
+)
+
+const testBlocksize = 64
+
+// Writes a control file for `target` as zsyncmake would
+func makeZsync(target []byte, targetURL string) []byte {
+	var b bytes.Buffer
+
+	sum := sha1.Sum(target)
+	fmt.Fprintf(&b, "zsync: 0.6.2\nFilename: app.AppImage\nBlocksize: %d\nLength: %d\nHash-Lengths: 1,4,16\nURL: %s\nSHA-1: %s\n\n",
+		testBlocksize, len(target), targetURL, hex.EncodeToString(sum[:]))
+
+	for off := 0; off < len(target); off += testBlocksize {
+		block := make([]byte, testBlocksize)
+		copy(block, target[off:])
+
+		a, s := rsum(block)
+		b.Write(binary.BigEndian.AppendUint32(nil, uint32(a)<<16|uint32(s)))
+
+		h := md4.New()
+		h.Write(block)
+		b.Write(h.Sum(nil))
+	}
+
+	return b.Bytes()
+}
+
+// Deterministic data, different for every block
+func testData(seed byte, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7) ^ byte(i/testBlocksize) ^ seed
+	}
+
+	return b
+}
+
+// Serves `target` and its control file. Unless `ranges`, requests for part of
+// the target get all of it
+func zsyncServer(t *testing.T, target []byte, ranges bool) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app.AppImage.zsync":
+			w.Write(makeZsync(target, "app.AppImage"))
+		case "/app.AppImage":
+			if !ranges {
+				r.Header.Del("Range")
+			}
+			http.ServeContent(w, r, "app.AppImage", time.Time{}, bytes.NewReader(target))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func assembleFrom(t *testing.T, srv *httptest.Server, local []byte) ([]byte, *UpdateStats) {
+	c, err := fetchZsync(srv.URL + "/app.AppImage.zsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.URL != srv.URL+"/app.AppImage" {
+		t.Errorf("target URL %s wasn't resolved against the control file's", c.URL)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "local"), local, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	in, err := os.Open(filepath.Join(dir, "local"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	stats, err := c.assemble(in, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b, stats
+}
+
+func TestZsyncDelta(t *testing.T) {
+	local := testData(0, 20*testBlocksize)
+
+	// One block changed, the rest shifted by a few bytes and more appended
+	target := append([]byte("prefix"), local...)
+	copy(target[5*testBlocksize:], strings.Repeat("changed", 10))
+	target = append(target, testData(1, 3*testBlocksize+10)...)
+
+	got, stats := assembleFrom(t, zsyncServer(t, target, true), local)
+
+	if !bytes.Equal(got, target) {
+		t.Fatal("assembled file differs from the target")
+	}
+
+	if stats.Reused+stats.Downloaded != int64(len(target)) || stats.Reused < 15*testBlocksize {
+		t.Errorf("reused %d and downloaded %d bytes of %d", stats.Reused, stats.Downloaded, len(target))
+	}
+}
+
+func TestZsyncServerWithoutRanges(t *testing.T) {
+	local := testData(0, 10*testBlocksize)
+	target := append(bytes.Clone(local[:5*testBlocksize]), testData(2, 5*testBlocksize)...)
+
+	got, stats := assembleFrom(t, zsyncServer(t, target, false), local)
+
+	if !bytes.Equal(got, target) {
+		t.Fatal("assembled file differs from the target")
+	}
+
+	if stats.Reused != 0 || stats.Downloaded != int64(len(target)) {
+		t.Errorf("reused %d and downloaded %d bytes, want the whole file downloaded", stats.Reused, stats.Downloaded)
+	}
+}
+
+func TestZsyncChecksMismatch(t *testing.T) {
+	target := testData(0, 4*testBlocksize)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/app.AppImage.zsync" {
+			w.Write(makeZsync(target, "app.AppImage"))
+			return
+		}
+
+		// Not what the control file describes
+		http.ServeContent(w, r, "app.AppImage", time.Time{}, bytes.NewReader(testData(3, len(target))))
+	}))
+	defer srv.Close()
+
+	c, err := fetchZsync(srv.URL + "/app.AppImage.zsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	in, _ := os.Create(filepath.Join(dir, "local"))
+	defer in.Close()
+	out, _ := os.Create(filepath.Join(dir, "out"))
+	defer out.Close()
+
+	if _, err := c.assemble(in, out); err == nil {
+		t.Error("assembled a file that doesn't match its SHA-1")
+	}
+}
+
+func TestParseZsyncInvalid(t *testing.T) {
+	base, _ := url.Parse("https://example.com/app.AppImage.zsync")
+
+	for _, control := range []string{
+		"",
+		"Filename: app\n\n",
+		"Blocksize: 64\nLength: 64\nSHA-1: 00\n\n", // No URL
+		"Blocksize: 64\nLength: 64\nURL: app\nSHA-1: 00\nHash-Lengths: 1,9,16\n\n",
+		"Blocksize: 64\nLength: 128\nURL: app\nSHA-1: 00\n\n" + strings.Repeat("x", 20), // One block short
+	} {
+		if _, err := parseZsync(strings.NewReader(control), base); err == nil {
+			t.Errorf("parsed %q", control)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+module github.com/CalebQ42/squashfs
+
+go 1.22.5
+
+require (
+	github.com/klauspost/compress v1.17.9
+	github.com/pierrec/lz4/v4 v4.1.21
+	github.com/rasky/go-lzo v0.0.0-20200203143853-96a758eda86e
+	github.com/therootcompany/xz v1.0.1
+	github.com/ulikunitz/xz v0.5.12
+)